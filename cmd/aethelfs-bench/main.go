@@ -0,0 +1,153 @@
+// Command aethelfs-bench runs a standard benchmark suite against a
+// file-backed device and writes a JSON report: sequential and random read
+// and write bandwidth at several block sizes, metadata operations per
+// second and fsync latency percentiles. Given a baseline report, it exits
+// non-zero when any metric regresses by more than the tolerance, so CI can
+// gate performance changes.
+//
+// The suite drives the filesystem's handlers directly through fstest, as
+// the unit tests do, so it measures the filesystem and its device path
+// without the kernel's FUSE round trips. Use the scripts in scripts/ for
+// numbers through a real mount.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+)
+
+// Exit codes
+const (
+	exitOK         = 0
+	exitRegression = 1
+	exitError      = 2
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "compare" {
+		os.Exit(runCompare(os.Args[2:]))
+	}
+
+	device := flag.String("device", "", "Device file to benchmark on, created or overwritten (default: a temporary file)")
+	size := flag.Int64("size", 512<<20, "Size of the device file in bytes")
+	segmentSize := flag.Int64("map-segment-size", dax.DefaultSegmentSize, "Map the device in segments of this many bytes, as the daemon does (0 maps it whole)")
+	dataMB := flag.Int64("data-mb", 64, "Megabytes each read and write pass moves")
+	metaOps := flag.Int("meta-ops", 10000, "Files created, looked up and removed by the metadata pass")
+	fsyncs := flag.Int("fsyncs", 2000, "Fsyncs timed for the latency percentiles")
+	runs := flag.Int("runs", 3, "Times the suite runs; each metric reports the median")
+	out := flag.String("out", "", "Write the report here instead of stdout")
+	baseline := flag.String("baseline", "", "Compare against this earlier report and exit 1 on a regression")
+	tolerance := flag.Float64("tolerance", 0.10, "Fraction a metric may regress by before -baseline fails")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: aethelfs-bench [options]")
+		fmt.Fprintln(os.Stderr, "       aethelfs-bench compare [-tolerance F] OLD.json NEW.json")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 || *runs < 1 || *dataMB < 1 || *metaOps < 1 || *fsyncs < 1 {
+		flag.Usage()
+		os.Exit(exitError)
+	}
+	if *size < common.MinDeviceSize {
+		log.Fatalf("-size must be at least %d bytes", common.MinDeviceSize)
+	}
+
+	path := *device
+	if path == "" {
+		tmp, err := os.CreateTemp("", "aethelfs-bench-*.img")
+		if err != nil {
+			log.Fatalf("Cannot create a device file: %v", err)
+		}
+		tmp.Close()
+		path = tmp.Name()
+		defer os.Remove(path)
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	cfg := suiteConfig{
+		device:      path,
+		size:        *size,
+		segmentSize: *segmentSize,
+		dataBytes:   *dataMB << 20,
+		metaOps:     *metaOps,
+		fsyncs:      *fsyncs,
+	}
+	report := Report{
+		Time:  time.Now().UTC(),
+		Build: common.GetBuildInfo(),
+	}
+	var samples [][]Metric
+	for i := 0; i < *runs; i++ {
+		log.Printf("Run %d of %d on %s", i+1, *runs, path)
+		metrics, env, err := runSuite(cfg)
+		if err != nil {
+			log.Fatalf("Benchmark failed: %v", err)
+		}
+		report.Env = env
+		samples = append(samples, metrics)
+	}
+	report.Runs = *runs
+	report.Metrics = medians(samples)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Fatalf("Cannot encode the report: %v", err)
+	}
+	data = append(data, '\n')
+	if *out == "" {
+		os.Stdout.Write(data)
+	} else if err := os.WriteFile(*out, data, 0644); err != nil {
+		log.Fatalf("Cannot write the report: %v", err)
+	}
+
+	if *baseline != "" {
+		old, err := readReport(*baseline)
+		if err != nil {
+			log.Fatalf("Cannot read the baseline: %v", err)
+		}
+		if !printComparison(os.Stderr, compareReports(old, &report, *tolerance)) {
+			os.Exit(exitRegression)
+		}
+	}
+}
+
+// runCompare implements "aethelfs-bench compare OLD NEW" and returns the
+// process exit code
+func runCompare(args []string) int {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	tolerance := flags.Float64("tolerance", 0.10, "Fraction a metric may regress by")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: aethelfs-bench compare [-tolerance F] OLD.json NEW.json")
+		fmt.Fprintln(os.Stderr, "Exits 0 when no metric regressed, 1 when one did and 2 on error.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return exitError
+	}
+	old, err := readReport(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	cur, err := readReport(flags.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if !printComparison(os.Stdout, compareReports(old, cur, *tolerance)) {
+		return exitRegression
+	}
+	return exitOK
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"aethelfs/internal/common"
+)
+
+// reportedCPUFlags are the CPU features that change the persistence path
+// or copy speed; the rest of /proc/cpuinfo's flags are left out
+var reportedCPUFlags = []string{"sse2", "avx2", "avx512f", "clflush", "clflushopt", "clwb", "movdir64b"}
+
+// Report is the JSON a benchmark run writes and compare reads
+type Report struct {
+	Time    time.Time        `json:"time"`
+	Build   common.BuildInfo `json:"build"`
+	Env     Env              `json:"env"`
+	Runs    int              `json:"runs"`
+	Metrics []Metric         `json:"metrics"`
+}
+
+// Env describes where a report was taken, so reports from different
+// machines or persistence paths are not mistaken for a regression
+type Env struct {
+	OS          string   `json:"os"`
+	Arch        string   `json:"arch"`
+	CPUs        int      `json:"cpus"`
+	CPUModel    string   `json:"cpu_model,omitempty"`
+	CPUFlags    []string `json:"cpu_flags"`
+	Persistence string   `json:"persistence"`       // Flush path barriers and fsync use
+	Backing     string   `json:"backing,omitempty"` // What the device mapping is backed by
+	MapSync     bool     `json:"map_sync"`
+	Device      string   `json:"device"`
+	DeviceSize  int64    `json:"device_size"`
+}
+
+// Metric is one measured value. Bandwidth and operation rates are better
+// higher, latencies lower.
+type Metric struct {
+	Name           string  `json:"name"`
+	Unit           string  `json:"unit"`
+	Value          float64 `json:"value"`
+	HigherIsBetter bool    `json:"higher_is_better"`
+}
+
+// cpuInfo reads the CPU model and the reported flags from /proc/cpuinfo
+func cpuInfo() (model string, flags []string) {
+	flags = []string{}
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return "", flags
+	}
+	defer file.Close()
+
+	have := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "model name":
+			if model == "" {
+				model = strings.TrimSpace(value)
+			}
+		case "flags":
+			for _, flag := range strings.Fields(value) {
+				have[flag] = true
+			}
+		}
+	}
+	for _, flag := range reportedCPUFlags {
+		if have[flag] {
+			flags = append(flags, flag)
+		}
+	}
+	return model, flags
+}
+
+// hostEnv fills in the host half of Env
+func hostEnv() Env {
+	model, flags := cpuInfo()
+	return Env{
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		CPUs:     runtime.NumCPU(),
+		CPUModel: model,
+		CPUFlags: flags,
+	}
+}
+
+// medians reduces the metrics of several runs to the median of each
+func medians(runs [][]Metric) []Metric {
+	out := make([]Metric, len(runs[0]))
+	for i, m := range runs[0] {
+		values := make([]float64, len(runs))
+		for r := range runs {
+			values[r] = runs[r][i].Value
+		}
+		sort.Float64s(values)
+		m.Value = values[len(values)/2]
+		if len(values)%2 == 0 {
+			m.Value = (values[len(values)/2-1] + values[len(values)/2]) / 2
+		}
+		out[i] = m
+	}
+	return out
+}
+
+// readReport loads a report written by an earlier run
+func readReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &r, nil
+}
+
+// Comparison is one metric of a baseline against a new report
+type Comparison struct {
+	Metric
+	Old       float64
+	Change    float64 // Fraction of Old; positive is an improvement
+	Regressed bool
+	Missing   bool // In the baseline but not the new report
+}
+
+// compareReports compares each metric of old with cur. A metric regresses
+// when it is worse than old by more than tolerance, as a fraction of the
+// old value; a metric the new report lacks counts as a regression too.
+func compareReports(old, cur *Report, tolerance float64) []Comparison {
+	values := make(map[string]Metric, len(cur.Metrics))
+	for _, m := range cur.Metrics {
+		values[m.Name] = m
+	}
+	var out []Comparison
+	for _, o := range old.Metrics {
+		c := Comparison{Metric: o, Old: o.Value}
+		m, ok := values[o.Name]
+		if !ok {
+			c.Missing, c.Regressed = true, true
+			out = append(out, c)
+			continue
+		}
+		c.Value = m.Value
+		if o.Value != 0 {
+			c.Change = (m.Value - o.Value) / o.Value
+			if !o.HigherIsBetter {
+				c.Change = (o.Value - m.Value) / o.Value
+			}
+		}
+		c.Regressed = c.Change < -tolerance
+		out = append(out, c)
+	}
+	return out
+}
+
+// printComparison writes a comparison table and reports whether every
+// metric held up
+func printComparison(w io.Writer, comparisons []Comparison) bool {
+	ok := true
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tUNIT\tOLD\tNEW\tCHANGE\t")
+	for _, c := range comparisons {
+		status := ""
+		if c.Regressed {
+			status = "REGRESSED"
+			ok = false
+		}
+		if c.Missing {
+			fmt.Fprintf(tw, "%s\t%s\t%.1f\t-\t-\tMISSING\n", c.Name, c.Unit, c.Old)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.1f\t%.1f\t%+.1f%%\t%s\n", c.Name, c.Unit, c.Old, c.Value, c.Change*100, status)
+	}
+	tw.Flush()
+	return ok
+}
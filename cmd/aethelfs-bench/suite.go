@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"bazil.org/fuse"
+	"golang.org/x/sys/unix"
+
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// blockSizes are the I/O sizes the read and write passes use
+var blockSizes = []struct {
+	name string
+	size int64
+}{
+	{"4k", 4 << 10},
+	{"64k", 64 << 10},
+	{"1m", 1 << 20},
+}
+
+// fsyncPercentiles are the fsync latency percentiles reported
+var fsyncPercentiles = []struct {
+	name string
+	p    float64
+}{
+	{"p50", 0.50},
+	{"p99", 0.99},
+	{"p999", 0.999},
+}
+
+// randSeed fixes the random offsets, so every run and every report does
+// the same I/O
+const randSeed = 1
+
+// suiteConfig sizes one run of the suite
+type suiteConfig struct {
+	device      string
+	size        int64
+	segmentSize int64 // Mapping segment size; 0 maps the device whole
+	dataBytes   int64 // Bytes each read and write pass moves
+	metaOps     int
+	fsyncs      int
+}
+
+// suite is one run on a freshly formatted device
+type suite struct {
+	cfg     suiteConfig
+	h       *fstest.Harness
+	metrics []Metric
+}
+
+// runSuite formats the device file, mounts it with the default options
+// and runs every pass, returning the metrics in a fixed order
+func runSuite(cfg suiteConfig) ([]Metric, Env, error) {
+	env := hostEnv()
+	env.Device, env.DeviceSize = cfg.device, cfg.size
+	if err := freshDevice(cfg.device, cfg.size); err != nil {
+		return nil, env, err
+	}
+	device, err := dax.OpenDevice(cfg.device, dax.DeviceOptions{SegmentSize: cfg.segmentSize})
+	if err != nil {
+		return nil, env, err
+	}
+	defer device.Close()
+	h, err := fstest.Mount(device, fs.DefaultOptions())
+	if err != nil {
+		return nil, env, err
+	}
+	defer h.Close()
+
+	s := &suite{cfg: cfg, h: h}
+	if env.Persistence, err = s.persistence(); err != nil {
+		return nil, env, err
+	}
+	if st := h.FS.Stats().SelfTest; st != nil {
+		env.Backing, env.MapSync = st.Backing, st.MapSync
+	}
+	for _, bs := range blockSizes {
+		if err := s.dataPass(bs.name, bs.size); err != nil {
+			return nil, env, fmt.Errorf("%s I/O: %v", bs.name, err)
+		}
+	}
+	if err := s.metadataPass(); err != nil {
+		return nil, env, fmt.Errorf("metadata: %v", err)
+	}
+	if err := s.fsyncPass(); err != nil {
+		return nil, env, fmt.Errorf("fsync: %v", err)
+	}
+	return s.metrics, env, nil
+}
+
+// freshDevice zeroes the device file, so the mount formats it, and
+// allocates its blocks up front so first writes do not pay for them
+func freshDevice(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := unix.Fallocate(int(file.Fd()), 0, 0, size); err != nil {
+		return file.Truncate(size)
+	}
+	return nil
+}
+
+// persistence reads back the flush path barriers and fsync use
+func (s *suite) persistence() (string, error) {
+	file, err := s.h.Create("/.bench-env", 0644)
+	if err != nil {
+		return "", err
+	}
+	defer s.h.Remove("/.bench-env")
+	resp := &fuse.GetxattrResponse{}
+	if err := file.Getxattr(s.h.Context(), &fuse.GetxattrRequest{Name: "user.aethelfs.persistence"}, resp); err != nil {
+		return "", err
+	}
+	return string(resp.Xattr), nil
+}
+
+// rate records a higher-is-better metric of n units over d
+func (s *suite) rate(name, unit string, n float64, d time.Duration) {
+	s.metrics = append(s.metrics, Metric{Name: name, Unit: unit, Value: n / d.Seconds(), HigherIsBetter: true})
+}
+
+// bandwidth records a bandwidth metric of n bytes over d
+func (s *suite) bandwidth(name string, n int64, d time.Duration) {
+	s.rate(name, "MB/s", float64(n)/(1<<20), d)
+}
+
+// dataPass writes a file sequentially and reads it back, then rewrites
+// and rereads it at random block-aligned offsets, all in blocks of bs.
+// Write passes end with an fsync, so they time durable writes.
+func (s *suite) dataPass(name string, bs int64) error {
+	p := "/data-" + name
+	file, err := s.h.Create(p, 0644)
+	if err != nil {
+		return err
+	}
+	defer s.h.Remove(p)
+
+	blocks := s.cfg.dataBytes / bs
+	total := blocks * bs
+	buf := make([]byte, bs)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	offsets := rand.New(rand.NewSource(randSeed)).Perm(int(blocks))
+
+	write := func(offset func(i int64) int64) (time.Duration, error) {
+		start := time.Now()
+		for i := int64(0); i < blocks; i++ {
+			if _, err := s.h.WriteAt(file, offset(i), buf); err != nil {
+				return 0, err
+			}
+		}
+		if err := s.h.Fsync(file); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+	read := func(offset func(i int64) int64) (time.Duration, error) {
+		start := time.Now()
+		for i := int64(0); i < blocks; i++ {
+			data, err := s.h.ReadAt(file, offset(i), int(bs))
+			if err != nil {
+				return 0, err
+			}
+			if int64(len(data)) != bs {
+				return 0, fmt.Errorf("short read of %d bytes at block %d", len(data), i)
+			}
+		}
+		return time.Since(start), nil
+	}
+	sequential := func(i int64) int64 { return i * bs }
+	random := func(i int64) int64 { return int64(offsets[i]) * bs }
+
+	d, err := write(sequential)
+	if err != nil {
+		return err
+	}
+	s.bandwidth("seq_write_"+name, total, d)
+	if d, err = read(sequential); err != nil {
+		return err
+	}
+	s.bandwidth("seq_read_"+name, total, d)
+	if d, err = write(random); err != nil {
+		return err
+	}
+	s.bandwidth("rand_write_"+name, total, d)
+	if d, err = read(random); err != nil {
+		return err
+	}
+	s.bandwidth("rand_read_"+name, total, d)
+	return nil
+}
+
+// metadataPass creates, looks up and removes metaOps empty files in one
+// directory, timing each phase
+func (s *suite) metadataPass() error {
+	if _, err := s.h.Mkdir("/meta", 0755); err != nil {
+		return err
+	}
+	defer s.h.Remove("/meta")
+	name := func(i int) string { return fmt.Sprintf("/meta/f%07d", i) }
+	n := s.cfg.metaOps
+
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if _, err := s.h.Create(name(i), 0644); err != nil {
+			return err
+		}
+	}
+	s.rate("create", "ops/s", float64(n), time.Since(start))
+
+	start = time.Now()
+	for i := 0; i < n; i++ {
+		if _, err := s.h.Lookup(name(i)); err != nil {
+			return err
+		}
+	}
+	s.rate("lookup", "ops/s", float64(n), time.Since(start))
+
+	start = time.Now()
+	for i := 0; i < n; i++ {
+		if err := s.h.Remove(name(i)); err != nil {
+			return err
+		}
+	}
+	s.rate("remove", "ops/s", float64(n), time.Since(start))
+	return nil
+}
+
+// fsyncPass times fsyncs each following a 4KB write, the pattern of a
+// database log, and records the latency percentiles
+func (s *suite) fsyncPass() error {
+	const (
+		bs     = 4 << 10
+		extent = 1 << 20 // Writes cycle through this much of the file
+	)
+	file, err := s.h.Create("/fsync", 0644)
+	if err != nil {
+		return err
+	}
+	defer s.h.Remove("/fsync")
+
+	buf := make([]byte, bs)
+	latencies := make([]time.Duration, s.cfg.fsyncs)
+	for i := range latencies {
+		if _, err := s.h.WriteAt(file, int64(i*bs%extent), buf); err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := s.h.Fsync(file); err != nil {
+			return err
+		}
+		latencies[i] = time.Since(start)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, pct := range fsyncPercentiles {
+		i := int(pct.p * float64(len(latencies)))
+		if i >= len(latencies) {
+			i = len(latencies) - 1
+		}
+		s.metrics = append(s.metrics, Metric{
+			Name:  "fsync_" + pct.name,
+			Unit:  "us",
+			Value: float64(latencies[i]) / float64(time.Microsecond),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"aethelfs/internal/control"
+)
+
+// usageError reports bad command-line arguments
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string { return e.msg }
+
+// command is one aethelfsctl subcommand
+type command struct {
+	summary string
+	run     func(c *control.Client, args []string, out *printer) error
+}
+
+// commands maps subcommand names to their implementations. Most map one
+// to one onto control socket commands of the same name.
+var commands = map[string]command{
+	"stats": {
+		summary: "Show allocator, inode and operation statistics",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("stats", "[-watch INTERVAL]")
+			watch := flags.Duration("watch", 0, "Show them again every INTERVAL, e.g. 1s, to follow queue depth live")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			for {
+				if err := out.call(c, "stats", nil); err != nil || *watch <= 0 {
+					return err
+				}
+				time.Sleep(*watch)
+				fmt.Println()
+			}
+		},
+	},
+	"usage":           simple("usage", "Show bytes and inodes charged to each uid"),
+	"regions":         simple("regions", "Show allocation regions and their usage"),
+	"version":         simple("version", "Show the daemon version, features and format"),
+	"features":        simple("features", "Show which operations, flags and limits the mount supports"),
+	"config":          simple("config", "Show the effective mount options and those of the previous mount"),
+	"grow":            simple("grow", "Show file growth by directory"),
+	"refresh":         simple("refresh", "Re-read the device's metadata on a read-only mount"),
+	"flush-calibrate": simple("flush-calibrate", "Re-measure flush costs and update the auto flush threshold"),
+	"workers":         simple("workers", "Show background workers: state, last run, last error and crashes"),
+	"syncfs":          simple("syncfs", "Make all written data and metadata durable, like syncfs(2)"),
+	"health":          simple("health", "Show whether flush failures degraded the filesystem, and in which region"),
+	"clear-errors":    simple("clear-errors", "Accept writes again after flush failures degraded the filesystem"),
+	"pinned":          simple("pinned", "List pinned files and the bytes each holds"),
+	"crash-dumps": {
+		summary: "List the postmortem dumps earlier daemons left when they crashed",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("crash-dumps", "[-clear]")
+			clear := flags.Bool("clear", false, "Remove the dumps once they have been dealt with")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			if *clear {
+				return out.call(c, "clear-crash-dumps", nil)
+			}
+			return out.call(c, "crash-dumps", nil)
+		},
+	},
+	"top": {
+		summary: "Show the hottest files",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("top", "[-n N] [-metric bytes|reads|writes] [-window DURATION]")
+			n := flags.Int("n", 10, "Number of files to show")
+			metric := flags.String("metric", "bytes", "Ranking metric: bytes, reads or writes")
+			window := flags.String("window", "", "Only count accesses in this recent window, e.g. 5m")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			return out.call(c, "top", map[string]interface{}{"n": *n, "metric": *metric, "window": *window})
+		},
+	},
+	"alloc-log": {
+		summary: "Show recent allocations and frees",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("alloc-log", "[-n N]")
+			n := flags.Int("n", 0, "Number of entries to show (0 shows all kept)")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			return out.call(c, "alloc-log", map[string]interface{}{"n": *n})
+		},
+	},
+	"dedup": {
+		summary: "Merge files with identical contents",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("dedup", "[-rate-mb N] [-dry-run]")
+			rate := flags.Int64("rate-mb", 0, "Hash at most this many MB/s (0 is unthrottled)")
+			dryRun := flags.Bool("dry-run", false, "Only report what would be merged")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			return out.call(c, "dedup", map[string]interface{}{"rate_mb": *rate, "dry_run": *dryRun})
+		},
+	},
+	"inode": {
+		summary: "Describe the node with an inode number",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("inode", "INO")
+			if err := parse(flags, args, 1); err != nil {
+				return err
+			}
+			ino, err := strconv.ParseUint(flags.Arg(0), 0, 64)
+			if err != nil {
+				return &usageError{fmt.Sprintf("invalid inode number %q", flags.Arg(0))}
+			}
+			return out.call(c, "inode", map[string]interface{}{"ino": ino})
+		},
+	},
+	"heat-reset": {
+		summary: "Clear access counters of one file, or of all files",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("heat-reset", "[PATH]")
+			if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+				flags.Usage()
+				return &usageError{"heat-reset takes at most one path"}
+			}
+			return out.call(c, "heat-reset", map[string]interface{}{"path": flags.Arg(0)})
+		},
+	},
+	"pin": {
+		summary: "Keep a file's extent from being relocated by background work",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("pin", "[-prefault] PATH")
+			prefault := flags.Bool("prefault", false, "Fault in the file's pages before returning")
+			if err := parse(flags, args, 1); err != nil {
+				return err
+			}
+			return out.call(c, "pin", map[string]interface{}{"path": flags.Arg(0), "prefault": *prefault})
+		},
+	},
+	"unpin": {
+		summary: "Let background work relocate a pinned file again",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("unpin", "PATH")
+			if err := parse(flags, args, 1); err != nil {
+				return err
+			}
+			return out.call(c, "unpin", map[string]interface{}{"path": flags.Arg(0)})
+		},
+	},
+	"reserve": {
+		summary: "Reserve contiguous space for a file, or release its reservation",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("reserve", "[-offset N] [-release] PATH [LENGTH]")
+			offset := flags.Int64("offset", 0, "Logical offset the reservation starts at")
+			release := flags.Bool("release", false, "Give back the space the file holds past its size")
+			if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 {
+				flags.Usage()
+				return &usageError{"reserve takes a path and a length"}
+			}
+			var length int64
+			switch {
+			case *release && flags.NArg() == 1:
+			case !*release && flags.NArg() == 2:
+				n, err := strconv.ParseInt(flags.Arg(1), 0, 64)
+				if err != nil || n <= 0 {
+					return &usageError{fmt.Sprintf("invalid length %q", flags.Arg(1))}
+				}
+				length = n
+			default:
+				flags.Usage()
+				return &usageError{"reserve takes a length, or -release without one"}
+			}
+			return out.call(c, "reserve", map[string]interface{}{"path": flags.Arg(0), "offset": *offset, "length": length})
+		},
+	},
+	"epoch": {
+		summary: "Show the write epoch, or start a new one with -advance",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("epoch", "[-advance]")
+			advance := flags.Bool("advance", false, "End the current epoch and report it, for the next changed-since")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			if *advance {
+				return out.call(c, "advance-epoch", nil)
+			}
+			return out.call(c, "epoch", nil)
+		},
+	},
+	"changed-since": {
+		summary: "List the files and ranges written after a write epoch",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("changed-since", "EPOCH")
+			if err := parse(flags, args, 1); err != nil {
+				return err
+			}
+			epoch, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+			if err != nil {
+				return &usageError{"changed-since takes an epoch number"}
+			}
+			return out.call(c, "changed-since", map[string]interface{}{"epoch": epoch})
+		},
+	},
+	"report": {
+		summary: "Summarize write amplification, for the mount or one file",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("report", "[PATH]")
+			if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+				flags.Usage()
+				return &usageError{"report takes at most one path"}
+			}
+			var result json.RawMessage
+			if err := c.Call("report", map[string]interface{}{"path": flags.Arg(0)}, &result); err != nil {
+				return err
+			}
+			var report struct {
+				Summary string `json:"summary"`
+			}
+			if out.json || json.Unmarshal(result, &report) != nil {
+				out.print(result)
+				return nil
+			}
+			fmt.Println(report.Summary)
+			return nil
+		},
+	},
+	"ingest": {
+		summary: "Create the files and directories of a tar archive read from stdin",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("ingest", "< archive.tar")
+			if err := parse(flags, args, 0); err != nil {
+				return err
+			}
+			return ingest(c, os.Stdin, out)
+		},
+	},
+	"txn": {
+		summary: "Replace the contents of several files atomically: begin, stage, commit, abort or list",
+		run:     runTxn,
+	},
+	"call": {
+		summary: "Send any control command with optional JSON arguments",
+		run: func(c *control.Client, args []string, out *printer) error {
+			flags := newFlags("call", "COMMAND [JSON]")
+			if err := flags.Parse(args); err != nil || flags.NArg() < 1 || flags.NArg() > 2 {
+				flags.Usage()
+				return &usageError{"call takes a command and optional JSON arguments"}
+			}
+			var cmdArgs interface{}
+			if flags.NArg() == 2 {
+				if !json.Valid([]byte(flags.Arg(1))) {
+					return &usageError{"arguments are not valid JSON"}
+				}
+				cmdArgs = json.RawMessage(flags.Arg(1))
+			}
+			return out.call(c, flags.Arg(0), cmdArgs)
+		},
+	},
+}
+
+// simple is a command without arguments that prints the daemon's reply
+func simple(name, summary string) command {
+	return command{
+		summary: summary,
+		run: func(c *control.Client, args []string, out *printer) error {
+			if err := parse(newFlags(name, ""), args, 0); err != nil {
+				return err
+			}
+			return out.call(c, name, nil)
+		},
+	}
+}
+
+// newFlags creates the flag set of a subcommand
+func newFlags(name, synopsis string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: aethelfsctl %s %s\n", name, synopsis)
+		flags.SetOutput(os.Stderr)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parse parses args and requires exactly nargs positional arguments
+func parse(flags *flag.FlagSet, args []string, nargs int) error {
+	if err := flags.Parse(args); err != nil {
+		flags.Usage()
+		return &usageError{err.Error()}
+	}
+	if flags.NArg() != nargs {
+		flags.Usage()
+		return &usageError{fmt.Sprintf("%s takes %d argument(s)", flags.Name(), nargs)}
+	}
+	return nil
+}
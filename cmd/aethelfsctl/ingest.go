@@ -0,0 +1,95 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/fs"
+)
+
+// frameBytes bounds the file data sent in one ingest request. Data is
+// base64 encoded, so frames stay well under control.MaxRequestSize.
+const frameBytes = 8 * 1024 * 1024
+
+// ingest streams the regular files and directories of a tar archive to
+// the daemon in frames. Failed entries are listed on stderr and make the
+// command exit with a failure status once the archive is done.
+func ingest(client *control.Client, r io.Reader, out *printer) error {
+	tr := tar.NewReader(r)
+	var frame []fs.IngestEntry
+	var size int64
+	var summary struct {
+		Created int `json:"created"`
+		Failed  int `json:"failed"`
+	}
+
+	send := func() error {
+		var results []fs.IngestResult
+		err := client.Call("ingest", map[string]interface{}{"entries": frame}, &results)
+		for _, res := range results {
+			if res.Error != "" {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", res.Path, res.Error)
+				summary.Failed++
+				continue
+			}
+			summary.Created++
+		}
+		frame, size = frame[:0], 0
+		return err
+	}
+
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg {
+			fmt.Fprintf(os.Stderr, "%s: skipped unsupported tar entry type %q\n", h.Name, h.Typeflag)
+			continue
+		}
+		if h.Size > frameBytes {
+			fmt.Fprintf(os.Stderr, "%s: %d bytes is too large to ingest; copy it through the mount\n", h.Name, h.Size)
+			summary.Failed++
+			continue
+		}
+
+		e := fs.IngestEntry{
+			Path:  h.Name,
+			Mode:  h.FileInfo().Mode(),
+			Uid:   uint32(h.Uid),
+			Gid:   uint32(h.Gid),
+			Mtime: h.ModTime.UnixNano(),
+		}
+		if h.Typeflag == tar.TypeReg {
+			e.Size = h.Size
+			if e.Data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		}
+		if size+e.Size > frameBytes && len(frame) > 0 {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+		frame = append(frame, e)
+		size += e.Size
+	}
+	if len(frame) > 0 {
+		if err := send(); err != nil {
+			return err
+		}
+	}
+
+	result, _ := json.Marshal(summary)
+	out.print(result)
+	out.failed = summary.Failed > 0
+	return nil
+}
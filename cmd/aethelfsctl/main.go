@@ -0,0 +1,90 @@
+// Command aethelfsctl talks to a running aethelfsd through its control socket
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"aethelfs/internal/control"
+)
+
+// Exit codes, so scripts can tell an unreachable daemon from a failed command
+const (
+	exitOK         = 0
+	exitFailed     = 1 // The daemon ran the command and reported an error
+	exitUsage      = 2
+	exitConnection = 3 // The daemon could not be found or reached
+)
+
+func main() {
+	socket := flag.String("socket", "", "Control socket of the aethelfsd instance (default: discovered from the mount)")
+	mount := flag.String("mount", "", "Mountpoint whose control socket to use when several aethelfs mounts exist")
+	jsonOut := flag.Bool("json", false, "Print results as JSON for scripting")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	name := flag.Arg(0)
+	if name == "help" {
+		usage()
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "aethelfsctl: unknown command %q\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	path, err := findSocket(*socket, *mount)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "aethelfsctl: %v\n", err)
+		os.Exit(exitConnection)
+	}
+	client, err := control.Dial(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "aethelfsctl: %v\n", err)
+		os.Exit(exitConnection)
+	}
+	defer client.Close()
+
+	out := &printer{json: *jsonOut}
+	if err := cmd.run(client, flag.Args()[1:], out); err != nil {
+		fmt.Fprintf(os.Stderr, "aethelfsctl: %v\n", err)
+		var cmdErr *control.CommandError
+		var usageErr *usageError
+		switch {
+		case errors.As(err, &usageErr):
+			os.Exit(exitUsage)
+		case errors.As(err, &cmdErr):
+			os.Exit(exitFailed)
+		}
+		os.Exit(exitConnection)
+	}
+	if out.failed {
+		os.Exit(exitFailed)
+	}
+}
+
+// usage lists the global flags and commands
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: aethelfsctl [--socket PATH | --mount DIR] [--json] <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nExit status: 0 success, 1 command failed, 2 usage error, 3 daemon unreachable")
+}
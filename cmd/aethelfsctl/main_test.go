@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so the
+// tests can run aethelfsctl as a process and see its exit status
+const runMainEnv = "AETHELFSCTL_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(exitOK)
+	}
+	os.Exit(m.Run())
+}
+
+// serve mounts a file-backed device and serves its commands on a control
+// socket, returning the harness and the socket path
+func serve(t *testing.T) (*fstest.Harness, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fstest.DefaultSize); err != nil {
+		t.Fatal(err)
+	}
+	device, err := dax.NewDevice(path)
+	if err != nil {
+		t.Skipf("file-backed device unavailable: %v", err)
+	}
+	opts := fs.DefaultOptions()
+	opts.FlushInterval = 0
+	opts.CompactRate = 0
+	opts.AllocLogSize = 64
+	opts.MaxPinnedBytes = 1 << 20
+	h, err := fstest.Mount(device, opts)
+	if err != nil {
+		device.Close()
+		t.Fatalf("mount: %v", err)
+	}
+	s, err := control.Listen(filepath.Join(t.TempDir(), "control.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.FS.RegisterControl(s)
+	go s.Serve()
+	t.Cleanup(func() {
+		s.Close()
+		h.Close()
+		device.Close()
+	})
+	return h, s.Path()
+}
+
+// result is what one aethelfsctl run printed and its exit status
+type result struct {
+	stdout, stderr string
+	code           int
+}
+
+// ctl runs aethelfsctl with args against socket, with stdin as its input
+func ctl(t *testing.T, socket string, stdin []byte, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"--socket", socket}, args...)...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("aethelfsctl %s: %v", strings.Join(args, " "), err)
+	}
+	return result{stdout: stdout.String(), stderr: stderr.String(), code: cmd.ProcessState.ExitCode()}
+}
+
+// tarball builds an archive holding a directory and one file in it
+func tarball(t *testing.T, dir, file string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	if err := w.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteHeader(&tar.Header{Name: dir + "/" + file, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestCommands runs every subcommand once with --json and once without,
+// against a live daemon
+func TestCommands(t *testing.T) {
+	h, socket := serve(t)
+	if _, err := h.WriteFile("/file", bytes.Repeat([]byte("data"), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteFile("/reserved", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		args  []string
+		stdin []byte
+		want  string // Part of the plain output, empty to only check for some
+		code  int
+	}{
+		{"stats", nil, nil, "", exitOK},
+		{"usage", nil, nil, "", exitOK},
+		{"regions", nil, nil, "", exitOK},
+		{"version", nil, nil, "", exitOK},
+		{"features", nil, nil, "", exitOK},
+		{"config", nil, nil, "", exitOK},
+		{"grow", nil, nil, "", exitOK},
+		// Only a read-only mount has anything to refresh
+		{"refresh", nil, nil, "", exitFailed},
+		{"flush-calibrate", nil, nil, "", -1},
+		{"workers", nil, nil, "", exitOK},
+		{"syncfs", nil, nil, "", exitOK},
+		{"health", nil, nil, "", exitOK},
+		{"clear-errors", nil, nil, "", exitOK},
+		{"pinned", nil, nil, "", exitOK},
+		{"crash-dumps", nil, nil, "", exitOK},
+		{"crash-dumps", []string{"-clear"}, nil, "", exitOK},
+		{"top", []string{"-n", "3", "-metric", "writes"}, nil, "", exitOK},
+		{"alloc-log", []string{"-n", "5"}, nil, "", exitOK},
+		{"dedup", []string{"-dry-run"}, nil, "", exitOK},
+		{"inode", []string{"1"}, nil, "", exitOK},
+		{"heat-reset", []string{"/file"}, nil, "", exitOK},
+		{"pin", []string{"/file"}, nil, "", exitOK},
+		{"unpin", []string{"/file"}, nil, "", exitOK},
+		{"reserve", []string{"/reserved", "65536"}, nil, "", exitOK},
+		{"reserve", []string{"-release", "/reserved"}, nil, "", exitOK},
+		{"epoch", nil, nil, "", exitOK},
+		{"epoch", []string{"-advance"}, nil, "", exitOK},
+		{"changed-since", []string{"0"}, nil, "", exitOK},
+		{"report", []string{"/file"}, nil, "", exitOK},
+		{"ingest", nil, tarball(t, "plain", "a", []byte("ingested")), "created", exitOK},
+		{"txn", []string{"list"}, nil, "", exitOK},
+		{"call", []string{"inode", `{"ino": 1}`}, nil, "", exitOK},
+	}
+	seen := map[string]bool{}
+	for _, tt := range tests {
+		seen[tt.name] = true
+		for _, jsonOut := range []bool{false, true} {
+			args := append([]string{tt.name}, tt.args...)
+			stdin := tt.stdin
+			if jsonOut {
+				args = append([]string{"--json"}, args...)
+				if tt.name == "ingest" {
+					stdin = tarball(t, "json", "a", []byte("ingested"))
+				}
+			}
+			res := ctl(t, socket, stdin, args...)
+			// Whether the device supports it decides the result of -1
+			if tt.code == -1 && res.code == exitFailed {
+				continue
+			}
+			if tt.code != -1 && res.code != tt.code {
+				t.Errorf("aethelfsctl %s: exit %d, want %d: %s", strings.Join(args, " "), res.code, tt.code, res.stderr)
+				continue
+			}
+			if res.code != exitOK {
+				continue
+			}
+			if jsonOut {
+				if !json.Valid([]byte(res.stdout)) {
+					t.Errorf("aethelfsctl %s printed invalid JSON: %q", strings.Join(args, " "), res.stdout)
+				}
+			} else if !strings.Contains(res.stdout, tt.want) {
+				t.Errorf("aethelfsctl %s printed %q, want %q in it", strings.Join(args, " "), res.stdout, tt.want)
+			}
+		}
+	}
+	for name := range commands {
+		if !seen[name] {
+			t.Errorf("no test runs aethelfsctl %s", name)
+		}
+	}
+
+	if got, err := h.ReadFile("/plain/a"); err != nil || string(got) != "ingested" {
+		t.Errorf("ingested file reads %q, %v", got, err)
+	}
+}
+
+func TestTxn(t *testing.T) {
+	h, socket := serve(t)
+	if _, err := h.WriteFile("/a", []byte("old a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res := ctl(t, socket, nil, "--json", "txn", "begin")
+	var begun struct {
+		ID uint64 `json:"id"`
+	}
+	if res.code != exitOK || json.Unmarshal([]byte(res.stdout), &begun) != nil || begun.ID == 0 {
+		t.Fatalf("txn begin: exit %d, %q: %s", res.code, res.stdout, res.stderr)
+	}
+	id := strconv.FormatUint(begun.ID, 10)
+
+	if _, err := h.WriteFile("/b", []byte("old b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	local := filepath.Join(t.TempDir(), "b")
+	if err := os.WriteFile(local, []byte("new b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"txn", "stage", id, "/a", "-"},
+		{"txn", "stage", id, "/b", local},
+		{"txn", "commit", id},
+	} {
+		stdin := []byte("new a")
+		if res := ctl(t, socket, stdin, args...); res.code != exitOK {
+			t.Fatalf("aethelfsctl %s: exit %d: %s", strings.Join(args, " "), res.code, res.stderr)
+		}
+	}
+	for path, want := range map[string]string{"/a": "new a", "/b": "new b"} {
+		if got, err := h.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("%s reads %q, %v after commit, want %q", path, got, err, want)
+		}
+	}
+
+	res = ctl(t, socket, nil, "txn", "begin")
+	if res.code != exitOK {
+		t.Fatalf("txn begin: exit %d: %s", res.code, res.stderr)
+	}
+	if res := ctl(t, socket, nil, "txn", "abort", strings.Fields(res.stdout)[1]); res.code != exitOK {
+		t.Errorf("txn abort: exit %d: %s", res.code, res.stderr)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	h, socket := serve(t)
+	if _, err := h.WriteFile("/file", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+
+	tests := []struct {
+		name   string
+		socket string
+		stdin  []byte
+		args   []string
+		code   int
+	}{
+		{"no command", socket, nil, nil, exitUsage},
+		{"unknown command", socket, nil, []string{"explode"}, exitUsage},
+		{"extra argument", socket, nil, []string{"stats", "now"}, exitUsage},
+		{"bad inode number", socket, nil, []string{"inode", "one"}, exitUsage},
+		{"bad json", socket, nil, []string{"call", "stats", "{"}, exitUsage},
+		{"bad txn id", socket, nil, []string{"txn", "commit", "x"}, exitUsage},
+		{"unknown daemon command", socket, nil, []string{"call", "explode"}, exitFailed},
+		{"missing file", socket, nil, []string{"pin", "/missing"}, exitFailed},
+		{"missing transaction", socket, nil, []string{"txn", "commit", "999"}, exitFailed},
+		{"failed ingest entry", socket, tarball(t, "file", "a", nil), []string{"ingest"}, exitFailed},
+		{"daemon unreachable", missing, nil, []string{"stats"}, exitConnection},
+		{"help", missing, nil, []string{"help"}, exitOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := ctl(t, tt.socket, tt.stdin, tt.args...); res.code != tt.code {
+				t.Errorf("exit %d, want %d: %s", res.code, tt.code, res.stderr)
+			}
+		})
+	}
+}
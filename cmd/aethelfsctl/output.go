@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"aethelfs/internal/control"
+)
+
+// printer writes command results as indented JSON with --json, or in a
+// compact human-readable form otherwise
+type printer struct {
+	json   bool
+	failed bool // Set when a result reports partial failure
+}
+
+// call runs a control command and prints its result
+func (p *printer) call(c *control.Client, cmd string, args interface{}) error {
+	var result json.RawMessage
+	if err := c.Call(cmd, args, &result); err != nil {
+		return err
+	}
+	p.print(result)
+	return nil
+}
+
+// print writes one result
+func (p *printer) print(result json.RawMessage) {
+	var v interface{}
+	if p.json || json.Unmarshal(result, &v) != nil {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			fmt.Fprintf(w, "%s:\t%s\n", k, scalar(v[k]))
+		}
+	case []interface{}:
+		rows := make([]map[string]interface{}, 0, len(v))
+		for _, item := range v {
+			row, ok := item.(map[string]interface{})
+			if !ok {
+				fmt.Fprintln(w, scalar(item))
+				continue
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) == 0 {
+			return
+		}
+		cols := sortedKeys(rows[0])
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(cols, "\t")))
+		for _, row := range rows {
+			cells := make([]string, len(cols))
+			for i, col := range cols {
+				cells[i] = scalar(row[col])
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+	default:
+		fmt.Fprintln(w, scalar(v))
+	}
+}
+
+// scalar formats a value on one line; nested values stay compact JSON
+func scalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		return v
+	case float64:
+		if v == float64(int64(v)) {
+			return fmt.Sprintf("%d", int64(v))
+		}
+		return fmt.Sprintf("%g", v)
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// socketEnv overrides socket discovery without a flag
+const socketEnv = "AETHELFS_CONTROL_SOCKET"
+
+// mountFSType is how aethelfsd mounts appear in /proc/mounts
+const mountFSType = "fuse.aethelfsd"
+
+// findSocket picks the control socket: the --socket flag, then
+// $AETHELFS_CONTROL_SOCKET, then the path the daemon publishes in the
+// control directory of --mount, or of the only aethelfs mount
+func findSocket(socket, mount string) (string, error) {
+	if socket != "" {
+		return socket, nil
+	}
+	if env := os.Getenv(socketEnv); env != "" {
+		return env, nil
+	}
+
+	mounts := []string{mount}
+	if mount == "" {
+		var err error
+		if mounts, err = aethelfsMounts("/proc/mounts"); err != nil {
+			return "", err
+		}
+	}
+
+	var found []string
+	for _, m := range mounts {
+		data, err := os.ReadFile(filepath.Join(m, ".aethelfs", "control-socket"))
+		if err != nil {
+			continue
+		}
+		if path := strings.TrimSpace(string(data)); path != "" {
+			found = append(found, path)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no control socket found; start aethelfsd with -control-socket or pass --socket")
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%d aethelfs mounts serve a control socket; choose one with --mount", len(found))
+}
+
+// aethelfsMounts lists the mountpoints of aethelfsd filesystems in a
+// mounts table such as /proc/mounts
+func aethelfsMounts(table string) ([]string, error) {
+	file, err := os.Open(table)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == mountFSType {
+			mounts = append(mounts, unescapeMount(fields[1]))
+		}
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMount decodes the octal escapes (\040 for space and so on)
+// the kernel uses for whitespace and backslashes in mount paths
+func unescapeMount(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"aethelfs/internal/control"
+)
+
+// runTxn implements "aethelfsctl txn", the client side of the daemon's
+// multi-file transactions:
+//
+//	txn begin                    prints the new transaction id
+//	txn stage ID PATH [FILE|-]   stages FILE (default stdin) as PATH's new contents
+//	txn commit ID                replaces every staged file at once
+//	txn abort ID                 discards the staged contents
+//	txn list                     shows open transactions
+func runTxn(c *control.Client, args []string, out *printer) error {
+	flags := newFlags("txn", "begin | stage ID PATH [FILE|-] | commit ID | abort ID | list")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		flags.Usage()
+		return &usageError{"txn takes an operation"}
+	}
+	op, rest := flags.Arg(0), flags.Args()[1:]
+
+	switch op {
+	case "begin", "list":
+		if len(rest) != 0 {
+			return &usageError{fmt.Sprintf("txn %s takes no arguments", op)}
+		}
+		return out.call(c, "txn", map[string]interface{}{"op": op})
+	case "commit", "abort":
+		if len(rest) != 1 {
+			return &usageError{fmt.Sprintf("txn %s takes a transaction id", op)}
+		}
+		id, err := parseTxnID(rest[0])
+		if err != nil {
+			return err
+		}
+		return out.call(c, "txn", map[string]interface{}{"op": op, "id": id})
+	case "stage":
+		if len(rest) != 2 && len(rest) != 3 {
+			return &usageError{"txn stage takes a transaction id, a path and an optional local file"}
+		}
+		id, err := parseTxnID(rest[0])
+		if err != nil {
+			return err
+		}
+		in := os.Stdin
+		if len(rest) == 3 && rest[2] != "-" {
+			if in, err = os.Open(rest[2]); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		return stageFile(c, id, rest[1], in, out)
+	}
+	flags.Usage()
+	return &usageError{fmt.Sprintf("unknown txn operation %q", op)}
+}
+
+// parseTxnID parses a transaction id argument
+func parseTxnID(s string) (uint64, error) {
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, &usageError{fmt.Sprintf("invalid transaction id %q", s)}
+	}
+	return id, nil
+}
+
+// stageFile sends r as the new contents of path in frames of at most
+// frameBytes, appending every frame after the first
+func stageFile(c *control.Client, id uint64, path string, r io.Reader, out *printer) error {
+	buf := make([]byte, frameBytes)
+	var total int64
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n > 0 || first {
+			args := map[string]interface{}{
+				"op": "stage", "id": id, "path": path, "data": buf[:n], "append": !first,
+			}
+			if cerr := c.Call("txn", args, nil); cerr != nil {
+				return cerr
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	result, _ := json.Marshal(map[string]interface{}{"id": id, "path": path, "staged": total})
+	out.print(result)
+	return nil
+}
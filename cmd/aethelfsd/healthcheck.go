@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"aethelfs/internal/ctlproto"
+)
+
+// Healthcheck exit codes, suitable for exec probes
+const (
+	healthOK       = 0
+	healthDegraded = 1
+	healthDead     = 2
+)
+
+// probeName is the file the health check creates in the mount root
+const probeName = ".aethelfs-healthcheck"
+
+// runHealthcheck implements "aethelfsd healthcheck [options] <mountpoint>"
+// and returns the process exit code
+func runHealthcheck(args []string) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 5*time.Second, "Time allowed for each check")
+	controlSocket := flags.String("control-socket", "", "Also check that this control socket answers")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: aethelfsd healthcheck [options] <mountpoint>")
+		fmt.Fprintln(os.Stderr, "Exits 0 when healthy, 1 when degraded and 2 when the mount is dead.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return healthDead
+	}
+	mountpoint := flags.Arg(0)
+
+	// A hung FUSE server blocks statfs forever, so run it with a deadline
+	if err := withTimeout(*timeout, func() error {
+		var st unix.Statfs_t
+		return unix.Statfs(mountpoint, &st)
+	}); err != nil {
+		fmt.Printf("dead: statfs %s: %v\n", mountpoint, err)
+		return healthDead
+	}
+
+	status := healthOK
+	if err := withTimeout(*timeout, func() error {
+		return probeFile(filepath.Join(mountpoint, fmt.Sprintf("%s.%d", probeName, os.Getpid())))
+	}); err != nil {
+		fmt.Printf("degraded: probe file: %v\n", err)
+		status = healthDegraded
+	}
+
+	if *controlSocket != "" {
+		if err := pingControl(*controlSocket, *timeout); err != nil {
+			fmt.Printf("degraded: control socket: %v\n", err)
+			status = healthDegraded
+		}
+	}
+
+	if status == healthOK {
+		fmt.Println("healthy")
+	}
+	return status
+}
+
+// withTimeout runs fn, giving up after timeout. fn may keep running.
+func withTimeout(timeout time.Duration, fn func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// probeFile creates, writes, reads back and removes a file at path
+func probeFile(path string) error {
+	want := []byte(fmt.Sprintf("aethelfs health probe %d\n", time.Now().UnixNano()))
+	if err := os.WriteFile(path, want, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("read back %d bytes that differ from the %d written", len(got), len(want))
+	}
+	return os.Remove(path)
+}
+
+// pingControl sends the health command and checks for a successful reply
+// that does not report the filesystem degraded by flush failures
+func pingControl(path string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err := json.NewEncoder(conn).Encode(ctlproto.Request{Version: ctlproto.Version, Cmd: "health"}); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp ctlproto.Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("malformed reply: %v", err)
+	}
+	if failed := resp.Failed(); failed != nil {
+		return fmt.Errorf("command failed: %s", failed.Message)
+	}
+	var health struct {
+		Degraded *struct {
+			Region string `json:"region"`
+			Policy string `json:"policy"`
+		} `json:"degraded"`
+	}
+	if err := json.Unmarshal(resp.Result, &health); err != nil {
+		return fmt.Errorf("malformed reply: %v", err)
+	}
+	if d := health.Degraded; d != nil {
+		return fmt.Errorf("filesystem degraded by flush failures in region %s (writes %s)", d.Region, d.Policy)
+	}
+	return nil
+}
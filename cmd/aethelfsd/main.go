@@ -1,15 +1,28 @@
 package main
 
 import (
+	"expvar"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
 	"syscall"
+	"time"
 
+	"aethelfs/internal/audit"
 	"aethelfs/internal/common"
+	"aethelfs/internal/control"
 	"aethelfs/internal/dax"
+	"aethelfs/internal/disk"
 	"aethelfs/internal/fs"
+	"aethelfs/internal/metrics"
+	"aethelfs/internal/sdnotify"
+	"aethelfs/internal/trace"
 
 	"bazil.org/fuse"
 )
@@ -18,12 +31,116 @@ import (
 var debugMode *bool
 
 func main() {
+	// Subcommands take over before the daemon's flags are parsed
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+
 	// Define command-line flags
+	showVersion := flag.Bool("version", false, "Print version, build information and features, then exit")
 	debugMode = flag.Bool("debug", false, "Enable debug mode with verbose logging")
+	defaults := fs.DefaultOptions()
+	metaBatchSize := flag.Int("meta-batch-size", defaults.MetaBatchSize,
+		"Metadata mutations batched per device flush (1 disables batching)")
+	metaBatchDelay := flag.Duration("meta-batch-delay", defaults.MetaBatchDelay,
+		"Maximum time a metadata mutation waits for its batch to flush")
+	maxFileSize := flag.Int64("max-file-size", defaults.MaxFileSize, "Largest file size in bytes; larger writes fail with EFBIG")
+	flushWorkers := flag.Int("flush-workers", 0, "Goroutines used to flush large devices (0 uses GOMAXPROCS)")
+	mapSegment := flag.Int64("map-segment-size", dax.DefaultSegmentSize, "Map the device in segments of this many bytes, a multiple of 2MB (0 maps it whole)")
+	blockSize := flag.Int64("block-size", 0, "Allocation block size used when formatting a new device, 256 to 2M (0 uses 4096); must match a formatted device")
+	inodeRatio := flag.Int64("inode-ratio", 0, "Device bytes per inode when formatting a new device, limiting how many files it holds (0 uses 16384); must match a formatted device")
+	allocator := flag.String("allocator", "", "Allocator used when formatting a new device: freelist or bitmap (empty uses freelist); must match a formatted device")
+	label := flag.String("label", "", "Store this label on the device and show it in the mount's fsname (aethelfs:LABEL)")
+	regions := flag.String("regions", "", "Split the device into named allocation regions (name=OFFSET+SIZE,...)")
+	largeFileThreshold := flag.Int64("large-file-threshold", 0, "Files at least this many bytes are placed in -large-file-region")
+	placement := flag.String("placement", defaults.Placement,
+		"Where new extents go: pack from the start of a region, or spread by inode across it")
+	largeFileRegion := flag.String("large-file-region", "", "Region preferred for files over -large-file-threshold")
+	allocLogSize := flag.Int("alloc-log-size", 0, "Keep this many recent allocations and frees for the control socket alloc-log command")
+	maxPanics := flag.Int("max-panics", 0, "Exit after this many recovered handler panics (0 never exits)")
+	crashDir := flag.String("crash-dir", defaultCrashDir,
+		"Write a postmortem dump under this directory when the daemon crashes, and report dumps found there at start (empty disables)")
+	fileMode := flag.Bool("file", false, "Allow a regular file as the device, e.g. on an fsdax mount or for testing")
+	readOnly := flag.Bool("read-only", false, "Mount a device another aethelfsd may be serving, read-only, e.g. for backups")
+	recovery := flag.Bool("recovery", false, "Mount a damaged device read-only to salvage data, logging metadata inconsistencies instead of failing")
+	forceDevice := flag.Bool("force-device", false, "Take over a device lock still held after its recorded aethelfsd exited")
+	lockDir := flag.String("lock-dir", dax.DefaultLockDir, "Directory for the locks that stop two daemons mounting one device")
+	forceMount := flag.Bool("force-mount", false, "Lazily unmount a stale aethelfsd mount left at the mountpoint")
+	readahead := flag.Int64("readahead", defaults.Readahead, "Bytes prefetched past sequential reads (0 disables)")
+	noPrefetchHints := flag.Bool("no-prefetch-hints", false, "Do not prefetch the chunks earlier opens of a file read first")
+	flushInterval := flag.Duration("flush-interval", defaults.FlushInterval, "How often dirty ranges are flushed in the background (0 disables)")
+	reuseDelay := flag.String("reuse-delay", "",
+		"Hold freed extents back from reuse for this duration (e.g. 10m) or up to this many bytes, released early when space runs low")
+	maxPinnedBytes := flag.Int64("max-pinned-bytes", 0, "Limit the bytes pinned files may hold; pins past it fail with EDQUOT (0 disables pinning)")
+	pinPrefault := flag.Bool("pin-prefault", false, "Fault in every file's pages as it is pinned")
+	staticInitialSize := flag.Bool("static-initial-size", false, "Give new files the fixed default initial allocation instead of one learned from recent file sizes")
+	initialSizePercentile := flag.Int("initial-size-percentile", defaults.InitialSizePercentile,
+		"Percentile of recent final file sizes per top-level directory that new files are allocated")
+	verifyWrites := flag.Bool("verify-writes", false, "Debug: read back every write after flushing it and fail mismatches with EIO (slow; for qualifying hardware)")
+	protectMetadata := flag.Bool("protect-metadata", defaults.ProtectMetadata, "Keep the metadata region write-protected so stray writes fault instead of corrupting it")
+	writeEpochInterval := flag.Duration("write-epoch-interval", 0, "Advance the write epoch incremental backups query this often (0 advances only on request)")
+	compactRate := flag.Int64("compact-rate", defaults.CompactRate, "Bytes per second background compaction may move to merge free space (0 disables)")
+	compactThreshold := flag.Float64("compact-threshold", defaults.CompactThreshold, "Compact when the largest free extent is below this fraction of free space")
+	backgroundMaxLatency := flag.Duration("background-max-latency", defaults.BackgroundMaxLatency,
+		"Hold compaction and dedup off while average read/write latency exceeds this (0 ignores latency)")
+	compactMaxLatency := flag.Duration("compact-max-latency", 0, "Deprecated alias of -background-max-latency")
+	backgroundMaxQueue := flag.Int("background-max-queue", defaults.BackgroundMaxQueue,
+		"Hold compaction and dedup off while more than this many FUSE requests are in flight (negative ignores the queue)")
+	backgroundMaxDefer := flag.Duration("background-max-defer", defaults.BackgroundMaxDefer,
+		"Longest a background task holds off for foreground requests before each chunk of work")
+	flushStrategy := flag.String("flush-strategy", defaults.FlushStrategy, "How ranges are made durable: clwb, msync, or auto to choose by size after calibrating at mount")
+	flushErrorLimit := flag.Int("flush-error-limit", defaults.FlushErrorLimit,
+		"Degrade the filesystem after this many consecutive flush failures in one region (0 never degrades)")
+	onFlushErrors := flag.String("on-flush-errors", defaults.OnFlushErrors, "What writes do once degraded: fail with EIO, or continue")
+	maxDirtyBytes := flag.Int64("max-dirty-bytes", defaults.MaxDirtyBytes,
+		"Throttle writes once this many bytes await the background flusher (0 never throttles)")
+	dirtyLowBytes := flag.Int64("dirty-low-bytes", 0, "Dirty bytes at which throttled writes resume (0 is half of -max-dirty-bytes)")
+	requireDurable := flag.Bool("require-durable", false, "Refuse to mount unless the persistence self-test at mount passes")
+	conservativeFlush := flag.Bool("conservative-flush", false, "Flush file data in the background too instead of leaving it to kernel writeback")
+	metadataWarnBytes := flag.Int64("metadata-warn-bytes", 0, "Warn while heap used by in-memory inodes is over this many bytes (0 never warns)")
+	noSuid := flag.Bool("no-suid", false, "Strip setuid and setgid bits at create and chmod, whatever the mount flags")
+	noDeviceNodes := flag.Bool("no-device-nodes", false, "Refuse to create character and block device nodes, even for root")
+	exclusiveWrite := flag.Bool("exclusive-write", false, "Allow at most one writable open per file; further write opens fail with EBUSY")
+	delayAllocBudget := flag.Int64("delay-alloc-budget", defaults.DelayAllocBudget,
+		"Memory in bytes new files may buffer writes in before getting an extent (0 allocates at create)")
+	coalesceAppends := flag.Bool("coalesce-appends", false, "Stage small sequential appends and write them to the device in batches")
+	serialize := flag.Bool("serialize", false, "Debugging aid: handle one operation at a time")
+	maxParallel := flag.Int("max-parallel", 0, "Handle at most this many operations concurrently (0 is unbounded)")
+	ino32 := flag.Bool("ino32", false, "Keep inode numbers below 2^32 for 32-bit applications and NFSv3 clients")
+	dirSync := flag.String("dir-sync", defaults.DirSync, "What fsync on a directory guarantees: batch, full or none")
+	slowOpThreshold := flag.Duration("slow-op-threshold", defaults.SlowOpThreshold,
+		"Log operations taking at least this long, with the requests in flight (0 disables)")
+	maxBackground := flag.Int("max-background", DefaultMaxBackground, "Background requests, such as readahead and writeback, the kernel may queue (1-65535)")
+	congestionThreshold := flag.Int("congestion-threshold", 0,
+		"Queued background requests at which the kernel throttles their submitters (0 is three quarters of -max-background)")
+	syncMode := flag.String("sync-mode", defaults.SyncMode, "When writes become durable: default (after fsync or a background flush) or strict (before they are acknowledged)")
+	strictSyncPolicy := flag.String("strict-sync-policy", strictSyncDisableWriteback,
+		"With -sync-mode=strict, disable-writeback mounts without the kernel writeback cache; error refuses to start")
+	uidQuota := flag.String("uid-quota", "", "Limit the bytes allocated to files of each uid (uid=BYTES,...); growth past it fails with EDQUOT")
+	preload := flag.String("preload", "", "Create the files and directories of this tar archive before serving (- reads stdin)")
+	fastMount := flag.Bool("fast-mount", false, "Rebuild the free list in the background so the mount is usable sooner")
+	exposeControlDir := flag.Bool("expose-control-dir", false, "List the virtual .aethelfs directory in the mount root")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "Export operation traces to this OTLP/HTTP collector (e.g. localhost:4318)")
+	traceSampleRatio := flag.Float64("trace-sample-ratio", 0.01, "Fraction of operations traced when -otlp-endpoint is set")
+	traceSlowThreshold := flag.Duration("trace-slow-threshold", 10*time.Millisecond,
+		"Always trace operations at least this slow (0 disables)")
+	auditLogPath := flag.String("audit-log", "", "Append a record of every namespace mutation and control command to this file (reopened on SIGHUP)")
+	controlSocket := flag.String("control-socket", "", "Serve administrative commands on this unix socket")
+	controlAllowUid := flag.String("control-allow-uid", "", "Comma-separated uids besides the daemon's and root's allowed every control command")
+	controlReadOnlyGid := flag.Int("control-readonly-gid", -1, "Group allowed the read-only control commands, such as stats and config (-1 for none)")
+	statsAddr := flag.String("stats-addr", "", "Serve an expvar-compatible JSON stats document on this address")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9100)")
+	readyFd := flag.Int("ready-fd", -1, "Write a byte to and close this file descriptor once the filesystem is serving")
+	execMode := flag.Bool("exec", false, "Run the command after -- once mounted, then unmount and exit with its status")
 
 	// Parse command line arguments
 	flag.Parse()
 
+	if *showVersion {
+		printVersion()
+		return
+	}
+
 	// Make the debug flag available to the fs package
 	fs.SetDebugMode(debugMode)
 
@@ -35,29 +152,82 @@ func main() {
 
 	// Check arguments (adjusted to account for possible flags)
 	args := flag.Args()
+	var command []string
+	if *execMode {
+		var err error
+		if args, command, err = splitExecArgs(args); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if len(args) != 2 {
-		log.Fatal("Usage: aethelfsd [-debug] <dax-device> <mountpoint>")
+		log.Fatal("Usage: aethelfsd [options] <dax-device> <mountpoint> [-- command args...]")
 	}
 
 	daxPath := args[0]
 	mountpoint := args[1]
+	if *recovery {
+		*readOnly = true
+	}
+
+	// Reject paths that cannot be mapped before locking or opening them
+	if _, err := dax.ClassifyPath(daxPath, *fileMode); err != nil {
+		log.Fatal(err)
+	}
+
+	// Catch stale mounts and unusable mountpoints before touching the device
+	if err := checkMountpoint(mountpoint, *forceMount); err != nil {
+		log.Fatal(err)
+	}
+
+	// Claim the device so a second daemon can't corrupt its metadata. A
+	// read-only mount writes nothing and shares the device with the writer.
+	var lock *dax.Lock
+	var err error
+	if *readOnly {
+		if *preload != "" || *label != "" {
+			log.Fatal("-preload and -label write to the device and cannot be used with -read-only")
+		}
+		if *requireDurable {
+			log.Fatal("-require-durable writes a test pattern and cannot be used with -read-only")
+		}
+		lock, err = dax.LockDeviceShared(daxPath, *lockDir)
+	} else {
+		lock, err = dax.LockDevice(daxPath, *lockDir, *forceDevice)
+	}
+	if err != nil {
+		log.Fatalf("Cannot use %s: %v", daxPath, err)
+	}
 
 	// Open the DAX device
-	device, err := dax.NewDevice(daxPath)
+	device, err := dax.OpenDevice(daxPath, dax.DeviceOptions{ReadOnly: *readOnly, SegmentSize: *mapSegment})
 	if err != nil {
 		log.Fatalf("Failed to open DAX device: %v", err)
 	}
-	defer device.Close()
+	device.SetFlushWorkers(*flushWorkers)
+
+	// Failure testing only: wrap the device in a fault injector
+	var backend dax.Backend = device
+	if spec := os.Getenv(dax.FaultEnv); spec != "" {
+		faulty := dax.NewFaultDevice(device)
+		if err := faulty.ParseFaults(spec); err != nil {
+			log.Fatalf("Invalid %s: %v", dax.FaultEnv, err)
+		}
+		log.Printf("Warning: injecting device faults: %s", spec)
+		backend = faulty
+	}
 
 	// Build mount options with optimized settings
-	opts := []fuse.MountOption{
-		fuse.FSName("aethelfs"),
-		fuse.Subtype("aethelfsd"),
-		fuse.AllowOther(),
-		fuse.MaxReadahead(4 * 1024 * 1024), // 4MB readahead
-		fuse.AsyncRead(),                   // Enable asynchronous reads
-		fuse.WritebackCache(),              // Enable write caching
-		fuse.MaxBackground(64),             // Increase concurrent operations
+	opts, writeback, err := mountOptions(mountConfig{
+		FSName:           fsName(device, *label),
+		ReadOnly:         *readOnly,
+		SyncMode:         *syncMode,
+		StrictSyncPolicy: *strictSyncPolicy,
+
+		MaxBackground:       *maxBackground,
+		CongestionThreshold: *congestionThreshold,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Enable low‑level FUSE package logging
@@ -72,31 +242,327 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to mount FUSE filesystem: %v", err)
 	}
-	defer c.Close()
+	logMountLimits(c, *maxBackground, *congestionThreshold, writeback)
 
 	// Initialize the filesystem with the DAX device
-	filesystem, err := fs.NewFilesystem(device)
+	fsOpts := fs.DefaultOptions()
+	fsOpts.MetaBatchSize = *metaBatchSize
+	fsOpts.MetaBatchDelay = *metaBatchDelay
+	fsOpts.MaxFileSize = *maxFileSize
+	fsOpts.ExposeControlDir = *exposeControlDir
+	fsOpts.FastMount = *fastMount
+	fsOpts.ExclusiveWrite = *exclusiveWrite
+	fsOpts.NoSuid = *noSuid
+	fsOpts.NoDeviceNodes = *noDeviceNodes
+	fsOpts.CoalesceAppends = *coalesceAppends
+	fsOpts.DelayAllocBudget = *delayAllocBudget
+	fsOpts.Serialize = *serialize
+	fsOpts.Ino32 = *ino32
+	fsOpts.DirSync = *dirSync
+	fsOpts.MaxParallel = *maxParallel
+	fsOpts.FlushInterval = *flushInterval
+	fsOpts.MaxPinnedBytes = *maxPinnedBytes
+	fsOpts.PinPrefault = *pinPrefault
+	fsOpts.WriteEpochInterval = *writeEpochInterval
+	fsOpts.ProtectMetadata = *protectMetadata
+	fsOpts.VerifyWrites = *verifyWrites
+	fsOpts.SlowOpThreshold = *slowOpThreshold
+	fsOpts.MaxBackground = *maxBackground
+	if fsOpts.MaxBackground == 0 {
+		fsOpts.MaxBackground = DefaultMaxBackground
+	}
+	fsOpts.StaticInitialSize = *staticInitialSize
+	fsOpts.InitialSizePercentile = *initialSizePercentile
+	fsOpts.CompactRate = *compactRate
+	fsOpts.CompactThreshold = *compactThreshold
+	fsOpts.BackgroundMaxLatency = *backgroundMaxLatency
+	flag.Visit(func(fl *flag.Flag) {
+		if fl.Name == "compact-max-latency" {
+			fsOpts.BackgroundMaxLatency = *compactMaxLatency
+		}
+	})
+	fsOpts.BackgroundMaxQueue = *backgroundMaxQueue
+	fsOpts.BackgroundMaxDefer = *backgroundMaxDefer
+	fsOpts.Readahead = *readahead
+	fsOpts.NoPrefetchHints = *noPrefetchHints
+	fsOpts.WritebackCache = writeback // Matches the fuse.WritebackCache mount option
+	fsOpts.SyncMode = *syncMode
+	fsOpts.ReadOnly = *readOnly
+	fsOpts.Recovery = *recovery
+	fsOpts.ConservativeFlush = *conservativeFlush
+	fsOpts.RequireDurable = *requireDurable
+	fsOpts.FlushErrorLimit = *flushErrorLimit
+	fsOpts.OnFlushErrors = *onFlushErrors
+	fsOpts.MaxDirtyBytes = *maxDirtyBytes
+	fsOpts.DirtyLowBytes = *dirtyLowBytes
+	fsOpts.FlushStrategy = *flushStrategy
+	fsOpts.AllocLogSize = *allocLogSize
+	fsOpts.BlockSize = *blockSize
+	fsOpts.Allocator = *allocator
+	fsOpts.InodeRatio = *inodeRatio
+	fsOpts.Label = *label
+	fsOpts.MaxPanics = *maxPanics
+	if *crashDir != "" {
+		fsOpts.CrashDir = filepath.Join(*crashDir, filepath.Base(daxPath))
+	}
+	fsOpts.MetadataWarnBytes = *metadataWarnBytes
+	if fsOpts.Regions, err = fs.ParseRegions(*regions); err != nil {
+		log.Fatalf("Invalid -regions: %v", err)
+	}
+	if fsOpts.UidQuota, err = fs.ParseUidQuota(*uidQuota); err != nil {
+		log.Fatalf("Invalid -uid-quota: %v", err)
+	}
+	if fsOpts.ReuseDelay, fsOpts.ReuseDelayBytes, err = fs.ParseReuseDelay(*reuseDelay); err != nil {
+		log.Fatalf("Invalid -reuse-delay: %v", err)
+	}
+	if *controlSocket != "" {
+		if fsOpts.ControlSocket, err = filepath.Abs(*controlSocket); err != nil {
+			log.Fatalf("Invalid -control-socket: %v", err)
+		}
+	}
+	controlAccess := control.Access{ReadOnlyGid: *controlReadOnlyGid}
+	if controlAccess.AllowUids, err = control.ParseUids(*controlAllowUid); err != nil {
+		log.Fatalf("Invalid -control-allow-uid: %v", err)
+	}
+	fsOpts.LargeFileThreshold = *largeFileThreshold
+	fsOpts.LargeFileRegion = *largeFileRegion
+	fsOpts.Placement = *placement
+	fsOpts.Progress = func(p fs.MountProgress) {
+		status := fmt.Sprintf("Scanning %s: %d/%d inodes, %d extents (%.0f%%)",
+			p.Phase, p.InodesLoaded, p.InodesTotal, p.ExtentsIndexed, p.Percent)
+		log.Print(status)
+		sdnotify.Notify("STATUS=" + status)
+	}
+	filesystem, err := fs.NewFilesystem(backend, fsOpts)
 	if err != nil {
 		log.Fatalf("Failed to create filesystem: %v", err)
 	}
+	filesystem.SetCrashHandler(crashHandler(filesystem))
+
+	// Enable operation tracing if a collector is configured
+	if *otlpEndpoint != "" {
+		tracer := trace.New(trace.Config{
+			Endpoint:      *otlpEndpoint,
+			SampleRatio:   *traceSampleRatio,
+			SlowThreshold: *traceSlowThreshold,
+		})
+		defer tracer.Close()
+		filesystem.SetTracer(tracer)
+		log.Printf("Tracing enabled: exporting to %s (sample ratio %.3f, slow threshold %v)",
+			*otlpEndpoint, *traceSampleRatio, *traceSlowThreshold)
+	}
+
+	// Open the audit log if requested; SIGHUP reopens it for rotation
+	var auditLog *audit.Logger
+	if *auditLogPath != "" {
+		auditLog, err = audit.Open(*auditLogPath, audit.DefaultQueueLen)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLog.Close()
+		filesystem.SetAuditLog(auditLog)
+
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		go func() {
+			for range hupCh {
+				if err := auditLog.Reopen(); err != nil {
+					log.Printf("Warning: failed to reopen audit log: %v", err)
+				} else {
+					log.Printf("Audit log reopened: %s", *auditLogPath)
+				}
+			}
+		}()
+	}
 
-	// Serve the filesystem
-	if err := fs.Serve(c, filesystem); err != nil {
-		log.Fatalf("Failed to serve FUSE filesystem: %v", err)
+	// Load the preload archive before the mount is served
+	if *preload != "" {
+		if err := preloadTar(filesystem, *preload); err != nil {
+			log.Fatalf("Failed to preload %s: %v", *preload, err)
+		}
 	}
 
-	// Wait for the FUSE server to exit properly
+	// Start the control socket if requested
+	var ctl *control.Server
+	if *controlSocket != "" {
+		ctl, err = control.Listen(*controlSocket)
+		if err != nil {
+			log.Fatalf("Failed to start control socket: %v", err)
+		}
+		if err := ctl.SetAccess(controlAccess); err != nil {
+			log.Fatalf("Failed to start control socket: %v", err)
+		}
+		ctl.SetAuditLog(auditLog)
+		filesystem.RegisterControl(ctl)
+		go ctl.Serve()
+	}
+
+	// Expose the JSON stats document if requested
+	if *statsAddr != "" {
+		expvar.Publish("aethelfs", expvar.Func(func() interface{} {
+			return filesystem.Stats()
+		}))
+		mux := http.NewServeMux()
+		mux.Handle("/", expvar.Handler())
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			if err := http.ListenAndServe(*statsAddr, mux); err != nil {
+				log.Printf("Warning: stats endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	// Expose metrics if requested
+	if *metricsAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, metrics.Default.Handler()); err != nil {
+				log.Printf("Warning: metrics endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	// Serve the filesystem; with -fast-mount the free list may still be rebuilding
+	sdnotify.Notify("READY=1")
+	go runWatchdog(filesystem)
+	serveErr := make(chan error, 1)
+	go func() {
+		defer crashOnPanic(filesystem)
+		serveErr <- fs.Serve(c, filesystem)
+	}()
+
 	log.Printf("Filesystem mounted successfully at %s (%.2f GB available). Press Ctrl+C to exit.",
 		mountpoint, float64(common.MaxFilesystemSize)/(1024*1024*1024))
 	// Set up signal handling for clean shutdown
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
-	<-signalCh
 
-	log.Println("Unmounting filesystem...")
-	err = fuse.Unmount(mountpoint)
+	if *readyFd >= 0 {
+		if err := signalReadyFd(*readyFd); err != nil {
+			log.Printf("Warning: failed to signal readiness: %v", err)
+		}
+	}
+
+	// In -exec mode the command's lifetime bounds the mount's; signals are
+	// passed on to it so it can exit cleanly first
+	exitCode := 0
+	var cmdDone <-chan error
+	if *execMode {
+		cmd, done, err := startCommand(command)
+		if err != nil {
+			log.Printf("Failed to start %s: %v", command[0], err)
+			exitCode = 127
+			select {
+			case signalCh <- syscall.SIGTERM:
+			default: // A signal is already pending
+			}
+		} else {
+			cmdDone = done
+			go func() {
+				for sig := range signalCh {
+					cmd.Process.Signal(sig)
+				}
+			}()
+		}
+	}
+
+	select {
+	case cmdErr := <-cmdDone:
+		exitCode = exitStatus(cmdErr)
+		log.Printf("%s exited with status %d; unmounting filesystem...", command[0], exitCode)
+		sdnotify.Notify("STOPPING=1")
+		if err := fuse.Unmount(mountpoint); err != nil {
+			log.Printf("Warning: Failed to unmount cleanly: %v", err)
+		}
+		err = <-serveErr
+	case <-signalCh:
+		log.Println("Unmounting filesystem...")
+		sdnotify.Notify("STOPPING=1")
+		if err := fuse.Unmount(mountpoint); err != nil {
+			log.Printf("Warning: Failed to unmount cleanly: %v", err)
+			log.Println("You may need to run 'fusermount -u " + mountpoint + "' manually")
+		}
+		// Serve returns once the kernel has released the mount
+		err = <-serveErr
+	case err = <-serveErr:
+		log.Println("Filesystem was unmounted externally")
+	}
 	if err != nil {
-		log.Printf("Warning: Failed to unmount cleanly: %v", err)
-		log.Println("You may need to run 'fusermount -u " + mountpoint + "' manually")
+		log.Printf("Warning: FUSE server stopped with error: %v", err)
+	}
+
+	// Tear down strictly in order so nothing touches the mapping after it
+	// is gone: stop control commands, stop the background workers and
+	// sync the whole filesystem, then unmap the device
+	if ctl != nil {
+		ctl.Close()
+	}
+	if err := filesystem.Close(); err != nil {
+		log.Printf("Warning: final sync failed on close: %v", err)
+	}
+	if err := device.Close(); err != nil {
+		log.Printf("Warning: failed to close DAX device: %v", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		log.Printf("Warning: failed to release device lock: %v", err)
+	}
+	c.Close()
+
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// fsName identifies the mount in the mount table by the label being set,
+// or else the one already stored on the device
+func fsName(device *dax.Device, label string) string {
+	if label == "" {
+		if super, err := disk.ReadSuperblock(device.At(0, disk.SuperblockOffset+disk.SuperblockSize)); err == nil {
+			label = super.Label
+		}
+	}
+	return fs.FSName(label)
+}
+
+// preloadTar ingests a tar archive, or stdin for "-", into the filesystem
+func preloadTar(filesystem *fs.Filesystem, path string) error {
+	r := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	start := time.Now()
+	created, failed, err := filesystem.IngestTar(r)
+	log.Printf("Preloaded %d entries from %s in %v (%d failed)", created, path, time.Since(start), failed)
+	return err
+}
+
+// defaultCrashDir holds a subdirectory of crash dumps per device
+const defaultCrashDir = "/var/lib/aethelfs/crash"
+
+// crashHandler returns the handler the filesystem calls when it gives up
+// on a panic: it writes a crash dump for the next start to report, then
+// exits
+func crashHandler(filesystem *fs.Filesystem) func(reason string, stack []byte) {
+	return func(reason string, stack []byte) {
+		log.Printf("Fatal: %s\n%s", reason, stack)
+		if path, err := filesystem.WriteCrashDump(reason, stack); err != nil {
+			log.Printf("Error: could not write crash dump: %v", err)
+		} else {
+			log.Printf("Crash dump written to %s", path)
+		}
+		os.Exit(1)
+	}
+}
+
+// crashOnPanic is deferred in goroutines whose panics nothing else
+// recovers, turning them into a crash dump instead of a bare stack trace
+func crashOnPanic(filesystem *fs.Filesystem) {
+	if r := recover(); r != nil {
+		crashHandler(filesystem)(fmt.Sprintf("unrecovered panic: %v", r), debug.Stack())
 	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/fs"
+)
+
+// What -strict-sync-policy does when strict sync mode meets the kernel's
+// writeback cache
+const (
+	strictSyncDisableWriteback = "disable-writeback" // Mount without the writeback cache
+	strictSyncError            = "error"             // Refuse to start
+)
+
+// DefaultMaxBackground is the number of background requests, such as
+// readahead and writeback, the kernel may queue for the daemon
+const DefaultMaxBackground = 64
+
+// maxUserBgreqPath caps max_background for mounts by unprivileged users
+const maxUserBgreqPath = "/proc/sys/fs/fuse/max_user_bgreq"
+
+// mountConfig holds the flags the FUSE mount options depend on
+type mountConfig struct {
+	FSName           string
+	ReadOnly         bool
+	SyncMode         string
+	StrictSyncPolicy string
+
+	// MaxBackground bounds the background requests the kernel queues;
+	// zero means DefaultMaxBackground. CongestionThreshold is the queue
+	// length at which the kernel starts throttling their submitters; zero
+	// leaves the kernel's default of three quarters of MaxBackground.
+	MaxBackground       int
+	CongestionThreshold int
+}
+
+// checkQueueLimits validates the background request limits against the
+// kernel's: both are 16-bit, congestion past max_background is never
+// reached, and without CAP_SYS_ADMIN the kernel caps max_background at
+// max_user_bgreq
+func checkQueueLimits(cfg *mountConfig) error {
+	if cfg.MaxBackground == 0 {
+		cfg.MaxBackground = DefaultMaxBackground
+	}
+	if cfg.MaxBackground < 1 || cfg.MaxBackground > 0xffff {
+		return fmt.Errorf("max background requests must be between 1 and 65535, not %d", cfg.MaxBackground)
+	}
+	if cfg.CongestionThreshold < 0 || cfg.CongestionThreshold > cfg.MaxBackground {
+		return fmt.Errorf("congestion threshold %d must be between 0 and the %d max background requests",
+			cfg.CongestionThreshold, cfg.MaxBackground)
+	}
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(maxUserBgreqPath)
+	if err != nil {
+		return nil // Older kernels have no cap to check
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && cfg.MaxBackground > limit {
+		return fmt.Errorf("max background requests %d exceed the %d %s allows unprivileged mounts",
+			cfg.MaxBackground, limit, maxUserBgreqPath)
+	}
+	return nil
+}
+
+// mountOptions assembles the FUSE mount options and reports whether they
+// turn on the kernel's writeback cache. The cache lets the kernel
+// acknowledge writes before the daemon sees them, which no flushing can
+// make durable, so strict sync mode either mounts without it or refuses
+// to start, as the strict sync policy says.
+func mountOptions(cfg mountConfig) (opts []fuse.MountOption, writeback bool, err error) {
+	if err := checkQueueLimits(&cfg); err != nil {
+		return nil, false, err
+	}
+	opts = []fuse.MountOption{
+		fuse.FSName(cfg.FSName),
+		fuse.Subtype("aethelfsd"),
+		fuse.AllowOther(),
+		fuse.MaxReadahead(4 * 1024 * 1024),            // 4MB readahead
+		fuse.AsyncRead(),                              // Enable asynchronous reads
+		fuse.MaxBackground(uint16(cfg.MaxBackground)), // Concurrent background requests
+	}
+	if cfg.CongestionThreshold > 0 {
+		opts = append(opts, fuse.CongestionThreshold(uint16(cfg.CongestionThreshold)))
+	}
+	if cfg.ReadOnly {
+		return append(opts, fuse.ReadOnly()), false, nil
+	}
+
+	switch cfg.SyncMode {
+	case "", fs.SyncModeDefault:
+		writeback = true
+	case fs.SyncModeStrict:
+		switch cfg.StrictSyncPolicy {
+		case "", strictSyncDisableWriteback:
+			log.Printf("Strict sync mode: mounting without the kernel writeback cache, " +
+				"which would acknowledge writes before they reach the daemon")
+		case strictSyncError:
+			return nil, false, fmt.Errorf("strict sync mode cannot be durable with the kernel writeback cache; "+
+				"use -strict-sync-policy=%s to mount without it", strictSyncDisableWriteback)
+		default:
+			return nil, false, fmt.Errorf("unknown strict sync policy %q (want %s or %s)",
+				cfg.StrictSyncPolicy, strictSyncDisableWriteback, strictSyncError)
+		}
+	default:
+		return nil, false, fmt.Errorf("unknown sync mode %q (want %s or %s)",
+			cfg.SyncMode, fs.SyncModeDefault, fs.SyncModeStrict)
+	}
+	if writeback {
+		opts = append(opts, fuse.WritebackCache()) // Enable write caching
+	}
+	return opts, writeback, nil
+}
+
+// logMountLimits reports what the mount settled on. The kernel takes the
+// queue limits as given once checkQueueLimits passes them; the size of
+// the writes it sends is capped by the FUSE library's INIT reply, and the
+// aethelfs_write_request_bytes histogram shows what actually arrives.
+func logMountLimits(c *fuse.Conn, maxBackground, congestion int, writeback bool) {
+	threshold := "kernel default"
+	if congestion > 0 {
+		threshold = strconv.Itoa(congestion)
+	}
+	p := c.Protocol()
+	log.Printf("FUSE protocol %d.%d: max background requests %d, congestion threshold %s, writeback cache %v",
+		p.Major, p.Minor, maxBackground, threshold, writeback)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"aethelfs/internal/fs"
+)
+
+func TestMountOptionsSyncMatrix(t *testing.T) {
+	base, _, err := mountOptions(mountConfig{FSName: "test", ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		syncMode, policy string
+		readOnly         bool
+		writeback        bool
+		err              string // Part of the error, empty if none
+	}{
+		{syncMode: "", writeback: true},
+		{syncMode: fs.SyncModeDefault, writeback: true},
+		{syncMode: fs.SyncModeDefault, policy: strictSyncError, writeback: true},
+		{syncMode: fs.SyncModeStrict},
+		{syncMode: fs.SyncModeStrict, policy: strictSyncDisableWriteback},
+		{syncMode: fs.SyncModeStrict, policy: strictSyncError, err: "strict sync mode cannot be durable"},
+		{syncMode: fs.SyncModeStrict, policy: "maybe", err: "unknown strict sync policy"},
+		{syncMode: "eventual", err: "unknown sync mode"},
+		// A read-only mount takes no writes to cache
+		{syncMode: fs.SyncModeDefault, readOnly: true},
+		{syncMode: fs.SyncModeStrict, policy: strictSyncError, readOnly: true},
+	}
+	for _, c := range cases {
+		cfg := mountConfig{FSName: "test", SyncMode: c.syncMode, StrictSyncPolicy: c.policy, ReadOnly: c.readOnly}
+		opts, writeback, err := mountOptions(cfg)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%+v: error %v, want one about %q", cfg, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", cfg, err)
+			continue
+		}
+		if writeback != c.writeback {
+			t.Errorf("%+v: writeback cache %v, want %v", cfg, writeback, c.writeback)
+		}
+		// The common options plus either ReadOnly or, with the cache, WritebackCache
+		want := len(base) - 1
+		if c.readOnly || c.writeback {
+			want++
+		}
+		if len(opts) != want {
+			t.Errorf("%+v: %d mount options, want %d", cfg, len(opts), want)
+		}
+	}
+}
+
+func TestMountOptionsQueueLimits(t *testing.T) {
+	for _, cfg := range []mountConfig{
+		{MaxBackground: 0x10000},
+		{MaxBackground: -1},
+		{MaxBackground: 16, CongestionThreshold: 17},
+		{CongestionThreshold: -1},
+	} {
+		if _, _, err := mountOptions(cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+	base, _, err := mountOptions(mountConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts, _, err := mountOptions(mountConfig{MaxBackground: 16, CongestionThreshold: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(opts) != len(base)+1 {
+		t.Errorf("a congestion threshold added %d options, want 1", len(opts)-len(base))
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fuseType is the mount type the kernel reports for our mounts
+const fuseType = "fuse.aethelfsd"
+
+// checkMountpoint verifies mountpoint can be mounted on. A stale mount
+// left by a crashed daemon is lazily unmounted when force is set.
+func checkMountpoint(mountpoint string, force bool) error {
+	abs, err := filepath.Abs(mountpoint)
+	if err != nil {
+		return fmt.Errorf("cannot resolve mountpoint %s: %v", mountpoint, err)
+	}
+
+	stale := false
+	info, statErr := os.Stat(abs)
+	switch {
+	case errors.Is(statErr, syscall.ENOTCONN):
+		stale = true
+	case statErr == nil:
+		if fsType, ok := mountType(abs); ok && fsType == fuseType {
+			stale = true
+		}
+	}
+
+	if stale {
+		if !force {
+			return fmt.Errorf("%s is still mounted by a previous aethelfsd (transport endpoint is not connected?); "+
+				"run 'fusermount -uz %s' or restart with -force-mount", abs, abs)
+		}
+		log.Printf("Lazily unmounting stale mount at %s", abs)
+		if err := lazyUnmount(abs); err != nil {
+			return fmt.Errorf("failed to unmount stale mount at %s: %v", abs, err)
+		}
+		info, statErr = os.Stat(abs)
+	}
+
+	switch {
+	case os.IsNotExist(statErr):
+		return fmt.Errorf("mountpoint %s does not exist; create it with 'mkdir -p %s'", abs, abs)
+	case statErr != nil:
+		return fmt.Errorf("cannot access mountpoint %s: %v", abs, statErr)
+	case !info.IsDir():
+		return fmt.Errorf("mountpoint %s is not a directory", abs)
+	}
+
+	if fsType, ok := mountType(abs); ok {
+		log.Printf("Warning: %s is already a %s mount point; aethelfs will be stacked on top", abs, fsType)
+	}
+	if empty, err := isEmptyDir(abs); err == nil && !empty {
+		log.Printf("Warning: mountpoint %s is not empty; its contents will be hidden while mounted", abs)
+	}
+	return nil
+}
+
+// mountType returns the filesystem type mounted exactly at path, if any
+func mountType(path string) (string, bool) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	// Fields: id parent major:minor root mountpoint options [optional...] - fstype source superopts
+	var fsType string
+	found := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || unescapeMountinfo(fields[4]) != path {
+			continue
+		}
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				// The last matching entry is the one on top
+				fsType, found = fields[i+1], true
+				break
+			}
+		}
+	}
+	return fsType, found
+}
+
+// unescapeMountinfo decodes the octal escapes mountinfo uses for spaces,
+// tabs, newlines and backslashes in paths
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	r := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+	return r.Replace(s)
+}
+
+// lazyUnmount detaches the mount at path, falling back to fusermount when
+// the daemon lacks the privilege to unmount directly
+func lazyUnmount(path string) error {
+	err := unix.Unmount(path, unix.MNT_DETACH)
+	if err == nil {
+		return nil
+	}
+	out, ferr := exec.Command("fusermount", "-uz", path).CombinedOutput()
+	if ferr != nil {
+		return fmt.Errorf("%v; fusermount: %v: %s", err, ferr, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// isEmptyDir reports whether the directory at path has no entries
+func isEmptyDir(path string) (bool, error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer dir.Close()
+
+	if _, err := dir.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// signalReadyFd writes a single byte to fd and closes it, the readiness
+// pipe convention used by container init systems
+func signalReadyFd(fd int) error {
+	f := os.NewFile(uintptr(fd), "ready-fd")
+	if f == nil {
+		return fmt.Errorf("invalid ready fd %d", fd)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		return fmt.Errorf("ready fd %d: %w", fd, err)
+	}
+	return nil
+}
+
+// splitExecArgs separates "<dax-device> <mountpoint> -- cmd args..." into
+// the daemon arguments and the command to run once the mount is ready
+func splitExecArgs(args []string) (daemonArgs, command []string, err error) {
+	for i, arg := range args {
+		if arg == "--" {
+			if i == len(args)-1 {
+				return nil, nil, errors.New("-exec requires a command after --")
+			}
+			return args[:i], args[i+1:], nil
+		}
+	}
+	return nil, nil, errors.New("-exec requires -- followed by a command")
+}
+
+// startCommand runs command with the daemon's stdio and environment. Its
+// exit is reported on the returned channel.
+func startCommand(command []string) (*exec.Cmd, <-chan error, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	return cmd, done, nil
+}
+
+// exitStatus converts the result of waiting on a command into the status
+// the daemon should exit with, following the shell's 128+signal convention
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/fs"
+)
+
+// printVersion prints the build information and feature set for -version
+func printVersion() {
+	info := common.GetBuildInfo()
+	fmt.Printf("aethelfsd %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("commit:     %s\n", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Printf("built:      %s\n", info.BuildDate)
+	}
+	fmt.Printf("go:         %s %s\n", info.GoVersion, info.Platform)
+	fmt.Printf("layout:     %d\n", disk.LayoutVersion)
+
+	features := fs.Features()
+	names := make([]string, 0, len(features))
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Print("features:  ")
+	for _, name := range names {
+		sign := "-"
+		if features[name] {
+			sign = "+"
+		}
+		fmt.Printf(" %s%s", sign, name)
+	}
+	fmt.Println()
+}
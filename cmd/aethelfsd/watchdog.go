@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/sdnotify"
+)
+
+// runWatchdog pets the systemd watchdog at half its interval while the
+// filesystem is making progress: either idle or completing requests. A
+// serve loop with requests in flight and none finishing is left to be
+// restarted.
+func runWatchdog(filesystem *fs.Filesystem) {
+	interval, ok := sdnotify.WatchdogInterval()
+	if !ok {
+		return
+	}
+	log.Printf("systemd watchdog enabled (%v)", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	_, lastDone := filesystem.OpCounts()
+	for range ticker.C {
+		started, done := filesystem.OpCounts()
+		idle := started == done
+		if idle || done != lastDone {
+			sdnotify.Notify("WATCHDOG=1")
+		} else {
+			log.Printf("Warning: %d requests in flight and none completed; withholding watchdog", started-done)
+		}
+		lastDone = done
+	}
+}
@@ -0,0 +1,74 @@
+// Package alloc hands out block-aligned extents of a region of the device.
+// An Allocator is not safe for concurrent use; the filesystem serializes
+// calls to all of its allocators.
+package alloc
+
+import (
+	"fmt"
+
+	"aethelfs/internal/common"
+)
+
+// Allocator kinds, chosen when a device is formatted
+const (
+	KindFreeList = "freelist" // First-fit free list in front of a bump tail
+	KindBitmap   = "bitmap"   // One bit per block, persisted in the metadata region
+)
+
+// Extent is a byte range of the device
+type Extent struct {
+	Offset common.DeviceOffset `json:"offset"`
+	Size   common.ByteCount    `json:"size"`
+}
+
+// End returns the first offset past e
+func (e Extent) End() common.DeviceOffset {
+	return e.Offset.Plus(e.Size)
+}
+
+// Stats reports an allocator's utilization. Allocated plus Free is
+// always the region size.
+type Stats struct {
+	Allocated common.ByteCount    // Bytes handed out and not freed
+	Free      common.ByteCount    // Bytes available, including space never allocated
+	Reusable  common.ByteCount    // Free bytes below the high-water mark
+	HighWater common.DeviceOffset // See Allocator.HighWater
+}
+
+// Allocator manages the space of one region. Sizes passed to it are
+// multiples of the block size.
+type Allocator interface {
+	// Alloc returns the offset of size free bytes, reporting false when
+	// there is no room. With tailOnly only space above the high-water
+	// mark is used, so a mount scan can run concurrently.
+	Alloc(size common.ByteCount, tailOnly bool) (common.DeviceOffset, bool)
+	// AllocFrom is Alloc searching from the block-aligned offset from
+	// rather than the start of the region, wrapping around when nothing
+	// past it fits. It spreads allocations over the region.
+	AllocFrom(size common.ByteCount, from common.DeviceOffset) (common.DeviceOffset, bool)
+	// Free returns [offset, offset+size) to the allocator
+	Free(offset common.DeviceOffset, size common.ByteCount)
+	// HighWater returns the end of the highest extent ever allocated;
+	// space above it has never been used
+	HighWater() common.DeviceOffset
+	// Reclaim frees gaps a mount scan found below a high-water mark taken
+	// before it started. Gaps may overlap space freed meanwhile.
+	Reclaim(gaps []Extent)
+	// Stats reports utilization
+	Stats() Stats
+	// FreeExtents lists the free space below the high-water mark
+	FreeExtents() []Extent
+	// Serialize encodes the allocator's state; Load replaces the state
+	// with one Serialize produced for the same region
+	Serialize() []byte
+	Load(data []byte) error
+}
+
+// CheckKind returns an error unless kind names an allocator
+func CheckKind(kind string) error {
+	switch kind {
+	case KindFreeList, KindBitmap:
+		return nil
+	}
+	return fmt.Errorf("unknown allocator %q (want %s or %s)", kind, KindFreeList, KindBitmap)
+}
@@ -0,0 +1,292 @@
+package alloc
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"aethelfs/internal/common"
+)
+
+const (
+	testBlock  = common.ByteCount(4096)
+	testOffset = common.DeviceOffset(1 << 20) // Regions start past a metadata reservation
+	testBlocks = 64
+	testSize   = testBlocks * testBlock
+)
+
+// allocators builds each kind of allocator over the test region
+var allocators = []struct {
+	kind string
+	new  func(tb testing.TB) Allocator
+}{
+	{KindFreeList, func(tb testing.TB) Allocator {
+		return NewFreeList(testOffset, testSize)
+	}},
+	{KindBitmap, func(tb testing.TB) Allocator {
+		bits := make([]byte, (int64(testOffset.Plus(testSize))/int64(testBlock)+7)/8)
+		b, err := NewBitmap(bits, testOffset, testSize, testBlock)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return b
+	}},
+}
+
+// blk returns the offset of block n of the test region
+func blk(n int) common.DeviceOffset {
+	return testOffset.Plus(common.ByteCount(n) * testBlock)
+}
+
+// mustAlloc allocates blocks blocks or fails the test
+func mustAlloc(t *testing.T, a Allocator, blocks int) common.DeviceOffset {
+	t.Helper()
+	offset, ok := a.Alloc(common.ByteCount(blocks)*testBlock, false)
+	if !ok {
+		t.Fatalf("no room for %d blocks: %+v", blocks, a.Stats())
+	}
+	return offset
+}
+
+// checkStats fails the test unless a reports allocated bytes in use and
+// the rest of the region free
+func checkStats(t *testing.T, a Allocator, allocated common.ByteCount) {
+	t.Helper()
+	s := a.Stats()
+	if s.Allocated != allocated || s.Free != testSize-allocated {
+		t.Errorf("stats %+v, want %d allocated and %d free", s, allocated, testSize-allocated)
+	}
+}
+
+// conformance are the behaviors every Allocator must share. Each case
+// gets an empty allocator of the kind under test, and a second one for
+// the cases that need it.
+var conformance = []struct {
+	name string
+	run  func(t *testing.T, a, fresh Allocator)
+}{
+	{"empty", func(t *testing.T, a, _ Allocator) {
+		checkStats(t, a, 0)
+		if hw := a.HighWater(); hw != testOffset {
+			t.Errorf("high water %d, want the region start %d", hw, testOffset)
+		}
+		if free := a.FreeExtents(); len(free) != 0 {
+			t.Errorf("free extents %v below an unused high water mark", free)
+		}
+	}},
+	{"fills the region exactly", func(t *testing.T, a, _ Allocator) {
+		for n := 0; n < testBlocks; n++ {
+			if got := mustAlloc(t, a, 1); got != blk(n) {
+				t.Fatalf("allocation %d at %d, want %d", n, got, blk(n))
+			}
+		}
+		if _, ok := a.Alloc(testBlock, false); ok {
+			t.Error("allocated from a full region")
+		}
+		checkStats(t, a, testSize)
+		if hw := a.HighWater(); hw != blk(testBlocks) {
+			t.Errorf("high water %d, want the region end %d", hw, blk(testBlocks))
+		}
+	}},
+	{"too large", func(t *testing.T, a, _ Allocator) {
+		if _, ok := a.Alloc(testSize+testBlock, false); ok {
+			t.Error("allocated more than the region")
+		}
+		checkStats(t, a, 0)
+		if got := mustAlloc(t, a, testBlocks); got != testOffset {
+			t.Errorf("whole region at %d, want %d", got, testOffset)
+		}
+	}},
+	{"reuses freed space first fit", func(t *testing.T, a, _ Allocator) {
+		mustAlloc(t, a, 2)
+		hole := mustAlloc(t, a, 4)
+		mustAlloc(t, a, 2)
+		a.Free(hole, 4*testBlock)
+		checkStats(t, a, 4*testBlock)
+		if s := a.Stats(); s.Reusable != 4*testBlock {
+			t.Errorf("reusable %d, want the %d freed", s.Reusable, 4*testBlock)
+		}
+		if got := mustAlloc(t, a, 3); got != hole {
+			t.Errorf("reallocated at %d, want the hole at %d", got, hole)
+		}
+		// The hole's last block is too small for two
+		if got := mustAlloc(t, a, 2); got != blk(8) {
+			t.Errorf("allocated at %d, want the tail at %d", got, blk(8))
+		}
+	}},
+	{"tail only skips freed space", func(t *testing.T, a, _ Allocator) {
+		first := mustAlloc(t, a, 4)
+		mustAlloc(t, a, 4)
+		a.Free(first, 4*testBlock)
+		got, ok := a.Alloc(testBlock, true)
+		if !ok || got != blk(8) {
+			t.Errorf("tail-only allocation at %d, %v, want %d", got, ok, blk(8))
+		}
+	}},
+	{"alloc from an offset", func(t *testing.T, a, _ Allocator) {
+		mustAlloc(t, a, 10)
+		got, ok := a.AllocFrom(2*testBlock, blk(30))
+		if !ok || got != blk(30) {
+			t.Fatalf("allocation from block 30 at %d, %v", got, ok)
+		}
+		// Space skipped over stays free
+		if got := mustAlloc(t, a, 20); got != blk(10) {
+			t.Errorf("allocation below it at %d, want %d", got, blk(10))
+		}
+		checkStats(t, a, 32*testBlock)
+	}},
+	{"alloc from wraps around", func(t *testing.T, a, _ Allocator) {
+		for n := 0; n < testBlocks; n++ {
+			mustAlloc(t, a, 1)
+		}
+		a.Free(blk(2), testBlock)
+		got, ok := a.AllocFrom(testBlock, blk(40))
+		if !ok || got != blk(2) {
+			t.Errorf("wrapped allocation at %d, %v, want %d", got, ok, blk(2))
+		}
+		if _, ok := a.AllocFrom(testBlock, blk(40)); ok {
+			t.Error("allocated from a full region")
+		}
+	}},
+	{"frees coalesce", func(t *testing.T, a, _ Allocator) {
+		offsets := make([]common.DeviceOffset, 4)
+		for i := range offsets {
+			offsets[i] = mustAlloc(t, a, 2)
+		}
+		mustAlloc(t, a, 1)
+		a.Free(offsets[0], 2*testBlock)
+		a.Free(offsets[2], 2*testBlock)
+		a.Free(offsets[1], 2*testBlock)
+		if got := mustAlloc(t, a, 6); got != offsets[0] {
+			t.Errorf("six blocks at %d, want the coalesced frees at %d", got, offsets[0])
+		}
+	}},
+	{"reclaim", func(t *testing.T, a, _ Allocator) {
+		for n := 0; n < 8; n++ {
+			mustAlloc(t, a, 1)
+		}
+		// A mount scan found only blocks 0-1 and 6-7 in use
+		a.Reclaim([]Extent{{Offset: blk(2), Size: 4 * testBlock}})
+		checkStats(t, a, 4*testBlock)
+		want := []Extent{{Offset: blk(2), Size: 4 * testBlock}}
+		if got := a.FreeExtents(); !reflect.DeepEqual(got, want) {
+			t.Errorf("free extents %v, want %v", got, want)
+		}
+		if got := mustAlloc(t, a, 4); got != blk(2) {
+			t.Errorf("allocated at %d, want the reclaimed gap at %d", got, blk(2))
+		}
+	}},
+	{"serialize and load", func(t *testing.T, a, fresh Allocator) {
+		mustAlloc(t, a, 3)
+		hole := mustAlloc(t, a, 5)
+		mustAlloc(t, a, 2)
+		a.Free(hole, 5*testBlock)
+		state := a.Serialize()
+
+		if err := fresh.Load(state); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fresh.Stats(), a.Stats()) {
+			t.Errorf("loaded stats %+v, want %+v", fresh.Stats(), a.Stats())
+		}
+		if got, want := mustAlloc(t, fresh, 5), mustAlloc(t, a, 5); got != want {
+			t.Errorf("loaded allocator allocated at %d, original at %d", got, want)
+		}
+		if err := fresh.Load(state[:len(state)-1]); err == nil {
+			t.Error("loaded truncated state")
+		}
+	}},
+	{"random churn", func(t *testing.T, a, _ Allocator) {
+		rng := rand.New(rand.NewSource(1))
+		live := map[common.DeviceOffset]common.ByteCount{}
+		var allocated common.ByteCount
+		for i := 0; i < 2000; i++ {
+			if len(live) > 0 && rng.Intn(2) == 0 {
+				for offset, size := range live {
+					a.Free(offset, size)
+					delete(live, offset)
+					allocated -= size
+					break
+				}
+			} else {
+				size := common.ByteCount(1+rng.Intn(4)) * testBlock
+				offset, ok := a.Alloc(size, false)
+				if !ok {
+					if testSize-allocated >= testSize/2 {
+						t.Fatalf("no room for %d with %d of %d allocated", size, allocated, testSize)
+					}
+					continue
+				}
+				end := offset.Plus(size)
+				if offset < testOffset || end > blk(testBlocks) || common.ByteCount(offset-testOffset)%testBlock != 0 {
+					t.Fatalf("allocation %d+%d outside the region or unaligned", offset, size)
+				}
+				for o, s := range live {
+					if offset < o.Plus(s) && o < end {
+						t.Fatalf("allocation %d+%d overlaps %d+%d", offset, size, o, s)
+					}
+				}
+				live[offset] = size
+				allocated += size
+			}
+			checkStats(t, a, allocated)
+		}
+	}},
+}
+
+func TestConformance(t *testing.T) {
+	for _, alloc := range allocators {
+		for _, c := range conformance {
+			t.Run(alloc.kind+"/"+c.name, func(t *testing.T) {
+				c.run(t, alloc.new(t), alloc.new(t))
+			})
+		}
+	}
+}
+
+func TestCheckKind(t *testing.T) {
+	for _, alloc := range allocators {
+		if err := CheckKind(alloc.kind); err != nil {
+			t.Errorf("CheckKind(%q): %v", alloc.kind, err)
+		}
+	}
+	if err := CheckKind("buddy"); err == nil {
+		t.Error("CheckKind accepted an unknown allocator")
+	}
+}
+
+func TestNewBitmapRejects(t *testing.T) {
+	bits := make([]byte, 8)
+	if _, err := NewBitmap(bits, testOffset+1, testSize, testBlock); err == nil {
+		t.Error("accepted an unaligned region")
+	}
+	if _, err := NewBitmap(bits, testOffset, testSize, testBlock); err == nil {
+		t.Error("accepted a bitmap too small for the region")
+	}
+}
+
+// BenchmarkChurn allocates and frees extents of mixed sizes in a region
+// kept about half full
+func BenchmarkChurn(b *testing.B) {
+	for _, alloc := range allocators {
+		b.Run(alloc.kind, func(b *testing.B) {
+			a := alloc.new(b)
+			rng := rand.New(rand.NewSource(1))
+			var live []Extent
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if len(live) >= testBlocks/4 {
+					j := rng.Intn(len(live))
+					a.Free(live[j].Offset, live[j].Size)
+					live[j] = live[len(live)-1]
+					live = live[:len(live)-1]
+					continue
+				}
+				size := common.ByteCount(1+rng.Intn(4)) * testBlock
+				if offset, ok := a.Alloc(size, false); ok {
+					live = append(live, Extent{Offset: offset, Size: size})
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package alloc
+
+import (
+	"fmt"
+	"math/bits"
+
+	"aethelfs/internal/common"
+)
+
+// Bitmap allocates from a bitmap with one bit per block, set while the
+// block is allocated. The bits are the caller's memory, typically the
+// mapped metadata region, so every allocation is reflected in the
+// persisted bitmap as it happens. Bit n covers the block at n*blockSize;
+// the bitmap covers the whole device and regions share it.
+type Bitmap struct {
+	bits       []byte
+	start, end int64 // Region bounds in blocks
+	blockSize  int64
+	high       int64 // Block past the highest ever allocated
+}
+
+// NewBitmap returns an allocator for [offset, offset+size) backed by
+// bits, which must have a bit for every block of the region. Blocks already
+// marked are kept allocated.
+func NewBitmap(bits []byte, offset common.DeviceOffset, size, blockSize common.ByteCount) (*Bitmap, error) {
+	b := &Bitmap{
+		bits:      bits,
+		start:     int64(offset) / int64(blockSize),
+		end:       int64(offset.Plus(size)) / int64(blockSize),
+		blockSize: int64(blockSize),
+	}
+	if int64(offset)%b.blockSize != 0 || size%blockSize != 0 {
+		return nil, fmt.Errorf("region %d+%d is not aligned to %d byte blocks", offset, size, blockSize)
+	}
+	if b.end > int64(len(bits))*8 {
+		return nil, fmt.Errorf("bitmap of %d bytes cannot cover region %d+%d", len(bits), offset, size)
+	}
+	b.high = b.start
+	for n := b.end - 1; n >= b.start; n-- {
+		if b.isSet(n) {
+			b.high = n + 1
+			break
+		}
+	}
+	return b, nil
+}
+
+func (b *Bitmap) isSet(n int64) bool {
+	return b.bits[n/8]&(1<<uint(n%8)) != 0
+}
+
+// setRange sets or clears the bits of blocks [from, to)
+func (b *Bitmap) setRange(from, to int64, set bool) {
+	for n := from; n < to; n++ {
+		if set {
+			b.bits[n/8] |= 1 << uint(n%8)
+		} else {
+			b.bits[n/8] &^= 1 << uint(n%8)
+		}
+	}
+}
+
+// blocks converts a byte extent within the region to a block range
+func (b *Bitmap) blocks(offset common.DeviceOffset, size common.ByteCount) (int64, int64) {
+	from := int64(offset) / b.blockSize
+	to := (int64(offset.Plus(size)) + b.blockSize - 1) / b.blockSize
+	if from < b.start {
+		from = b.start
+	}
+	if to > b.end {
+		to = b.end
+	}
+	return from, to
+}
+
+// Alloc implements Allocator. It takes the first run of free blocks
+// long enough, skipping fully allocated bytes of the bitmap.
+func (b *Bitmap) Alloc(size common.ByteCount, tailOnly bool) (common.DeviceOffset, bool) {
+	n := b.start
+	if tailOnly {
+		n = b.high
+	}
+	return b.search(size, n, b.end)
+}
+
+// AllocFrom implements Allocator
+func (b *Bitmap) AllocFrom(size common.ByteCount, from common.DeviceOffset) (common.DeviceOffset, bool) {
+	n := int64(from) / b.blockSize
+	if n < b.start || n >= b.end {
+		n = b.start
+	}
+	if offset, ok := b.search(size, n, b.end); ok {
+		return offset, true
+	}
+	// Wrap around, including runs that start before n and cross it
+	to := n + (int64(size)+b.blockSize-1)/b.blockSize - 1
+	if to > b.end {
+		to = b.end
+	}
+	return b.search(size, b.start, to)
+}
+
+// search takes the first run of free blocks long enough for size within
+// blocks [n, end)
+func (b *Bitmap) search(size common.ByteCount, n, end int64) (common.DeviceOffset, bool) {
+	need := (int64(size) + b.blockSize - 1) / b.blockSize
+	run := int64(0)
+	for n < end {
+		if run == 0 && n%8 == 0 && n+8 <= end && b.bits[n/8] == 0xff {
+			n += 8
+			continue
+		}
+		if b.isSet(n) {
+			run = 0
+		} else if run++; run == need {
+			first := n - need + 1
+			b.setRange(first, n+1, true)
+			if n+1 > b.high {
+				b.high = n + 1
+			}
+			return common.DeviceOffset(first * b.blockSize), true
+		}
+		n++
+	}
+	return 0, false
+}
+
+// Free implements Allocator
+func (b *Bitmap) Free(offset common.DeviceOffset, size common.ByteCount) {
+	from, to := b.blocks(offset, size)
+	b.setRange(from, to, false)
+}
+
+// HighWater implements Allocator
+func (b *Bitmap) HighWater() common.DeviceOffset {
+	return common.DeviceOffset(b.high * b.blockSize)
+}
+
+// Reclaim implements Allocator
+func (b *Bitmap) Reclaim(gaps []Extent) {
+	for _, gap := range gaps {
+		b.Free(gap.Offset, gap.Size)
+	}
+}
+
+// allocated counts the set bits of blocks [from, to)
+func (b *Bitmap) allocated(from, to int64) int64 {
+	var count int64
+	for n := from; n < to; {
+		if n%8 == 0 && n+8 <= to {
+			count += int64(bits.OnesCount8(b.bits[n/8]))
+			n += 8
+			continue
+		}
+		if b.isSet(n) {
+			count++
+		}
+		n++
+	}
+	return count
+}
+
+// Stats implements Allocator
+func (b *Bitmap) Stats() Stats {
+	used := b.allocated(b.start, b.high)
+	return Stats{
+		Allocated: common.ByteCount(used * b.blockSize),
+		Free:      common.ByteCount((b.end - b.start - used) * b.blockSize),
+		Reusable:  common.ByteCount((b.high - b.start - used) * b.blockSize),
+		HighWater: b.HighWater(),
+	}
+}
+
+// FreeExtents implements Allocator: the runs of clear bits below the
+// high-water mark, in offset order
+func (b *Bitmap) FreeExtents() []Extent {
+	var free []Extent
+	for n := b.start; n < b.high; n++ {
+		if b.isSet(n) {
+			continue
+		}
+		first := n
+		for n < b.high && !b.isSet(n) {
+			n++
+		}
+		free = append(free, Extent{
+			Offset: common.DeviceOffset(first * b.blockSize),
+			Size:   common.ByteCount((n - first) * b.blockSize),
+		})
+	}
+	return free
+}
+
+// Serialize implements Allocator: the region's bits, packed from its
+// first block
+func (b *Bitmap) Serialize() []byte {
+	out := make([]byte, (b.end-b.start+7)/8)
+	for n := b.start; n < b.end; n++ {
+		if b.isSet(n) {
+			i := n - b.start
+			out[i/8] |= 1 << uint(i%8)
+		}
+	}
+	return out
+}
+
+// Load implements Allocator
+func (b *Bitmap) Load(data []byte) error {
+	if int64(len(data)) != (b.end-b.start+7)/8 {
+		return fmt.Errorf("bitmap state of %d bytes does not match a region of %d blocks", len(data), b.end-b.start)
+	}
+	b.high = b.start
+	for n := b.start; n < b.end; n++ {
+		i := n - b.start
+		set := data[i/8]&(1<<uint(i%8)) != 0
+		b.setRange(n, n+1, set)
+		if set {
+			b.high = n + 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package alloc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"aethelfs/internal/common"
+)
+
+// FreeList allocates first fit from a list of freed extents, and from an
+// unallocated tail when none fits. A free that exactly abuts listed
+// extents joins them, so space around a relocated extent merges; other
+// frees are appended, and Reclaim sorts and coalesces the list.
+type FreeList struct {
+	start, end common.DeviceOffset
+	next       common.DeviceOffset // Start of the unallocated tail
+	free       []Extent
+}
+
+// NewFreeList returns an empty free list allocator for [offset, offset+size)
+func NewFreeList(offset common.DeviceOffset, size common.ByteCount) *FreeList {
+	return &FreeList{start: offset, end: offset.Plus(size), next: offset}
+}
+
+// Alloc implements Allocator
+func (l *FreeList) Alloc(size common.ByteCount, tailOnly bool) (common.DeviceOffset, bool) {
+	if !tailOnly {
+		for i, space := range l.free {
+			if space.Size < size {
+				continue
+			}
+			offset := space.Offset
+			if space.Size > size {
+				l.free[i].Offset = space.Offset.Plus(size)
+				l.free[i].Size -= size
+			} else {
+				l.free = append(l.free[:i], l.free[i+1:]...)
+			}
+			return offset, true
+		}
+	}
+
+	if l.end.Sub(l.next) < size {
+		return 0, false
+	}
+	offset := l.next
+	l.next = offset.Plus(size)
+	return offset, true
+}
+
+// AllocFrom implements Allocator. It takes the lowest free offset at or
+// past from, in a listed extent or the tail; skipping ahead in the tail
+// lists the space skipped.
+func (l *FreeList) AllocFrom(size common.ByteCount, from common.DeviceOffset) (common.DeviceOffset, bool) {
+	best, bestAt := -1, common.DeviceOffset(-1)
+	for i, space := range l.free {
+		at := space.Offset
+		if at < from {
+			at = from
+		}
+		if space.End().Sub(at) >= size && (bestAt < 0 || at < bestAt) {
+			best, bestAt = i, at
+		}
+	}
+	if best >= 0 {
+		space := l.free[best]
+		var rest []Extent
+		if bestAt > space.Offset {
+			rest = append(rest, Extent{Offset: space.Offset, Size: bestAt.Sub(space.Offset)})
+		}
+		if end := bestAt.Plus(size); end < space.End() {
+			rest = append(rest, Extent{Offset: end, Size: space.End().Sub(end)})
+		}
+		l.free = append(l.free[:best], append(rest, l.free[best+1:]...)...)
+		return bestAt, true
+	}
+
+	at := l.next
+	if at < from {
+		at = from
+	}
+	if l.end.Sub(at) < size {
+		return l.Alloc(size, false)
+	}
+	if at > l.next {
+		l.free = append(l.free, Extent{Offset: l.next, Size: at.Sub(l.next)})
+	}
+	l.next = at.Plus(size)
+	return at, true
+}
+
+// Free implements Allocator
+func (l *FreeList) Free(offset common.DeviceOffset, size common.ByteCount) {
+	before, after := -1, -1
+	for i, space := range l.free {
+		if space.End() == offset {
+			before = i
+		} else if space.Offset == offset.Plus(size) {
+			after = i
+		}
+	}
+	switch {
+	case before >= 0 && after >= 0:
+		l.free[before].Size += size + l.free[after].Size
+		l.free = append(l.free[:after], l.free[after+1:]...)
+	case before >= 0:
+		l.free[before].Size += size
+	case after >= 0:
+		l.free[after].Offset = offset
+		l.free[after].Size += size
+	default:
+		l.free = append(l.free, Extent{Offset: offset, Size: size})
+	}
+}
+
+// HighWater implements Allocator
+func (l *FreeList) HighWater() common.DeviceOffset {
+	return l.next
+}
+
+// Reclaim implements Allocator
+func (l *FreeList) Reclaim(gaps []Extent) {
+	l.free = merge(append(append([]Extent(nil), gaps...), l.free...))
+}
+
+// Stats implements Allocator
+func (l *FreeList) Stats() Stats {
+	var reusable common.ByteCount
+	for _, space := range l.free {
+		reusable += space.Size
+	}
+	return Stats{
+		Allocated: l.next.Sub(l.start) - reusable,
+		Free:      l.end.Sub(l.next) + reusable,
+		Reusable:  reusable,
+		HighWater: l.next,
+	}
+}
+
+// FreeExtents implements Allocator. The list is in allocation order, not
+// sorted, so overlapping frees stay visible.
+func (l *FreeList) FreeExtents() []Extent {
+	return append([]Extent(nil), l.free...)
+}
+
+// Serialize implements Allocator: the tail offset, the extent count,
+// then each extent's offset and size, all little-endian int64s
+func (l *FreeList) Serialize() []byte {
+	buf := make([]byte, 16+16*len(l.free))
+	binary.LittleEndian.PutUint64(buf[0:], uint64(l.next))
+	binary.LittleEndian.PutUint64(buf[8:], uint64(len(l.free)))
+	for i, space := range l.free {
+		binary.LittleEndian.PutUint64(buf[16+16*i:], uint64(space.Offset))
+		binary.LittleEndian.PutUint64(buf[24+16*i:], uint64(space.Size))
+	}
+	return buf
+}
+
+// Load implements Allocator
+func (l *FreeList) Load(data []byte) error {
+	if len(data) < 16 {
+		return fmt.Errorf("free list state too short: %d bytes", len(data))
+	}
+	next := common.DeviceOffset(binary.LittleEndian.Uint64(data[0:]))
+	count := binary.LittleEndian.Uint64(data[8:])
+	if next < l.start || next > l.end || count > uint64(len(data)-16)/16 || uint64(len(data)) != 16+16*count {
+		return fmt.Errorf("free list state does not match region %d-%d", l.start, l.end)
+	}
+	free := make([]Extent, count)
+	for i := range free {
+		free[i].Offset = common.DeviceOffset(binary.LittleEndian.Uint64(data[16+16*i:]))
+		free[i].Size = common.ByteCount(binary.LittleEndian.Uint64(data[24+16*i:]))
+		if free[i].Offset < l.start || free[i].Size <= 0 || free[i].End() > next {
+			return fmt.Errorf("free extent %d+%d lies outside the allocated part of the region", free[i].Offset, free[i].Size)
+		}
+	}
+	l.next, l.free = next, free
+	return nil
+}
+
+// merge sorts extents by offset and coalesces overlapping or adjacent ones
+func merge(extents []Extent) []Extent {
+	if len(extents) == 0 {
+		return extents
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].Offset < extents[j].Offset })
+
+	merged := extents[:1]
+	for _, e := range extents[1:] {
+		last := &merged[len(merged)-1]
+		if e.Offset <= last.End() {
+			if e.End() > last.End() {
+				last.Size = e.End().Sub(last.Offset)
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	recordsWritten = metrics.NewCounter("aethelfs_audit_records_total",
+		"Audit records written to the audit log")
+	recordsDropped = metrics.NewCounter("aethelfs_audit_dropped_total",
+		"Audit records dropped because the queue was full")
+)
+
+// DefaultQueueLen is the number of records buffered ahead of the writer
+const DefaultQueueLen = 4096
+
+// Record describes a single namespace mutation or control command
+type Record struct {
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"`
+	Path   string    `json:"path"`
+	Uid    uint32    `json:"uid"`
+	Gid    uint32    `json:"gid"`
+	Pid    uint32    `json:"pid"`
+	Result string    `json:"result"`
+}
+
+// Logger appends records to a host file as JSON lines. Records are queued
+// and written by a background goroutine so logging never stalls callers;
+// when the queue is full records are dropped and counted. A nil *Logger is
+// valid and discards everything.
+type Logger struct {
+	path  string
+	queue chan Record
+	done  chan struct{}
+
+	mu   sync.Mutex // Protects file and w against Reopen
+	file *os.File
+	w    *bufio.Writer
+}
+
+// Open starts an audit logger appending to path
+func Open(path string, queueLen int) (*Logger, error) {
+	if queueLen <= 0 {
+		queueLen = DefaultQueueLen
+	}
+
+	l := &Logger{
+		path:  path,
+		queue: make(chan Record, queueLen),
+		done:  make(chan struct{}),
+	}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+
+	go l.run()
+	return l, nil
+}
+
+// Log queues a record without blocking
+func (l *Logger) Log(rec Record) {
+	if l == nil {
+		return
+	}
+	select {
+	case l.queue <- rec:
+	default:
+		recordsDropped.Inc()
+	}
+}
+
+// Reopen closes and reopens the log file, allowing external rotation
+func (l *Logger) Reopen() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.w.Flush()
+		l.file.Close()
+	}
+	l.file = file
+	l.w = bufio.NewWriter(file)
+	return nil
+}
+
+// Close drains the queue and closes the log file
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.queue)
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+// run writes queued records, flushing whenever the queue drains
+func (l *Logger) run() {
+	defer close(l.done)
+
+	for rec := range l.queue {
+		l.write(rec)
+
+		// Flush once there is nothing else waiting
+		if len(l.queue) == 0 {
+			l.mu.Lock()
+			if err := l.w.Flush(); err != nil {
+				log.Printf("Warning: audit log flush failed: %v", err)
+			}
+			l.mu.Unlock()
+		}
+	}
+}
+
+// write encodes a single record
+func (l *Logger) write(rec Record) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Warning: failed to encode audit record: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+	l.w.WriteByte('\n')
+	recordsWritten.Inc()
+}
@@ -0,0 +1,49 @@
+// Package clock abstracts the time source so time-dependent behavior can
+// be driven deterministically. Real is the system clock; a Fake only moves
+// when advanced.
+package clock
+
+import "time"
+
+// Clock tells the time and runs timers
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls fn in its own goroutine once d has elapsed
+	AfterFunc(d time.Duration, fn func()) Timer
+	// NewTicker delivers the time on its channel every d, dropping ticks
+	// for a slow receiver
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a pending AfterFunc call, as returned by time.AfterFunc
+type Timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Ticker is a periodic tick, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) AfterFunc(d time.Duration, fn func()) Timer {
+	return time.AfterFunc(d, fn)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
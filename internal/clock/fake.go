@@ -0,0 +1,159 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock that stands still until Advance or Set moves it. Timers
+// and tickers due by the new time fire in deadline order; AfterFunc
+// callbacks run synchronously in the advancing goroutine, so their
+// effects are visible when Advance returns.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+// NewFake returns a fake clock reading start
+func NewFake(start time.Time) *Fake {
+	return &Fake{now: start}
+}
+
+// fakeTimer is a scheduled callback; a ticker reschedules itself
+type fakeTimer struct {
+	clock    *Fake
+	deadline time.Time
+	fn       func()
+	period   time.Duration // Non-zero for tickers
+	ch       chan time.Time
+}
+
+// Now implements Clock
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc implements Clock
+func (c *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{clock: c, fn: fn}
+	c.mu.Lock()
+	c.scheduleLocked(t, d)
+	c.mu.Unlock()
+	return t
+}
+
+// NewTicker implements Clock
+func (c *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	t := &fakeTimer{clock: c, period: d, ch: make(chan time.Time, 1)}
+	c.mu.Lock()
+	c.scheduleLocked(t, d)
+	c.mu.Unlock()
+	return fakeTicker{t}
+}
+
+// Advance moves the clock forward by d, firing what falls due
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	c.Set(target)
+}
+
+// Set moves the clock to t, firing what falls due on the way. Moving it
+// backwards fires nothing.
+func (c *Fake) Set(t time.Time) {
+	for {
+		c.mu.Lock()
+		if len(c.waiters) == 0 || c.waiters[0].deadline.After(t) {
+			if t.After(c.now) {
+				c.now = t
+			}
+			c.mu.Unlock()
+			return
+		}
+		w := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		if w.deadline.After(c.now) {
+			c.now = w.deadline
+		}
+		if w.period > 0 {
+			c.scheduleLocked(w, w.period)
+		}
+		now := c.now
+		c.mu.Unlock()
+
+		if w.ch != nil {
+			select {
+			case w.ch <- now:
+			default: // Drop the tick like time.Ticker
+			}
+		} else {
+			w.fn()
+		}
+	}
+}
+
+// Pending returns how many timers and tickers are scheduled
+func (c *Fake) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// scheduleLocked (re)arms t to fire d from now. The caller holds c.mu.
+func (c *Fake) scheduleLocked(t *fakeTimer, d time.Duration) bool {
+	active := c.removeLocked(t)
+	t.deadline = c.now.Add(d)
+	i := sort.Search(len(c.waiters), func(i int) bool { return c.waiters[i].deadline.After(t.deadline) })
+	c.waiters = append(c.waiters, nil)
+	copy(c.waiters[i+1:], c.waiters[i:])
+	c.waiters[i] = t
+	return active
+}
+
+// removeLocked unschedules t, reporting whether it was scheduled
+func (c *Fake) removeLocked(t *fakeTimer) bool {
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Stop implements Timer
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.removeLocked(t)
+}
+
+// Reset implements Timer
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.scheduleLocked(t, d)
+}
+
+// fakeTicker adapts a periodic fakeTimer to Ticker
+type fakeTicker struct {
+	*fakeTimer
+}
+
+// C implements Ticker
+func (t fakeTicker) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop implements Ticker
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
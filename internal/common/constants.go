@@ -11,9 +11,21 @@ const (
 	// Maximum single allocation size (2GB)
 	MaxAllocationSize = int64(2 * 1024 * 1024 * 1024)
 
-	// Metadata reservation size (1MB)
-	MetadataReservationSize = int64(1 * 1024 * 1024)
+	// Metadata reservation size (1MB). Untyped, like the block size, so
+	// it serves as either a DeviceOffset or a ByteCount.
+	MetadataReservationSize = 1 * 1024 * 1024
 
-	// Block alignment size (4KB - typical page size)
-	BlockAlignmentSize = int64(4 * 1024)
+	// Block alignment size (4KB - typical page size). Devices are formatted
+	// with this block size unless another is chosen; smaller block sizes
+	// select small-block mode.
+	BlockAlignmentSize = 4 * 1024
+
+	// Smallest usable device: the metadata reservation plus one data block
+	MinDeviceSize = MetadataReservationSize + BlockAlignmentSize
+
+	// Largest read served by a single request (1MB); larger requests are clamped
+	MaxReadSize = 1 * 1024 * 1024
+
+	// Default maximum file size, bounded by the single-extent allocation limit
+	DefaultMaxFileSize = MaxAllocationSize
 )
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"errors"
+	"math"
+)
+
+// DeviceOffset is a byte position on the device. Offsets and lengths have
+// distinct types so the compiler catches one passed for the other; an
+// offset plus a length is an offset, and the distance between two offsets
+// a length.
+type DeviceOffset int64
+
+// ByteCount is a length, size or capacity in bytes
+type ByteCount int64
+
+// ErrOverflow is returned by the checked helpers when a result would not
+// fit in an int64 or an operand is negative
+var ErrOverflow = errors.New("device offset arithmetic overflows")
+
+// Plus returns the offset n bytes past o. It does not check for overflow;
+// use AddChecked on values derived from requests.
+func (o DeviceOffset) Plus(n ByteCount) DeviceOffset {
+	return o + DeviceOffset(n)
+}
+
+// Sub returns the length from p to o
+func (o DeviceOffset) Sub(p DeviceOffset) ByteCount {
+	return ByteCount(o - p)
+}
+
+// AddChecked returns the offset n bytes past o, or ErrOverflow if either
+// is negative or the sum does not fit
+func AddChecked(o DeviceOffset, n ByteCount) (DeviceOffset, error) {
+	if o < 0 || n < 0 || int64(n) > math.MaxInt64-int64(o) {
+		return 0, ErrOverflow
+	}
+	return o + DeviceOffset(n), nil
+}
+
+// AlignUp rounds n up to a multiple of align, which must be positive, or
+// returns ErrOverflow if n is negative or the rounded value does not fit
+func AlignUp(n, align ByteCount) (ByteCount, error) {
+	if n < 0 || align <= 0 {
+		return 0, ErrOverflow
+	}
+	rem := n % align
+	if rem == 0 {
+		return n, nil
+	}
+	if int64(n) > math.MaxInt64-int64(align-rem) {
+		return 0, ErrOverflow
+	}
+	return n + align - rem, nil
+}
+
+// InRange reports whether [o, o+n) lies within [0, limit) without
+// overflowing on the way
+func InRange(o DeviceOffset, n, limit ByteCount) bool {
+	end, err := AddChecked(o, n)
+	return err == nil && int64(end) <= int64(limit)
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAddChecked(t *testing.T) {
+	tests := []struct {
+		o       DeviceOffset
+		n       ByteCount
+		want    DeviceOffset
+		wantErr bool
+	}{
+		{0, 0, 0, false},
+		{4096, 512, 4608, false},
+		{math.MaxInt64 - 1, 1, math.MaxInt64, false},
+		{math.MaxInt64, 0, math.MaxInt64, false},
+		{0, math.MaxInt64, math.MaxInt64, false},
+		{math.MaxInt64, 1, 0, true},
+		{1, math.MaxInt64, 0, true},
+		{math.MaxInt64 / 2, math.MaxInt64/2 + 2, 0, true},
+		{-1, 1, 0, true},
+		{1, -1, 0, true},
+		{math.MinInt64, math.MaxInt64, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := AddChecked(tt.o, tt.n)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("AddChecked(%d, %d) = %d, %v; want %d, error %v", tt.o, tt.n, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAlignUp(t *testing.T) {
+	tests := []struct {
+		n, align ByteCount
+		want     ByteCount
+		wantErr  bool
+	}{
+		{0, 4096, 0, false},
+		{1, 4096, 4096, false},
+		{4095, 4096, 4096, false},
+		{4096, 4096, 4096, false},
+		{4097, 4096, 8192, false},
+		{7, 1, 7, false},
+		{10, 3, 12, false},
+		{math.MaxInt64, 1, math.MaxInt64, false},
+		{math.MaxInt64 - 4095, 4096, math.MaxInt64 - 4095, false}, // The highest multiple
+		{math.MaxInt64 - 4096, 4096, math.MaxInt64 - 4095, false}, // Rounds up to it
+		{math.MaxInt64 - 4094, 4096, 0, true},                     // Rounds past the limit
+		{math.MaxInt64, 4096, 0, true},
+		{4096, 0, 0, true},
+		{4096, -4096, 0, true},
+		{-1, 4096, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := AlignUp(tt.n, tt.align)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("AlignUp(%d, %d) = %d, %v; want %d, error %v", tt.n, tt.align, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestInRange(t *testing.T) {
+	const limit = 1 << 20
+	tests := []struct {
+		o    DeviceOffset
+		n    ByteCount
+		want bool
+	}{
+		{0, 0, true},
+		{0, limit, true},
+		{limit - 1, 1, true},
+		{limit, 0, true}, // Empty range at the end
+		{limit - 1, 2, false},
+		{limit, 1, false},
+		{0, limit + 1, false},
+		{1, math.MaxInt64, false}, // End overflows rather than wrapping into range
+		{math.MaxInt64, 1, false},
+		{-1, 1, false},
+		{0, -1, false},
+	}
+	for _, tt := range tests {
+		if got := InRange(tt.o, tt.n, limit); got != tt.want {
+			t.Errorf("InRange(%d, %d, %d) = %v, want %v", tt.o, tt.n, limit, got, tt.want)
+		}
+	}
+}
+
+func TestPlusSub(t *testing.T) {
+	o := DeviceOffset(1 << 20)
+	if got := o.Plus(4096); got != 1<<20+4096 {
+		t.Errorf("Plus = %d", got)
+	}
+	if got := o.Plus(4096).Sub(o); got != 4096 {
+		t.Errorf("Sub = %d, want 4096", got)
+	}
+}
@@ -0,0 +1,137 @@
+package control
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Access levels of a control socket peer
+const (
+	accessNone     = iota // Refused at connect
+	accessReadOnly        // Only commands registered with HandleReadOnly
+	accessFull            // Every command
+)
+
+// Access says who besides the daemon's own uid and root may use the
+// control socket. Peers are identified by SO_PEERCRED on each connection,
+// so the checks hold even when the socket's mode has to let them connect.
+type Access struct {
+	// AllowUids may run every command
+	AllowUids []uint32
+
+	// ReadOnlyGid may run the read-only commands, those registered with
+	// HandleReadOnly; a peer qualifies through its primary or a
+	// supplementary group. Negative allows no group.
+	ReadOnlyGid int
+}
+
+// Peer is the process at the other end of a control connection
+type Peer struct {
+	Uid uint32
+	Gid uint32
+	Pid int32
+}
+
+// peerOf reads the credentials of the process that connected conn
+func peerOf(conn net.Conn) (Peer, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return Peer{}, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return Peer{}, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return Peer{}, err
+	}
+	if credErr != nil {
+		return Peer{}, fmt.Errorf("SO_PEERCRED: %w", credErr)
+	}
+	return Peer{Uid: cred.Uid, Gid: cred.Gid, Pid: cred.Pid}, nil
+}
+
+// level returns what peer may do on a socket owned by self
+func (a *Access) level(peer Peer, self uint32) int {
+	if peer.Uid == self || peer.Uid == 0 {
+		return accessFull
+	}
+	for _, uid := range a.AllowUids {
+		if peer.Uid == uid {
+			return accessFull
+		}
+	}
+	if a.ReadOnlyGid >= 0 && peerInGroup(peer, uint32(a.ReadOnlyGid)) {
+		return accessReadOnly
+	}
+	return accessNone
+}
+
+// peerInGroup reports whether peer's primary or supplementary groups
+// include gid. SO_PEERCRED only carries the primary group; the others are
+// read from /proc, and a peer that has exited by then does not qualify.
+func peerInGroup(peer Peer, gid uint32) bool {
+	if peer.Gid == gid {
+		return true
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", peer.Pid))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			if g, err := strconv.ParseUint(field, 10, 32); err == nil && uint32(g) == gid {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// socketMode returns the permissions the socket needs so the peers a
+// allows can connect at all; connect(2) only checks write permission
+func (a *Access) socketMode(self uint32) os.FileMode {
+	for _, uid := range a.AllowUids {
+		if uid != self && uid != 0 {
+			return 0666
+		}
+	}
+	if a.ReadOnlyGid >= 0 {
+		return 0660
+	}
+	return 0600
+}
+
+// ParseUids parses a comma-separated list of numeric uids
+func ParseUids(spec string) ([]uint32, error) {
+	var uids []uint32
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		uid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid uid %q", field)
+		}
+		uids = append(uids, uint32(uid))
+	}
+	return uids, nil
+}
@@ -0,0 +1,240 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"aethelfs/internal/audit"
+	"aethelfs/internal/ctlproto"
+
+	"golang.org/x/sys/unix"
+)
+
+// self is the daemon's uid in the access checks
+const self = 1000
+
+// socketPair returns the two ends of a connected unix socket, as a
+// client and the daemon would see them
+func socketPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns[i] = conn
+	}
+	return conns[0], conns[1]
+}
+
+// newServer returns a server with a read-only and a full command
+func newServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := Listen(filepath.Join(t.TempDir(), "control.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.HandleReadOnly("stats", func(json.RawMessage) (interface{}, error) { return "stats", nil })
+	s.Handle("freeze", func(json.RawMessage) (interface{}, error) { return "frozen", nil })
+	return s
+}
+
+func TestAccessLevel(t *testing.T) {
+	a := Access{AllowUids: []uint32{2000}, ReadOnlyGid: 500}
+	cases := []struct {
+		name string
+		peer Peer
+		want int
+	}{
+		{"daemon's uid", Peer{Uid: self, Gid: 1}, accessFull},
+		{"root", Peer{Uid: 0, Gid: 0}, accessFull},
+		{"allowed uid", Peer{Uid: 2000, Gid: 1}, accessFull},
+		{"read-only group", Peer{Uid: 3000, Gid: 500}, accessReadOnly},
+		{"stranger", Peer{Uid: 3000, Gid: 1}, accessNone},
+	}
+	for _, c := range cases {
+		if got := a.level(c.peer, self); got != c.want {
+			t.Errorf("%s: level %d, want %d", c.name, got, c.want)
+		}
+	}
+	closed := Access{ReadOnlyGid: -1}
+	if got := closed.level(Peer{Uid: 3000, Gid: 0}, self); got != accessNone {
+		t.Errorf("no read-only group, yet gid 0 got level %d", got)
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	cases := []struct {
+		a    Access
+		want os.FileMode
+	}{
+		{Access{ReadOnlyGid: -1}, 0600},
+		{Access{AllowUids: []uint32{self, 0}, ReadOnlyGid: -1}, 0600},
+		{Access{ReadOnlyGid: 500}, 0660},
+		{Access{AllowUids: []uint32{2000}, ReadOnlyGid: 500}, 0666},
+	}
+	for _, c := range cases {
+		if got := c.a.socketMode(self); got != c.want {
+			t.Errorf("socketMode(%+v) = %o, want %o", c.a, got, c.want)
+		}
+	}
+}
+
+func TestParseUids(t *testing.T) {
+	got, err := ParseUids(" 1000, 2000,,3000 ")
+	if err != nil || !reflect.DeepEqual(got, []uint32{1000, 2000, 3000}) {
+		t.Errorf("ParseUids = %v, %v", got, err)
+	}
+	for _, bad := range []string{"alice", "-1", "4294967296"} {
+		if _, err := ParseUids(bad); err == nil {
+			t.Errorf("ParseUids(%q) accepted", bad)
+		}
+	}
+}
+
+func TestPeerOfSocketPair(t *testing.T) {
+	_, server := socketPair(t)
+	peer, err := peerOf(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Peer{Uid: uint32(os.Geteuid()), Gid: uint32(os.Getegid()), Pid: int32(os.Getpid())}
+	if peer != want {
+		t.Errorf("peerOf = %+v, want %+v", peer, want)
+	}
+
+	if _, err := peerOf(fakeConn{}); err == nil {
+		t.Error("peerOf accepted a connection that is not a unix socket")
+	}
+}
+
+// fakeConn is a connection with no credentials to read
+type fakeConn struct{ net.Conn }
+
+func TestDispatchPermissions(t *testing.T) {
+	s := newServer(t)
+	cases := []struct {
+		level int
+		cmd   string
+		code  string // Empty if the command runs
+	}{
+		{accessFull, "freeze", ""},
+		{accessFull, "stats", ""},
+		{accessReadOnly, "stats", ""},
+		{accessReadOnly, "hello", ""},
+		{accessReadOnly, "freeze", ctlproto.CodePermission},
+		{accessNone, "stats", ctlproto.CodePermission},
+		{accessNone, "freeze", ctlproto.CodePermission},
+	}
+	for _, c := range cases {
+		resp := s.dispatch(Request{Version: ctlproto.Version, Cmd: c.cmd}, Peer{Uid: 3000}, c.level)
+		failed := resp.Failed()
+		switch {
+		case c.code == "" && failed != nil:
+			t.Errorf("%s at level %d: %v", c.cmd, c.level, failed.Message)
+		case c.code != "" && (failed == nil || failed.Code != c.code):
+			t.Errorf("%s at level %d: %+v, want a %s error", c.cmd, c.level, resp, c.code)
+		}
+	}
+}
+
+func TestServeConnAudits(t *testing.T) {
+	s := newServer(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := audit.Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetAuditLog(l)
+
+	client, server := socketPair(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serveConn(server)
+	}()
+	enc := json.NewEncoder(client)
+	r := bufio.NewReader(client)
+	for _, cmd := range []string{"stats", "nonesuch"} {
+		if err := enc.Encode(Request{Version: ctlproto.Version, Cmd: cmd}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.ReadBytes('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	<-done
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d records, want 2:\n%s", len(lines), data)
+	}
+	for i, want := range []struct{ op, result string }{
+		{"control:stats", "ok"},
+		{"control:nonesuch", `unknown command "nonesuch"`},
+	} {
+		var rec audit.Record
+		if err := json.Unmarshal([]byte(lines[i]), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Op != want.op || rec.Result != want.result {
+			t.Errorf("record %d = %+v, want %s with %q", i, rec, want.op, want.result)
+		}
+		if rec.Uid != uint32(os.Geteuid()) || rec.Pid != uint32(os.Getpid()) {
+			t.Errorf("record %d tagged uid %d pid %d, want the peer's %d and %d",
+				i, rec.Uid, rec.Pid, os.Geteuid(), os.Getpid())
+		}
+	}
+}
+
+func TestServeConnRefusesStranger(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root is always let in")
+	}
+	s := newServer(t)
+	s.self++ // Not this process's uid
+	client, server := socketPair(t)
+	go s.serveConn(server)
+	if err := json.NewEncoder(client).Encode(Request{Version: ctlproto.Version, Cmd: "stats"}); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(client)
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if failed := resp.Failed(); failed == nil || failed.Code != ctlproto.CodePermission {
+		t.Errorf("stranger's request: %+v, want a permission error", resp)
+	}
+	// And is disconnected after the one refusal
+	if _, err := r.ReadBytes('\n'); err == nil {
+		t.Error("connection left open after refusing the peer")
+	}
+}
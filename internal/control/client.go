@@ -0,0 +1,112 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"aethelfs/internal/ctlproto"
+)
+
+// MaxRequestSize is the longest request line the server accepts
+const MaxRequestSize = 16 * 1024 * 1024
+
+// CommandError is a failure reported by the daemon, as opposed to a
+// failure to reach it. Code is one of the ctlproto error codes; daemons
+// that predate versioning always report ctlproto.CodeFailed.
+type CommandError struct {
+	Cmd  string
+	Code string
+	Msg  string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Cmd, e.Msg)
+}
+
+// Client sends commands to a control socket over one connection
+type Client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	enc     *json.Encoder
+	version int // Protocol version agreed with the daemon
+}
+
+// Dial connects to the control socket at path and agrees on a protocol
+// version with the daemon
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn), enc: json.NewEncoder(conn)}
+	if err := c.hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// hello negotiates the protocol version. A daemon that predates
+// versioning does not know the command and is spoken to in version 0.
+func (c *Client) hello() error {
+	c.version = ctlproto.Version
+	var result ctlproto.HelloResult
+	err := c.Call(ctlproto.HelloCmd, ctlproto.Hello{
+		Version:    ctlproto.Version,
+		MinVersion: ctlproto.MinVersion,
+		Client:     "aethelfsctl",
+	}, &result)
+	if cmdErr, ok := err.(*CommandError); ok && cmdErr.Code == ctlproto.CodeFailed {
+		c.version = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.version = result.Version
+	return nil
+}
+
+// Version returns the protocol version agreed with the daemon
+func (c *Client) Version() int {
+	return c.version
+}
+
+// Call runs cmd with args, which may be nil, and decodes the result into
+// result unless it is nil. A command that fails returns a *CommandError.
+func (c *Client) Call(cmd string, args interface{}, result interface{}) error {
+	req := Request{Version: c.version, Cmd: cmd}
+	if args != nil {
+		raw, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		req.Args = raw
+	}
+	if err := c.enc.Encode(req); err != nil {
+		return err
+	}
+
+	line, err := c.r.ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var resp Response
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return fmt.Errorf("malformed reply: %w", err)
+	}
+	if failed := resp.Failed(); failed != nil {
+		return &CommandError{Cmd: cmd, Code: failed.Code, Msg: failed.Message}
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,286 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"aethelfs/internal/audit"
+	"aethelfs/internal/common"
+	"aethelfs/internal/ctlproto"
+	"aethelfs/internal/metrics"
+)
+
+var deniedRequests = metrics.NewCounter("aethelfs_control_denied_total",
+	"Control socket requests refused because of the peer's credentials")
+
+// Request is a single command sent to the control socket as one JSON line
+type Request = ctlproto.Request
+
+// Response is the reply to a Request, also a single JSON line
+type Response = ctlproto.Response
+
+// HandlerFunc executes a command. args is nil when the request had none.
+type HandlerFunc func(args json.RawMessage) (interface{}, error)
+
+// Server answers commands on a unix domain socket. The socket belongs to
+// the daemon's uid; other peers need to be let in with SetAccess.
+type Server struct {
+	path string
+	ln   net.Listener
+	self uint32 // The daemon's uid, always allowed
+
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+	readOnly map[string]bool // Commands a read-only peer may run
+	access   Access
+	audit    *audit.Logger // Records every command; nil when disabled
+
+	wg sync.WaitGroup
+}
+
+// Listen creates the control socket at path, replacing a stale one. Only
+// the daemon's uid and root may use it until SetAccess widens it.
+func Listen(path string) (*Server, error) {
+	// A leftover socket from a crashed daemon would make Listen fail
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to restrict control socket: %w", err)
+	}
+
+	s := &Server{
+		path:     path,
+		ln:       ln,
+		self:     uint32(os.Geteuid()),
+		handlers: make(map[string]HandlerFunc),
+		readOnly: make(map[string]bool),
+		access:   Access{ReadOnlyGid: -1},
+	}
+	s.HandleReadOnly("help", s.help)
+	s.HandleReadOnly(ctlproto.HelloCmd, s.hello)
+	return s, nil
+}
+
+// SetAccess lets the peers a describes use the socket. Its mode is
+// widened just enough for them to connect, and every connection is
+// checked against a, so the mode alone never grants anything.
+func (s *Server) SetAccess(a Access) error {
+	if a.ReadOnlyGid >= 0 {
+		if err := os.Chown(s.path, -1, a.ReadOnlyGid); err != nil {
+			return fmt.Errorf("failed to give the control socket to group %d: %w", a.ReadOnlyGid, err)
+		}
+	}
+	if err := os.Chmod(s.path, a.socketMode(s.self)); err != nil {
+		return fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.access = a
+	return nil
+}
+
+// SetAuditLog records every command, with the peer's credentials, in l
+func (s *Server) SetAuditLog(l *audit.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = l
+}
+
+// Path returns the socket path
+func (s *Server) Path() string {
+	return s.path
+}
+
+// Handle registers fn to serve cmd
+func (s *Server) Handle(cmd string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[cmd] = fn
+	delete(s.readOnly, cmd)
+}
+
+// HandleReadOnly registers fn to serve cmd, which only reports state, so
+// peers with read-only access may run it too
+func (s *Server) HandleReadOnly(cmd string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[cmd] = fn
+	s.readOnly[cmd] = true
+}
+
+// Serve accepts connections until the server is closed
+func (s *Server) Serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// Close stops accepting connections, waits for active ones and removes the socket
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.wg.Wait()
+	os.Remove(s.path)
+	return err
+}
+
+// serveConn answers requests on one connection until it is closed. A
+// peer with no access gets one permission error and is disconnected.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	peer, err := peerOf(conn)
+	if err != nil {
+		log.Printf("Warning: control socket could not identify a peer: %v", err)
+		return
+	}
+	s.mu.RLock()
+	level := s.access.level(peer, s.self)
+	s.mu.RUnlock()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), MaxRequestSize)
+	enc := json.NewEncoder(conn)
+
+	for scanner.Scan() {
+		var req Request
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp = ctlproto.Failure(0, ctlproto.Errorf(ctlproto.CodeBadRequest, "malformed request: %v", err))
+		} else {
+			resp = s.dispatch(req, peer, level)
+		}
+		if err := enc.Encode(resp); err != nil {
+			log.Printf("Warning: control socket write failed: %v", err)
+			return
+		}
+		if level == accessNone {
+			return
+		}
+	}
+}
+
+// dispatch runs the handler for a request from peer, if its access level
+// allows it, and audits the outcome. The reply uses the request's
+// protocol version, except that a request too new for this daemon is
+// refused in the newest version it speaks. Hello is exempt, so that a
+// newer client can negotiate down.
+func (s *Server) dispatch(req Request, peer Peer, level int) (resp Response) {
+	defer func() { s.auditCmd(req.Cmd, peer, resp) }()
+	v := req.Version
+	if req.Cmd == ctlproto.HelloCmd && v > ctlproto.Version {
+		v = ctlproto.Version
+	} else if err := ctlproto.Check(&req); err != nil {
+		return ctlproto.Failure(ctlproto.Version, err)
+	}
+	if level == accessNone {
+		deniedRequests.Inc()
+		return ctlproto.Failure(v, ctlproto.Errorf(ctlproto.CodePermission, "permission denied for uid %d", peer.Uid))
+	}
+
+	s.mu.RLock()
+	fn, ok := s.handlers[req.Cmd]
+	readOnly := s.readOnly[req.Cmd]
+	s.mu.RUnlock()
+	if !ok {
+		return ctlproto.Failure(v, ctlproto.Errorf(ctlproto.CodeUnknownCommand, "unknown command %q", req.Cmd))
+	}
+	if level == accessReadOnly && !readOnly {
+		deniedRequests.Inc()
+		return ctlproto.Failure(v, ctlproto.Errorf(ctlproto.CodePermission,
+			"permission denied: uid %d may only run read-only commands", peer.Uid))
+	}
+
+	result, err := fn(req.Args)
+	if err != nil {
+		return ctlproto.Failure(v, err)
+	}
+	if resp, err = ctlproto.Success(v, result); err != nil {
+		return ctlproto.Failure(v, err)
+	}
+	return resp
+}
+
+// auditCmd records a command and its outcome in the audit log
+func (s *Server) auditCmd(cmd string, peer Peer, resp Response) {
+	s.mu.RLock()
+	l := s.audit
+	s.mu.RUnlock()
+	if l == nil {
+		return
+	}
+	result := "ok"
+	if !resp.OK {
+		result = resp.Error
+	}
+	l.Log(audit.Record{
+		Time:   time.Now(),
+		Op:     "control:" + cmd,
+		Uid:    peer.Uid,
+		Gid:    peer.Gid,
+		Pid:    uint32(peer.Pid),
+		Result: result,
+	})
+}
+
+// hello agrees on the protocol version with a client
+func (s *Server) hello(args json.RawMessage) (interface{}, error) {
+	var hello ctlproto.Hello
+	if err := DecodeArgs(args, &hello); err != nil {
+		return nil, err
+	}
+	v, err := ctlproto.Negotiate(hello)
+	if err != nil {
+		return nil, err
+	}
+	return ctlproto.HelloResult{
+		Version:    v,
+		MaxVersion: ctlproto.Version,
+		Server:     "aethelfsd " + common.GetBuildInfo().Version,
+	}, nil
+}
+
+// help lists the registered commands
+func (s *Server) help(args json.RawMessage) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cmds := make([]string, 0, len(s.handlers))
+	for cmd := range s.handlers {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	return cmds, nil
+}
+
+// DecodeArgs unmarshals optional command arguments into v
+func DecodeArgs(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package control_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/ctlproto"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// serve mounts a filesystem and serves its commands on a control socket
+func serve(t *testing.T) *control.Server {
+	t.Helper()
+	opts := fs.DefaultOptions()
+	opts.FlushInterval = 0
+	opts.CompactRate = 0
+	h, err := fstest.New(0, opts)
+	if err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	s, err := control.Listen(filepath.Join(t.TempDir(), "control.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.FS.RegisterControl(s)
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// rawConn speaks the wire format directly, as a client of another
+// version would
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRaw(t *testing.T, path string) *rawConn {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &rawConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// call sends line and decodes the reply
+func (c *rawConn) call(line string) ctlproto.Response {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	reply, err := c.r.ReadBytes('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var resp ctlproto.Response
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		c.t.Fatalf("malformed reply %s: %v", reply, err)
+	}
+	return resp
+}
+
+func TestClientNegotiatesVersion(t *testing.T) {
+	s := serve(t)
+	c, err := control.Dial(s.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := c.Version(); got != ctlproto.Version {
+		t.Errorf("agreed on version %d, want %d", got, ctlproto.Version)
+	}
+	var report fs.FeatureReport
+	if err := c.Call("features", nil, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Operations) == 0 {
+		t.Error("features reported no operations")
+	}
+
+	err = c.Call("frobnicate", nil, nil)
+	if e, ok := err.(*control.CommandError); !ok || e.Code != ctlproto.CodeUnknownCommand {
+		t.Errorf("unknown command: %v, want a %s error", err, ctlproto.CodeUnknownCommand)
+	}
+}
+
+func TestNewerClientNegotiatesDown(t *testing.T) {
+	c := dialRaw(t, serve(t).Path())
+	resp := c.call(`{"v":99,"cmd":"hello","args":{"version":99,"min_version":1}}`)
+	var hello ctlproto.HelloResult
+	if !resp.OK || json.Unmarshal(resp.Result, &hello) != nil {
+		t.Fatalf("hello from a newer client: %+v", resp)
+	}
+	if hello.Version != ctlproto.Version || hello.MaxVersion != ctlproto.Version {
+		t.Errorf("hello agreed on %+v, want version %d", hello, ctlproto.Version)
+	}
+
+	// A client speaking only newer versions cannot be served
+	resp = c.call(`{"v":99,"cmd":"hello","args":{"version":99,"min_version":50}}`)
+	if failed := resp.Failed(); failed == nil || failed.Code != ctlproto.CodeVersion {
+		t.Errorf("hello with no common version: %+v", resp)
+	}
+}
+
+func TestNewerRequestRefused(t *testing.T) {
+	c := dialRaw(t, serve(t).Path())
+	// Refused without running, whatever the command
+	for _, cmd := range []string{"stats", "syncfs", "frobnicate"} {
+		resp := c.call(`{"v":99,"cmd":"` + cmd + `"}`)
+		if resp.OK || resp.Err == nil || resp.Err.Code != ctlproto.CodeVersion {
+			t.Errorf("%s at version 99: %+v, want a %s error", cmd, resp, ctlproto.CodeVersion)
+		}
+		if resp.Version != ctlproto.Version {
+			t.Errorf("refusal sent at version %d, want %d", resp.Version, ctlproto.Version)
+		}
+	}
+}
+
+func TestVersionZeroClient(t *testing.T) {
+	c := dialRaw(t, serve(t).Path())
+	if resp := c.call(`{"cmd":"stats"}`); !resp.OK || len(resp.Result) == 0 {
+		t.Errorf("unversioned stats: %+v", resp)
+	}
+	// Failures carry only the plain error a version 0 client reads
+	resp := c.call(`{"cmd":"frobnicate"}`)
+	if resp.OK || resp.Error == "" || resp.Err != nil {
+		t.Errorf("unversioned unknown command: %+v", resp)
+	}
+	resp = c.call(`{"cmd":`)
+	if resp.OK || resp.Error == "" {
+		t.Errorf("malformed request: %+v", resp)
+	}
+}
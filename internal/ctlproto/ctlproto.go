@@ -0,0 +1,149 @@
+// Package ctlproto defines the wire format of the control socket, shared
+// by the daemon and aethelfsctl so the two sides cannot drift apart.
+//
+// Each request and response is one JSON object on its own line. Requests
+// carry the protocol version the client speaks; a client opens with a
+// hello request to learn the version the daemon speaks and settles on the
+// lower of the two. A daemon refuses requests newer than it understands
+// with CodeVersion instead of guessing at their meaning. Requests without
+// a version come from clients that predate versioning and are read as
+// version 0, which differs from version 1 only in lacking the envelope's
+// structured errors.
+//
+// Adding a command needs no change here: its arguments and result travel
+// as raw JSON inside the envelope. Bump Version only when the envelope
+// itself, or the meaning of an existing command, changes incompatibly.
+package ctlproto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the newest protocol version this build speaks
+const Version = 1
+
+// MinVersion is the oldest protocol version this build still accepts
+const MinVersion = 0
+
+// HelloCmd negotiates the protocol version; see Hello
+const HelloCmd = "hello"
+
+// Error codes of a failed request
+const (
+	CodeFailed         = "failed"          // The command ran and failed
+	CodeBadRequest     = "bad_request"     // The request could not be parsed
+	CodeUnknownCommand = "unknown_command" // No such command
+	CodePermission     = "permission"      // The peer may not run the command
+	CodeVersion        = "version"         // The request's version is not supported
+)
+
+// Request is a single command sent to the control socket
+type Request struct {
+	Version int             `json:"v,omitempty"`
+	Cmd     string          `json:"cmd"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// Response is the reply to a Request. A failure sets both Err and, for
+// version 0 clients, the plain Error string.
+type Response struct {
+	Version int             `json:"v,omitempty"`
+	OK      bool            `json:"ok"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Err     *Error          `json:"err,omitempty"`
+}
+
+// Error is a structured request failure
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf builds an Error with the given code
+func Errorf(code, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Hello is the argument of a hello request: the versions the client speaks
+type Hello struct {
+	Version    int    `json:"version"`
+	MinVersion int    `json:"min_version"`
+	Client     string `json:"client,omitempty"` // Free-form, for logs
+}
+
+// HelloResult is the daemon's answer to a hello request
+type HelloResult struct {
+	Version    int    `json:"version"`     // Agreed version, used from now on
+	MaxVersion int    `json:"max_version"` // Newest version the daemon speaks
+	Server     string `json:"server,omitempty"`
+}
+
+// Negotiate returns the version a client speaking hello should use with a
+// daemon speaking MinVersion through Version, or a CodeVersion error if
+// their ranges do not overlap
+func Negotiate(hello Hello) (int, error) {
+	v := hello.Version
+	if v > Version {
+		v = Version
+	}
+	if v < MinVersion || v < hello.MinVersion {
+		return 0, Errorf(CodeVersion, "client speaks protocol versions %d-%d, daemon %d-%d",
+			hello.MinVersion, hello.Version, MinVersion, Version)
+	}
+	return v, nil
+}
+
+// Check returns a CodeVersion error if this build cannot serve req
+func Check(req *Request) error {
+	if req.Version > Version {
+		return Errorf(CodeVersion, "request uses protocol version %d; daemon speaks up to %d, upgrade aethelfsd",
+			req.Version, Version)
+	}
+	return nil
+}
+
+// Success builds the response carrying result at version v
+func Success(v int, result interface{}) (Response, error) {
+	resp := Response{Version: v, OK: true}
+	if result != nil {
+		raw, err := json.Marshal(result)
+		if err != nil {
+			return Response{}, fmt.Errorf("failed to encode result: %w", err)
+		}
+		resp.Result = raw
+	}
+	return resp, nil
+}
+
+// Failure builds the response for err at version v. The code comes from
+// an *Error err wraps, CodeFailed if there is none.
+func Failure(v int, err error) Response {
+	code := CodeFailed
+	var e *Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+	resp := Response{Version: v, Error: err.Error()}
+	if v >= 1 {
+		resp.Err = &Error{Code: code, Message: err.Error()}
+	}
+	return resp
+}
+
+// Failed returns the error a response reports, or nil if it succeeded
+func (r *Response) Failed() *Error {
+	switch {
+	case r.OK:
+		return nil
+	case r.Err != nil:
+		return r.Err
+	}
+	return &Error{Code: CodeFailed, Message: r.Error}
+}
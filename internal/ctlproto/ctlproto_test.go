@@ -0,0 +1,136 @@
+package ctlproto
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, req := range []Request{
+		{Cmd: "stats"},
+		{Version: Version, Cmd: "txn", Args: json.RawMessage(`{"op":"begin"}`)},
+		{Version: Version + 1, Cmd: "snapshot", Args: json.RawMessage(`[1,2,3]`)},
+	} {
+		raw, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Request
+		if err := json.Unmarshal(raw, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, req) {
+			t.Errorf("round trip of %s = %+v, want %+v", raw, got, req)
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	success, err := Success(Version, map[string]int{"files": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, resp := range []Response{
+		success,
+		Failure(0, fmt.Errorf("disk on fire")),
+		Failure(Version, Errorf(CodeUnknownCommand, "unknown command %q", "frobnicate")),
+	} {
+		raw, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Response
+		if err := json.Unmarshal(raw, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, resp) {
+			t.Errorf("round trip of %s = %+v, want %+v", raw, got, resp)
+		}
+	}
+}
+
+func TestVersionZeroRequest(t *testing.T) {
+	// Clients that predate versioning send no version at all
+	var req Request
+	if err := json.Unmarshal([]byte(`{"cmd":"stats"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != 0 || Check(&req) != nil {
+		t.Errorf("unversioned request read as version %d, check %v", req.Version, Check(&req))
+	}
+	if raw, _ := json.Marshal(Request{Cmd: "stats"}); string(raw) != `{"cmd":"stats"}` {
+		t.Errorf("version 0 request encodes as %s", raw)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		hello Hello
+		want  int
+		fail  bool
+	}{
+		{Hello{Version: Version, MinVersion: MinVersion}, Version, false},
+		{Hello{Version: Version + 5, MinVersion: MinVersion}, Version, false},
+		{Hello{Version: Version + 5, MinVersion: Version}, Version, false},
+		{Hello{Version: 0, MinVersion: 0}, 0, false},
+		{Hello{Version: Version + 5, MinVersion: Version + 1}, 0, true},
+		{Hello{Version: MinVersion - 1, MinVersion: MinVersion - 1}, 0, true},
+	}
+	for _, c := range cases {
+		got, err := Negotiate(c.hello)
+		if c.fail {
+			if e, ok := err.(*Error); !ok || e.Code != CodeVersion {
+				t.Errorf("Negotiate(%+v) = %d, %v, want a %s error", c.hello, got, err, CodeVersion)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("Negotiate(%+v) = %d, %v, want %d", c.hello, got, err, c.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for v := MinVersion; v <= Version; v++ {
+		if err := Check(&Request{Version: v, Cmd: "stats"}); err != nil {
+			t.Errorf("version %d refused: %v", v, err)
+		}
+	}
+	err := Check(&Request{Version: Version + 1, Cmd: "stats"})
+	if e, ok := err.(*Error); !ok || e.Code != CodeVersion {
+		t.Errorf("newer request: %v, want a %s error", err, CodeVersion)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	wrapped := fmt.Errorf("quota: %w", Errorf(CodePermission, "denied"))
+	cases := []struct {
+		v    int
+		err  error
+		want *Error
+	}{
+		{Version, fmt.Errorf("disk on fire"), &Error{Code: CodeFailed, Message: "disk on fire"}},
+		{Version, wrapped, &Error{Code: CodePermission, Message: "quota: denied"}},
+		{0, wrapped, nil},
+	}
+	for _, c := range cases {
+		resp := Failure(c.v, c.err)
+		if resp.OK || resp.Error != c.err.Error() {
+			t.Errorf("Failure(%d, %v) = %+v", c.v, c.err, resp)
+		}
+		if !reflect.DeepEqual(resp.Err, c.want) {
+			t.Errorf("Failure(%d, %v).Err = %+v, want %+v", c.v, c.err, resp.Err, c.want)
+		}
+	}
+
+	// A version 0 failure still reads as one, with the generic code
+	resp := Failure(0, wrapped)
+	if got := resp.Failed(); got == nil || got.Code != CodeFailed || got.Message != "quota: denied" {
+		t.Errorf("version 0 failure read as %+v", got)
+	}
+	if ok := (&Response{OK: true}); ok.Failed() != nil {
+		t.Error("a success reads as failed")
+	}
+}
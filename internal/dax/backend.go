@@ -0,0 +1,30 @@
+package dax
+
+import "aethelfs/internal/common"
+
+// Backend is the storage the filesystem is mapped onto. Device is the
+// production implementation; FaultDevice wraps one to inject failures.
+type Backend interface {
+	// Size returns the usable size in bytes
+	Size() int64
+	// At returns the mapping of [offset, offset+length) the filesystem
+	// reads and writes directly, or nil if the range is out of bounds
+	At(offset common.DeviceOffset, length common.ByteCount) []byte
+	// Flush makes the whole mapping durable
+	Flush() error
+	// FlushRange makes the bytes in [offset, offset+length) durable
+	FlushRange(offset common.DeviceOffset, length common.ByteCount) error
+	// Prefetch asks for [offset, offset+length) to be faulted in ahead of
+	// use. It is advisory and may return before the pages are resident.
+	Prefetch(offset, length int64) error
+	// Close releases the mapping
+	Close() error
+}
+
+// Protector is implemented by backends that can write-protect parts of
+// their mapping, so a stray store faults instead of corrupting the device
+type Protector interface {
+	// Protect makes the page-aligned range [offset, offset+length)
+	// writable or read-only
+	Protect(offset common.DeviceOffset, length common.ByteCount, writable bool) error
+}
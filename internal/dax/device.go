@@ -2,28 +2,78 @@ package dax
 
 import (
 	"aethelfs/internal/common"
+	"errors"
 	"fmt"
 	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 
 	"golang.org/x/sys/unix"
 )
 
+// flushChunkSize is the largest region passed to a single msync by Flush
+const flushChunkSize = 64 * 1024 * 1024
+
+// ErrClosed is returned by a Device used after Close
+var ErrClosed = errors.New("dax device is closed")
+
+// flushStarted is called by FlushRange once it holds the mapping; tests
+// replace it to keep a flush running across Close
+var flushStarted = func() {}
+
 // Device represents a DAX character device
 type Device struct {
-	file     *os.File
-	size     int64
-	mmapData []byte
+	clwbMax      int64        // Auto strategy threshold in bytes; atomic
+	closed       int32        // Set by Close; checked before touching the mapping
+	mapMu        sync.RWMutex // Read-held by operations on the mapping; Close takes it to unmap
+	file         *os.File
+	size         int64
+	mmapData     []byte       // The whole device, across segments
+	mapped       []byte       // What Close unmaps
+	segments     []Segment    // See Segments
+	flushWorkers int32        // Parallel msync workers for Flush; <= 0 means GOMAXPROCS
+	charDev      bool         // A DAX character device rather than a regular file
+	readOnly     bool         // Mapped PROT_READ; flushes are no-ops
+	strategy     atomic.Value // string; see SetFlushStrategy
+}
+
+// DeviceOptions adjusts how OpenDevice maps a device
+type DeviceOptions struct {
+	// ReadOnly maps the device PROT_READ, for a device another daemon may
+	// be writing. Flushing it does nothing: there is nothing of ours to
+	// make durable.
+	ReadOnly bool
+	// SegmentSize maps the device as consecutive segments of this many
+	// bytes, a multiple of 2MB, instead of one mapping. Zero maps it whole.
+	SegmentSize int64
 }
 
 // NewDevice opens a DAX device and maps it into memory
 func NewDevice(path string) (*Device, error) {
-	// Check if the path exists
-	if _, err := os.Stat(path); err != nil {
-		return nil, fmt.Errorf("DAX device not found: %v", err)
+	return OpenDevice(path, DeviceOptions{})
+}
+
+// NewReadOnlyDevice opens a DAX device another daemon may be writing and
+// maps it PROT_READ
+func NewReadOnlyDevice(path string) (*Device, error) {
+	return OpenDevice(path, DeviceOptions{ReadOnly: true})
+}
+
+// OpenDevice opens a DAX device and maps it into memory as opts selects
+func OpenDevice(path string, opts DeviceOptions) (*Device, error) {
+	readOnly := opts.ReadOnly
+	// Catch directories, sockets and the like before mmap fails on them
+	if _, err := ClassifyPath(path, true); err != nil {
+		return nil, err
 	}
 
 	// Open the device file
-	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	mode, prot := os.O_RDWR, unix.PROT_READ|unix.PROT_WRITE
+	if readOnly {
+		mode, prot = os.O_RDONLY, unix.PROT_READ
+	}
+	file, err := os.OpenFile(path, mode, 0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open DAX device: %v", err)
 	}
@@ -37,7 +87,12 @@ func NewDevice(path string) (*Device, error) {
 	size := stat.Size()
 
 	// For DAX character devices, stat.Size() might be 0
-	// In this case, use our configured maximum size
+	// In this case, use our configured maximum size. A regular file that
+	// small is simply too small: mapping past its end would fault.
+	if size < common.MinDeviceSize && stat.Mode()&os.ModeCharDevice == 0 {
+		file.Close()
+		return nil, fmt.Errorf("DAX device too small: %d bytes, need at least %d", size, common.MinDeviceSize)
+	}
 	if size <= 4096 {
 		// Use configured maximum size from common package
 		size = common.MaxFilesystemSize
@@ -46,8 +101,7 @@ func NewDevice(path string) (*Device, error) {
 	}
 
 	// Memory map the device
-	mmapData, err := unix.Mmap(int(file.Fd()), 0, int(size),
-		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	m, err := mapDevice(int(file.Fd()), size, prot, opts.SegmentSize)
 	if err != nil {
 		file.Close()
 		return nil, fmt.Errorf("failed to mmap DAX device: %v", err)
@@ -56,77 +110,215 @@ func NewDevice(path string) (*Device, error) {
 	return &Device{
 		file:     file,
 		size:     size,
-		mmapData: mmapData,
+		mmapData: m.data,
+		mapped:   m.whole,
+		segments: m.segments,
+		charDev:  stat.Mode()&os.ModeCharDevice != 0,
+		readOnly: readOnly,
 	}, nil
 }
 
+// ReadOnly reports whether the device is mapped without write access
+func (d *Device) ReadOnly() bool {
+	return d.readOnly
+}
+
 // Size returns the size of the DAX device
 func (d *Device) Size() int64 {
 	return d.size
 }
 
-// MmapData returns the memory-mapped data
-func (d *Device) MmapData() []byte {
-	return d.mmapData
+// At returns the mapping of device bytes [offset, offset+length), or nil
+// once the device is closed or if the range is out of bounds. The range
+// may span segments.
+func (d *Device) At(offset common.DeviceOffset, length common.ByteCount) []byte {
+	if atomic.LoadInt32(&d.closed) != 0 || !common.InRange(offset, length, common.ByteCount(d.size)) {
+		return nil
+	}
+	end := offset.Plus(length)
+	return d.mmapData[offset:end:end]
 }
 
 // Flush ensures all data is written to storage
 func (d *Device) Flush() error {
+	if err := d.hold(); err != nil {
+		return err
+	}
+	defer d.mapMu.RUnlock()
+
 	// Validate the data slice is not nil
 	if d.mmapData == nil || len(d.mmapData) == 0 {
 		return fmt.Errorf("no mapped data to flush")
 	}
+	if d.readOnly {
+		return nil
+	}
 
 	// On some systems, msync can fail if the memory region is too large
 	// Let's flush in smaller chunks to prevent this
 	pageSize := os.Getpagesize()
-	chunkSize := 64 * 1024 * 1024 // 64MB chunks
+	chunkSize := flushChunkSize
 
-	// Only flush smaller chunks if the total size is very large
-	if len(d.mmapData) > chunkSize*2 {
-		var lastErr error
+	// For smaller regions, just do a single msync; goroutine overhead
+	// would dominate any gain from parallelism
+	if len(d.mmapData) <= chunkSize*2 {
+		if err := d.msync(0, len(d.mmapData)); err != nil {
+			return err
+		}
+		flushedBytes.With(FlushMsync).Add(int64(len(d.mmapData)))
+		return nil
+	}
 
-		for offset := 0; offset < len(d.mmapData); offset += chunkSize {
-			end := offset + chunkSize
-			if end > len(d.mmapData) {
-				end = len(d.mmapData)
+	// Msync of disjoint ranges parallelizes well, so hand the chunks to
+	// a bounded pool of workers
+	chunks := make(chan [2]int)
+	var wg sync.WaitGroup
+	var firstErr error
+	var errMu sync.Mutex
+
+	for i := 0; i < d.FlushWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if err := d.msync(c[0], c[1]); err != nil {
+					// Continue with other chunks instead of returning immediately
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+				}
 			}
+		}()
+	}
 
-			// Make sure we align to page boundaries
-			alignedOffset := (offset / pageSize) * pageSize
-			alignedEnd := ((end + pageSize - 1) / pageSize) * pageSize
+	for offset := 0; offset < len(d.mmapData); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(d.mmapData) {
+			end = len(d.mmapData)
+		}
 
-			if alignedEnd > len(d.mmapData) {
-				alignedEnd = len(d.mmapData)
-			}
+		// Make sure we align to page boundaries
+		alignedOffset := (offset / pageSize) * pageSize
+		alignedEnd := ((end + pageSize - 1) / pageSize) * pageSize
 
-			// Skip empty chunks
-			if alignedEnd <= alignedOffset {
-				continue
-			}
+		if alignedEnd > len(d.mmapData) {
+			alignedEnd = len(d.mmapData)
+		}
 
-			chunk := d.mmapData[alignedOffset:alignedEnd]
-			if err := unix.Msync(chunk, unix.MS_SYNC); err != nil {
-				lastErr = fmt.Errorf("msync failed for chunk %d-%d: %w",
-					alignedOffset, alignedEnd, err)
-				// Continue with other chunks instead of returning immediately
-			}
+		// Skip empty chunks
+		if alignedEnd <= alignedOffset {
+			continue
 		}
+		chunks <- [2]int{alignedOffset, alignedEnd}
+	}
+	close(chunks)
+	wg.Wait()
 
-		return lastErr
+	if firstErr == nil {
+		flushedBytes.With(FlushMsync).Add(int64(len(d.mmapData)))
 	}
+	return firstErr
+}
+
+// msync synchronously writes back [start, end) of the mapping, which is
+// page aligned, one segment at a time, retrying transient failures
+func (d *Device) msync(start, end int) error {
+	return d.eachSegment(int64(start), int64(end), func(start, end int64) error {
+		return retryFlush("msync", start, end-start, func() error {
+			return unix.Msync(d.mmapData[start:end], unix.MS_SYNC)
+		})
+	})
+}
+
+// SetFlushWorkers sets how many goroutines Flush uses for large devices.
+// Values <= 0 select GOMAXPROCS.
+func (d *Device) SetFlushWorkers(n int) {
+	atomic.StoreInt32(&d.flushWorkers, int32(n))
+}
 
-	// For smaller regions, just do a single msync
-	if err := unix.Msync(d.mmapData, unix.MS_SYNC); err != nil {
-		return fmt.Errorf("msync failed: %w", err)
+// FlushWorkers returns the number of goroutines Flush uses for large devices
+func (d *Device) FlushWorkers() int {
+	if n := atomic.LoadInt32(&d.flushWorkers); n > 0 {
+		return int(n)
 	}
+	return runtime.GOMAXPROCS(0)
+}
 
+// FlushRange ensures the bytes in [offset, offset+length) are written to
+// storage, by msync or cache line flushing as the flush strategy selects.
+// For msync the range is widened to page boundaries.
+func (d *Device) FlushRange(at common.DeviceOffset, n common.ByteCount) error {
+	if err := d.hold(); err != nil {
+		return err
+	}
+	defer d.mapMu.RUnlock()
+	if !common.InRange(at, n, common.ByteCount(len(d.mmapData))) {
+		return fmt.Errorf("flush range out of bounds: offset=%d, length=%d, size=%d",
+			at, n, len(d.mmapData))
+	}
+	if n == 0 || d.readOnly {
+		return nil
+	}
+	flushStarted()
+	offset, length := int64(at), int64(n)
+	method := d.methodFor(length)
+	if err := d.flushWith(method, offset, length); err != nil {
+		return err
+	}
+	rangeFlushes.With(method).Inc()
+	rangeFlushBytes.With(method).Add(length)
+	flushedBytes.With(method).Add(coveredBytes(method, offset, length))
 	return nil
 }
 
-// Close unmaps and closes the device
+// Prefetch advises the kernel that [offset, offset+length) will be read
+// soon. The range is widened to page boundaries as madvise requires.
+func (d *Device) Prefetch(offset, length int64) error {
+	if err := d.hold(); err != nil {
+		return err
+	}
+	defer d.mapMu.RUnlock()
+	if offset < 0 || length < 0 || offset > int64(len(d.mmapData))-length {
+		return fmt.Errorf("prefetch range out of bounds: offset=%d, length=%d, size=%d",
+			offset, length, len(d.mmapData))
+	}
+	if length == 0 {
+		return nil
+	}
+
+	alignedOffset, alignedEnd := d.pageAlign(offset, length)
+	return d.eachSegment(alignedOffset, alignedEnd, func(start, end int64) error {
+		if err := unix.Madvise(d.mmapData[start:end], unix.MADV_WILLNEED); err != nil {
+			return fmt.Errorf("madvise failed for range %d-%d: %w", start, end, err)
+		}
+		return nil
+	})
+}
+
+// hold read-locks the mapping for an operation on it, or returns ErrClosed
+// once Close has begun. The caller unlocks d.mapMu when it is done.
+func (d *Device) hold() error {
+	d.mapMu.RLock()
+	if atomic.LoadInt32(&d.closed) != 0 {
+		d.mapMu.RUnlock()
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close unmaps and closes the device. Flushes and other operations on the
+// mapping that are already running finish first; those that start later
+// return ErrClosed, as do later calls to Close. Slices returned by At must
+// not be used once Close has been called.
 func (d *Device) Close() error {
-	if err := unix.Munmap(d.mmapData); err != nil {
+	if !atomic.CompareAndSwapInt32(&d.closed, 0, 1) {
+		return ErrClosed
+	}
+	d.mapMu.Lock()
+	defer d.mapMu.Unlock()
+	if err := unix.Munmap(d.mapped); err != nil {
 		return err
 	}
 	return d.file.Close()
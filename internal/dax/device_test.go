@@ -0,0 +1,117 @@
+package dax_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+)
+
+// newFileDevice maps a file as a device, skipping the test where the file
+// cannot be mapped
+func newFileDevice(t *testing.T, size int64) *dax.Device {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, size); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dax.NewDevice(path)
+	if err != nil {
+		t.Skipf("file-backed device unavailable: %v", err)
+	}
+	return d
+}
+
+// TestCloseUnderLoad closes a device while flushes of it are running:
+// each flush either completes or returns ErrClosed, never touching the
+// mapping after it is gone
+func TestCloseUnderLoad(t *testing.T) {
+	const size = 8 << 20
+	for round := 0; round < 10; round++ {
+		d := newFileDevice(t, size)
+		errs := make(chan error, 16)
+		var started, wg sync.WaitGroup
+		for i := 0; i < cap(errs); i++ {
+			started.Add(1)
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				at := common.DeviceOffset(i) * (size / 16)
+				for n := 0; ; n++ {
+					var err error
+					switch n % 3 {
+					case 0:
+						err = d.FlushRange(at, 64<<10)
+					case 1:
+						err = d.Prefetch(int64(at), 64<<10)
+					default:
+						err = d.Flush()
+					}
+					if n == 0 {
+						started.Done()
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(i)
+		}
+		started.Wait()
+		time.Sleep(time.Millisecond)
+		if err := d.Close(); err != nil {
+			t.Fatalf("close under load: %v", err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if !errors.Is(err, dax.ErrClosed) {
+				t.Errorf("operation racing close: %v, want ErrClosed", err)
+			}
+		}
+		if err := d.Close(); !errors.Is(err, dax.ErrClosed) {
+			t.Errorf("second close: %v, want ErrClosed", err)
+		}
+	}
+}
+
+// TestCloseWaitsForFlush holds a flush open and checks that Close waits
+// for it to finish before unmapping
+func TestCloseWaitsForFlush(t *testing.T) {
+	d := newFileDevice(t, 8<<20)
+	inside, release := make(chan struct{}), make(chan struct{})
+	defer dax.SetFlushStarted(func() {
+		close(inside)
+		<-release
+	})()
+
+	flushed := make(chan error, 1)
+	go func() { flushed <- d.FlushRange(0, 64<<10) }()
+	<-inside
+	closed := make(chan error, 1)
+	go func() { closed <- d.Close() }()
+
+	select {
+	case err := <-closed:
+		t.Fatalf("close returned %v with a flush running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-flushed; err != nil {
+		t.Errorf("flush running across close: %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if err := d.FlushRange(0, 64<<10); !errors.Is(err, dax.ErrClosed) {
+		t.Errorf("flush after close: %v, want ErrClosed", err)
+	}
+}
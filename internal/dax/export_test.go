@@ -0,0 +1,19 @@
+package dax
+
+import "os"
+
+// Hooks for the external tests in package dax_test
+
+// SetStat makes ClassifyPath stat paths with stat until the returned
+// function restores os.Stat
+func SetStat(stat func(string) (os.FileInfo, error)) func() {
+	statPath = stat
+	return func() { statPath = os.Stat }
+}
+
+// SetFlushStarted makes Device.FlushRange call fn once it holds the
+// mapping, until the returned function restores the default
+func SetFlushStarted(fn func()) func() {
+	flushStarted = fn
+	return func() { flushStarted = func() {} }
+}
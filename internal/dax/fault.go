@@ -0,0 +1,279 @@
+package dax
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/common"
+)
+
+// FaultEnv names the environment variable holding a fault specification.
+// It is deliberately not a flag: fault injection is for failure testing only.
+const FaultEnv = "AETHELFS_FAULTS"
+
+// rangeFault fails flushes overlapping [offset, offset+length)
+type rangeFault struct {
+	offset int64
+	length int64
+	err    error
+}
+
+// callFault fails the flush call with the given number
+type callFault struct {
+	call int
+	err  error
+}
+
+// FaultDevice wraps a Backend and fails, delays or corrupts its flushes on
+// demand, making it possible to exercise error paths without broken
+// hardware
+type FaultDevice struct {
+	Backend
+
+	mu        sync.Mutex
+	calls     int         // Flush and FlushRange calls seen so far
+	failAt    []callFault // Call numbers (1-based) that fail, with their errors
+	panicAt   []int       // Call numbers (1-based) that panic
+	ranges    []rangeFault
+	delay     time.Duration
+	failCount int // Injected failures returned so far
+
+	corruptEvery int // Corrupt every nth data range flush; zero for none
+	dataFlushes  int // FlushRange calls past the metadata reservation
+	corrupted    int // Ranges corrupted so far
+}
+
+// NewFaultDevice wraps b with no faults programmed
+func NewFaultDevice(b Backend) *FaultDevice {
+	return &FaultDevice{Backend: b}
+}
+
+// FailNthFlush makes the nth Flush or FlushRange call from now fail with err
+func (d *FaultDevice) FailNthFlush(n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failAt = append(d.failAt, callFault{call: d.calls + n, err: err})
+}
+
+// PanicNthFlush makes the nth Flush or FlushRange call from now panic,
+// for exercising panic recovery in the callers
+func (d *FaultDevice) PanicNthFlush(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.panicAt = append(d.panicAt, d.calls+n)
+}
+
+// FailRange makes every flush overlapping [offset, offset+length) fail with err.
+// Whole-device flushes always overlap.
+func (d *FaultDevice) FailRange(offset, length int64, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ranges = append(d.ranges, rangeFault{offset: offset, length: length, err: err})
+}
+
+// CorruptEveryNthFlush makes every nth FlushRange of file data, after it
+// succeeds, flip the bits of the range's first byte, as media that loses a
+// write would. The metadata reservation is never corrupted.
+func (d *FaultDevice) CorruptEveryNthFlush(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.corruptEvery = n
+	d.dataFlushes = 0
+}
+
+// Corrupted returns the number of ranges corrupted so far
+func (d *FaultDevice) Corrupted() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.corrupted
+}
+
+// SetDelay makes every flush sleep for delay first, simulating slow media
+func (d *FaultDevice) SetDelay(delay time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.delay = delay
+}
+
+// Reset clears all programmed faults
+func (d *FaultDevice) Reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failAt = nil
+	d.panicAt = nil
+	d.ranges = nil
+	d.delay = 0
+	d.corruptEvery = 0
+}
+
+// Failures returns the number of injected failures returned so far
+func (d *FaultDevice) Failures() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failCount
+}
+
+// Flush implements Backend. Injected EINTR and EAGAIN are retried like
+// the device's own, so a transient fault only fails the flush if it
+// outlasts the retries.
+func (d *FaultDevice) Flush() error {
+	if err := retryFlush("injected flush", 0, d.Size(), func() error {
+		return d.inject(0, d.Size())
+	}); err != nil {
+		return err
+	}
+	return d.Backend.Flush()
+}
+
+// FlushRange implements Backend, retrying injected faults as Flush does
+func (d *FaultDevice) FlushRange(offset common.DeviceOffset, length common.ByteCount) error {
+	if err := retryFlush("injected flush", int64(offset), int64(length), func() error {
+		return d.inject(int64(offset), int64(length))
+	}); err != nil {
+		return err
+	}
+	if err := d.Backend.FlushRange(offset, length); err != nil {
+		return err
+	}
+	d.corrupt(offset, length)
+	return nil
+}
+
+// corrupt flips the first byte of a flushed data range if it is one the
+// programmed corruption falls on
+func (d *FaultDevice) corrupt(offset common.DeviceOffset, length common.ByteCount) {
+	if length <= 0 || int64(offset) < common.MetadataReservationSize {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.corruptEvery == 0 {
+		return
+	}
+	d.dataFlushes++
+	if d.dataFlushes%d.corruptEvery != 0 {
+		return
+	}
+	d.At(offset, 1)[0] ^= 0xff
+	d.corrupted++
+}
+
+// inject applies the programmed delay and returns the fault, if any, for a
+// flush of [offset, offset+length)
+func (d *FaultDevice) inject(offset, length int64) error {
+	d.mu.Lock()
+	d.calls++
+	for i, n := range d.panicAt {
+		if n == d.calls {
+			d.panicAt = append(d.panicAt[:i], d.panicAt[i+1:]...)
+			d.mu.Unlock()
+			panic(fmt.Sprintf("injected panic at flush %d (%d-%d)", n, offset, offset+length))
+		}
+	}
+	delay := d.delay
+	var err error
+	for i, f := range d.failAt {
+		if f.call == d.calls {
+			d.failAt = append(d.failAt[:i], d.failAt[i+1:]...)
+			err = f.err
+			break
+		}
+	}
+	if err == nil {
+		for _, r := range d.ranges {
+			if offset < r.offset+r.length && r.offset < offset+length {
+				err = r.err
+				break
+			}
+		}
+	}
+	if err != nil {
+		d.failCount++
+	}
+	d.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return err
+}
+
+// ParseFaults programs d from a comma-separated specification:
+//
+//	flush=N            fail the Nth flush (may repeat)
+//	panic=N            panic in the Nth flush (may repeat)
+//	range=OFFSET+LEN   fail flushes overlapping the range (may repeat)
+//	delay=DURATION     delay every flush
+//	corrupt=N          corrupt the data of every Nth file data flush
+//	errno=NAME         error for later flush= and range= entries (EIO, ENOSPC,
+//	                   EINVAL, or the transient EAGAIN and EINTR)
+func (d *FaultDevice) ParseFaults(spec string) error {
+	errno := syscall.EIO
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("invalid fault %q", field)
+		}
+
+		switch key {
+		case "flush":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid flush fault %q", value)
+			}
+			d.FailNthFlush(n, errno)
+		case "panic":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid panic fault %q", value)
+			}
+			d.PanicNthFlush(n)
+		case "range":
+			off, length, ok := strings.Cut(value, "+")
+			o, err1 := strconv.ParseInt(off, 0, 64)
+			l, err2 := strconv.ParseInt(length, 0, 64)
+			if !ok || err1 != nil || err2 != nil || o < 0 || l <= 0 {
+				return fmt.Errorf("invalid range fault %q", value)
+			}
+			d.FailRange(o, l, errno)
+		case "corrupt":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid corrupt fault %q", value)
+			}
+			d.CorruptEveryNthFlush(n)
+		case "delay":
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid delay fault %q", value)
+			}
+			d.SetDelay(delay)
+		case "errno":
+			switch strings.ToUpper(value) {
+			case "EIO":
+				errno = syscall.EIO
+			case "ENOSPC":
+				errno = syscall.ENOSPC
+			case "EINVAL":
+				errno = syscall.EINVAL
+			case "EAGAIN":
+				errno = syscall.EAGAIN
+			case "EINTR":
+				errno = syscall.EINTR
+			default:
+				return fmt.Errorf("unsupported fault errno %q", value)
+			}
+		default:
+			return fmt.Errorf("unknown fault %q", key)
+		}
+	}
+	return nil
+}
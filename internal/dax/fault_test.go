@@ -0,0 +1,153 @@
+package dax_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+	"aethelfs/internal/metrics"
+)
+
+func newFaultDevice() *dax.FaultDevice {
+	return dax.NewFaultDevice(dax.NewMemDevice(1 << 20))
+}
+
+func TestFailNthFlush(t *testing.T) {
+	d := newFaultDevice()
+	d.FailNthFlush(2, syscall.EIO)
+
+	if err := d.Flush(); err != nil {
+		t.Fatalf("first flush: %v", err)
+	}
+	err := d.FlushRange(4096, 4096)
+	if !errors.Is(err, syscall.EIO) {
+		t.Fatalf("second flush: %v, want EIO", err)
+	}
+	var flushErr *dax.FlushError
+	if !errors.As(err, &flushErr) || flushErr.Offset != 4096 || flushErr.Length != 4096 {
+		t.Errorf("second flush error %#v does not describe the range", err)
+	}
+	if err := d.FlushRange(4096, 4096); err != nil {
+		t.Errorf("third flush: %v", err)
+	}
+	if n := d.Failures(); n != 1 {
+		t.Errorf("%d failures counted, want 1", n)
+	}
+}
+
+func TestFailRange(t *testing.T) {
+	d := newFaultDevice()
+	d.FailRange(8192, 4096, syscall.ENOSPC)
+
+	tests := []struct {
+		offset, length int64
+		fails          bool
+	}{
+		{0, 4096, false},
+		{4096, 4096, false},
+		{4096, 4097, true},
+		{8192, 4096, true},
+		{12287, 1, true},
+		{12288, 4096, false},
+	}
+	for _, tt := range tests {
+		err := d.FlushRange(common.DeviceOffset(tt.offset), common.ByteCount(tt.length))
+		if fails := errors.Is(err, syscall.ENOSPC); fails != tt.fails {
+			t.Errorf("flush of %d+%d: %v, want failure %v", tt.offset, tt.length, err, tt.fails)
+		}
+	}
+	if err := d.Flush(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("whole-device flush: %v, want ENOSPC", err)
+	}
+
+	d.Reset()
+	if err := d.Flush(); err != nil {
+		t.Errorf("flush after reset: %v", err)
+	}
+}
+
+func TestParseFaults(t *testing.T) {
+	valid := []string{
+		"",
+		"flush=3",
+		"flush=1,flush=4, errno=ENOSPC ,range=0x1000+4096",
+		"errno=eagain,flush=2",
+		"panic=7,corrupt=2,delay=1ms",
+	}
+	for _, spec := range valid {
+		if err := newFaultDevice().ParseFaults(spec); err != nil {
+			t.Errorf("%q: %v", spec, err)
+		}
+	}
+	invalid := []string{
+		"flush",
+		"flush=0",
+		"flush=x",
+		"range=4096",
+		"range=-1+4096",
+		"range=0+0",
+		"corrupt=0",
+		"delay=soon",
+		"errno=EPERM",
+		"explode=1",
+	}
+	for _, spec := range invalid {
+		if err := newFaultDevice().ParseFaults(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+
+	d := newFaultDevice()
+	if err := d.ParseFaults("flush=1,errno=ENOSPC,flush=2"); err != nil {
+		t.Fatal(err)
+	}
+	// errno applies to the entries after it
+	if err := d.Flush(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("first flush: %v, want EIO", err)
+	}
+	if err := d.Flush(); !errors.Is(err, syscall.ENOSPC) {
+		t.Errorf("second flush: %v, want ENOSPC", err)
+	}
+}
+
+// deviceFlushErrors reads the filesystem's failed device flush counter
+func deviceFlushErrors() int64 {
+	n, _ := metrics.Default.Snapshot()["aethelfs_device_flush_errors_total"].(int64)
+	return n
+}
+
+func TestInjectedFailureSurfacesAsEIO(t *testing.T) {
+	opts := fs.DefaultOptions()
+	opts.FlushInterval = 0
+	opts.CompactRate = 0
+	h, err := fstest.NewWithFaults(0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	file, err := h.WriteFile("/file", make([]byte, 8192), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Fsync(file); err != nil {
+		t.Fatal(err)
+	}
+
+	before := deviceFlushErrors()
+	h.Faults.FailNthFlush(1, syscall.EINVAL)
+	// Whatever the device reports, callers see EIO
+	if err := h.Fsync(file); !fstest.IsErrno(err, syscall.EIO) {
+		t.Errorf("fsync with the flush failing: %v, want EIO", err)
+	}
+	if n := deviceFlushErrors() - before; n != 1 {
+		t.Errorf("%d device flush errors counted, want 1", n)
+	}
+	if err := h.Fsync(file); err != nil {
+		t.Errorf("fsync after the fault: %v", err)
+	}
+}
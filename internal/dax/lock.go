@@ -0,0 +1,207 @@
+package dax
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultLockDir holds the mount locks of devices in use
+const DefaultLockDir = "/run/aethelfs"
+
+// ErrDeviceBusy is returned by LockDevice while another daemon has the
+// device mounted
+var ErrDeviceBusy = errors.New("device already in use")
+
+// Lock is one daemon's exclusive claim on a device, or a read-only
+// daemon's shared one
+type Lock struct {
+	file   *os.File
+	path   string
+	shared bool
+}
+
+// lockHolder identifies the process that wrote a lock file. The start
+// time tells a live holder from a later process that reused its PID.
+type lockHolder struct {
+	pid   int
+	start uint64 // Clock ticks after boot, from /proc/PID/stat
+}
+
+// LockDevice claims the device at path for this process, failing with
+// ErrDeviceBusy naming the holder's PID while another daemon has it. The
+// claim is an flock on a file in dir keyed by the device's number, or by
+// the filesystem and inode of a regular file standing in for a device.
+// The kernel drops the flock when its holder exits, so a lock left by a
+// crash is simply taken over. A lock still held after its recorded holder
+// died has leaked into another process; with force the lock file is
+// replaced, fencing that process off.
+func LockDevice(path, dir string, force bool) (*Lock, error) {
+	name, err := lockName(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify DAX device: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	lockPath := filepath.Join(dir, name)
+
+	forced := false
+	for {
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open device lock: %v", err)
+		}
+		err = unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			// A takeover or clean shutdown may have replaced the file
+			// between our open and flock; only a lock on the current
+			// file counts
+			if !sameFile(file, lockPath) {
+				file.Close()
+				continue
+			}
+			l := &Lock{file: file, path: lockPath}
+			if err := l.record(); err != nil {
+				l.Unlock()
+				return nil, err
+			}
+			return l, nil
+		}
+
+		holder, herr := readHolder(file)
+		file.Close()
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+		}
+		switch {
+		case herr != nil:
+			return nil, fmt.Errorf("%w (lock %s held by an unknown process)", ErrDeviceBusy, lockPath)
+		case holder.alive():
+			return nil, fmt.Errorf("%w by PID %d (lock %s)", ErrDeviceBusy, holder.pid, lockPath)
+		case !force || forced:
+			return nil, fmt.Errorf("%w: lock %s is held although its holder PID %d has exited; "+
+				"make sure no aethelfsd uses the device and retry with -force-device", ErrDeviceBusy, lockPath, holder.pid)
+		}
+		fmt.Printf("Warning: taking over %s from exited PID %d\n", lockPath, holder.pid)
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to replace device lock: %v", err)
+		}
+		forced = true
+	}
+}
+
+// LockDeviceShared registers a read-only daemon on the device at path. It
+// never contends with the exclusive lock of the daemon serving the device:
+// readers flock a separate file, NAME.readers, with LOCK_SH, so any number
+// of them can mount alongside the writer and each other. Tools that must
+// exclude readers, such as a reformat, take that file exclusively.
+func LockDeviceShared(path, dir string) (*Lock, error) {
+	name, err := lockName(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to identify DAX device: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	lockPath := filepath.Join(dir, strings.TrimSuffix(name, ".lock")+".readers")
+
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device lock: %v", err)
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_SH|unix.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s is held exclusively", ErrDeviceBusy, lockPath)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+	}
+	return &Lock{file: file, path: lockPath, shared: true}, nil
+}
+
+// Unlock releases the device for other daemons. The readers file stays,
+// since other readers may still hold it.
+func (l *Lock) Unlock() error {
+	if !l.shared {
+		os.Remove(l.path)
+	}
+	return l.file.Close()
+}
+
+// record writes this process's PID and start time into the lock file
+func (l *Lock) record() error {
+	start, err := processStart(os.Getpid())
+	if err != nil {
+		return fmt.Errorf("failed to read process start time: %v", err)
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = l.file.WriteAt([]byte(fmt.Sprintf("%d %d\n", os.Getpid(), start)), 0)
+	return err
+}
+
+// lockName keys the lock by major:minor of a character device, or by
+// device and inode of a regular file
+func lockName(path string) (string, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return "", err
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFCHR {
+		return fmt.Sprintf("dax-%d:%d.lock", unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev))), nil
+	}
+	return fmt.Sprintf("file-%d:%d-%d.lock", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)), st.Ino), nil
+}
+
+// sameFile reports whether file is still the one at path
+func sameFile(file *os.File, path string) bool {
+	a, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	b, err := os.Stat(path)
+	return err == nil && os.SameFile(a, b)
+}
+
+// readHolder parses the holder recorded in a lock file
+func readHolder(file *os.File) (lockHolder, error) {
+	buf := make([]byte, 64)
+	n, err := file.ReadAt(buf, 0)
+	if n == 0 {
+		return lockHolder{}, fmt.Errorf("empty lock file: %v", err)
+	}
+	var h lockHolder
+	if _, err := fmt.Sscanf(string(buf[:n]), "%d %d", &h.pid, &h.start); err != nil {
+		return lockHolder{}, err
+	}
+	return h, nil
+}
+
+// alive reports whether the recorded holder is still running
+func (h lockHolder) alive() bool {
+	start, err := processStart(h.pid)
+	return err == nil && start == h.start
+}
+
+// processStart returns the start time of a process from /proc/PID/stat
+func processStart(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces; fields resume after its ')'
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	// starttime is field 22 overall, the 20th after pid and comm
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("short /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,97 @@
+package dax
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// PathKind is the type of file a device path names
+type PathKind int
+
+// Device path kinds
+const (
+	PathUnsupported PathKind = iota // Anything else, or the path could not be read
+	PathCharDevice                  // Device-dax character device, /dev/daxN.M
+	PathBlockDevice                 // Block device such as an fsdax /dev/pmemN
+	PathRegularFile                 // Regular file, e.g. on an fsdax mount or for testing
+)
+
+// String names the kind for messages
+func (k PathKind) String() string {
+	switch k {
+	case PathCharDevice:
+		return "character device"
+	case PathBlockDevice:
+		return "block device"
+	case PathRegularFile:
+		return "regular file"
+	}
+	return "unsupported"
+}
+
+// ErrUnsupportedPath is returned by ClassifyPath for paths that cannot be
+// mapped as a device
+var ErrUnsupportedPath = errors.New("unsupported DAX device path")
+
+// supportedPaths lists what a device path may name, for error messages
+const supportedPaths = "use a device-dax character device such as /dev/dax0.0, " +
+	"or a regular file with -file"
+
+// statPath stats a device path; tests replace it to classify fake paths
+var statPath = os.Stat
+
+// ClassifyPath reports what kind of file path names, before anything tries
+// to map it. Character devices are always accepted and regular files only
+// with allowFile. Block devices and everything else are rejected with an
+// error naming the file type; an fsdax pmem block device gets a hint on
+// how to use it instead.
+func ClassifyPath(path string, allowFile bool) (PathKind, error) {
+	info, err := statPath(path)
+	switch {
+	case errors.Is(err, syscall.ELOOP):
+		return PathUnsupported, fmt.Errorf("%w: %s is a symlink loop", ErrUnsupportedPath, path)
+	case os.IsNotExist(err):
+		return PathUnsupported, fmt.Errorf("DAX device not found: %v", err)
+	case err != nil:
+		return PathUnsupported, fmt.Errorf("cannot stat DAX device: %v", err)
+	}
+
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeCharDevice != 0:
+		return PathCharDevice, nil
+	case mode&os.ModeDevice != 0:
+		if strings.HasPrefix(filepath.Base(path), "pmem") {
+			return PathBlockDevice, fmt.Errorf("%w: %s is a pmem block device in fsdax mode, which cannot be mapped directly; "+
+				"reconfigure the namespace as devdax (ndctl create-namespace --mode=devdax) "+
+				"or mount it with -o dax and pass a file on it with -file", ErrUnsupportedPath, path)
+		}
+		return PathBlockDevice, fmt.Errorf("%w: %s is a block device; %s", ErrUnsupportedPath, path, supportedPaths)
+	case mode.IsRegular():
+		if !allowFile {
+			return PathRegularFile, fmt.Errorf("%w: %s is a regular file; pass -file to use a file as the device",
+				ErrUnsupportedPath, path)
+		}
+		return PathRegularFile, nil
+	}
+	return PathUnsupported, fmt.Errorf("%w: %s is a %s; %s", ErrUnsupportedPath, path, fileType(mode), supportedPaths)
+}
+
+// fileType names the type of an unsupported file
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	}
+	return "file of unsupported type " + mode.Type().String()
+}
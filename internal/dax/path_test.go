@@ -0,0 +1,95 @@
+package dax_test
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"aethelfs/internal/dax"
+)
+
+// fakeInfo is a stat result for a path that need not exist
+type fakeInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (i fakeInfo) Name() string       { return i.name }
+func (i fakeInfo) Size() int64        { return 0 }
+func (i fakeInfo) Mode() os.FileMode  { return i.mode }
+func (i fakeInfo) ModTime() time.Time { return time.Time{} }
+func (i fakeInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i fakeInfo) Sys() interface{}   { return nil }
+
+func TestClassifyPath(t *testing.T) {
+	modes := map[string]os.FileMode{
+		"/dev/dax0.0":   os.ModeDevice | os.ModeCharDevice,
+		"/dev/pmem0":    os.ModeDevice,
+		"/dev/sda":      os.ModeDevice,
+		"/mnt/pmem/img": 0,
+		"/mnt/pmem":     os.ModeDir,
+		"/run/sock":     os.ModeSocket,
+		"/run/fifo":     os.ModeNamedPipe,
+	}
+	errs := map[string]error{
+		"/loop":    syscall.ELOOP,
+		"/missing": syscall.ENOENT,
+		"/secret":  syscall.EACCES,
+	}
+	defer dax.SetStat(func(path string) (os.FileInfo, error) {
+		if err, ok := errs[path]; ok {
+			return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+		}
+		mode, ok := modes[path]
+		if !ok {
+			t.Fatalf("stat of unexpected path %s", path)
+		}
+		return fakeInfo{name: path, mode: mode}, nil
+	})()
+
+	tests := []struct {
+		path        string
+		allowFile   bool
+		kind        dax.PathKind
+		unsupported bool   // The error wraps ErrUnsupportedPath
+		msg         string // Part of the error; empty for none
+	}{
+		{"/dev/dax0.0", false, dax.PathCharDevice, false, ""},
+		{"/dev/dax0.0", true, dax.PathCharDevice, false, ""},
+		{"/dev/pmem0", true, dax.PathBlockDevice, true, "devdax"},
+		{"/dev/sda", true, dax.PathBlockDevice, true, "is a block device"},
+		{"/mnt/pmem/img", true, dax.PathRegularFile, false, ""},
+		{"/mnt/pmem/img", false, dax.PathRegularFile, true, "pass -file"},
+		{"/mnt/pmem", true, dax.PathUnsupported, true, "is a directory"},
+		{"/run/sock", true, dax.PathUnsupported, true, "is a socket"},
+		{"/run/fifo", true, dax.PathUnsupported, true, "is a named pipe"},
+		{"/loop", true, dax.PathUnsupported, true, "symlink loop"},
+		{"/missing", true, dax.PathUnsupported, false, "not found"},
+		{"/secret", true, dax.PathUnsupported, false, "cannot stat"},
+	}
+	for _, tt := range tests {
+		kind, err := dax.ClassifyPath(tt.path, tt.allowFile)
+		if kind != tt.kind {
+			t.Errorf("%s (file %v): %v, want %v", tt.path, tt.allowFile, kind, tt.kind)
+		}
+		if tt.msg == "" {
+			if err != nil {
+				t.Errorf("%s (file %v): %v", tt.path, tt.allowFile, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s (file %v): %v, want an error mentioning %q", tt.path, tt.allowFile, err, tt.msg)
+		}
+		if errors.Is(err, dax.ErrUnsupportedPath) != tt.unsupported {
+			t.Errorf("%s (file %v): %v wraps ErrUnsupportedPath: %v", tt.path, tt.allowFile, err, !tt.unsupported)
+		}
+	}
+	// Only pmem devices get the fsdax hint
+	if _, err := dax.ClassifyPath("/dev/sda", true); strings.Contains(err.Error(), "fsdax") {
+		t.Errorf("plain block device given the fsdax hint: %v", err)
+	}
+}
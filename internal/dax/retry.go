@@ -0,0 +1,79 @@
+package dax
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/metrics"
+)
+
+// Transient flush errors are retried this many times in all, sleeping
+// flushRetryBackoff before the first retry and doubling it each time
+const (
+	flushAttempts     = 5
+	flushRetryBackoff = time.Millisecond
+)
+
+var flushRetries = metrics.NewCounterVec("aethelfs_flush_retries_total",
+	"Flush attempts retried after a transient error, by errno", "errno")
+
+// FlushError is a failed flush of [Offset, Offset+Length). Transient
+// errors were retried before being returned; Attempts counts the tries.
+type FlushError struct {
+	Op       string // "msync", or the injecting layer
+	Offset   int64
+	Length   int64
+	Attempts int
+	Err      error
+}
+
+func (e *FlushError) Error() string {
+	msg := fmt.Sprintf("%s failed for range %d-%d: %v", e.Op, e.Offset, e.Offset+e.Length, e.Err)
+	if e.Attempts > 1 {
+		msg += fmt.Sprintf(" (after %d attempts)", e.Attempts)
+	}
+	return msg
+}
+
+func (e *FlushError) Unwrap() error { return e.Err }
+
+// Transient reports whether the flush failed only for want of retries
+func (e *FlushError) Transient() bool {
+	return IsTransient(e.Err)
+}
+
+// IsTransient reports whether err is a flush failure that may succeed if
+// tried again: msync interrupted by a signal, or refused under memory
+// pressure. Anything else is permanent, e.g. a media error.
+func IsTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// retryFlush calls flush until it succeeds, fails permanently, or has
+// been tried flushAttempts times, backing off between transient failures.
+// Failures are returned as a *FlushError describing the range.
+func retryFlush(op string, offset, length int64, flush func() error) error {
+	backoff := flushRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := flush()
+		if err == nil {
+			return nil
+		}
+		if !IsTransient(err) || attempt == flushAttempts {
+			return &FlushError{Op: op, Offset: offset, Length: length, Attempts: attempt, Err: err}
+		}
+		flushRetries.With(errnoName(err)).Inc()
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// errnoName labels a transient error for the retry metric
+func errnoName(err error) string {
+	if errors.Is(err, syscall.EINTR) {
+		return "EINTR"
+	}
+	return "EAGAIN"
+}
@@ -0,0 +1,91 @@
+package dax_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/dax"
+	"aethelfs/internal/metrics"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EINTR, true},
+		{syscall.EAGAIN, true},
+		{fmt.Errorf("msync: %w", syscall.EAGAIN), true},
+		{&dax.FlushError{Op: "msync", Err: syscall.EINTR}, true},
+		{syscall.EIO, false},
+		{syscall.ENOSPC, false},
+		{errors.New("interrupted"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := dax.IsTransient(tt.err); got != tt.want {
+			t.Errorf("IsTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// flushRetries reads the retry counter for errno
+func flushRetries(errno string) int64 {
+	byErrno, _ := metrics.Default.Snapshot()["aethelfs_flush_retries_total"].(map[string]int64)
+	return byErrno[errno]
+}
+
+func TestTransientFaultRetried(t *testing.T) {
+	for _, errno := range []string{"EAGAIN", "EINTR"} {
+		t.Run(errno, func(t *testing.T) {
+			d := newFaultDevice()
+			if err := d.ParseFaults("errno=" + errno + ",flush=1,flush=2"); err != nil {
+				t.Fatal(err)
+			}
+			before := flushRetries(errno)
+			// The first two attempts fail, the third succeeds
+			if err := d.Flush(); err != nil {
+				t.Fatalf("flush with two transient faults: %v", err)
+			}
+			if n := d.Failures(); n != 2 {
+				t.Errorf("%d injected failures, want 2", n)
+			}
+			if n := flushRetries(errno) - before; n != 2 {
+				t.Errorf("%d retries counted, want 2", n)
+			}
+		})
+	}
+}
+
+func TestTransientFaultGivesUp(t *testing.T) {
+	for _, errno := range []string{"EAGAIN", "EINTR"} {
+		t.Run(errno, func(t *testing.T) {
+			d := newFaultDevice()
+			if err := d.ParseFaults("errno=" + errno + ",range=4096+4096"); err != nil {
+				t.Fatal(err)
+			}
+			err := d.FlushRange(4096, 4096)
+			var flushErr *dax.FlushError
+			if !errors.As(err, &flushErr) {
+				t.Fatalf("flush with a persistent transient fault: %v, want a FlushError", err)
+			}
+			if flushErr.Attempts != 5 || !flushErr.Transient() {
+				t.Errorf("gave up after %d attempts, transient %v; want 5 attempts, transient",
+					flushErr.Attempts, flushErr.Transient())
+			}
+			if n := d.Failures(); n != 5 {
+				t.Errorf("%d injected failures, want 5", n)
+			}
+		})
+	}
+
+	// Permanent failures are not retried
+	d := newFaultDevice()
+	d.FailRange(0, 4096, syscall.EIO)
+	var flushErr *dax.FlushError
+	if err := d.FlushRange(0, 4096); !errors.As(err, &flushErr) || flushErr.Attempts != 1 {
+		t.Errorf("flush with a permanent fault: %v, want one attempt", err)
+	}
+}
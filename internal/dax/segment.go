@@ -0,0 +1,141 @@
+package dax
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"aethelfs/internal/common"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSegmentSize is the segment size the daemon maps devices in
+const DefaultSegmentSize = 1 << 30
+
+// segmentAlign is the granularity of segment sizes and of the address the
+// segments are mapped at. Device DAX refuses mappings not aligned to its
+// own alignment, commonly 2MB.
+const segmentAlign = 2 * 1024 * 1024
+
+// Segment is one mapping of a segmented device, covering device bytes
+// [Offset, Offset+Length)
+type Segment struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// mapping is the device's memory: data is the whole device as one slice
+// whatever the segmenting, and whole what Close unmaps
+type mapping struct {
+	whole    []byte
+	data     []byte
+	segments []Segment
+}
+
+// mapDevice maps size bytes of fd. With segmentSize zero or at least the
+// size, the device is one mapping. Otherwise an inaccessible reservation
+// covering the device is made first and each segment is mapped over its
+// part of it with MAP_FIXED, so the segments sit back to back and a range
+// spanning several still reads as one slice.
+func mapDevice(fd int, size int64, prot int, segmentSize int64) (mapping, error) {
+	if segmentSize < 0 || segmentSize%segmentAlign != 0 {
+		return mapping{}, fmt.Errorf("segment size %d is not a multiple of %d", segmentSize, segmentAlign)
+	}
+	if segmentSize == 0 || segmentSize >= size {
+		data, err := unix.Mmap(fd, 0, int(size), prot, unix.MAP_SHARED)
+		if err != nil {
+			return mapping{}, err
+		}
+		return mapping{whole: data, data: data, segments: []Segment{{Offset: 0, Length: size}}}, nil
+	}
+
+	// Over-reserve by the alignment so the segments start aligned
+	whole, err := unix.Mmap(-1, 0, int(size+segmentAlign), unix.PROT_NONE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_NORESERVE)
+	if err != nil {
+		return mapping{}, fmt.Errorf("cannot reserve address space: %w", err)
+	}
+	pad := int64(-uintptr(unsafe.Pointer(&whole[0])) & (segmentAlign - 1))
+	m := mapping{whole: whole, data: whole[pad : pad+size : pad+size]}
+	for offset := int64(0); offset < size; offset += segmentSize {
+		length := segmentSize
+		if length > size-offset {
+			length = size - offset
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_MMAP, uintptr(unsafe.Pointer(&m.data[offset])), uintptr(length),
+			uintptr(prot), uintptr(unix.MAP_SHARED|unix.MAP_FIXED), uintptr(fd), uintptr(offset))
+		if errno != 0 {
+			unix.Munmap(whole)
+			return mapping{}, fmt.Errorf("cannot map segment at %d: %w", offset, errno)
+		}
+		m.segments = append(m.segments, Segment{Offset: offset, Length: length})
+	}
+	return m, nil
+}
+
+// Segments returns the device's segment table in offset order. A device
+// mapped whole has one segment.
+func (d *Device) Segments() []Segment {
+	return append([]Segment(nil), d.segments...)
+}
+
+// Protect implements Protector, changing the protection of each segment
+// the range covers. A read-only device cannot be made writable.
+func (d *Device) Protect(offset common.DeviceOffset, length common.ByteCount, writable bool) error {
+	if err := d.hold(); err != nil {
+		return err
+	}
+	defer d.mapMu.RUnlock()
+	pageSize := int64(os.Getpagesize())
+	if !common.InRange(offset, length, common.ByteCount(d.size)) || int64(offset)%pageSize != 0 || int64(length)%pageSize != 0 {
+		return fmt.Errorf("protect range not page aligned or out of bounds: offset=%d, length=%d, size=%d",
+			offset, length, d.size)
+	}
+	prot := unix.PROT_READ
+	if writable {
+		if d.readOnly {
+			return fmt.Errorf("device is mapped read-only")
+		}
+		prot |= unix.PROT_WRITE
+	}
+	return d.eachSegment(int64(offset), int64(offset)+int64(length), func(start, end int64) error {
+		if err := unix.Mprotect(d.mmapData[start:end], prot); err != nil {
+			return fmt.Errorf("mprotect failed for range %d-%d: %w", start, end, err)
+		}
+		return nil
+	})
+}
+
+// eachSegment calls fn for the parts of the page-aligned range [start,
+// end) in each segment, so system calls never span two mappings
+func (d *Device) eachSegment(start, end int64, fn func(start, end int64) error) error {
+	for _, s := range d.segments {
+		lo, hi := s.Offset, s.Offset+s.Length
+		if lo < start {
+			lo = start
+		}
+		if hi > end {
+			hi = end
+		}
+		if lo >= hi {
+			continue
+		}
+		if err := fn(lo, hi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pageAlign widens [offset, offset+length) to page boundaries within the
+// device
+func (d *Device) pageAlign(offset, length int64) (start, end int64) {
+	pageSize := int64(os.Getpagesize())
+	start = offset / pageSize * pageSize
+	end = (offset + length + pageSize - 1) / pageSize * pageSize
+	if end > d.size {
+		end = d.size
+	}
+	return start, end
+}
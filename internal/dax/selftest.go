@@ -0,0 +1,157 @@
+package dax
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// selfTestAlign is the alignment of the second mapping the self-test
+// reads back through. Device DAX refuses mappings that are not aligned to
+// its page size, which is 2MB by default.
+const selfTestAlign = 2 * 1024 * 1024
+
+// SelfTester is implemented by backends that can check, at mount, that
+// what is flushed actually reaches the device
+type SelfTester interface {
+	// SelfTest writes a pattern to the scratch range [offset,
+	// offset+length), which it overwrites, flushes it with the current
+	// strategy, and reads it back through a separate mapping
+	SelfTest(offset, length int64) SelfTestResult
+}
+
+// SelfTestResult is the outcome of a SelfTest run. Problems lists every
+// check that failed; the device is only trusted when it is empty.
+type SelfTestResult struct {
+	Passed   bool     `json:"passed"`
+	Strategy string   `json:"strategy"` // Flush method the pattern was flushed with
+	Backing  string   `json:"backing"`  // What the mapping is backed by
+	MapSync  bool     `json:"map_sync"` // Whether the device accepts MAP_SYNC mappings
+	Problems []string `json:"problems,omitempty"`
+	Duration int64    `json:"duration_ns"`
+}
+
+// SelfTest implements SelfTester. It catches flushes that fail, backing
+// stores that cannot be durable such as tmpfs, and a mapping that does
+// not show the bytes written through it. A pass cannot prove that data
+// survives power loss, only that nothing in the path is known to lose it.
+func (d *Device) SelfTest(offset, length int64) (r SelfTestResult) {
+	start := time.Now()
+	method := d.methodFor(length)
+	r = SelfTestResult{Strategy: method, Backing: d.backing()}
+	defer func() {
+		r.Passed = len(r.Problems) == 0
+		r.Duration = time.Since(start).Nanoseconds()
+	}()
+	fail := func(format string, args ...interface{}) {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if err := d.hold(); err != nil {
+		fail("%v", err)
+		return r
+	}
+	defer d.mapMu.RUnlock()
+	if offset < 0 || length <= 0 || offset > int64(len(d.mmapData))-length {
+		fail("scratch range out of bounds: offset=%d, length=%d, size=%d", offset, length, len(d.mmapData))
+		return r
+	}
+	if d.readOnly {
+		fail("device is mapped read-only")
+		return r
+	}
+	if r.Backing == "tmpfs" || r.Backing == "ramfs" {
+		fail("device file is on %s, which does not survive a reboot", r.Backing)
+	}
+
+	// A pattern that differs per mount, so a stale copy cannot pass
+	pattern := make([]byte, length)
+	seed := uint64(start.UnixNano()) | 1
+	for i := range pattern {
+		seed ^= seed << 13
+		seed ^= seed >> 7
+		seed ^= seed << 17
+		pattern[i] = byte(seed)
+	}
+	copy(d.mmapData[offset:offset+length], pattern)
+
+	if err := d.flushWith(method, offset, length); err != nil {
+		fail("%s flush failed: %v", method, err)
+	}
+	// Whatever the strategy, msync is what whole-device flushes and the
+	// fallback rely on, so it must work on this mapping too
+	if method != FlushMsync {
+		if err := d.flushWith(FlushMsync, offset, length); err != nil {
+			fail("msync failed: %v", err)
+		}
+	}
+
+	mapped, err := d.mapAgain(offset, length, &r.MapSync)
+	if err != nil {
+		fail("second mapping failed: %v", err)
+		return r
+	}
+	defer unix.Munmap(mapped.whole)
+	if !bytes.Equal(mapped.data, pattern) {
+		fail("pattern read back through a second mapping does not match")
+	}
+	return r
+}
+
+// remapping is a second read-only mapping of part of the device
+type remapping struct {
+	whole []byte // The aligned mapping, for Munmap
+	data  []byte // The requested range within it
+}
+
+// mapAgain maps [offset, offset+length) a second time, read-only. It asks
+// for MAP_SYNC first and records in mapSync whether the device took it.
+func (d *Device) mapAgain(offset, length int64, mapSync *bool) (remapping, error) {
+	align := int64(os.Getpagesize())
+	if d.charDev {
+		align = selfTestAlign
+	}
+	start := offset / align * align
+	end := (offset + length + align - 1) / align * align
+	if end > d.size {
+		end = d.size
+	}
+
+	fd := int(d.file.Fd())
+	whole, err := unix.Mmap(fd, start, int(end-start), unix.PROT_READ, unix.MAP_SHARED_VALIDATE|unix.MAP_SYNC)
+	*mapSync = err == nil
+	if err != nil {
+		whole, err = unix.Mmap(fd, start, int(end-start), unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			return remapping{}, err
+		}
+	}
+	return remapping{whole: whole, data: whole[offset-start : offset-start+length]}, nil
+}
+
+// backing names the filesystem a regular device file lives on, as far as
+// durability is concerned
+func (d *Device) backing() string {
+	if d.charDev {
+		return "device-dax"
+	}
+	// The node of a block device lives on devtmpfs; what backs it is the
+	// device itself
+	if info, err := d.file.Stat(); err == nil && info.Mode()&os.ModeDevice != 0 {
+		return "block-device"
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(int(d.file.Fd()), &st); err != nil {
+		return "unknown"
+	}
+	switch st.Type {
+	case unix.TMPFS_MAGIC:
+		return "tmpfs"
+	case unix.RAMFS_MAGIC:
+		return "ramfs"
+	}
+	return "file"
+}
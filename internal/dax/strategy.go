@@ -0,0 +1,216 @@
+package dax
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"aethelfs/internal/metrics"
+	"aethelfs/pkg/cache"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Flush strategies for FlushRange
+const (
+	FlushMsync = "msync" // msync every range
+	FlushCLWB  = "clwb"  // Flush the range's cache lines
+	FlushAuto  = "auto"  // Cache lines up to the calibrated threshold, msync above
+)
+
+// defaultCLWBMax is the auto threshold used until a calibration runs
+const defaultCLWBMax = 16 * 1024
+
+// calibrationRounds is how many times each size is timed; the fastest counts
+const calibrationRounds = 4
+
+// cacheLineSize is the granularity cache line flushing writes back
+const cacheLineSize = 64
+
+var (
+	rangeFlushes = metrics.NewCounterVec("aethelfs_range_flushes_total",
+		"Range flushes by the method that served them", "method")
+	rangeFlushBytes = metrics.NewCounterVec("aethelfs_range_flush_bytes_total",
+		"Bytes made durable by range flushes, by method", "method")
+	flushedBytes = metrics.NewCounterVec("aethelfs_flushed_bytes_total",
+		"Device bytes written back by all flushes, widened to the pages or cache lines each covers, by method", "method")
+)
+
+// coveredBytes returns how many bytes method writes back to make
+// [offset, offset+length) durable: whole pages for msync, whole cache
+// lines otherwise
+func coveredBytes(method string, offset, length int64) int64 {
+	unit := int64(cacheLineSize)
+	if method != FlushCLWB {
+		unit = int64(os.Getpagesize())
+	}
+	start := offset / unit * unit
+	end := (offset + length + unit - 1) / unit * unit
+	return end - start
+}
+
+// FlushedBytes returns the device bytes written back so far by each
+// flush method, including whole-device flushes, which count as msync
+func FlushedBytes() map[string]int64 {
+	return map[string]int64{
+		FlushMsync: flushedBytes.With(FlushMsync).Value(),
+		FlushCLWB:  flushedBytes.With(FlushCLWB).Value(),
+	}
+}
+
+// ErrNoCacheFlush is returned when cache line flushing cannot make the
+// device durable: the CPU lacks the instructions, or the device is a
+// regular file whose page cache only msync writes back
+var ErrNoCacheFlush = errors.New("cache line flushing is not available for this device")
+
+// FlushTuner is implemented by backends whose range flush method can be
+// chosen and calibrated
+type FlushTuner interface {
+	// SetFlushStrategy selects FlushMsync, FlushCLWB or FlushAuto
+	SetFlushStrategy(strategy string) error
+	// FlushStrategy returns the strategy and the auto threshold in bytes
+	FlushStrategy() (string, int64)
+	// Calibrate times both methods on the scratch range [offset,
+	// offset+length), which it overwrites, and sets the auto threshold
+	Calibrate(offset, length int64) (Calibration, error)
+}
+
+// CalibrationSample is the fastest time each method took to flush Size
+// freshly written bytes
+type CalibrationSample struct {
+	Size    int64 `json:"size"`
+	CLWBNs  int64 `json:"clwb_ns"`
+	MsyncNs int64 `json:"msync_ns"`
+}
+
+// Calibration is the outcome of a Calibrate run
+type Calibration struct {
+	CLWBMax int64               `json:"clwb_max"` // Largest range auto flushes by cache line
+	Samples []CalibrationSample `json:"samples"`
+}
+
+// canFlushLines reports whether cache line flushing makes this device
+// durable. Only a character DAX device maps the media directly.
+func (d *Device) canFlushLines() bool {
+	return d.charDev && cpu.X86.HasSSE2
+}
+
+// SetFlushStrategy selects how FlushRange makes ranges durable. Auto
+// falls back to msync alone where cache line flushing is unavailable.
+func (d *Device) SetFlushStrategy(strategy string) error {
+	switch strategy {
+	case FlushMsync:
+	case FlushCLWB, FlushAuto:
+		if !d.canFlushLines() {
+			if strategy == FlushAuto {
+				strategy = FlushMsync
+				break
+			}
+			return ErrNoCacheFlush
+		}
+	default:
+		return fmt.Errorf("unknown flush strategy %q", strategy)
+	}
+	d.strategy.Store(strategy)
+	if atomic.LoadInt64(&d.clwbMax) == 0 {
+		atomic.StoreInt64(&d.clwbMax, defaultCLWBMax)
+	}
+	return nil
+}
+
+// FlushStrategy returns the current strategy and the auto threshold
+func (d *Device) FlushStrategy() (string, int64) {
+	strategy, _ := d.strategy.Load().(string)
+	if strategy == "" {
+		strategy = FlushMsync
+	}
+	return strategy, atomic.LoadInt64(&d.clwbMax)
+}
+
+// methodFor picks the method that flushes a range of length bytes
+func (d *Device) methodFor(length int64) string {
+	strategy, clwbMax := d.FlushStrategy()
+	if strategy == FlushAuto {
+		if length <= clwbMax {
+			return FlushCLWB
+		}
+		return FlushMsync
+	}
+	return strategy
+}
+
+// flushWith makes the page-aligned or line-aligned range durable using
+// method. The range has been bounds checked.
+func (d *Device) flushWith(method string, offset, length int64) error {
+	if method == FlushCLWB {
+		cache.EnsureDataConsistency(unsafe.Pointer(&d.mmapData[offset]), int(length))
+	} else {
+		alignedOffset, alignedEnd := d.pageAlign(offset, length)
+		if err := d.msync(int(alignedOffset), int(alignedEnd)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calibrate measures the cost of both methods for range sizes from 4KB
+// up to length, quadrupling each step, and sets the auto threshold to the
+// largest size at which cache line flushing was no slower than msync.
+// The scratch range must not hold live data.
+func (d *Device) Calibrate(offset, length int64) (Calibration, error) {
+	if err := d.hold(); err != nil {
+		return Calibration{}, err
+	}
+	defer d.mapMu.RUnlock()
+	if offset < 0 || length <= 0 || offset > int64(len(d.mmapData))-length {
+		return Calibration{}, fmt.Errorf("calibration range out of bounds: offset=%d, length=%d, size=%d",
+			offset, length, len(d.mmapData))
+	}
+	if !d.canFlushLines() {
+		return Calibration{}, ErrNoCacheFlush
+	}
+
+	scratch := d.mmapData[offset : offset+length]
+	timeFlush := func(method string, size int64, round int) (int64, error) {
+		// Dirty every line so both methods have the same work to do
+		for i := int64(0); i < size; i += 64 {
+			scratch[i] = byte(round)
+		}
+		start := time.Now()
+		err := d.flushWith(method, offset, size)
+		return time.Since(start).Nanoseconds(), err
+	}
+
+	var c Calibration
+	crossed := false
+	for size := int64(4096); size <= length; size *= 4 {
+		s := CalibrationSample{Size: size}
+		for round := 0; round < calibrationRounds; round++ {
+			ns, err := timeFlush(FlushCLWB, size, round)
+			if err != nil {
+				return c, err
+			}
+			if s.CLWBNs == 0 || ns < s.CLWBNs {
+				s.CLWBNs = ns
+			}
+			if ns, err = timeFlush(FlushMsync, size, round); err != nil {
+				return c, err
+			}
+			if s.MsyncNs == 0 || ns < s.MsyncNs {
+				s.MsyncNs = ns
+			}
+		}
+		c.Samples = append(c.Samples, s)
+		// Past the first size where msync wins, larger ranges use msync
+		if !crossed && s.CLWBNs <= s.MsyncNs {
+			c.CLWBMax = size
+		} else {
+			crossed = true
+		}
+	}
+	atomic.StoreInt64(&d.clwbMax, c.CLWBMax)
+	return c, nil
+}
@@ -0,0 +1,92 @@
+package disk
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// FeatureSet holds on-device feature flags, split like ext4's:
+// compat features can be ignored by binaries that don't know them,
+// ro_compat ones only permit read-only mounts and incompat ones forbid
+// mounting at all.
+type FeatureSet struct {
+	Compat   uint64 `json:"compat"`
+	ROCompat uint64 `json:"ro_compat"`
+	Incompat uint64 `json:"incompat"`
+}
+
+// Incompat feature bits
+const (
+	// IncompatBlockSize marks a device formatted with a block size other
+	// than DefaultBlockSize. Binaries that predate the superblock field
+	// would misplace every extent on it.
+	IncompatBlockSize uint64 = 1 << 0
+	// IncompatBitmapAlloc marks a device whose allocation state is a
+	// block bitmap at BitmapOffset. Binaries without it would allocate
+	// over extents the bitmap records.
+	IncompatBitmapAlloc uint64 = 1 << 1
+)
+
+// Feature names by bit. New on-device features are added here together
+// with the code that understands them.
+var (
+	compatNames   = map[uint64]string{}
+	roCompatNames = map[uint64]string{}
+	incompatNames = map[uint64]string{
+		IncompatBlockSize:   "block_size",
+		IncompatBitmapAlloc: "bitmap_alloc",
+	}
+)
+
+// Supported is the set of features this binary understands
+var Supported = FeatureSet{
+	Compat:   knownBits(compatNames),
+	ROCompat: knownBits(roCompatNames),
+	Incompat: knownBits(incompatNames),
+}
+
+// knownBits ORs the bits of a name table together
+func knownBits(names map[uint64]string) uint64 {
+	var mask uint64
+	for bit := range names {
+		mask |= bit
+	}
+	return mask
+}
+
+// Names lists every feature in fs, unknown bits by number
+func (fs FeatureSet) Names() []string {
+	var names []string
+	names = appendNames(names, "compat", fs.Compat, compatNames)
+	names = appendNames(names, "ro_compat", fs.ROCompat, roCompatNames)
+	names = appendNames(names, "incompat", fs.Incompat, incompatNames)
+	return names
+}
+
+// CheckMountable returns an error naming the features in fs that prevent
+// this binary from mounting the device. Unknown compat features are
+// harmless; unknown ro_compat features would permit a read-only mount,
+// which is not supported yet, so they are refused too.
+func CheckMountable(fs FeatureSet) error {
+	var missing []string
+	missing = appendNames(missing, "ro_compat", fs.ROCompat&^Supported.ROCompat, roCompatNames)
+	missing = appendNames(missing, "incompat", fs.Incompat&^Supported.Incompat, incompatNames)
+	if len(missing) > 0 {
+		return fmt.Errorf("device uses features this version does not support: %v", missing)
+	}
+	return nil
+}
+
+// appendNames appends the name of every bit set in mask
+func appendNames(names []string, class string, mask uint64, table map[uint64]string) []string {
+	for mask != 0 {
+		bit := uint64(1) << bits.TrailingZeros64(mask)
+		mask &^= bit
+		if name, ok := table[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("%s_bit%d", class, bits.TrailingZeros64(bit)))
+		}
+	}
+	return names
+}
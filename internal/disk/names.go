@@ -0,0 +1,163 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Name and symlink target limits. Records store lengths in 16 bits, with
+// the top bit marking freed records.
+const (
+	MaxNameLen    = 255
+	MaxSymlinkLen = 4096
+)
+
+// Name heap record layout: a little-endian uint16 header holding the
+// string length, with nameFreed set once the record is released, followed
+// by the string bytes. Records are packed back to back from offset 0.
+const (
+	nameHeaderLen = 2
+	nameFreed     = 0x8000
+)
+
+// Name heap errors
+var (
+	ErrNameTooLong = errors.New("name too long")
+	ErrHeapFull    = errors.New("name heap full")
+)
+
+// NameRef locates a string in a NameHeap by the offset of its record.
+// Inode and dentry records store it instead of the string itself.
+type NameRef uint32
+
+// NameHeap stores variable-length names and symlink targets in a region
+// of the device. Strings are returned as slices of the region, so loading
+// a directory doesn't copy names until they are used. It is not safe for
+// concurrent use.
+type NameHeap struct {
+	data []byte // The heap's region of the device
+	used int    // Bytes occupied by records, live or freed
+	live int    // Bytes occupied by live records
+}
+
+// NewNameHeap returns an empty heap over data
+func NewNameHeap(data []byte) *NameHeap {
+	return &NameHeap{data: data}
+}
+
+// OpenNameHeap walks the first used bytes of data as records, validating
+// each, and returns the heap they form
+func OpenNameHeap(data []byte, used int) (*NameHeap, error) {
+	if used < 0 || used > len(data) {
+		return nil, fmt.Errorf("name heap: %d bytes used of %d", used, len(data))
+	}
+	h := &NameHeap{data: data, used: used}
+	for off := 0; off < used; {
+		n, freed, err := h.header(off)
+		if err != nil {
+			return nil, err
+		}
+		if !freed {
+			h.live += nameHeaderLen + n
+		}
+		off += nameHeaderLen + n
+	}
+	return h, nil
+}
+
+// header decodes the record at off
+func (h *NameHeap) header(off int) (length int, freed bool, err error) {
+	if off < 0 || off+nameHeaderLen > h.used {
+		return 0, false, fmt.Errorf("name heap: record at %d out of range", off)
+	}
+	v := binary.LittleEndian.Uint16(h.data[off:])
+	length = int(v &^ nameFreed)
+	if length > MaxSymlinkLen || off+nameHeaderLen+length > h.used {
+		return 0, false, fmt.Errorf("name heap: corrupt record at %d (length %d)", off, length)
+	}
+	return length, v&nameFreed != 0, nil
+}
+
+// Add appends s and returns its reference. Names are limited to
+// MaxNameLen bytes by their callers; the heap itself accepts up to
+// MaxSymlinkLen.
+func (h *NameHeap) Add(s []byte) (NameRef, error) {
+	if len(s) > MaxSymlinkLen {
+		return 0, ErrNameTooLong
+	}
+	size := nameHeaderLen + len(s)
+	if h.used+size > len(h.data) {
+		return 0, ErrHeapFull
+	}
+	off := h.used
+	binary.LittleEndian.PutUint16(h.data[off:], uint16(len(s)))
+	copy(h.data[off+nameHeaderLen:], s)
+	h.used += size
+	h.live += size
+	return NameRef(off), nil
+}
+
+// Get returns the string at ref. The slice aliases the heap; callers copy
+// it if they keep it past the next Compact.
+func (h *NameHeap) Get(ref NameRef) ([]byte, error) {
+	off := int(ref)
+	n, freed, err := h.header(off)
+	if err != nil {
+		return nil, err
+	}
+	if freed {
+		return nil, fmt.Errorf("name heap: record at %d is freed", off)
+	}
+	return h.data[off+nameHeaderLen : off+nameHeaderLen+n], nil
+}
+
+// Free releases the string at ref. Its space is reclaimed by Compact.
+func (h *NameHeap) Free(ref NameRef) error {
+	off := int(ref)
+	n, freed, err := h.header(off)
+	if err != nil {
+		return err
+	}
+	if freed {
+		return fmt.Errorf("name heap: record at %d freed twice", off)
+	}
+	binary.LittleEndian.PutUint16(h.data[off:], uint16(n)|nameFreed)
+	h.live -= nameHeaderLen + n
+	return nil
+}
+
+// Used returns the bytes occupied by records, including freed ones
+func (h *NameHeap) Used() int {
+	return h.used
+}
+
+// Reclaimable returns the bytes Compact would free
+func (h *NameHeap) Reclaimable() int {
+	return h.used - h.live
+}
+
+// Compact slides live records down over freed ones, as a defragmentation
+// pass does, and returns where each moved record now lives. Records that
+// didn't move are omitted. Callers must rewrite every stored NameRef
+// through the map before using it again.
+func (h *NameHeap) Compact() map[NameRef]NameRef {
+	moved := make(map[NameRef]NameRef)
+	dst := 0
+	for off := 0; off < h.used; {
+		// Records were validated when added or opened
+		v := binary.LittleEndian.Uint16(h.data[off:])
+		size := nameHeaderLen + int(v&^nameFreed)
+		if v&nameFreed == 0 {
+			if dst != off {
+				copy(h.data[dst:], h.data[off:off+size])
+				moved[NameRef(off)] = NameRef(dst)
+			}
+			dst += size
+		}
+		off += size
+	}
+	h.used = dst
+	h.live = dst
+	return moved
+}
@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// StampTableSize is the size of the write stamp table, which occupies the
+// end of the metadata reservation. A bitmap allocator's bitmap grows
+// toward it from BitmapOffset; a device whose bitmap reaches it keeps no
+// stamp table.
+const StampTableSize = 64 * 1024
+
+// StampTableOffset returns where the write stamp table starts in a
+// metadata reservation ending at reserved
+func StampTableOffset(reserved int64) int64 {
+	return reserved - StampTableSize
+}
+
+// Write stamp table layout, little-endian:
+//
+//	0   magic     [4]byte "AEWS"
+//	4   count     uint32, records that follow
+//	8   checksum  uint32, CRC32C of the count records
+//	12  reserved  uint32
+//	16  records   count entries of 32 bytes:
+//	16    extent  uint64, device offset of the file's extent
+//	24    epoch   uint64, write epoch of the stamp
+//	32    start   int64, first byte written in it
+//	40    end     int64, byte past the last
+const (
+	stampHeaderLen = 16
+	stampRecordLen = 32
+)
+
+// MaxWriteStamps is how many stamps the table holds
+const MaxWriteStamps = (StampTableSize - stampHeaderLen) / stampRecordLen
+
+var stampMagic = [4]byte{'A', 'E', 'W', 'S'}
+
+// WriteStamp records the bytes of a file written during one write epoch.
+// Files are identified by the device offset of their extent, which is
+// what the mount scan finds them by.
+type WriteStamp struct {
+	Extent uint64
+	Epoch  uint64
+	Start  int64
+	End    int64
+}
+
+// EncodeWriteStamps writes stamps into table, which must be
+// StampTableSize bytes
+func EncodeWriteStamps(table []byte, stamps []WriteStamp) error {
+	if len(table) != StampTableSize {
+		return fmt.Errorf("write stamp table of %d bytes, want %d", len(table), StampTableSize)
+	}
+	if len(stamps) > MaxWriteStamps {
+		return fmt.Errorf("%d write stamps do not fit a table of %d", len(stamps), MaxWriteStamps)
+	}
+	records := table[stampHeaderLen : stampHeaderLen+len(stamps)*stampRecordLen]
+	for i, s := range stamps {
+		r := records[i*stampRecordLen:]
+		binary.LittleEndian.PutUint64(r, s.Extent)
+		binary.LittleEndian.PutUint64(r[8:], s.Epoch)
+		binary.LittleEndian.PutUint64(r[16:], uint64(s.Start))
+		binary.LittleEndian.PutUint64(r[24:], uint64(s.End))
+	}
+	copy(table, stampMagic[:])
+	binary.LittleEndian.PutUint32(table[4:], uint32(len(stamps)))
+	binary.LittleEndian.PutUint32(table[8:], crc32.Checksum(records, castagnoli))
+	binary.LittleEndian.PutUint32(table[12:], 0)
+	return nil
+}
+
+// DecodeWriteStamps reads the stamps in table. A table never written,
+// with no magic, holds none.
+func DecodeWriteStamps(table []byte) ([]WriteStamp, error) {
+	if len(table) != StampTableSize {
+		return nil, fmt.Errorf("write stamp table of %d bytes, want %d", len(table), StampTableSize)
+	}
+	var magic [4]byte
+	copy(magic[:], table)
+	if magic != stampMagic {
+		return nil, nil
+	}
+	count := int(binary.LittleEndian.Uint32(table[4:]))
+	if count > MaxWriteStamps {
+		return nil, fmt.Errorf("write stamp table claims %d records, at most %d fit", count, MaxWriteStamps)
+	}
+	records := table[stampHeaderLen : stampHeaderLen+count*stampRecordLen]
+	if sum := binary.LittleEndian.Uint32(table[8:]); sum != crc32.Checksum(records, castagnoli) {
+		return nil, fmt.Errorf("write stamp table checksum mismatch")
+	}
+	stamps := make([]WriteStamp, count)
+	for i := range stamps {
+		r := records[i*stampRecordLen:]
+		stamps[i] = WriteStamp{
+			Extent: binary.LittleEndian.Uint64(r),
+			Epoch:  binary.LittleEndian.Uint64(r[8:]),
+			Start:  int64(binary.LittleEndian.Uint64(r[16:])),
+			End:    int64(binary.LittleEndian.Uint64(r[24:])),
+		}
+	}
+	return stamps, nil
+}
@@ -0,0 +1,77 @@
+package disk
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestWriteStampsRoundTrip(t *testing.T) {
+	stamps := []WriteStamp{
+		{Extent: 1 << 20, Epoch: 1, Start: 0, End: 8192},
+		{Extent: 1 << 20, Epoch: 2, Start: 100, End: 103},
+		{Extent: 3 << 20, Epoch: 7, Start: 1 << 40, End: 1<<40 + 1},
+	}
+	table := make([]byte, StampTableSize)
+	if err := EncodeWriteStamps(table, stamps); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeWriteStamps(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, stamps) {
+		t.Errorf("decoded %+v, want %+v", got, stamps)
+	}
+
+	// A shorter table written over a longer one leaves no trace of it
+	if err := EncodeWriteStamps(table, stamps[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := DecodeWriteStamps(table); !reflect.DeepEqual(got, stamps[:1]) {
+		t.Errorf("decoded %+v after rewrite, want %+v", got, stamps[:1])
+	}
+}
+
+func TestDecodeWriteStamps(t *testing.T) {
+	valid := func() []byte {
+		table := make([]byte, StampTableSize)
+		EncodeWriteStamps(table, []WriteStamp{{Extent: 4096, Epoch: 1, End: 10}})
+		return table
+	}
+	tests := []struct {
+		name    string
+		table   func() []byte
+		want    int
+		wantErr bool
+	}{
+		{"never written", func() []byte { return make([]byte, StampTableSize) }, 0, false},
+		{"valid", valid, 1, false},
+		{"short", func() []byte { return valid()[:StampTableSize-1] }, 0, true},
+		{"record corrupted", func() []byte { t := valid(); t[stampHeaderLen] ^= 1; return t }, 0, true},
+		{"count corrupted", func() []byte { t := valid(); binary.LittleEndian.PutUint32(t[4:], 2); return t }, 0, true},
+		{"count too large", func() []byte {
+			t := valid()
+			binary.LittleEndian.PutUint32(t[4:], MaxWriteStamps+1)
+			return t
+		}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeWriteStamps(tt.table())
+			if (err != nil) != tt.wantErr || len(got) != tt.want {
+				t.Errorf("got %d stamps, error %v; want %d, error %v", len(got), err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncodeWriteStampsFull(t *testing.T) {
+	table := make([]byte, StampTableSize)
+	if err := EncodeWriteStamps(table, make([]WriteStamp, MaxWriteStamps)); err != nil {
+		t.Errorf("a full table: %v", err)
+	}
+	if err := EncodeWriteStamps(table, make([]WriteStamp, MaxWriteStamps+1)); err == nil {
+		t.Error("one stamp more than fits was encoded")
+	}
+}
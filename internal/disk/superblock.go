@@ -0,0 +1,434 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"time"
+)
+
+// Superblock location and size within the metadata reservation
+const (
+	SuperblockOffset = 0
+	SuperblockSize   = 4096
+)
+
+// BitmapOffset is where the allocation bitmap of an IncompatBitmapAlloc
+// device starts, right after the superblock
+const BitmapOffset = SuperblockOffset + SuperblockSize
+
+// LayoutVersion is the on-device format version written by this binary
+const LayoutVersion = 1
+
+// Allocation block sizes. Every extent offset and length on the device is
+// a multiple of the block size chosen at format time.
+const (
+	DefaultBlockSize = 4096
+	MinBlockSize     = 256
+	MaxBlockSize     = 2 * 1024 * 1024
+)
+
+// DefaultInodeRatio is the device bytes per inode a device is formatted
+// with unless another ratio is chosen, as with mke2fs
+const DefaultInodeRatio = 16384
+
+// Magic identifies a formatted aethelfs device
+var Magic = [8]byte{'A', 'E', 'T', 'H', 'E', 'L', 'F', 'S'}
+
+// ErrNoSuperblock is returned by ReadSuperblock for an unformatted device
+var ErrNoSuperblock = errors.New("no aethelfs superblock")
+
+// ErrIncompatibleOption is returned when a mount asks for an option the
+// device's format cannot honor
+var ErrIncompatibleOption = errors.New("mount option incompatible with device format")
+
+// MaxLabelLen is the longest device label
+const MaxLabelLen = 32
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Superblock is the first block of the metadata reservation. Fields are
+// stored little-endian at fixed offsets:
+//
+//	0   magic            [8]byte
+//	8   layout version   uint32
+//	12  block size       uint32, 0 on devices formatted before it existed
+//	16  compat features  uint64
+//	24  ro_compat        uint64
+//	32  incompat         uint64
+//	40  format time      int64 (Unix nanoseconds)
+//	48  creator version  [32]byte, NUL padded
+//	80  label            [32]byte, NUL padded
+//	112 last mount       mount record, rewritten at every mount:
+//	112   time           int64 (Unix nanoseconds), 0 if never recorded
+//	120   count          uint32
+//	124   flags          uint32
+//	128   dir sync       [16]byte, NUL padded
+//	144   flush strategy [16]byte, NUL padded
+//	160   version        [32]byte, NUL padded
+//	192 error record     set when flush failures degraded the filesystem:
+//	192   time           int64 (Unix nanoseconds), 0 if none recorded
+//	200   failures       uint32, consecutive failures that triggered it
+//	204   reserved       uint32
+//	208   region         [16]byte, NUL padded
+//	224 write epoch      uint64, 0 until first advanced; see WriteEpoch
+//	232 inode limit      uint64, 0 on devices formatted before it existed
+//	240 learned sizes    MaxLearnedSizes entries of 16 bytes, unused ones zero:
+//	240   dir hash       uint64, FNV-1a of the top-level directory's path
+//	248   size           uint32, initial allocation learned for it
+//	252   samples        uint32, files the size was learned from
+//	496 ...              zero
+//	4092 checksum        uint32, CRC32C of bytes 0-4091
+type Superblock struct {
+	LayoutVersion  uint32
+	BlockSize      uint32
+	Features       FeatureSet
+	FormatTime     time.Time
+	CreatorVersion string
+	Label          string
+	LastMount      MountRecord
+	Errors         ErrorRecord
+
+	// WriteEpoch is the filesystem's current write epoch. Files record
+	// the epoch of their writes so incremental backups can ask what
+	// changed after the epoch of the last one.
+	WriteEpoch uint64
+
+	// InodeLimit is how many inodes may exist at once, fixed at format
+	// time from the inode ratio. Zero, on older devices, means no limit.
+	InodeLimit uint64
+
+	// LearnedSizes are the initial allocations learned from the sizes
+	// files reached, per top-level directory, at the last unmount
+	LearnedSizes []LearnedSize
+}
+
+// MaxLearnedSizes is how many learned initial sizes the superblock holds
+const MaxLearnedSizes = 16
+
+// LearnedSize is the initial allocation learned for the files of one
+// top-level directory, identified by HashDir of its path
+type LearnedSize struct {
+	DirHash uint64
+	Size    uint32
+	Samples uint32
+}
+
+// HashDir returns the hash a LearnedSize identifies a directory path by
+func HashDir(p string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(p))
+	return h.Sum64()
+}
+
+// MountRecord holds the effective options of the most recent mount, so a
+// device can be inspected without knowing how its daemon was started
+type MountRecord struct {
+	Time          time.Time `json:"time"`
+	Count         uint32    `json:"count"` // Mounts since the record was introduced
+	Flags         uint32    `json:"flags"`
+	DirSync       string    `json:"dir_sync"`
+	FlushStrategy string    `json:"flush_strategy"`
+	Version       string    `json:"version"` // Binary that mounted the device
+}
+
+// ErrorRecord marks a device whose flushes kept failing, so the problem
+// outlives the daemon that saw it. It is zero until an error is recorded
+// and cleared by an administrator once the device is dealt with.
+type ErrorRecord struct {
+	Time     time.Time `json:"time"`
+	Failures uint32    `json:"failures"`
+	Region   string    `json:"region"` // Region whose flushes failed
+}
+
+// IsZero reports whether no error is recorded
+func (r ErrorRecord) IsZero() bool {
+	return r.Time.IsZero()
+}
+
+// Mount record flags
+const (
+	MountQuotas          uint32 = 1 << 0 // Per-uid quotas were enforced
+	MountExclusiveWrite  uint32 = 1 << 1
+	MountWritebackCache  uint32 = 1 << 2
+	MountNoSuid          uint32 = 1 << 3
+	MountNoDeviceNodes   uint32 = 1 << 4
+	MountSpreadPlacement uint32 = 1 << 5
+)
+
+// Field offsets within the encoded superblock
+const (
+	offMagic    = 0
+	offLayout   = 8
+	offBlock    = 12
+	offCompat   = 16
+	offROCompat = 24
+	offIncompat = 32
+	offFormat   = 40
+	offCreator  = 48
+	creatorLen  = 32
+	offLabel    = 80
+	offMount    = 112
+	offMountCnt = 120
+	offMountFlg = 124
+	offDirSync  = 128
+	offFlushStr = 144
+	offMountVer = 160
+	modeLen     = 16
+	offErrTime  = 192
+	offErrCount = 200
+	offErrRgn   = 208
+	offEpoch    = 224
+	offInodes   = 232
+	offLearned  = 240
+	learnedLen  = 16
+	offChecksum = SuperblockSize - 4
+)
+
+// CheckLabel returns an error unless label fits the superblock and can
+// appear in a mount table's comma separated, whitespace delimited fields
+func CheckLabel(label string) error {
+	if len(label) > MaxLabelLen {
+		return fmt.Errorf("label %q is longer than %d bytes", label, MaxLabelLen)
+	}
+	for _, c := range label {
+		if c <= ' ' || c == ',' || c == '\\' || c >= 0x7f {
+			return fmt.Errorf("label %q may only contain printable ASCII without spaces, commas or backslashes", label)
+		}
+	}
+	return nil
+}
+
+// Bitmap returns the allocation bitmap of a device of the given block size
+// whose metadata reservation ends at reserved, one bit per block. It fails
+// when the device has more blocks than the reservation can map.
+func Bitmap(data []byte, blockSize, reserved int64) ([]byte, error) {
+	size := (int64(len(data))/blockSize + 7) / 8
+	if BitmapOffset+size > reserved {
+		return nil, fmt.Errorf("a bitmap of %d byte blocks cannot map a %d byte device: %d bytes do not fit the metadata reservation",
+			blockSize, len(data), size)
+	}
+	return data[BitmapOffset : BitmapOffset+size], nil
+}
+
+// CheckBitmap returns an error if a bitmap returned by Bitmap marks a
+// block of the metadata reservation, or one past the end of a device of
+// deviceSize bytes, allocated. Allocators never set those bits, so one
+// that is set means the bitmap was overwritten.
+func CheckBitmap(bitmap []byte, blockSize, reserved, deviceSize int64) error {
+	first, end := reserved/blockSize, deviceSize/blockSize
+	for n := int64(0); n < int64(len(bitmap))*8; n++ {
+		if n == first && end > first {
+			n = end
+		}
+		if n < int64(len(bitmap))*8 && bitmap[n/8]&(1<<uint(n%8)) != 0 {
+			return fmt.Errorf("block %d is marked allocated outside the data area %d-%d", n, first, end)
+		}
+	}
+	return nil
+}
+
+// CheckBlockSize returns an error unless size is a power of two between
+// MinBlockSize and MaxBlockSize
+func CheckBlockSize(size int64) error {
+	if size < MinBlockSize || size > MaxBlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("invalid block size %d: must be a power of two from %d to %d",
+			size, MinBlockSize, MaxBlockSize)
+	}
+	return nil
+}
+
+// NewSuperblock returns a superblock for a device being formatted now
+// with the given block size
+func NewSuperblock(creatorVersion string, blockSize uint32) *Superblock {
+	sb := &Superblock{
+		LayoutVersion:  LayoutVersion,
+		BlockSize:      blockSize,
+		FormatTime:     time.Now(),
+		CreatorVersion: creatorVersion,
+	}
+	if blockSize != DefaultBlockSize {
+		sb.Features.Incompat |= IncompatBlockSize
+	}
+	return sb
+}
+
+// ReadSuperblock decodes the superblock at the start of data
+func ReadSuperblock(data []byte) (*Superblock, error) {
+	if len(data) < SuperblockOffset+SuperblockSize {
+		return nil, fmt.Errorf("device too small for a superblock: %d bytes", len(data))
+	}
+	b := data[SuperblockOffset : SuperblockOffset+SuperblockSize]
+
+	var magic [8]byte
+	copy(magic[:], b[offMagic:])
+	if magic != Magic {
+		return nil, ErrNoSuperblock
+	}
+	if sum := binary.LittleEndian.Uint32(b[offChecksum:]); sum != crc32.Checksum(b[:offChecksum], castagnoli) {
+		return nil, fmt.Errorf("superblock checksum mismatch")
+	}
+
+	blockSize := binary.LittleEndian.Uint32(b[offBlock:])
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if err := CheckBlockSize(int64(blockSize)); err != nil {
+		return nil, fmt.Errorf("superblock: %w", err)
+	}
+	return decodeSuperblock(b, blockSize), nil
+}
+
+// ReadSuperblockLenient decodes the superblock for salvage, describing
+// each inconsistency instead of failing on it. A bad block size is
+// replaced by DefaultBlockSize. It only fails if there is no superblock.
+func ReadSuperblockLenient(data []byte) (*Superblock, []string, error) {
+	if len(data) < SuperblockOffset+SuperblockSize {
+		return nil, nil, fmt.Errorf("device too small for a superblock: %d bytes", len(data))
+	}
+	b := data[SuperblockOffset : SuperblockOffset+SuperblockSize]
+
+	var magic [8]byte
+	copy(magic[:], b[offMagic:])
+	if magic != Magic {
+		return nil, nil, ErrNoSuperblock
+	}
+	var problems []string
+	if sum := binary.LittleEndian.Uint32(b[offChecksum:]); sum != crc32.Checksum(b[:offChecksum], castagnoli) {
+		problems = append(problems, fmt.Sprintf("superblock checksum mismatch: stored %#x", sum))
+	}
+	blockSize := binary.LittleEndian.Uint32(b[offBlock:])
+	if blockSize == 0 {
+		blockSize = DefaultBlockSize
+	}
+	if err := CheckBlockSize(int64(blockSize)); err != nil {
+		problems = append(problems, fmt.Sprintf("superblock: %v; assuming %d byte blocks", err, DefaultBlockSize))
+		blockSize = DefaultBlockSize
+	}
+	return decodeSuperblock(b, blockSize), problems, nil
+}
+
+// decodeSuperblock decodes the fields of a superblock whose block size
+// has been validated
+func decodeSuperblock(b []byte, blockSize uint32) *Superblock {
+	return &Superblock{
+		LayoutVersion: binary.LittleEndian.Uint32(b[offLayout:]),
+		BlockSize:     blockSize,
+		Features: FeatureSet{
+			Compat:   binary.LittleEndian.Uint64(b[offCompat:]),
+			ROCompat: binary.LittleEndian.Uint64(b[offROCompat:]),
+			Incompat: binary.LittleEndian.Uint64(b[offIncompat:]),
+		},
+		FormatTime:     time.Unix(0, int64(binary.LittleEndian.Uint64(b[offFormat:]))),
+		CreatorVersion: cstring(b[offCreator : offCreator+creatorLen]),
+		Label:          cstring(b[offLabel : offLabel+MaxLabelLen]),
+		LastMount:      readMountRecord(b),
+		Errors:         readErrorRecord(b),
+		WriteEpoch:     binary.LittleEndian.Uint64(b[offEpoch:]),
+		InodeLimit:     binary.LittleEndian.Uint64(b[offInodes:]),
+		LearnedSizes:   readLearnedSizes(b),
+	}
+}
+
+// readLearnedSizes decodes the learned size table, skipping unused entries
+func readLearnedSizes(b []byte) []LearnedSize {
+	var sizes []LearnedSize
+	for i := 0; i < MaxLearnedSizes; i++ {
+		e := b[offLearned+i*learnedLen:]
+		ls := LearnedSize{
+			DirHash: binary.LittleEndian.Uint64(e),
+			Size:    binary.LittleEndian.Uint32(e[8:]),
+			Samples: binary.LittleEndian.Uint32(e[12:]),
+		}
+		if ls.Size != 0 {
+			sizes = append(sizes, ls)
+		}
+	}
+	return sizes
+}
+
+// readErrorRecord decodes the error record; it is zero on devices that
+// never recorded one, including those written before it existed
+func readErrorRecord(b []byte) ErrorRecord {
+	var rec ErrorRecord
+	if nanos := int64(binary.LittleEndian.Uint64(b[offErrTime:])); nanos != 0 {
+		rec.Time = time.Unix(0, nanos)
+	}
+	rec.Failures = binary.LittleEndian.Uint32(b[offErrCount:])
+	rec.Region = cstring(b[offErrRgn : offErrRgn+modeLen])
+	return rec
+}
+
+// readMountRecord decodes the mount record; it is zero on devices last
+// mounted by binaries that predate it
+func readMountRecord(b []byte) MountRecord {
+	var rec MountRecord
+	if nanos := int64(binary.LittleEndian.Uint64(b[offMount:])); nanos != 0 {
+		rec.Time = time.Unix(0, nanos)
+	}
+	rec.Count = binary.LittleEndian.Uint32(b[offMountCnt:])
+	rec.Flags = binary.LittleEndian.Uint32(b[offMountFlg:])
+	rec.DirSync = cstring(b[offDirSync : offDirSync+modeLen])
+	rec.FlushStrategy = cstring(b[offFlushStr : offFlushStr+modeLen])
+	rec.Version = cstring(b[offMountVer : offMountVer+creatorLen])
+	return rec
+}
+
+// cstring returns b up to its first NUL
+func cstring(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
+
+// WriteSuperblock encodes sb at the start of data. The caller is
+// responsible for flushing the range.
+func WriteSuperblock(data []byte, sb *Superblock) error {
+	if len(data) < SuperblockOffset+SuperblockSize {
+		return fmt.Errorf("device too small for a superblock: %d bytes", len(data))
+	}
+
+	var b [SuperblockSize]byte
+	copy(b[offMagic:], Magic[:])
+	binary.LittleEndian.PutUint32(b[offLayout:], sb.LayoutVersion)
+	binary.LittleEndian.PutUint32(b[offBlock:], sb.BlockSize)
+	binary.LittleEndian.PutUint64(b[offCompat:], sb.Features.Compat)
+	binary.LittleEndian.PutUint64(b[offROCompat:], sb.Features.ROCompat)
+	binary.LittleEndian.PutUint64(b[offIncompat:], sb.Features.Incompat)
+	binary.LittleEndian.PutUint64(b[offFormat:], uint64(sb.FormatTime.UnixNano()))
+	copy(b[offCreator:offCreator+creatorLen], sb.CreatorVersion)
+	copy(b[offLabel:offLabel+MaxLabelLen], sb.Label)
+	if rec := sb.LastMount; !rec.Time.IsZero() {
+		binary.LittleEndian.PutUint64(b[offMount:], uint64(rec.Time.UnixNano()))
+		binary.LittleEndian.PutUint32(b[offMountCnt:], rec.Count)
+		binary.LittleEndian.PutUint32(b[offMountFlg:], rec.Flags)
+		copy(b[offDirSync:offDirSync+modeLen], rec.DirSync)
+		copy(b[offFlushStr:offFlushStr+modeLen], rec.FlushStrategy)
+		copy(b[offMountVer:offMountVer+creatorLen], rec.Version)
+	}
+	if rec := sb.Errors; !rec.IsZero() {
+		binary.LittleEndian.PutUint64(b[offErrTime:], uint64(rec.Time.UnixNano()))
+		binary.LittleEndian.PutUint32(b[offErrCount:], rec.Failures)
+		copy(b[offErrRgn:offErrRgn+modeLen], rec.Region)
+	}
+	binary.LittleEndian.PutUint64(b[offEpoch:], sb.WriteEpoch)
+	binary.LittleEndian.PutUint64(b[offInodes:], sb.InodeLimit)
+	for i, ls := range sb.LearnedSizes {
+		if i == MaxLearnedSizes {
+			break
+		}
+		e := b[offLearned+i*learnedLen:]
+		binary.LittleEndian.PutUint64(e, ls.DirHash)
+		binary.LittleEndian.PutUint32(e[8:], ls.Size)
+		binary.LittleEndian.PutUint32(e[12:], ls.Samples)
+	}
+	binary.LittleEndian.PutUint32(b[offChecksum:], crc32.Checksum(b[:offChecksum], castagnoli))
+
+	copy(data[SuperblockOffset:], b[:])
+	return nil
+}
@@ -0,0 +1,97 @@
+package disk
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestCheckBlockSize(t *testing.T) {
+	for _, size := range []int64{MinBlockSize, 512, DefaultBlockSize, 64 << 10, MaxBlockSize} {
+		if err := CheckBlockSize(size); err != nil {
+			t.Errorf("block size %d: %v", size, err)
+		}
+	}
+	for _, size := range []int64{0, -4096, MinBlockSize / 2, 3000, 4097, MaxBlockSize * 2} {
+		if err := CheckBlockSize(size); err == nil {
+			t.Errorf("block size %d accepted", size)
+		}
+	}
+}
+
+func TestSuperblockBlockSize(t *testing.T) {
+	for _, size := range []uint32{512, DefaultBlockSize, MaxBlockSize} {
+		data := make([]byte, SuperblockOffset+SuperblockSize)
+		if err := WriteSuperblock(data, NewSuperblock("test", size)); err != nil {
+			t.Fatal(err)
+		}
+		sb, err := ReadSuperblock(data)
+		if err != nil {
+			t.Fatalf("block size %d: %v", size, err)
+		}
+		if sb.BlockSize != size {
+			t.Errorf("read back block size %d, want %d", sb.BlockSize, size)
+		}
+		// Binaries that predate the field must refuse other block sizes
+		if flagged := sb.Features.Incompat&IncompatBlockSize != 0; flagged != (size != DefaultBlockSize) {
+			t.Errorf("block size %d: block_size feature set: %v", size, flagged)
+		}
+	}
+}
+
+func TestSuperblockBlockSizeField(t *testing.T) {
+	encode := func(word uint32) []byte {
+		data := make([]byte, SuperblockOffset+SuperblockSize)
+		sb := NewSuperblock("test", DefaultBlockSize)
+		sb.BlockSize = word
+		if err := WriteSuperblock(data, sb); err != nil {
+			t.Fatal(err)
+		}
+		if got := binary.LittleEndian.Uint32(data[SuperblockOffset+offBlock:]); got != word {
+			t.Fatalf("block size word %d, want %d", got, word)
+		}
+		return data
+	}
+
+	// Devices formatted before the field existed have zero there
+	sb, err := ReadSuperblock(encode(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.BlockSize != DefaultBlockSize {
+		t.Errorf("zero block size read as %d, want %d", sb.BlockSize, DefaultBlockSize)
+	}
+
+	if _, err := ReadSuperblock(encode(3000)); err == nil {
+		t.Error("superblock with a 3000 byte block size accepted")
+	}
+	sb, problems, err := ReadSuperblockLenient(encode(3000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.BlockSize != DefaultBlockSize || len(problems) != 1 {
+		t.Errorf("lenient read: block size %d, problems %q", sb.BlockSize, problems)
+	}
+}
+
+func TestCheckBitmap(t *testing.T) {
+	const blockSize, reserved, deviceSize = 4096, 1 << 20, 4<<20 + 4096*3
+	data := make([]byte, deviceSize)
+	bitmap, err := Bitmap(data, blockSize, reserved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, end := int64(reserved/blockSize), int64(deviceSize/blockSize)
+	for _, n := range []int64{first, first + 1, end - 1} {
+		bitmap[n/8] |= 1 << uint(n%8)
+	}
+	if err := CheckBitmap(bitmap, blockSize, reserved, deviceSize); err != nil {
+		t.Fatalf("bits of the data area: %v", err)
+	}
+	for _, n := range []int64{0, first - 1, end, int64(len(bitmap))*8 - 1} {
+		bitmap[n/8] |= 1 << uint(n%8)
+		if err := CheckBitmap(bitmap, blockSize, reserved, deviceSize); err == nil {
+			t.Errorf("bit of block %d accepted", n)
+		}
+		bitmap[n/8] &^= 1 << uint(n%8)
+	}
+}
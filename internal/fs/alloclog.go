@@ -0,0 +1,89 @@
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"aethelfs/internal/common"
+)
+
+// Allocator operations recorded in the replay log
+const (
+	allocOpAlloc   = "alloc"
+	allocOpFree    = "free"
+	allocOpUnshare = "unshare" // An owner released a shared extent
+)
+
+// AllocRecord is one allocator decision
+type AllocRecord struct {
+	Seq    uint64              `json:"seq"`
+	Time   time.Time           `json:"time"`
+	Op     string              `json:"op"`
+	Inode  uint64              `json:"inode"`
+	Offset common.DeviceOffset `json:"offset"`
+	Size   common.ByteCount    `json:"size"`
+	Region string              `json:"region,omitempty"`
+}
+
+// allocLog is a fixed-size ring of the most recent allocator decisions,
+// kept so corruption reports can be traced back to the extents involved.
+// The mutex only covers a slot copy. A nil *allocLog records nothing.
+type allocLog struct {
+	mu      sync.Mutex
+	records []AllocRecord
+	seq     uint64 // Records ever written; the next slot is seq % len(records)
+}
+
+// newAllocLog returns a log holding size records, or nil if size <= 0
+func newAllocLog(size int) *allocLog {
+	if size <= 0 {
+		return nil
+	}
+	return &allocLog{records: make([]AllocRecord, size)}
+}
+
+// record appends an allocator decision, overwriting the oldest when full
+func (l *allocLog) record(op string, inode uint64, offset common.DeviceOffset, size common.ByteCount, region string) {
+	if l == nil {
+		return
+	}
+	rec := AllocRecord{
+		Time:   time.Now(),
+		Op:     op,
+		Inode:  inode,
+		Offset: offset,
+		Size:   size,
+		Region: region,
+	}
+
+	l.mu.Lock()
+	rec.Seq = l.seq
+	l.records[l.seq%uint64(len(l.records))] = rec
+	l.seq++
+	l.mu.Unlock()
+}
+
+// dump returns up to n of the most recent records, oldest first. n <= 0
+// returns everything retained.
+func (l *allocLog) dump(n int) []AllocRecord {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	count := uint64(len(l.records))
+	if l.seq < count {
+		count = l.seq
+	}
+	if n > 0 && uint64(n) < count {
+		count = uint64(n)
+	}
+
+	out := make([]AllocRecord, 0, count)
+	for seq := l.seq - count; seq < l.seq; seq++ {
+		out = append(out, l.records[seq%uint64(len(l.records))])
+	}
+	return out
+}
@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/metrics"
+)
+
+// Origins of device flushes
+const (
+	flushOriginData       = "data"       // fsync, barriers and relocation copies
+	flushOriginBackground = "background" // The background flusher
+	flushOriginMetadata   = "metadata"   // Metadata batch flushes of the whole device
+	flushOriginDevice     = "device"     // Whole-device flushes on close and release
+	flushOriginSuper      = "superblock" // Superblock writes at mount
+)
+
+var flushOrigins = []string{flushOriginData, flushOriginBackground, flushOriginMetadata, flushOriginDevice, flushOriginSuper}
+
+var (
+	flushOriginBytes = metrics.NewCounterVec("aethelfs_flush_origin_bytes_total",
+		"Device bytes the filesystem asked to flush, by what asked", "origin")
+	writeAmplification = metrics.NewGauge("aethelfs_write_amplification_permille",
+		"Device bytes written back per thousand bytes written by applications")
+)
+
+// FlushEfficiency compares the bytes applications wrote with the bytes
+// flushed to make them durable. Flushed bytes come from the device, which
+// widens each flush to the pages or cache lines it writes back; the origin
+// breakdown is the ranges the filesystem asked for, before widening.
+type FlushEfficiency struct {
+	WrittenBytes  int64            `json:"written_bytes"`
+	FlushedBytes  int64            `json:"flushed_bytes"`
+	ByMethod      map[string]int64 `json:"by_method"`
+	ByOrigin      map[string]int64 `json:"by_origin"`
+	Amplification float64          `json:"amplification"`
+}
+
+// FileEfficiency is the same comparison for one file. Its flushes are the
+// fsyncs and barriers of its extent; background and whole-device flushes
+// are not attributed to files.
+type FileEfficiency struct {
+	Path          string  `json:"path"`
+	Inode         uint64  `json:"inode"`
+	WrittenBytes  int64   `json:"written_bytes"`
+	FlushedBytes  int64   `json:"flushed_bytes"`
+	Amplification float64 `json:"amplification"`
+}
+
+// EfficiencyReport is the result of the report control command
+type EfficiencyReport struct {
+	FlushEfficiency
+	File    *FileEfficiency `json:"file,omitempty"`
+	Summary string          `json:"summary"`
+}
+
+// noteFlush counts a flush of length bytes requested by origin
+func noteFlush(origin string, length int64) {
+	flushOriginBytes.With(origin).Add(length)
+}
+
+// noteFileFlush counts a flush of the file's extent
+func (f *File) noteFileFlush(length int64) {
+	atomic.AddInt64(&f.flushedBytes, length)
+}
+
+// ratio returns flushed/written, or zero before anything is written
+func ratio(flushed, written int64) float64 {
+	if written == 0 {
+		return 0
+	}
+	return float64(flushed) / float64(written)
+}
+
+// flushEfficiency totals the flush accounting since the daemon started
+func (f *Filesystem) flushEfficiency() FlushEfficiency {
+	e := FlushEfficiency{
+		WrittenBytes: bytesWritten.Value(),
+		ByMethod:     dax.FlushedBytes(),
+		ByOrigin:     make(map[string]int64, len(flushOrigins)),
+	}
+	for _, n := range e.ByMethod {
+		e.FlushedBytes += n
+	}
+	for _, origin := range flushOrigins {
+		e.ByOrigin[origin] = flushOriginBytes.With(origin).Value()
+	}
+	e.Amplification = ratio(e.FlushedBytes, e.WrittenBytes)
+	return e
+}
+
+// Report summarizes write amplification for the mount, and for the file
+// at path if one is given
+func (f *Filesystem) Report(path string) (EfficiencyReport, error) {
+	r := EfficiencyReport{FlushEfficiency: f.flushEfficiency()}
+
+	origins := make([]string, 0, len(r.ByOrigin))
+	for origin := range r.ByOrigin {
+		origins = append(origins, origin)
+	}
+	sort.Slice(origins, func(i, j int) bool { return r.ByOrigin[origins[i]] > r.ByOrigin[origins[j]] })
+	r.Summary = fmt.Sprintf("%s written, %s flushed, amplification %.1fx",
+		formatBytes(r.WrittenBytes), formatBytes(r.FlushedBytes), r.Amplification)
+	var requested int64
+	for _, n := range r.ByOrigin {
+		requested += n
+	}
+	if requested > 0 {
+		top := origins[0]
+		r.Summary += fmt.Sprintf(", top contributor: %s (%.0f%% of requested flushes)",
+			top, 100*float64(r.ByOrigin[top])/float64(requested))
+	}
+
+	if path != "" {
+		node, err := f.lookupPath(path)
+		if err != nil {
+			return r, err
+		}
+		file, ok := node.(*File)
+		if !ok {
+			return r, fmt.Errorf("%s is not a regular file", path)
+		}
+		fe := &FileEfficiency{
+			Path:         path,
+			Inode:        file.inode,
+			WrittenBytes: atomic.LoadInt64(&file.heat.bytesWritten),
+			FlushedBytes: atomic.LoadInt64(&file.flushedBytes),
+		}
+		fe.Amplification = ratio(fe.FlushedBytes, fe.WrittenBytes)
+		r.File = fe
+		r.Summary += fmt.Sprintf("\n%s: %s written, %s flushed by fsync, amplification %.1fx",
+			path, formatBytes(fe.WrittenBytes), formatBytes(fe.FlushedBytes), fe.Amplification)
+	}
+	return r, nil
+}
+
+// ctlReport returns the write amplification report. path adds the
+// figures of one file.
+func (f *Filesystem) ctlReport(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	return f.Report(params.Path)
+}
+
+// formatBytes renders n with a binary unit, e.g. "4.2 GB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTP"[exp])
+}
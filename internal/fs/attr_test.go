@@ -0,0 +1,200 @@
+package fs_test
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"aethelfs/internal/fs/fstest"
+)
+
+// TestStatWhileWriting stats a file from several goroutines while another
+// appends to it. Run with -race: the sizes seen must never be torn, and a
+// handle's getattr must report at least every append already
+// acknowledged.
+func TestStatWhileWriting(t *testing.T) {
+	h := newHarness(t)
+	file, err := h.Create("/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const chunk, chunks = 512, 2000
+	var acked int64 // Size after the last acknowledged append
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		data := make([]byte, chunk)
+		for i := 0; i < chunks; i++ {
+			off := int64(i) * chunk
+			if _, err := h.WriteAt(file, off, data); err != nil {
+				t.Errorf("append at %d: %v", off, err)
+				return
+			}
+			atomic.StoreInt64(&acked, off+chunk)
+			if i%100 == 0 {
+				if err := h.Fsync(file); err != nil {
+					t.Errorf("fsync: %v", err)
+					return
+				}
+			}
+		}
+	}()
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(handle bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				before := atomic.LoadInt64(&acked)
+				var attr fuse.Attr
+				if handle {
+					resp := &fuse.GetattrResponse{}
+					req := &fuse.GetattrRequest{Header: h.Header, Flags: fuse.GetattrFh}
+					if err := file.Getattr(h.Context(), req, resp); err != nil {
+						t.Errorf("getattr: %v", err)
+						return
+					}
+					attr = resp.Attr
+				} else {
+					var err error
+					if attr, err = h.Stat(file); err != nil {
+						t.Errorf("stat: %v", err)
+						return
+					}
+				}
+				size := int64(attr.Size)
+				switch {
+				case size%chunk != 0 || size > chunks*chunk:
+					t.Errorf("size %d is no size the file has had", size)
+					return
+				case size < before:
+					t.Errorf("size %d after an append to %d was acknowledged", size, before)
+					return
+				}
+			}
+		}(i%2 == 0)
+	}
+	wg.Wait()
+
+	if attr, _ := h.Stat(file); attr.Size != chunks*chunk {
+		t.Errorf("final size %d, want %d", attr.Size, chunks*chunk)
+	}
+}
+
+// TestSetattrPermissions applies each setattr as a given caller to a file
+// and a directory owned by 1000:1000 and checks the error and the
+// attributes it leaves
+func TestSetattrPermissions(t *testing.T) {
+	const owner, group, stranger = 1000, 1000, 2000
+	past := fstest.Epoch.Add(-time.Hour)
+	tests := []struct {
+		name     string
+		uid, gid uint32 // The caller
+		req      fuse.SetattrRequest
+		errno    syscall.Errno
+		check    func(a fuse.Attr) bool // What a success leaves
+	}{
+		{"owner chmods", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}, 0,
+			func(a fuse.Attr) bool { return a.Mode.Perm() == 0600 }},
+		{"root chmods", 0, 0, fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0600}, 0,
+			func(a fuse.Attr) bool { return a.Mode.Perm() == 0600 }},
+		{"stranger chmods", stranger, stranger, fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0777}, syscall.EPERM, nil},
+		{"group member chmods", stranger, group, fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0777}, syscall.EPERM, nil},
+
+		{"root gives away", 0, 0, fuse.SetattrRequest{Valid: fuse.SetattrUid, Uid: stranger}, 0,
+			func(a fuse.Attr) bool { return a.Uid == stranger && a.Mode&os.ModeSetuid != 0 }},
+		{"owner gives away", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrUid, Uid: stranger}, syscall.EPERM, nil},
+		{"owner chowns to itself", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrUid, Uid: owner}, 0,
+			func(a fuse.Attr) bool { return a.Uid == owner && a.Mode&(os.ModeSetuid|os.ModeSetgid) == 0 }},
+		{"owner chgrps to its primary group", owner, 3000, fuse.SetattrRequest{Valid: fuse.SetattrGid, Gid: 3000}, 0,
+			func(a fuse.Attr) bool { return a.Gid == 3000 && a.Mode&(os.ModeSetuid|os.ModeSetgid) == 0 }},
+		{"owner chgrps to another group", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrGid, Gid: 3000}, syscall.EPERM, nil},
+		{"stranger chgrps to its group", stranger, 3000, fuse.SetattrRequest{Valid: fuse.SetattrGid, Gid: 3000}, syscall.EPERM, nil},
+
+		{"owner sets mtime", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: past}, 0,
+			func(a fuse.Attr) bool { return a.Mtime.Equal(past) }},
+		{"group writer sets mtime", stranger, group, fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: past}, syscall.EPERM, nil},
+		{"group writer touches", stranger, group, fuse.SetattrRequest{Valid: fuse.SetattrMtime | fuse.SetattrMtimeNow}, 0,
+			func(a fuse.Attr) bool { return a.Mtime.After(fstest.Epoch) }},
+		{"stranger touches", stranger, stranger, fuse.SetattrRequest{Valid: fuse.SetattrMtime | fuse.SetattrMtimeNow}, syscall.EACCES, nil},
+
+		// A request is refused whole: nothing it asks for is done
+		{"owner chmods and gives away", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrMode | fuse.SetattrUid, Mode: 0600, Uid: stranger}, syscall.EPERM, nil},
+		{"owner truncates and gives away", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrUid, Size: 4096, Uid: stranger}, syscall.EPERM, nil},
+		{"group writer truncates and sets mtime", stranger, group, fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrMtime, Size: 4096, Mtime: past}, syscall.EPERM, nil},
+		{"owner truncates and chmods", owner, group, fuse.SetattrRequest{Valid: fuse.SetattrSize | fuse.SetattrMode, Size: 4096, Mode: 0600}, 0,
+			func(a fuse.Attr) bool { return a.Size == 4096 && a.Mode.Perm() == 0600 }},
+	}
+	for _, kind := range []string{"file", "dir"} {
+		for _, tt := range tests {
+			// Directories refuse any size change with EISDIR
+			if kind == "dir" && tt.req.Valid.Size() {
+				continue
+			}
+			t.Run(kind+"/"+tt.name, func(t *testing.T) {
+				h := newHarness(t)
+				var node fusefs.Node
+				var err error
+				if kind == "file" {
+					node, err = h.Create("/node", 0664)
+				} else {
+					node, err = h.Mkdir("/node", 0775)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := h.Chown(node, owner, group); err != nil {
+					t.Fatal(err)
+				}
+				// Root's chown keeps the special bits, which others' clear
+				if err := h.Chmod(node, 0664|os.ModeSetuid|os.ModeSetgid); err != nil {
+					t.Fatal(err)
+				}
+				before, err := h.Stat(node)
+				if err != nil {
+					t.Fatal(err)
+				}
+				h.Advance(time.Second)
+
+				req := tt.req
+				attr, err := h.As(tt.uid, tt.gid).Setattr(node, &req)
+				if tt.errno != 0 {
+					if !fstest.IsErrno(err, tt.errno) {
+						t.Fatalf("setattr: %v, want %v", err, tt.errno)
+					}
+					if after, _ := h.Stat(node); after != before {
+						t.Errorf("refused setattr changed %+v to %+v", before, after)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("setattr: %v", err)
+				}
+				if !tt.check(attr) {
+					t.Errorf("setattr left %+v", attr)
+				}
+				// Every change is a status change, and the type is kept
+				if !attr.Ctime.After(before.Ctime) {
+					t.Errorf("ctime %v not after %v", attr.Ctime, before.Ctime)
+				}
+				if attr.Mode&os.ModeType != before.Mode&os.ModeType {
+					t.Errorf("mode type %v became %v", before.Mode.Type(), attr.Mode.Type())
+				}
+			})
+		}
+	}
+}
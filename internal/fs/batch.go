@@ -0,0 +1,168 @@
+package fs
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"aethelfs/internal/clock"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	metaBatchOps = metrics.NewHistogram("aethelfs_meta_batch_ops",
+		"Metadata mutations made durable by a single flush",
+		metrics.ExponentialBuckets(1, 2, 10))
+	metaBatchLatency = metrics.NewHistogram("aethelfs_meta_batch_latency_seconds",
+		"Time from the oldest mutation in a batch to the end of its flush",
+		metrics.ExponentialBuckets(0.0001, 2, 14))
+	metaFlushDuration = metrics.NewHistogram("aethelfs_meta_flush_duration_seconds",
+		"Time spent in the device flush for a metadata batch",
+		metrics.ExponentialBuckets(0.0001, 2, 14))
+	metaFlushes = metrics.NewCounterVec("aethelfs_meta_flushes_total",
+		"Metadata batch flushes by trigger", "reason")
+	metaFlushErrors = metrics.NewCounter("aethelfs_meta_flush_errors_total",
+		"Metadata batch flushes that failed")
+)
+
+// Reasons a metadata batch is flushed
+const (
+	flushReasonFull    = "full"
+	flushReasonTimer   = "timer"
+	flushReasonBarrier = "barrier"
+)
+
+// metaBatch coalesces metadata flushes so that bursts of namespace
+// mutations share a single device flush
+type metaBatch struct {
+	flushFn  func() error
+	maxOps   int
+	maxDelay time.Duration
+	clock    clock.Clock
+
+	flushMu sync.Mutex // Serializes flushes so a barrier waits for one in progress
+
+	mu      sync.Mutex // Protects the fields below
+	pending int
+	oldest  time.Time
+	timer   clock.Timer
+	closed  bool
+	seq     uint64 // Mutations recorded so far
+	durable uint64 // Every mutation up to this sequence number is durable
+}
+
+// newMetaBatch creates a batch that calls flushFn to make mutations
+// durable, timing batches by clk
+func newMetaBatch(flushFn func() error, maxOps int, maxDelay time.Duration, clk clock.Clock) *metaBatch {
+	return &metaBatch{
+		flushFn:  flushFn,
+		maxOps:   maxOps,
+		maxDelay: maxDelay,
+		clock:    clk,
+	}
+}
+
+// add records a metadata mutation, flushing if the batch is full, and
+// returns its sequence number
+func (b *metaBatch) add() uint64 {
+	b.mu.Lock()
+	b.seq++
+	seq := b.seq
+	b.pending++
+	if b.pending == 1 {
+		b.oldest = b.clock.Now()
+	}
+	if b.closed {
+		b.mu.Unlock()
+		b.flush(flushReasonBarrier)
+		return seq
+	}
+
+	// Arm the max-delay timer for the first mutation of a batch
+	if b.timer == nil && b.maxDelay > 0 && b.maxOps > 1 {
+		b.timer = b.clock.AfterFunc(b.maxDelay, func() {
+			b.flush(flushReasonTimer)
+		})
+	}
+	full := b.pending >= b.maxOps
+	b.mu.Unlock()
+
+	if full {
+		b.flush(flushReasonFull)
+	}
+	return seq
+}
+
+// isDurable reports whether the mutation with sequence number seq has
+// been flushed
+func (b *metaBatch) isDurable(seq uint64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return seq <= b.durable
+}
+
+// sync is a hard barrier: every mutation recorded before the call is
+// durable when it returns without error
+func (b *metaBatch) sync() error {
+	return b.flush(flushReasonBarrier)
+}
+
+// flush makes all pending mutations durable
+func (b *metaBatch) flush(reason string) error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	n := b.pending
+	oldest := b.oldest
+	upto := b.seq
+	b.pending = 0
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.mu.Unlock()
+
+	if n == 0 {
+		// A flush that completed before we took flushMu already covered everything
+		return nil
+	}
+
+	start := time.Now()
+	err := b.flushFn()
+	end := time.Now()
+
+	metaFlushes.With(reason).Inc()
+	metaBatchOps.Observe(float64(n))
+	metaFlushDuration.Observe(end.Sub(start).Seconds())
+	metaBatchLatency.Observe(end.Sub(oldest).Seconds())
+
+	if err != nil {
+		metaFlushErrors.Inc()
+		log.Printf("Warning: metadata batch flush failed (%d ops): %v", n, err)
+
+		// Keep the mutations pending so the next barrier retries and reports it
+		b.mu.Lock()
+		if b.pending == 0 {
+			b.oldest = oldest
+		}
+		b.pending += n
+		b.mu.Unlock()
+		return err
+	}
+
+	b.mu.Lock()
+	if upto > b.durable {
+		b.durable = upto
+	}
+	b.mu.Unlock()
+	return nil
+}
+
+// close flushes anything pending and makes later mutations flush immediately
+func (b *metaBatch) close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	return b.flush(flushReasonBarrier)
+}
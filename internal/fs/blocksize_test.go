@@ -0,0 +1,141 @@
+package fs_test
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// blockOptions are the test options for formatting with blockSize byte
+// blocks, with inodes enough for tens of thousands of files
+func blockOptions(blockSize int64) fs.Options {
+	opts := testOptions()
+	opts.BlockSize = blockSize
+	opts.InodeRatio = 4096
+	if blockSize > opts.InodeRatio {
+		opts.InodeRatio = blockSize
+	}
+	return opts
+}
+
+// tinyFiles writes up to n synced files of 100 bytes, stopping early
+// when the device is full, and returns how many fit and the space they
+// took
+func tinyFiles(t *testing.T, h *fstest.Harness, n int) (int, int64) {
+	t.Helper()
+	free := freeBytes(t, h)
+	data := make([]byte, 100)
+	for i := 0; i < n; i++ {
+		file, err := h.WriteFile(fmt.Sprintf("/tiny%d", i), data, 0644)
+		if err == nil {
+			err = h.Fsync(file)
+		}
+		if fstest.IsErrno(err, syscall.ENOSPC) {
+			return i, free - freeBytes(t, h)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return n, free - freeBytes(t, h)
+}
+
+func TestSmallBlocksForTinyFiles(t *testing.T) {
+	n := 10000
+	if testing.Short() {
+		n = 1000
+	}
+
+	small := newHarnessWith(t, 0, blockOptions(512))
+	if st, err := small.Statfs(); err != nil || st.Bsize != 512 {
+		t.Fatalf("statfs block size %d, %v; want 512", st.Bsize, err)
+	}
+	files, used := tinyFiles(t, small, n)
+	if files != n {
+		t.Fatalf("only %d of %d tiny files fit with 512 byte blocks", files, n)
+	}
+	// Each file takes a single block
+	if want := int64(n) * 512; used != want {
+		t.Errorf("%d tiny files took %d bytes with 512 byte blocks, want %d", n, used, want)
+	}
+
+	def := newHarnessWith(t, 0, blockOptions(0))
+	if st, err := def.Statfs(); err != nil || st.Bsize != disk.DefaultBlockSize {
+		t.Fatalf("statfs block size %d, %v; want %d", st.Bsize, err, disk.DefaultBlockSize)
+	}
+	files, used = tinyFiles(t, def, n)
+	// Each file takes the initial allocation, so the device may fill first
+	if files == 0 || used/int64(files) < common.DefaultInitialFileSize {
+		t.Errorf("%d tiny files took %d bytes with the default block size, want at least %d each",
+			files, used, common.DefaultInitialFileSize)
+	}
+}
+
+func TestBlockSizeKeptOnRemount(t *testing.T) {
+	tests := []struct {
+		format, other int64
+		want          uint32
+	}{
+		{512, disk.DefaultBlockSize, 512},
+		{0, 512, disk.DefaultBlockSize},
+		{64 << 10, 512, 64 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d", tt.want), func(t *testing.T) {
+			h, err := fstest.New(0, blockOptions(tt.format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tinyFiles(t, h, 10)
+			if err := h.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The device keeps the block size it was formatted with, and
+			// refuses a mount asking for another
+			other := testOptions()
+			other.BlockSize = tt.other
+			if _, err := fstest.Mount(h.Device, other); !errors.Is(err, disk.ErrIncompatibleOption) {
+				t.Fatalf("remount with %d byte blocks: %v, want ErrIncompatibleOption", tt.other, err)
+			}
+			h2, err := fstest.Mount(h.Device, testOptions())
+			if err != nil {
+				t.Fatalf("remount: %v", err)
+			}
+			defer h2.Close()
+			st, err := h2.Statfs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Bsize != tt.want {
+				t.Errorf("statfs block size %d after remount, want %d", st.Bsize, tt.want)
+			}
+			file, err := h2.WriteFile("/after", make([]byte, 100), 0644)
+			if err == nil {
+				err = h2.Fsync(file)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range file.Layout().Extents {
+				if int64(e.Offset)%int64(tt.want) != 0 {
+					t.Errorf("extent at %d not aligned to the %d byte blocks", e.Offset, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBlockSizeRejected(t *testing.T) {
+	for _, size := range []int64{100, 3000, 4 << 20} {
+		if _, err := fstest.New(0, blockOptions(size)); err == nil {
+			t.Errorf("formatted with a %d byte block size", size)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package fs
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+
+	"aethelfs/internal/disk"
+
+	"bazil.org/fuse/fs"
+)
+
+// Behavior is a flag or semantic of an operation that applications may
+// rely on, and whether this build honors it. Handlers register theirs
+// beside their code with registerBehavior, so the features report changes
+// with them rather than with a hand-kept list.
+type Behavior struct {
+	Name      string `json:"name"`
+	Supported bool   `json:"supported"`
+	Errno     string `json:"errno,omitempty"` // What a caller sees when it is refused
+	Note      string `json:"note,omitempty"`
+}
+
+// behaviors holds every registered Behavior, in registration order
+var behaviors []Behavior
+
+// registerBehavior adds b to the features report. It returns b so it can
+// be called from a package-level declaration.
+func registerBehavior(b Behavior) Behavior {
+	behaviors = append(behaviors, b)
+	return b
+}
+
+// operations maps each FUSE operation to the interface a node implements
+// to handle it. The kernel fails an operation no node implements.
+var operations = []struct {
+	name  string
+	iface reflect.Type
+}{
+	{"lookup", reflect.TypeOf((*fs.NodeStringLookuper)(nil)).Elem()},
+	{"getattr", reflect.TypeOf((*fs.Node)(nil)).Elem()}, // Attr answers it without a Getattr
+	{"setattr", reflect.TypeOf((*fs.NodeSetattrer)(nil)).Elem()},
+	{"access", reflect.TypeOf((*fs.NodeAccesser)(nil)).Elem()},
+	{"open", reflect.TypeOf((*fs.NodeOpener)(nil)).Elem()},
+	{"create", reflect.TypeOf((*fs.NodeCreater)(nil)).Elem()},
+	{"mkdir", reflect.TypeOf((*fs.NodeMkdirer)(nil)).Elem()},
+	{"mknod", reflect.TypeOf((*fs.NodeMknoder)(nil)).Elem()},
+	{"symlink", reflect.TypeOf((*fs.NodeSymlinker)(nil)).Elem()},
+	{"readlink", reflect.TypeOf((*fs.NodeReadlinker)(nil)).Elem()},
+	{"link", reflect.TypeOf((*fs.NodeLinker)(nil)).Elem()},
+	{"unlink", reflect.TypeOf((*fs.NodeRemover)(nil)).Elem()},
+	{"rename", reflect.TypeOf((*fs.NodeRenamer)(nil)).Elem()},
+	{"read", reflect.TypeOf((*fs.HandleReader)(nil)).Elem()},
+	{"write", reflect.TypeOf((*fs.HandleWriter)(nil)).Elem()},
+	{"readdir", reflect.TypeOf((*fs.HandleReadDirAller)(nil)).Elem()},
+	{"flush", reflect.TypeOf((*fs.HandleFlusher)(nil)).Elem()},
+	{"fsync", reflect.TypeOf((*fs.NodeFsyncer)(nil)).Elem()},
+	{"release", reflect.TypeOf((*fs.HandleReleaser)(nil)).Elem()},
+	{"getxattr", reflect.TypeOf((*fs.NodeGetxattrer)(nil)).Elem()},
+	{"setxattr", reflect.TypeOf((*fs.NodeSetxattrer)(nil)).Elem()},
+	{"listxattr", reflect.TypeOf((*fs.NodeListxattrer)(nil)).Elem()},
+	{"removexattr", reflect.TypeOf((*fs.NodeRemovexattrer)(nil)).Elem()},
+}
+
+// Operation reports whether files and directories handle a FUSE operation
+type Operation struct {
+	Name string `json:"name"`
+	File bool   `json:"file"`
+	Dir  bool   `json:"dir"`
+}
+
+// Limits are the sizes a caller runs into
+type Limits struct {
+	MaxNameLen  int    `json:"max_name_len"`
+	MaxFileSize int64  `json:"max_file_size"`
+	BlockSize   uint32 `json:"block_size"`
+	InodeLimit  uint64 `json:"inode_limit"`
+}
+
+// FeatureReport is the mount's capability matrix: which operations are
+// handled, which flags and semantics are honored, and the limits
+type FeatureReport struct {
+	Operations []Operation     `json:"operations"`
+	Behaviors  []Behavior      `json:"behaviors"`
+	Limits     Limits          `json:"limits"`
+	Build      map[string]bool `json:"build_features"`
+}
+
+// FeatureReport describes what applications can expect of this mount.
+// Operations are read off the handler types themselves.
+func (f *Filesystem) FeatureReport() FeatureReport {
+	file := reflect.TypeOf((*File)(nil))
+	dir := reflect.TypeOf((*Dir)(nil))
+	r := FeatureReport{
+		Behaviors: append([]Behavior(nil), behaviors...),
+		Limits: Limits{
+			MaxNameLen:  disk.MaxNameLen,
+			MaxFileSize: f.opts.MaxFileSize,
+			BlockSize:   f.super.BlockSize,
+		},
+		Build: Features(),
+	}
+	sort.Slice(r.Behaviors, func(i, j int) bool { return r.Behaviors[i].Name < r.Behaviors[j].Name })
+	r.Limits.InodeLimit, _ = f.inodeCapacity()
+	for _, op := range operations {
+		r.Operations = append(r.Operations, Operation{
+			Name: op.name,
+			File: file.Implements(op.iface),
+			Dir:  dir.Implements(op.iface),
+		})
+	}
+	return r
+}
+
+// featuresReport returns the capability matrix as JSON
+func (f *Filesystem) featuresReport() ([]byte, error) {
+	return marshalReport(f.FeatureReport())
+}
+
+// ctlFeatures reports the capability matrix, as .aethelfs/features does
+func (f *Filesystem) ctlFeatures(args json.RawMessage) (interface{}, error) {
+	return f.FeatureReport(), nil
+}
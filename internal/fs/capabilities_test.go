@@ -0,0 +1,311 @@
+package fs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+// refusals maps the errno names behaviors report to the errno
+var refusals = map[string]syscall.Errno{
+	"EBUSY":      syscall.EBUSY,
+	"EEXIST":     syscall.EEXIST,
+	"EINVAL":     syscall.EINVAL,
+	"ENOSYS":     syscall.ENOSYS,
+	"EOPNOTSUPP": syscall.EOPNOTSUPP,
+	"EPERM":      syscall.EPERM,
+}
+
+// behaviorProbes exercise each registered behavior on a fresh mount and
+// return what a caller would see: nil if it is honored, the refusal
+// errno if it is refused, or another error if the probe found the
+// behavior broken
+var behaviorProbes = map[string]func(t *testing.T, h *fstest.Harness) error{
+	"open.O_EXCL": func(t *testing.T, h *fstest.Harness) error {
+		if _, err := h.Create("/file", 0644); err != nil {
+			t.Fatal(err)
+		}
+		root, err := h.Dir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &fuse.CreateRequest{Name: "file", Mode: 0644, Flags: fuse.OpenReadWrite | fuse.OpenCreate | fuse.OpenExclusive}
+		_, _, err = root.Create(h.Context(), req, &fuse.CreateResponse{})
+		return err
+	},
+	"open.O_APPEND": func(t *testing.T, h *fstest.Harness) error {
+		file, err := h.WriteFile("/file", []byte("abc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attr, err := h.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.WriteAt(file, int64(attr.Size), []byte("def")); err != nil {
+			return err
+		}
+		if got, err := h.ReadFile("/file"); err != nil || string(got) != "abcdef" {
+			return fmt.Errorf("append at the reported size left %q, %v", got, err)
+		}
+		return nil
+	},
+	"open.O_TRUNC": func(t *testing.T, h *fstest.Harness) error {
+		file, err := h.WriteFile("/file", []byte("abc"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Truncate(file, 0); err != nil {
+			return err
+		}
+		if got, err := h.ReadFile("/file"); err != nil || len(got) != 0 {
+			return fmt.Errorf("truncated file holds %q, %v", got, err)
+		}
+		return nil
+	},
+	"open.exclusive-write": func(t *testing.T, h *fstest.Harness) error {
+		file, err := h.Create("/file", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Setxattr(file, "user.aethelfs.exclusive-write", []byte("1")); err != nil {
+			t.Fatal(err)
+		}
+		// The create left the file open for writing
+		_, err = file.Open(h.Context(), &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+		return err
+	},
+	"mknod": func(t *testing.T, h *fstest.Harness) error {
+		root, err := h.Dir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = root.Mknod(h.Context(), &fuse.MknodRequest{Name: "fifo", Mode: os.ModeNamedPipe | 0644})
+		return err
+	},
+	"rename.replace-durable": func(t *testing.T, h *fstest.Harness) error {
+		data := bytes.Repeat([]byte("data"), 1024)
+		src, err := h.Create("/src", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.WriteAt(src, 0, data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := h.Create("/dst", 0644); err != nil {
+			t.Fatal(err)
+		}
+		root, err := h.Dir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := root.Rename(h.Context(), &fuse.RenameRequest{OldName: "src", NewName: "dst"}, root); err != nil {
+			return err
+		}
+		extents := src.Layout().Extents
+		if len(extents) == 0 {
+			return errors.New("renamed file has no extent")
+		}
+		if got := h.Crash.Crash().At(extents[0].Offset, common.ByteCount(len(data))); !bytes.Equal(got, data) {
+			return errors.New("renamed file's data not durable")
+		}
+		return nil
+	},
+	"rename.RENAME_NOREPLACE": renameFlags,
+	"rename.RENAME_EXCHANGE":  renameFlags,
+	"fallocate": func(t *testing.T, h *fstest.Harness) error {
+		file, err := h.Create("/file", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Setxattr(file, "user.aethelfs.reserve", []byte("65536")); err != nil {
+			return fmt.Errorf("reserve, the fallocate replacement: %v", err)
+		}
+		if _, ok := reflect.TypeOf(file).MethodByName("Fallocate"); ok {
+			return nil
+		}
+		return syscall.EOPNOTSUPP
+	},
+	"xattr.user": func(t *testing.T, h *fstest.Harness) error {
+		file, err := h.Create("/file", 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h.Setxattr(file, "user.comment", []byte("hello"))
+	},
+}
+
+// renameFlags probes the rename flags, which the kernel refuses with
+// EINVAL when the FUSE request has no field to carry them
+func renameFlags(t *testing.T, h *fstest.Harness) error {
+	if _, ok := reflect.TypeOf(fuse.RenameRequest{}).FieldByName("Flags"); ok {
+		return nil
+	}
+	return syscall.EINVAL
+}
+
+func TestFeatureBehaviorsMatchProbes(t *testing.T) {
+	h := newHarness(t)
+	for _, b := range h.FS.FeatureReport().Behaviors {
+		t.Run(b.Name, func(t *testing.T) {
+			probe, ok := behaviorProbes[b.Name]
+			if !ok {
+				t.Fatalf("behavior %q is registered without a probe", b.Name)
+			}
+			err := probe(t, newCrashHarness(t, crashOptions(alloc.KindFreeList)))
+			switch {
+			case b.Errno == "" && err != nil:
+				t.Errorf("probe: %v, want the behavior honored", err)
+			case b.Errno != "" && !fstest.IsErrno(err, refusals[b.Errno]):
+				t.Errorf("probe: %v, want %s", err, b.Errno)
+			}
+			if !b.Supported && err == nil {
+				t.Error("reported unsupported, yet the probe found it honored")
+			}
+		})
+	}
+}
+
+func TestFeatureOperations(t *testing.T) {
+	h := newHarness(t)
+	root, err := h.Dir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := h.Create("/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := make(map[string]fs.Operation)
+	for _, op := range h.FS.FeatureReport().Operations {
+		ops[op.Name] = op
+	}
+
+	// Each operation is probed, in order, on the nodes the report says
+	// handle it
+	probes := []struct {
+		name      string
+		file, dir func() error
+	}{
+		{name: "lookup", dir: func() error { _, err := h.Lookup("/file"); return err }},
+		{
+			name: "getattr",
+			file: func() error { _, err := h.Stat(file); return err },
+			dir:  func() error { _, err := h.Stat(root); return err },
+		},
+		{
+			name: "setattr",
+			file: func() error { return h.Chmod(file, 0600) },
+			dir:  func() error { return h.Chmod(root, 0755) },
+		},
+		{name: "create", dir: func() error { _, err := h.Create("/created", 0644); return err }},
+		{name: "mkdir", dir: func() error { _, err := h.Mkdir("/dir", 0755); return err }},
+		{name: "unlink", dir: func() error { return h.Remove("/created") }},
+		{name: "readdir", dir: func() error { _, err := h.ReadDir("/"); return err }},
+		{name: "write", file: func() error { _, err := h.WriteAt(file, 0, []byte("abc")); return err }},
+		{name: "read", file: func() error { _, err := h.ReadAt(file, 0, 3); return err }},
+		{name: "fsync", file: func() error { return h.Fsync(file) }},
+		{
+			name: "getxattr",
+			file: func() error { _, err := h.Getxattr(file, "user.aethelfs.stats"); return err },
+		},
+		{
+			name: "setxattr",
+			file: func() error { return h.Setxattr(file, "user.aethelfs.exclusive-write", []byte("0")) },
+		},
+	}
+	for _, probe := range probes {
+		name := probe.name
+		op, ok := ops[name]
+		if !ok {
+			t.Errorf("operation %s missing from the report", name)
+			continue
+		}
+		if probe.file != nil {
+			if !op.File {
+				t.Errorf("%s handled on files but reported unhandled", name)
+			} else if err := probe.file(); err != nil {
+				t.Errorf("%s on a file: %v", name, err)
+			}
+		}
+		if probe.dir != nil {
+			if !op.Dir {
+				t.Errorf("%s handled on directories but reported unhandled", name)
+			} else if err := probe.dir(); err != nil {
+				t.Errorf("%s on a directory: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestFeatureLimits(t *testing.T) {
+	opts := testOptions()
+	opts.MaxFileSize = 1 << 20
+	h := newHarnessWith(t, 0, opts)
+	limits := h.FS.FeatureReport().Limits
+
+	name := strings.Repeat("n", limits.MaxNameLen)
+	if _, err := h.Create("/"+name, 0644); err != nil {
+		t.Errorf("create with a name of the maximum length: %v", err)
+	}
+	if _, err := h.Create("/"+name+"n", 0644); !fstest.IsErrno(err, syscall.ENAMETOOLONG) {
+		t.Errorf("create with a name over the maximum length: %v, want ENAMETOOLONG", err)
+	}
+
+	file, err := h.Create("/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(file, limits.MaxFileSize-1, []byte("a")); err != nil {
+		t.Errorf("write ending at the maximum file size: %v", err)
+	}
+	if _, err := h.WriteAt(file, limits.MaxFileSize, []byte("a")); !fstest.IsErrno(err, syscall.EFBIG) {
+		t.Errorf("write past the maximum file size: %v, want EFBIG", err)
+	}
+
+	st, err := h.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.BlockSize != st.Bsize || limits.InodeLimit != st.Files {
+		t.Errorf("limits report block size %d and %d inodes, statfs %d and %d",
+			limits.BlockSize, limits.InodeLimit, st.Bsize, st.Files)
+	}
+}
+
+func TestFeaturesFile(t *testing.T) {
+	h := newHarness(t)
+	node, err := h.Lookup("/.aethelfs/features")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, ok := node.(fusefs.HandleReadAller)
+	if !ok {
+		t.Fatalf("features file %T cannot be read", node)
+	}
+	got, err := reader.ReadAll(h.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report fs.FeatureReport
+	if err := json.Unmarshal(got, &report); err != nil {
+		t.Fatalf("features file is not a report: %v", err)
+	}
+	if want := h.FS.FeatureReport(); !reflect.DeepEqual(report, want) {
+		t.Errorf("features file = %+v, want %+v", report, want)
+	}
+}
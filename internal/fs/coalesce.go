@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/clock"
+	"aethelfs/internal/metrics"
+)
+
+// Append coalescing limits
+const (
+	coalesceMaxWrite = 4 * 1024             // Larger writes go straight to the extent
+	coalesceBufSize  = 64 * 1024            // Staged bytes that force a drain
+	coalesceDelay    = 5 * time.Millisecond // Longest data stays staged
+)
+
+var (
+	coalescedWrites = metrics.NewCounter("aethelfs_coalesced_writes_total",
+		"Small appends staged instead of written to the extent")
+	coalesceDrains = metrics.NewCounter("aethelfs_coalesce_drains_total",
+		"Staged appends copied to the extent in one write")
+)
+
+// appendStage holds small sequential appends to a file until they can be
+// written in one go. Lock order is stage.mu before File.mu.
+type appendStage struct {
+	end   int64 // File offset staged data ends at; zero when empty. Atomic.
+	mu    sync.Mutex
+	buf   []byte // Staged bytes
+	start int64  // File offset of buf[0]
+	timer clock.Timer
+}
+
+// coalescing reports whether small appends to f are staged
+func (f *File) coalescing() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.fs.opts.SyncMode == SyncModeStrict {
+		return false // Nothing may wait in the stage
+	}
+	return f.coalesce || f.fs.opts.CoalesceAppends
+}
+
+// stageAppend stages a small write if it extends the file sequentially,
+// and reports whether it did. Writes that don't qualify drain the stage
+// first so they land after it.
+func (f *File) stageAppend(offset int64, data []byte) (bool, error) {
+	s := &f.stage
+	if atomic.LoadInt64(&s.end) == 0 && !f.coalescing() {
+		return false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	appendAt := s.start + int64(len(s.buf))
+	if len(s.buf) == 0 {
+		f.mu.RLock()
+		appendAt = f.size
+		f.mu.RUnlock()
+	}
+	if len(data) > coalesceMaxWrite || offset != appendAt || !f.coalescing() {
+		return false, f.drainLocked()
+	}
+
+	if len(s.buf) == 0 {
+		s.start = offset
+		if s.timer == nil {
+			s.timer = f.fs.clock.AfterFunc(coalesceDelay, f.drainAsync)
+		} else {
+			s.timer.Reset(coalesceDelay)
+		}
+	}
+	s.buf = append(s.buf, data...)
+	atomic.StoreInt64(&s.end, s.start+int64(len(s.buf)))
+	coalescedWrites.Inc()
+
+	if len(s.buf) >= coalesceBufSize {
+		return true, f.drainLocked()
+	}
+	return true, nil
+}
+
+// drainStaged writes any staged appends to the extent. Everything that
+// reads or makes durable a file's data calls it first.
+func (f *File) drainStaged() error {
+	if atomic.LoadInt64(&f.stage.end) == 0 {
+		return nil
+	}
+	f.stage.mu.Lock()
+	defer f.stage.mu.Unlock()
+	return f.drainLocked()
+}
+
+// drainAsync drains from the stage timer. A failed drain leaves the data
+// staged for the next fsync to retry and report.
+func (f *File) drainAsync() {
+	if err := f.drainStaged(); err != nil {
+		fmt.Printf("Warning: failed to write staged appends for inode %d: %v\n", f.inode, err)
+	}
+}
+
+// drainLocked writes the staged bytes through writeLocked. On failure they
+// stay staged so nothing is lost. The caller must hold stage.mu.
+func (f *File) drainLocked() error {
+	s := &f.stage
+	if len(s.buf) == 0 {
+		return nil
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+
+	f.mu.Lock()
+	err := f.writeLocked(nil, s.start, s.buf)
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	coalesceDrains.Inc()
+	f.fs.meta.add()
+
+	s.buf = s.buf[:0]
+	atomic.StoreInt64(&s.end, 0)
+	return nil
+}
+
+// sizeWithStaged returns size extended to cover any staged appends
+func (f *File) sizeWithStaged(size int64) int64 {
+	if end := atomic.LoadInt64(&f.stage.end); end > size {
+		return end
+	}
+	return size
+}
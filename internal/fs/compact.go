@@ -0,0 +1,210 @@
+package fs
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	ioLatency = metrics.NewHistogram("aethelfs_io_latency_seconds",
+		"Latency of FUSE reads and writes", metrics.ExponentialBuckets(1e-6, 4, 12))
+	compactTriggers = metrics.NewCounter("aethelfs_compact_triggers_total",
+		"Compaction passes started because free space was fragmented")
+	compactPauses = metrics.NewCounter("aethelfs_compact_pauses_total",
+		"Compaction passes skipped because foreground requests were queued or slow")
+	compactMovedBytes = metrics.NewCounter("aethelfs_compact_moved_bytes_total",
+		"Bytes of live extents relocated by background compaction")
+	compactMovedFiles = metrics.NewCounter("aethelfs_compact_moved_files_total",
+		"Extents relocated by background compaction")
+)
+
+// compactInterval is how often the compactor checks fragmentation and
+// spends its byte budget
+const compactInterval = time.Second
+
+// compactMaxExtent is the largest extent compaction moves. Small extents
+// stranded between free space are what fragments it; moving large ones
+// would cost more than it reclaims.
+const compactMaxExtent = 1024 * 1024
+
+// observeIO records the latency of a read or write begun at start
+func observeIO(start time.Time) {
+	ioLatency.Observe(time.Since(start).Seconds())
+}
+
+// compactor relocates small live extents bordering free space, so the
+// free extents on either side merge. It runs when the largest free extent
+// is below CompactThreshold of all free space and moves at most
+// CompactRate bytes per second. It sits out any interval that starts while
+// the foreground is busy, and yields to it between extents; see
+// priority.go.
+type compactor struct {
+	fs *Filesystem
+}
+
+// startCompactor starts the compactor as a supervised worker, unless it
+// is disabled
+func (f *Filesystem) startCompactor() {
+	if f.opts.CompactRate <= 0 || f.opts.CompactThreshold <= 0 {
+		return
+	}
+	c := &compactor{fs: f}
+	f.workers.start("compactor", c.run)
+}
+
+// run checks every interval until stopped
+func (c *compactor) run(w *worker) error {
+	ticker := c.fs.clock.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			c.pass(w)
+		case <-w.stopping():
+			return nil
+		}
+	}
+}
+
+// pass spends one interval's budget if free space is fragmented
+func (c *compactor) pass(w *worker) {
+	if c.fs.foregroundBusy() {
+		compactPauses.Inc()
+		backgroundDeferrals.With(taskCompact).Inc()
+		w.pause(true)
+		return
+	}
+	w.pause(false)
+	free := c.fs.freeList()
+	var total common.ByteCount
+	for _, r := range c.fs.regionStats() {
+		total += r.FreeBytes
+	}
+	if !fragmented(free, total, c.fs.opts.CompactThreshold) {
+		w.ran(nil)
+		return
+	}
+	compactTriggers.Inc()
+
+	budget := int64(float64(c.fs.opts.CompactRate) * compactInterval.Seconds())
+	for _, file := range c.fs.compactCandidates(free) {
+		if budget <= 0 {
+			break
+		}
+		if !c.fs.yieldBackground(taskCompact, w.stopping()) {
+			return
+		}
+		moved, err := file.compact(free)
+		if err != nil {
+			log.Printf("Warning: compaction of inode %d failed: %v", file.inode, err)
+			w.ran(err)
+			return
+		}
+		budget -= moved
+	}
+	w.ran(nil)
+}
+
+// fragmented reports whether the largest free extent is below threshold
+// of all free space. Space past the high-water mark counts as one extent.
+func fragmented(free []alloc.Extent, total common.ByteCount, threshold float64) bool {
+	if total <= 0 {
+		return false
+	}
+	var listed, largest common.ByteCount
+	for _, e := range free {
+		listed += e.Size
+		if e.Size > largest {
+			largest = e.Size
+		}
+	}
+	if tail := total - listed; tail > largest {
+		largest = tail
+	}
+	return float64(largest) < threshold*float64(total)
+}
+
+// compactCandidates returns files with small extents that border free
+// space, those between two free extents first since moving them merges
+// three extents into one
+func (f *Filesystem) compactCandidates(free []alloc.Extent) []*File {
+	starts := make(map[common.DeviceOffset]bool, len(free))
+	ends := make(map[common.DeviceOffset]bool, len(free))
+	for _, e := range free {
+		starts[e.Offset] = true
+		ends[e.End()] = true
+	}
+
+	type candidate struct {
+		file  *File
+		sides int
+	}
+	var candidates []candidate
+	f.walkFiles(func(p string, file *File) {
+		file.mu.RLock()
+		offset, length := file.offset, file.capacity()
+		movable := length > 0 && length <= compactMaxExtent && file.pending == nil && file.comp == nil && !file.pinned
+		file.mu.RUnlock()
+		if !movable {
+			return
+		}
+		sides := 0
+		if ends[offset] {
+			sides++
+		}
+		if starts[offset.Plus(length)] {
+			sides++
+		}
+		if sides > 0 {
+			candidates = append(candidates, candidate{file, sides})
+		}
+	})
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].sides > candidates[j].sides })
+
+	files := make([]*File, len(candidates))
+	for i, c := range candidates {
+		files[i] = c.file
+	}
+	return files
+}
+
+// compact moves the file's extent elsewhere so the free space around it
+// can merge, returning the bytes moved. Shared, compressed and pinned
+// extents are left in place. A new extent that lands in the
+// free space the old one borders would only shift the gap, so it is
+// given back and the file left alone.
+func (f *File) compact(free []alloc.Extent) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	capacity := f.capacity()
+	if capacity == 0 || capacity > compactMaxExtent || f.pending != nil || f.comp != nil || f.pinned || f.fs.refs.shared(f.offset) {
+		return 0, nil
+	}
+	newOffset, err := f.fs.allocateSpace(f.inode, capacity, f.fs.placement(f.tier, capacity))
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range free {
+		if newOffset < e.End() && newOffset.Plus(capacity) > e.Offset && (e.End() == f.offset || e.Offset == f.offset.Plus(capacity)) {
+			f.fs.freeSpace(f.inode, newOffset, capacity)
+			return 0, nil
+		}
+	}
+
+	newData := f.fs.device.At(newOffset, capacity)
+	copy(newData, f.data[:f.size])
+	f.fs.dirty.add(newOffset, common.ByteCount(f.size), originDaemon)
+
+	f.retireLocked(f.offset, capacity)
+	f.data = newData
+	f.offset = newOffset
+	compactMovedBytes.Add(f.size)
+	compactMovedFiles.Inc()
+	return f.size, nil
+}
@@ -0,0 +1,140 @@
+package fs
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	opInFlight = metrics.NewGaugeVec("aethelfs_op_in_flight",
+		"FUSE requests received and not yet answered, by operation type", "op")
+	opInFlightPeak = metrics.NewGaugeVec("aethelfs_op_in_flight_peak",
+		"Most requests of each operation type in flight at once since mount", "op")
+	opsQueuedPeak = metrics.NewGauge("aethelfs_ops_in_flight_peak",
+		"Most FUSE requests in flight at once since mount")
+	slowOps = metrics.NewCounterVec("aethelfs_slow_ops_total",
+		"Operations that took at least the slow operation threshold, by operation type", "op")
+	backpressurePercent = metrics.NewGauge("aethelfs_ops_backpressure_percent",
+		"Requests in flight as a percentage of the kernel's background queue limit")
+)
+
+// opDepth counts the requests of one operation type in flight
+type opDepth struct {
+	inFlight int64
+	peak     int64
+}
+
+// queueDepth tracks how many requests the daemon holds at once, in total
+// and per operation type, and the most it has held. Together with the
+// kernel's background queue limit it tells a daemon that is saturated
+// from a kernel that is not sending enough requests.
+type queueDepth struct {
+	inFlight int64
+	peak     int64
+	ops      sync.Map // Operation name to *opDepth
+}
+
+// raise records n in peak if it is the most seen
+func raise(peak *int64, n int64) {
+	for {
+		old := atomic.LoadInt64(peak)
+		if n <= old || atomic.CompareAndSwapInt64(peak, old, n) {
+			return
+		}
+	}
+}
+
+// begin counts a request of type op as received and returns how many are
+// now in flight, it included
+func (q *queueDepth) begin(op string) int64 {
+	v, ok := q.ops.Load(op)
+	if !ok {
+		v, _ = q.ops.LoadOrStore(op, &opDepth{})
+	}
+	d := v.(*opDepth)
+	raise(&d.peak, atomic.AddInt64(&d.inFlight, 1))
+	total := atomic.AddInt64(&q.inFlight, 1)
+	raise(&q.peak, total)
+	return total
+}
+
+// end counts a request of type op as answered
+func (q *queueDepth) end(op string) {
+	v, _ := q.ops.Load(op)
+	atomic.AddInt64(&v.(*opDepth).inFlight, -1)
+	atomic.AddInt64(&q.inFlight, -1)
+}
+
+// OpDepth is the current and peak in-flight count of one operation type
+type OpDepth struct {
+	Op       string `json:"op"`
+	InFlight int64  `json:"in_flight"`
+	Peak     int64  `json:"peak"`
+}
+
+// QueueDepth reports the requests in flight against the kernel's
+// background queue limit. BackpressurePercent near or above 100 means the
+// daemon holds as many requests as the kernel will queue and is the
+// bottleneck; well below it with slow operations, the kernel is not
+// sending enough parallelism.
+type QueueDepth struct {
+	InFlight            int64     `json:"in_flight"`
+	Peak                int64     `json:"peak"`
+	MaxBackground       int       `json:"max_background,omitempty"`
+	BackpressurePercent int64     `json:"backpressure_percent"`
+	Ops                 []OpDepth `json:"ops"` // Busiest first
+}
+
+// queueDepthReport snapshots the queue depth
+func (f *Filesystem) queueDepthReport() QueueDepth {
+	q := &f.depth
+	r := QueueDepth{
+		InFlight:            atomic.LoadInt64(&q.inFlight),
+		Peak:                atomic.LoadInt64(&q.peak),
+		MaxBackground:       f.opts.MaxBackground,
+		BackpressurePercent: f.backpressure(),
+		Ops:                 []OpDepth{},
+	}
+	q.ops.Range(func(k, v interface{}) bool {
+		d := v.(*opDepth)
+		r.Ops = append(r.Ops, OpDepth{
+			Op:       k.(string),
+			InFlight: atomic.LoadInt64(&d.inFlight),
+			Peak:     atomic.LoadInt64(&d.peak),
+		})
+		return true
+	})
+	sort.Slice(r.Ops, func(i, j int) bool {
+		if r.Ops[i].InFlight != r.Ops[j].InFlight {
+			return r.Ops[i].InFlight > r.Ops[j].InFlight
+		}
+		if r.Ops[i].Peak != r.Ops[j].Peak {
+			return r.Ops[i].Peak > r.Ops[j].Peak
+		}
+		return r.Ops[i].Op < r.Ops[j].Op
+	})
+	return r
+}
+
+// publishQueueDepth refreshes the queue depth gauges on a scrape
+func (f *Filesystem) publishQueueDepth() {
+	r := f.queueDepthReport()
+	for _, d := range r.Ops {
+		opInFlight.With(d.Op).Set(d.InFlight)
+		opInFlightPeak.With(d.Op).Set(d.Peak)
+	}
+	opsQueuedPeak.Set(r.Peak)
+	backpressurePercent.Set(r.BackpressurePercent)
+}
+
+// backpressure returns the requests in flight as a percentage of
+// Options.MaxBackground, or zero when the limit is not known
+func (f *Filesystem) backpressure() int64 {
+	if f.opts.MaxBackground <= 0 {
+		return 0
+	}
+	return atomic.LoadInt64(&f.depth.inFlight) * 100 / int64(f.opts.MaxBackground)
+}
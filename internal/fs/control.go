@@ -0,0 +1,205 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/control"
+)
+
+// RegisterControl adds the filesystem's commands to a control socket
+// server. Commands that only report state are registered read-only, so
+// a group given read-only access can monitor the mount.
+func (f *Filesystem) RegisterControl(s *control.Server) {
+	s.HandleReadOnly("stats", f.ctlStats)
+	s.HandleReadOnly("top", f.ctlTop)
+	s.Handle("heat-reset", f.ctlHeatReset)
+	s.HandleReadOnly("regions", f.ctlRegions)
+	s.HandleReadOnly("alloc-log", f.ctlAllocLog)
+	s.HandleReadOnly("version", f.ctlVersion)
+	s.HandleReadOnly("features", f.ctlFeatures)
+	s.Handle("dedup", f.writing(f.ctlDedup))
+	s.HandleReadOnly("grow", f.ctlGrow)
+	s.HandleReadOnly("inode", f.ctlInode)
+	s.HandleReadOnly("usage", f.ctlUsage)
+	s.Handle("ingest", f.writing(f.ctlIngest))
+	s.Handle("flush-calibrate", f.writing(f.ctlFlushCalibrate))
+	s.Handle("syncfs", f.ctlSyncFS)
+	s.HandleReadOnly("workers", f.ctlWorkers)
+	s.HandleReadOnly("health", f.ctlHealth)
+	s.Handle("clear-errors", f.writing(f.ctlClearErrors))
+	s.HandleReadOnly("crash-dumps", f.ctlCrashDumps)
+	s.Handle("clear-crash-dumps", f.ctlClearCrashDumps)
+	s.Handle("txn", f.writing(f.ctlTxn))
+	s.Handle("pin", f.writing(f.ctlPin))
+	s.Handle("unpin", f.writing(f.ctlUnpin))
+	s.HandleReadOnly("pinned", f.ctlPinned)
+	s.Handle("reserve", f.writing(f.ctlReserve))
+	s.HandleReadOnly("epoch", f.ctlEpoch)
+	s.Handle("advance-epoch", f.writing(f.ctlAdvanceEpoch))
+	s.HandleReadOnly("changed-since", f.ctlChangedSince)
+	s.HandleReadOnly("config", f.ctlConfig)
+	s.HandleReadOnly("report", f.ctlReport)
+	s.Handle("refresh", f.ctlRefresh)
+}
+
+// ctlConfig reports the effective mount options and the previous mount's
+func (f *Filesystem) ctlConfig(args json.RawMessage) (interface{}, error) {
+	return f.Config(), nil
+}
+
+// ctlDedup runs an online deduplication pass. rate_mb throttles hashing
+// in MB/s; dry_run only reports what would be merged.
+func (f *Filesystem) ctlDedup(args json.RawMessage) (interface{}, error) {
+	params := struct {
+		RateMB int64 `json:"rate_mb"`
+		DryRun bool  `json:"dry_run"`
+	}{}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	if params.RateMB < 0 {
+		return nil, fmt.Errorf("rate_mb must not be negative")
+	}
+	return f.dedup(params.RateMB*1024*1024, params.DryRun), nil
+}
+
+// ctlVersion reports the build, host capabilities and the device's format
+func (f *Filesystem) ctlVersion(args json.RawMessage) (interface{}, error) {
+	return struct {
+		Build          common.BuildInfo `json:"build"`
+		Features       map[string]bool  `json:"features"`
+		LayoutVersion  uint32           `json:"layout_version"`
+		BlockSize      uint32           `json:"block_size"`
+		CreatorVersion string           `json:"creator_version"`
+		FormatTime     time.Time        `json:"format_time"`
+		DeviceFeatures []string         `json:"device_features"`
+		Label          string           `json:"label"`
+	}{
+		Build:          common.GetBuildInfo(),
+		Features:       Features(),
+		LayoutVersion:  f.super.LayoutVersion,
+		BlockSize:      f.super.BlockSize,
+		CreatorVersion: f.super.CreatorVersion,
+		FormatTime:     f.super.FormatTime,
+		DeviceFeatures: f.super.Features.Names(),
+		Label:          f.super.Label,
+	}, nil
+}
+
+// ctlStats returns the same counters as .aethelfs/stats
+func (f *Filesystem) ctlStats(args json.RawMessage) (interface{}, error) {
+	data, err := f.statsReport()
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(data), nil
+}
+
+// ctlRegions returns per-region utilization
+func (f *Filesystem) ctlRegions(args json.RawMessage) (interface{}, error) {
+	return f.regionStats(), nil
+}
+
+// ctlAllocLog dumps the most recent allocator decisions, oldest first
+func (f *Filesystem) ctlAllocLog(args json.RawMessage) (interface{}, error) {
+	params := struct {
+		N int `json:"n"`
+	}{}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	if f.allocLog == nil {
+		return nil, fmt.Errorf("allocation log is disabled (see -alloc-log-size)")
+	}
+	return f.allocLog.dump(params.N), nil
+}
+
+// ctlTop returns the hottest files by a chosen metric
+func (f *Filesystem) ctlTop(args json.RawMessage) (interface{}, error) {
+	params := struct {
+		N      int    `json:"n"`
+		Metric string `json:"metric"`
+		Window string `json:"window"`
+	}{N: 10, Metric: heatByBytes}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+
+	switch params.Metric {
+	case heatByBytes, heatByReads, heatByWrites:
+	default:
+		return nil, fmt.Errorf("unknown metric %q (want %s, %s or %s)",
+			params.Metric, heatByBytes, heatByReads, heatByWrites)
+	}
+
+	var window time.Duration
+	if params.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(params.Window); err != nil {
+			return nil, fmt.Errorf("invalid window: %w", err)
+		}
+		if max := heatBuckets * heatBucketSpan; window > max {
+			return nil, fmt.Errorf("window %v exceeds the tracked maximum of %v", window, max)
+		}
+	}
+
+	return f.hottest(params.N, params.Metric, window), nil
+}
+
+// ctlHeatReset clears access counters for one file, or all files if no path is given
+func (f *Filesystem) ctlHeatReset(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+
+	if params.Path == "" {
+		count := 0
+		f.walkFiles(func(p string, file *File) {
+			file.heat.reset()
+			count++
+		})
+		return map[string]int{"reset": count}, nil
+	}
+
+	node, err := f.lookupPath(params.Path)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := node.(*File)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a regular file", params.Path)
+	}
+	file.heat.reset()
+	return map[string]int{"reset": 1}, nil
+}
+
+// lookupPath resolves an absolute path within the mount
+func (f *Filesystem) lookupPath(p string) (Node, error) {
+	var node Node = f.rootDir
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		dir, ok := node.(*Dir)
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", p, syscall.ENOTDIR)
+		}
+
+		dir.mu.RLock()
+		child, ok := dir.children[name]
+		dir.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", p, syscall.ENOENT)
+		}
+		node = child
+	}
+	return node, nil
+}
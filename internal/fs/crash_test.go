@@ -0,0 +1,222 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// crashDevice is the size of the devices crash tests capture images of
+const crashDevice = 8 << 20
+
+// crashOptions are the test options with allocator kind
+func crashOptions(kind string) fs.Options {
+	opts := testOptions()
+	opts.Allocator = kind
+	return opts
+}
+
+// newCrashHarness mounts a crash-simulating device
+func newCrashHarness(t *testing.T, opts fs.Options) *fstest.Harness {
+	t.Helper()
+	h, err := fstest.NewWithCrash(crashDevice, opts)
+	if err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// checkImage remounts a crash image and checks that the mount succeeds,
+// that every byte of the device is free again with no file in the
+// namespace, and that the extent at extent holds want
+func checkImage(t *testing.T, h *fstest.Harness, image *dax.MemDevice, opts fs.Options, free int64, extent common.DeviceOffset, want []byte) {
+	t.Helper()
+	if want != nil {
+		if got := image.At(extent, common.ByteCount(len(want))); !bytes.Equal(got, want) {
+			t.Errorf("synced data at %d lost in the crash", extent)
+		}
+	}
+	remounted, err := h.Remount(image, opts)
+	if err != nil {
+		t.Fatalf("remount: %v", err)
+	}
+	defer remounted.Close()
+	if got := freeBytes(t, remounted); got != free {
+		t.Errorf("%d bytes free after remount, want %d: space leaked", got, free)
+	}
+	if _, err := remounted.Lookup("/gone"); !fstest.IsErrno(err, syscall.ENOENT) {
+		t.Errorf("lookup of the deleted file after remount: %v, want ENOENT", err)
+	}
+}
+
+// TestCrashDuringUnlink crashes at every barrier of a two-phase delete,
+// on both sides of it, and remounts what is left
+func TestCrashDuringUnlink(t *testing.T) {
+	for _, kind := range []string{alloc.KindFreeList, alloc.KindBitmap} {
+		t.Run(kind, func(t *testing.T) {
+			opts := crashOptions(kind)
+			free := freeBytes(t, newCrashHarness(t, opts))
+			keep := bytes.Repeat([]byte("keep"), 8192)
+			for n := 1; ; n++ {
+				h := newCrashHarness(t, opts)
+				kept, err := h.WriteFile("/keep", keep, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				gone, err := h.WriteFile("/gone", bytes.Repeat([]byte("gone"), 8192), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := h.FS.SyncFS(); err != nil {
+					t.Fatal(err)
+				}
+				extent := kept.Layout().Extents[0].Offset
+
+				h.Crash.CrashAt(h.Crash.Barriers() + n)
+				if err := h.Remove("/gone"); err != nil {
+					t.Fatal(err)
+				}
+				h.Forget(gone)
+				if err := h.FS.SyncFS(); err != nil {
+					t.Fatal(err)
+				}
+				before, after, ok := h.Crash.Captured()
+				if !ok {
+					if n == 1 {
+						t.Fatal("the delete issued no barrier")
+					}
+					return
+				}
+				checkImage(t, h, before, opts, free, extent, keep)
+				checkImage(t, h, after, opts, free, extent, keep)
+			}
+		})
+	}
+}
+
+// TestCrashAroundDirFsync crashes on both sides of the barrier a
+// directory fsync issues. Data written to an extent but not synced is
+// durable only after it, and with DirSyncNone there is no barrier.
+func TestCrashAroundDirFsync(t *testing.T) {
+	for _, mode := range []string{fs.DirSyncBatch, fs.DirSyncFull, fs.DirSyncNone} {
+		t.Run(mode, func(t *testing.T) {
+			opts := crashOptions(alloc.KindBitmap)
+			opts.DirSync = mode
+			h := newCrashHarness(t, opts)
+			free := freeBytes(t, h)
+			dir, err := h.Mkdir("/dir", 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			file, err := h.WriteFile("/dir/file", bytes.Repeat([]byte("old!"), 1024), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.FS.SyncFS(); err != nil {
+				t.Fatal(err)
+			}
+			extent := file.Layout().Extents[0].Offset
+
+			// Overwrite in place without a file fsync, then create a
+			// second file and fsync the directory
+			written := bytes.Repeat([]byte("new!"), 1024)
+			if _, err := h.WriteAt(file, 0, written); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := h.Create("/dir/created", 0644); err != nil {
+				t.Fatal(err)
+			}
+			barrier := h.Crash.Barriers() + 1
+			h.Crash.CrashAt(barrier)
+			if err := dir.Fsync(h.Context(), nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if mode == fs.DirSyncNone {
+				if n := h.Crash.Barriers(); n >= barrier {
+					t.Fatalf("%d barriers issued by a no-op directory fsync", n-barrier+1)
+				}
+				if got := h.Crash.Crash().At(extent, common.ByteCount(len(written))); bytes.Equal(got, written) {
+					t.Error("unsynced data durable without a barrier")
+				}
+				return
+			}
+			before, after, ok := h.Crash.Captured()
+			if !ok {
+				t.Fatal("directory fsync issued no barrier")
+			}
+			if got := before.At(extent, common.ByteCount(len(written))); bytes.Equal(got, written) {
+				t.Error("unsynced data durable before the barrier")
+			}
+			checkImage(t, h, before, opts, free, 0, nil)
+			checkImage(t, h, after, opts, free, extent, written)
+		})
+	}
+}
+
+// TestCrashRenameOver replaces a file the classic way, writing a
+// temporary file and renaming it over the original, and crashes at every
+// barrier from the rename on. The new contents are durable once the
+// rename returns, and no image holds only part of them.
+func TestCrashRenameOver(t *testing.T) {
+	for _, fsync := range []bool{true, false} {
+		t.Run(fmt.Sprintf("fsync=%v", fsync), func(t *testing.T) {
+			opts := crashOptions(alloc.KindBitmap)
+			free := freeBytes(t, newCrashHarness(t, opts))
+			written := bytes.Repeat([]byte("new config\n"), 2000)
+			for n := 1; ; n++ {
+				h := newCrashHarness(t, opts)
+				if _, err := h.WriteFile("/config", bytes.Repeat([]byte("old config\n"), 2000), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := h.FS.SyncFS(); err != nil {
+					t.Fatal(err)
+				}
+				tmp, err := h.WriteFile("/config.tmp", written, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fsync {
+					if err := h.Fsync(tmp); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				first := h.Crash.Barriers() + 1
+				h.Crash.CrashAt(first + n - 1)
+				if err := h.Rename("/config.tmp", "/config"); err != nil {
+					t.Fatal(err)
+				}
+				extent := tmp.Layout().Extents[0].Offset
+				if got := h.Crash.Crash().At(extent, common.ByteCount(len(written))); !bytes.Equal(got, written) {
+					t.Fatal("the new contents are not durable once the rename returns")
+				}
+				if err := h.FS.SyncFS(); err != nil {
+					t.Fatal(err)
+				}
+				before, after, ok := h.Crash.Captured()
+				if !ok {
+					if n == 1 {
+						t.Fatal("the rename issued no barrier")
+					}
+					return
+				}
+				for _, image := range []*dax.MemDevice{before, after} {
+					got := image.At(extent, common.ByteCount(len(written)))
+					if !bytes.Equal(got, written) && !bytes.Equal(got, make([]byte, len(written))) {
+						t.Fatalf("crash at barrier %d leaves part of the new contents", n)
+					}
+				}
+				checkImage(t, h, after, opts, free, extent, written)
+			}
+		})
+	}
+}
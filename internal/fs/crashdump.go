@@ -0,0 +1,205 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+)
+
+// crashDumpAllocRecords is how much of the allocation log a crash dump
+// includes; more than a panic log line, since nothing else survives
+const crashDumpAllocRecords = 256
+
+// Crash dump file names are crashDumpPrefix, the time and crashDumpSuffix
+const (
+	crashDumpPrefix = "crash-"
+	crashDumpSuffix = ".json"
+)
+
+// CrashDump is the postmortem record written when the daemon gives up:
+// after Options.MaxPanics handler panics, or on a panic nothing recovered.
+// State whose lock the crash left held is omitted rather than waited for.
+type CrashDump struct {
+	Time         time.Time        `json:"time"`
+	Reason       string           `json:"reason"`
+	Build        common.BuildInfo `json:"build"`
+	Stack        string           `json:"stack"`
+	Regions      []RegionStats    `json:"regions,omitempty"`
+	AllocLog     []AllocRecord    `json:"alloc_log,omitempty"`
+	InFlight     []InFlightOp     `json:"in_flight"`
+	DirtyBytes   int64            `json:"dirty_bytes"`
+	DelayedBytes int64            `json:"delayed_bytes"`
+	Superblock   disk.Superblock  `json:"superblock"`
+}
+
+// CrashDumpInfo identifies a crash dump left by an earlier daemon
+type CrashDumpInfo struct {
+	Path   string    `json:"path"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+}
+
+// crashDumps holds the crash handler and the dumps found at mount
+type crashDumps struct {
+	handler func(reason string, stack []byte) // Set by the daemon; nil exits with log.Fatal
+
+	mu    sync.Mutex
+	found []CrashDumpInfo
+}
+
+// SetCrashHandler installs what runs when the daemon gives up on a panic.
+// It is expected to write a crash dump and exit; if it returns, the daemon
+// exits anyway.
+func (f *Filesystem) SetCrashHandler(fn func(reason string, stack []byte)) {
+	f.crashes.handler = fn
+}
+
+// crash hands a fatal panic to the crash handler and exits
+func (f *Filesystem) crash(reason string, stack []byte) {
+	if f.crashes.handler != nil {
+		f.crashes.handler(reason, stack)
+	}
+	log.Fatalf("Exiting: %s", reason)
+}
+
+// WriteCrashDump writes a crash dump to Options.CrashDir and returns its
+// path. It only tries the locks it needs, since the crash may have left
+// them held.
+func (f *Filesystem) WriteCrashDump(reason string, stack []byte) (string, error) {
+	if f.opts.CrashDir == "" {
+		return "", fmt.Errorf("no crash dump directory configured")
+	}
+	dump := CrashDump{
+		Time:         f.clock.Now(),
+		Reason:       reason,
+		Build:        common.GetBuildInfo(),
+		Stack:        string(stack),
+		AllocLog:     f.allocLog.dump(crashDumpAllocRecords),
+		InFlight:     f.inFlightOps(),
+		DelayedBytes: atomic.LoadInt64(&f.delayedBytes),
+		DirtyBytes:   -1,
+	}
+	if f.allocMu.TryLock() {
+		f.allocMu.Unlock()
+		dump.Regions = f.regionStats()
+	}
+	if f.dirty.mu.TryLock() {
+		dump.DirtyBytes = f.dirty.recorded + f.dirty.flushing
+		f.dirty.mu.Unlock()
+	}
+	if f.super != nil {
+		dump.Superblock = *f.super
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(f.opts.CrashDir, 0700); err != nil {
+		return "", err
+	}
+	name := crashDumpPrefix + dump.Time.UTC().Format("20060102T150405.000000000Z") + crashDumpSuffix
+	path := filepath.Join(f.opts.CrashDir, name)
+	tmp, err := os.CreateTemp(f.opts.CrashDir, ".crash-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// findCrashDumps looks for dumps left by earlier daemons and logs each
+// one, so a crash is noticed on the next start. They are reported on
+// every start until removed with aethelfsctl crash-dumps -clear.
+func (f *Filesystem) findCrashDumps() {
+	if f.opts.CrashDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(f.opts.CrashDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: could not look for crash dumps: %v", err)
+		}
+		return
+	}
+	var found []CrashDumpInfo
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, crashDumpPrefix) || !strings.HasSuffix(name, crashDumpSuffix) {
+			continue
+		}
+		info := CrashDumpInfo{Path: filepath.Join(f.opts.CrashDir, name)}
+		data, err := os.ReadFile(info.Path)
+		if err == nil {
+			var dump CrashDump
+			if err = json.Unmarshal(data, &dump); err == nil {
+				info.Time, info.Reason = dump.Time, dump.Reason
+			}
+		}
+		if err != nil {
+			info.Reason = fmt.Sprintf("unreadable: %v", err)
+		}
+		found = append(found, info)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Path < found[j].Path })
+	for _, info := range found {
+		log.Printf("Warning: an earlier aethelfsd crashed at %s (%s); postmortem dump in %s",
+			info.Time.Format(time.RFC3339), info.Reason, info.Path)
+	}
+
+	f.crashes.mu.Lock()
+	f.crashes.found = found
+	f.crashes.mu.Unlock()
+}
+
+// CrashDumps returns the dumps found at mount and not yet cleared
+func (f *Filesystem) CrashDumps() []CrashDumpInfo {
+	f.crashes.mu.Lock()
+	defer f.crashes.mu.Unlock()
+	return append([]CrashDumpInfo{}, f.crashes.found...)
+}
+
+// ctlCrashDumps lists the crash dumps found at mount
+func (f *Filesystem) ctlCrashDumps(args json.RawMessage) (interface{}, error) {
+	return f.CrashDumps(), nil
+}
+
+// ctlClearCrashDumps removes the crash dumps found at mount and reports
+// what was removed; dumps that could not be removed are kept listed
+func (f *Filesystem) ctlClearCrashDumps(args json.RawMessage) (interface{}, error) {
+	f.crashes.mu.Lock()
+	defer f.crashes.mu.Unlock()
+	removed := []CrashDumpInfo{}
+	var kept []CrashDumpInfo
+	for _, info := range f.crashes.found {
+		if err := os.Remove(info.Path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: could not remove crash dump %s: %v", info.Path, err)
+			kept = append(kept, info)
+			continue
+		}
+		removed = append(removed, info)
+	}
+	f.crashes.found = kept
+	return removed, nil
+}
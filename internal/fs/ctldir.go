@@ -0,0 +1,165 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+
+	"aethelfs/internal/common"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// controlDirName is the reserved name of the virtual directory at the root
+const controlDirName = ".aethelfs"
+
+// Inode numbers reserved for the virtual control directory and its files
+const (
+	ctlDirInode = uint64(0xFFFFFF00) + iota
+	ctlStatsInode
+	ctlFreelistInode
+	ctlConfigInode
+	ctlVersionInode
+	ctlSocketInode
+	ctlFeaturesInode
+)
+
+// ctlDir is a read-only virtual directory whose files are synthesized on
+// read and never persisted
+type ctlDir struct {
+	fs    *Filesystem
+	files map[string]*ctlFile
+}
+
+// ctlFile is a read-only virtual file generated from filesystem state
+type ctlFile struct {
+	inode    uint64
+	generate func() ([]byte, error)
+}
+
+// newCtlDir builds the virtual control directory for a filesystem
+func newCtlDir(f *Filesystem) *ctlDir {
+	return &ctlDir{
+		fs: f,
+		files: map[string]*ctlFile{
+			"stats":          {inode: ctlStatsInode, generate: f.statsReport},
+			"freelist":       {inode: ctlFreelistInode, generate: f.freelistReport},
+			"config":         {inode: ctlConfigInode, generate: f.configReport},
+			"version":        {inode: ctlVersionInode, generate: versionReport},
+			"control-socket": {inode: ctlSocketInode, generate: f.socketReport},
+			"features":       {inode: ctlFeaturesInode, generate: f.featuresReport},
+		},
+	}
+}
+
+// Attr implements the fs.Node interface
+func (c *ctlDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = ctlDirInode
+	a.Mode = 0555 | os.ModeDir
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	a.Size = 4096
+	return nil
+}
+
+// Lookup implements the fs.NodeStringLookuper interface
+func (c *ctlDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if file, ok := c.files[name]; ok {
+		return file, nil
+	}
+	return nil, syscall.ENOENT
+}
+
+// ReadDirAll implements the fs.HandleReadDirAller interface
+func (c *ctlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	dirents := make([]fuse.Dirent, 0, len(c.files))
+	for name, file := range c.files {
+		dirents = append(dirents, fuse.Dirent{
+			Inode: file.inode,
+			Type:  fuse.DT_File,
+			Name:  name,
+		})
+	}
+	return dirents, nil
+}
+
+// Attr implements the fs.Node interface. The size is reported as zero since
+// content is generated on read; reads bypass the page cache via direct IO.
+func (c *ctlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = c.inode
+	a.Mode = 0444
+	a.Uid = uint32(os.Getuid())
+	a.Gid = uint32(os.Getgid())
+	return nil
+}
+
+// Open implements the fs.NodeOpener interface
+func (c *ctlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsReadOnly() {
+		return nil, syscall.EPERM
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return c, nil
+}
+
+// ReadAll implements the fs.HandleReadAller interface
+func (c *ctlFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return c.generate()
+}
+
+// Write implements the fs.HandleWriter interface
+func (c *ctlFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	return syscall.EPERM
+}
+
+// Setattr implements the fs.NodeSetattrer interface
+func (c *ctlFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return syscall.EPERM
+}
+
+// statsReport returns filesystem counters and metrics as JSON
+func (f *Filesystem) statsReport() ([]byte, error) {
+	return marshalReport(f.Stats())
+}
+
+// freelistReport dumps the free extent list, one "offset size" pair per line
+func (f *Filesystem) freelistReport() ([]byte, error) {
+	freeList := f.freeList()
+
+	out := []byte(fmt.Sprintf("# %d free extents\n# offset size\n", len(freeList)))
+	for _, space := range freeList {
+		out = append(out, fmt.Sprintf("%d %d\n", space.Offset, space.Size)...)
+	}
+	return out, nil
+}
+
+// configReport returns the effective options as JSON
+func (f *Filesystem) configReport() ([]byte, error) {
+	return marshalReport(f.Config())
+}
+
+// socketReport returns the control socket path, letting clients find the
+// socket from the mountpoint. It is empty when no socket is served.
+func (f *Filesystem) socketReport() ([]byte, error) {
+	if f.opts.ControlSocket == "" {
+		return nil, nil
+	}
+	return []byte(f.opts.ControlSocket + "\n"), nil
+}
+
+// versionReport returns the daemon version
+func versionReport() ([]byte, error) {
+	return []byte(common.Version + "\n"), nil
+}
+
+// marshalReport renders v as indented JSON with a trailing newline
+func marshalReport(v interface{}) ([]byte, error) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,224 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"sort"
+	"sync"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	dedupMerged = metrics.NewCounter("aethelfs_dedup_merged_files_total",
+		"Files whose extent was replaced by a shared copy")
+	dedupReclaimed = metrics.NewCounter("aethelfs_dedup_reclaimed_bytes_total",
+		"Bytes freed by deduplication")
+	cowCopies = metrics.NewCounter("aethelfs_cow_copies_total",
+		"Shared extents copied before being written")
+)
+
+// dedupBlockSize is the granularity files are hashed at
+const dedupBlockSize = 64 * 1024
+
+// extentRefs counts extra owners of shared extents. An extent absent from
+// the map has a single owner.
+type extentRefs struct {
+	mu   sync.Mutex
+	refs map[common.DeviceOffset]int // Extent offset -> owners beyond the first
+}
+
+// share records one more owner of the extent at offset
+func (r *extentRefs) share(offset common.DeviceOffset) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.refs == nil {
+		r.refs = make(map[common.DeviceOffset]int)
+	}
+	r.refs[offset]++
+}
+
+// release drops one owner of the extent at offset and reports whether it
+// was the last, meaning the space can be freed
+func (r *extentRefs) release(offset common.DeviceOffset) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if n := r.refs[offset]; n > 0 {
+		if n == 1 {
+			delete(r.refs, offset)
+		} else {
+			r.refs[offset] = n - 1
+		}
+		return false
+	}
+	return true
+}
+
+// shared reports whether the extent at offset has more than one owner
+func (r *extentRefs) shared(offset common.DeviceOffset) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refs[offset] > 0
+}
+
+// unshareLocked gives the file a private copy of a shared extent before
+// it is modified. The caller holds f.mu for writing.
+func (f *File) unshareLocked() error {
+	if len(f.data) == 0 || !f.fs.refs.shared(f.offset) {
+		return nil
+	}
+	capacity := f.capacity()
+	newOffset, err := f.fs.allocateSpace(f.inode, capacity, f.fs.placement(f.tier, capacity))
+	if err != nil {
+		return err
+	}
+	newData := f.fs.device.At(newOffset, capacity)
+	copy(newData, f.data[:f.size])
+	f.fs.dirty.add(newOffset, common.ByteCount(f.size), originDaemon)
+
+	f.retireLocked(f.offset, capacity)
+	f.data = newData
+	f.offset = newOffset
+	cowCopies.Inc()
+	return nil
+}
+
+// DedupReport summarizes a deduplication pass
+type DedupReport struct {
+	FilesScanned   int   `json:"files_scanned"`
+	BytesScanned   int64 `json:"bytes_scanned"`
+	FilesMerged    int   `json:"files_merged"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+	Collisions     int   `json:"collisions"` // Hash matches rejected by byte comparison
+	DryRun         bool  `json:"dry_run"`
+}
+
+// dedupCandidate is a file with its content hash
+type dedupCandidate struct {
+	file *File
+	size int64
+	sum  [sha256.Size]byte
+}
+
+// dedup merges files with identical contents onto a single shared extent.
+// Files are hashed in dedupBlockSize blocks under their read lock, yielding
+// to foreground requests between blocks and hashing at no more than rate
+// bytes per second (0 is unthrottled). Candidates are compared byte for byte under
+// both files' write locks before merging. Compressed files are skipped.
+func (f *Filesystem) dedup(rate int64, dryRun bool) DedupReport {
+	report := DedupReport{DryRun: dryRun}
+
+	var files []*File
+	f.walkFiles(func(p string, file *File) {
+		files = append(files, file)
+	})
+
+	groups := make(map[[sha256.Size]byte][]dedupCandidate)
+	for _, file := range files {
+		c, ok := f.hashFile(file, rate)
+		if !ok {
+			continue
+		}
+		report.FilesScanned++
+		report.BytesScanned += c.size
+		groups[c.sum] = append(groups[c.sum], c)
+	}
+
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		// Keep the lowest inode so repeated passes converge
+		sort.Slice(group, func(i, j int) bool { return group[i].file.inode < group[j].file.inode })
+		keeper := group[0].file
+		for _, c := range group[1:] {
+			merged, reclaimed, collision := f.mergeExtent(keeper, c.file, dryRun)
+			if collision {
+				report.Collisions++
+			}
+			if merged {
+				report.FilesMerged++
+				report.BytesReclaimed += reclaimed
+			}
+		}
+	}
+
+	if !dryRun {
+		dedupMerged.Add(int64(report.FilesMerged))
+		dedupReclaimed.Add(report.BytesReclaimed)
+	}
+	return report
+}
+
+// hashFile hashes a raw, non-empty, unpinned file block by block
+func (f *Filesystem) hashFile(file *File, rate int64) (dedupCandidate, bool) {
+	h := sha256.New()
+	file.mu.RLock()
+	size := file.size
+	if size == 0 || file.comp != nil || file.pending != nil || file.pinned {
+		file.mu.RUnlock()
+		return dedupCandidate{}, false
+	}
+	file.mu.RUnlock()
+
+	for off := int64(0); off < size; off += dedupBlockSize {
+		file.mu.RLock()
+		if file.size != size || file.comp != nil {
+			// Changed while we were hashing; skip it this pass
+			file.mu.RUnlock()
+			return dedupCandidate{}, false
+		}
+		end := off + dedupBlockSize
+		if end > size {
+			end = size
+		}
+		h.Write(file.data[off:end])
+		file.mu.RUnlock()
+
+		f.yieldBackground(taskDedup, nil)
+		f.paceBackground(end-off, rate, nil)
+	}
+
+	c := dedupCandidate{file: file, size: size}
+	copy(c.sum[:], h.Sum(nil))
+	return c, true
+}
+
+// mergeExtent points dup at keeper's extent if their contents match,
+// freeing dup's own extent. It returns whether the files were (or in a
+// dry run would be) merged, the bytes reclaimed, and whether the contents
+// differed despite matching hashes.
+func (f *Filesystem) mergeExtent(keeper, dup *File, dryRun bool) (merged bool, reclaimed int64, collision bool) {
+	// Lock in inode order; keeper always has the lower inode
+	keeper.mu.Lock()
+	defer keeper.mu.Unlock()
+	dup.mu.Lock()
+	defer dup.mu.Unlock()
+
+	switch {
+	case keeper.comp != nil || dup.comp != nil, keeper.pinned || dup.pinned:
+		return false, 0, false
+	case dup.reserved > 0:
+		return false, 0, false // Merging would give up its reservation
+	case keeper.offset == dup.offset:
+		return false, 0, false // Already sharing
+	case keeper.size != dup.size:
+		return false, 0, false // Changed since hashing
+	case !bytes.Equal(keeper.data[:keeper.size], dup.data[:dup.size]):
+		return false, 0, true
+	}
+
+	reclaimed = int64(len(dup.data))
+	if dryRun {
+		return true, reclaimed, false
+	}
+
+	f.refs.share(keeper.offset)
+	dup.retireLocked(dup.offset, dup.capacity())
+	dup.data = keeper.data
+	dup.offset = keeper.offset
+	// Charged now for keeper's extent, which may differ in size
+	dup.settleLocked()
+	return true, reclaimed, false
+}
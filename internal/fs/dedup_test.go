@@ -0,0 +1,91 @@
+package fs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// charge returns what file's owner is charged for it: its extent rounded
+// up to whole blocks
+func charge(t *testing.T, h *fstest.Harness, file *fs.File) int64 {
+	t.Helper()
+	st, err := h.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int64
+	for _, e := range file.Layout().Extents {
+		n += int64(e.Length)
+	}
+	block := int64(st.Bsize)
+	return (n + block - 1) / block * block
+}
+
+// treeBytes reads the subtree bytes of the directory p
+func treeBytes(t *testing.T, h *fstest.Harness, p string) int64 {
+	t.Helper()
+	return treeXattr(t, h, p, "user.aethelfs.tree-bytes")
+}
+
+func TestDedupSettlesUsage(t *testing.T) {
+	h := newHarness(t)
+	data := bytes.Repeat([]byte("dedup"), 20000)
+	keeper, err := h.WriteFile("/keeper", data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Grown a piece at a time, the duplicate's extent ends up larger
+	dup, err := h.Create("/dup", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 0; off < len(data); off += 4096 {
+		end := off + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := h.WriteAt(dup, int64(off), data[off:end]); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Fsync(dup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := h.Fsync(keeper); err != nil {
+		t.Fatal(err)
+	}
+	keeperBytes, dupBytes := charge(t, h, keeper), charge(t, h, dup)
+	if keeperBytes == dupBytes {
+		t.Fatalf("both extents are %d bytes; the test needs them to differ", keeperBytes)
+	}
+
+	check := func(when string, want int64) {
+		t.Helper()
+		usage := h.FS.Usage()
+		if len(usage) != 1 || usage[0].Bytes != want {
+			t.Errorf("usage %s = %+v, want %d bytes", when, usage, want)
+		}
+		if got := treeBytes(t, h, "/"); got != want {
+			t.Errorf("tree bytes %s = %d, want %d", when, got, want)
+		}
+	}
+	check("before dedup", keeperBytes+dupBytes)
+
+	report := h.FS.Dedup(false)
+	if report.FilesMerged != 1 || report.BytesReclaimed != dupBytes {
+		t.Fatalf("dedup report %+v, want one file merged reclaiming %d bytes", report, dupBytes)
+	}
+	// Each owner of a shared extent is charged all of it
+	check("after dedup", 2*keeperBytes)
+
+	got, err := h.ReadFile("/dup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("the merged file reads back different contents")
+	}
+}
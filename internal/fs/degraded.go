@@ -0,0 +1,268 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+)
+
+// Policies for writes once repeated flush failures degrade the filesystem
+const (
+	OnFlushErrorsFail     = "fail"     // New writes fail with EIO
+	OnFlushErrorsContinue = "continue" // New writes proceed and are counted
+)
+
+// Flush regions that are not allocation regions
+const (
+	flushRegionMetadata = "metadata" // The metadata reservation
+	flushRegionDevice   = "device"   // A whole-device flush
+)
+
+var (
+	degradedGauge = metrics.NewGauge("aethelfs_degraded",
+		"1 while repeated flush failures have degraded the filesystem")
+	degradedWrites = metrics.NewCounterVec("aethelfs_degraded_writes_total",
+		"Writes attempted while degraded, by whether they were refused or allowed", "action")
+	transientFlushErrors = metrics.NewCounter("aethelfs_flush_transient_errors_total",
+		"Flushes that failed with EINTR or EAGAIN even after the device's retries")
+)
+
+// DegradedState describes why the filesystem was degraded
+type DegradedState struct {
+	Since     time.Time           `json:"since"`
+	Region    string              `json:"region"`
+	Failures  int                 `json:"failures"` // Consecutive failures that triggered it
+	Offset    common.DeviceOffset `json:"offset"`   // Range of the last failed flush
+	Length    common.ByteCount    `json:"length"`
+	LastError string              `json:"last_error"`
+	Policy    string              `json:"policy"`
+}
+
+// Health is what the health control command reports
+type Health struct {
+	Degraded *DegradedState   `json:"degraded,omitempty"`
+	Recorded disk.ErrorRecord `json:"recorded"` // Error record in the superblock
+	Failing  map[string]int   `json:"failing,omitempty"`
+	Recovery []string         `json:"recovery,omitempty"` // Problems a recovery mount tolerated
+}
+
+// flushHealth counts consecutive flush failures per region. Persistent
+// failures usually mean failing media, and acknowledging writes that
+// cannot be made durable only hides it, so after Options.FlushErrorLimit
+// of them the filesystem is degraded until an operator clears it.
+type flushHealth struct {
+	degraded int32 // Atomic; 1 while state is set
+
+	mu       sync.Mutex
+	failures map[string]int // Consecutive failures by region
+	state    *DegradedState
+}
+
+// flushRegion names the region a flush of [offset, offset+length) belongs
+// to. Regions are fixed at mount, so no lock is needed.
+func (f *Filesystem) flushRegion(offset common.DeviceOffset, length common.ByteCount) string {
+	if length >= common.ByteCount(f.device.Size()) {
+		return flushRegionDevice
+	}
+	for _, r := range f.regions {
+		if offset >= r.Offset && offset < r.end() {
+			return r.Name
+		}
+	}
+	return flushRegionMetadata
+}
+
+// flushSucceeded resets the failure count of the flushed region; a
+// whole-device flush resets them all. It does not clear a degraded
+// state, which only an operator does.
+func (f *Filesystem) flushSucceeded(offset common.DeviceOffset, length common.ByteCount) {
+	h := &f.health
+	name := f.flushRegion(offset, length)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if name == flushRegionDevice {
+		h.failures = nil
+	} else {
+		delete(h.failures, name)
+	}
+}
+
+// flushFailed counts a failed flush and degrades the filesystem when the
+// region reaches the limit. It reports whether the caller should still
+// log the failure: once degraded, the one diagnostic line logged here
+// stands for all later failures. Transient failures say nothing about the
+// media, so they are counted separately and never escalate.
+func (f *Filesystem) flushFailed(offset common.DeviceOffset, length common.ByteCount, err error) bool {
+	if dax.IsTransient(err) {
+		transientFlushErrors.Inc()
+		return true
+	}
+	h := &f.health
+	limit := f.opts.FlushErrorLimit
+	if limit <= 0 {
+		return true
+	}
+	name := f.flushRegion(offset, length)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.state != nil {
+		return false
+	}
+	if h.failures == nil {
+		h.failures = make(map[string]int)
+	}
+	h.failures[name]++
+	if h.failures[name] < limit {
+		return true
+	}
+
+	h.state = &DegradedState{
+		Since:     f.clock.Now(),
+		Region:    name,
+		Failures:  h.failures[name],
+		Offset:    offset,
+		Length:    length,
+		LastError: err.Error(),
+		Policy:    f.onFlushErrors(),
+	}
+	atomic.StoreInt32(&h.degraded, 1)
+	degradedGauge.Set(1)
+	log.Printf("Error: filesystem degraded after %d consecutive flush failures in region %s; "+
+		"last failure flushing %d bytes at %d: %v; new writes will %s; "+
+		"further flush failures are counted but not logged until aethelfsctl clear-errors",
+		h.state.Failures, name, length, offset, err, degradedAction(h.state.Policy))
+
+	if rerr := f.recordErrors(disk.ErrorRecord{
+		Time:     h.state.Since,
+		Failures: uint32(h.state.Failures),
+		Region:   name,
+	}); rerr != nil {
+		log.Printf("Warning: could not record flush errors in the superblock: %v", rerr)
+	}
+	return false
+}
+
+// onFlushErrors returns the configured policy, defaulting to fail
+func (f *Filesystem) onFlushErrors() string {
+	if f.opts.OnFlushErrors == "" {
+		return OnFlushErrorsFail
+	}
+	return f.opts.OnFlushErrors
+}
+
+// degradedAction describes what a policy does to writes
+func degradedAction(policy string) string {
+	if policy == OnFlushErrorsContinue {
+		return "be accepted"
+	}
+	return "fail with EIO"
+}
+
+// recordErrors stores rec in the superblock so the next mount, and
+// anyone inspecting the device, sees it. Called with health.mu held,
+// which serializes the writers of the error record.
+func (f *Filesystem) recordErrors(rec disk.ErrorRecord) error {
+	f.superMu.Lock()
+	defer f.superMu.Unlock()
+	f.super.Errors = rec
+	return f.writeSuperLocked()
+}
+
+// checkDegraded is called before operations that write new data. While
+// degraded it fails them with EIO, unless the policy lets them continue.
+func (f *Filesystem) checkDegraded() error {
+	if atomic.LoadInt32(&f.health.degraded) == 0 {
+		return nil
+	}
+	if f.onFlushErrors() == OnFlushErrorsContinue {
+		degradedWrites.With("allowed").Inc()
+		return nil
+	}
+	degradedWrites.With("refused").Inc()
+	return syscall.EIO
+}
+
+// Degraded returns why the filesystem is degraded, or nil
+func (f *Filesystem) Degraded() *DegradedState {
+	f.health.mu.Lock()
+	defer f.health.mu.Unlock()
+	if f.health.state == nil {
+		return nil
+	}
+	state := *f.health.state
+	return &state
+}
+
+// Health returns the degraded state, the superblock's error record and
+// the regions whose latest flushes failed
+func (f *Filesystem) Health() Health {
+	h := &f.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	report := Health{Recorded: f.super.Errors, Recovery: f.RecoveryProblems()}
+	if h.state != nil {
+		state := *h.state
+		report.Degraded = &state
+	}
+	if len(h.failures) > 0 {
+		report.Failing = make(map[string]int, len(h.failures))
+		for name, n := range h.failures {
+			report.Failing[name] = n
+		}
+	}
+	return report
+}
+
+// ClearErrors re-arms the filesystem after an operator has dealt with
+// the failing device: writes are accepted again, failure counts restart
+// and the superblock's error record is cleared. It returns the state
+// that was cleared.
+func (f *Filesystem) ClearErrors() (Health, error) {
+	before := f.Health()
+
+	h := &f.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.state = nil
+	h.failures = nil
+	atomic.StoreInt32(&h.degraded, 0)
+	degradedGauge.Set(0)
+	if !f.super.Errors.IsZero() {
+		if err := f.recordErrors(disk.ErrorRecord{}); err != nil {
+			return before, fmt.Errorf("could not clear the superblock error record: %w", err)
+		}
+	}
+	if before.Degraded != nil || !before.Recorded.IsZero() {
+		log.Printf("Flush errors cleared; writes are accepted again")
+	}
+	return before, nil
+}
+
+// ctlHealth reports whether flush failures have degraded the filesystem
+func (f *Filesystem) ctlHealth(args json.RawMessage) (interface{}, error) {
+	return f.Health(), nil
+}
+
+// ctlClearErrors clears the degraded state and reports what was cleared
+func (f *Filesystem) ctlClearErrors(args json.RawMessage) (interface{}, error) {
+	return f.ClearErrors()
+}
+
+// warnRecordedErrors logs an error record left by an earlier mount
+func (f *Filesystem) warnRecordedErrors() {
+	if rec := f.super.Errors; !rec.IsZero() {
+		log.Printf("Warning: device recorded %d consecutive flush failures in region %s at %v; "+
+			"check the media and run aethelfsctl clear-errors",
+			rec.Failures, rec.Region, rec.Time.Format(time.RFC3339))
+	}
+}
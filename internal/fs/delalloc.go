@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/clock"
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+// Delayed allocation limits
+const (
+	delayBufSize = 64 * 1024   // Buffered bytes that force an extent
+	delayMaxAge  = time.Second // Longest a new file's data stays buffered
+)
+
+// Reasons a buffered file is given an extent
+const (
+	materializeOverflow = "overflow" // Outgrew delayBufSize or the global budget
+	materializeSync     = "sync"     // fsync or a barrier
+	materializeAge      = "age"      // Lived longer than delayMaxAge
+)
+
+var (
+	delayedFiles = metrics.NewGauge("aethelfs_delayed_files",
+		"New files whose data is buffered in memory without an extent")
+	delayedBytes = metrics.NewGauge("aethelfs_delayed_bytes",
+		"Bytes buffered by delayed allocation")
+	delayMaterialized = metrics.NewCounterVec("aethelfs_delayed_materialized_total",
+		"Buffered files given an extent, by reason", "reason")
+	delayDiscarded = metrics.NewCounter("aethelfs_delayed_discarded_total",
+		"Files removed before their buffered data needed an extent")
+)
+
+// delayBuf holds the data of a new file until it needs an extent, so files
+// removed within delayMaxAge never touch the allocator. len(data) is
+// always the file size. It is protected by the file's lock.
+type delayBuf struct {
+	data  []byte
+	timer clock.Timer
+}
+
+// startDelay puts a new file in the buffered state
+func (f *File) startDelay() {
+	f.pending = &delayBuf{timer: f.fs.clock.AfterFunc(delayMaxAge, f.materializeAsync)}
+	delayedFiles.Add(1)
+}
+
+// delayed reports whether the file's data is still buffered
+func (f *File) delayed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.pending != nil
+}
+
+// reserveDelayed takes n bytes from the global delayed allocation budget,
+// reporting false if that would pass it. Negative n returns bytes.
+func (f *Filesystem) reserveDelayed(n int64) bool {
+	if atomic.AddInt64(&f.delayedBytes, n) > f.opts.DelayAllocBudget && n > 0 {
+		atomic.AddInt64(&f.delayedBytes, -n)
+		return false
+	}
+	delayedBytes.Add(n)
+	return true
+}
+
+// resizeBufferLocked sets the size of a buffered file, reporting whether
+// the buffer could hold it. A buffer that can't is materialized first so
+// the caller can fall through to the extent path. The caller holds f.mu
+// for writing.
+func (f *File) resizeBufferLocked(size int64) (bool, error) {
+	p := f.pending
+	if p == nil {
+		return false, nil
+	}
+	old := int64(len(p.data))
+	if size > delayBufSize || !f.fs.reserveDelayed(size-old) {
+		return false, f.materializeLocked(materializeOverflow)
+	}
+	if size > old {
+		p.data = append(p.data, make([]byte, size-old)...)
+	} else {
+		p.data = p.data[:size]
+	}
+	f.size = size
+	return true, nil
+}
+
+// bufferWriteLocked writes data at offset into a buffered file, reporting
+// whether it did. The caller holds f.mu for writing.
+func (f *File) bufferWriteLocked(offset int64, data []byte) (bool, error) {
+	if f.pending == nil {
+		return false, nil
+	}
+	size := f.size
+	if end := offset + int64(len(data)); end > size {
+		size = end
+	}
+	if ok, err := f.resizeBufferLocked(size); !ok {
+		return false, err
+	}
+	copy(f.pending.data[offset:], data)
+	f.touch(f.fs.clock.Now())
+	return true, nil
+}
+
+// readBufferLocked copies [offset, end) of a buffered file into dst,
+// reporting whether the file was buffered. The caller holds f.mu.
+func (f *File) readBufferLocked(dst []byte, offset, end int64) bool {
+	if f.pending == nil {
+		return false
+	}
+	copy(dst, f.pending.data[offset:end])
+	return true
+}
+
+// materialize gives a buffered file its extent
+func (f *File) materialize(reason string) error {
+	if !f.delayed() {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.materializeLocked(reason)
+}
+
+// materializeAsync materializes from the age timer. A failure leaves the
+// data buffered for the next write or fsync to retry and report.
+func (f *File) materializeAsync() {
+	if err := f.materialize(materializeAge); err != nil {
+		fmt.Printf("Warning: failed to allocate an extent for inode %d: %v\n", f.inode, err)
+	}
+}
+
+// materializeLocked copies a buffered file's data into a newly allocated
+// extent of at least the initial allocation and leaves the buffered
+// state. An empty file is left without an extent until its first write.
+// On failure the data stays buffered. The caller holds f.mu for writing.
+func (f *File) materializeLocked(reason string) error {
+	p := f.pending
+	if p == nil {
+		return nil
+	}
+	if size := int64(len(p.data)); size > 0 {
+		capacity := f.initialSize
+		if capacity < size {
+			capacity = size
+		}
+		err := f.reserveLocked(capacity)
+		if err == syscall.EDQUOT && capacity > size {
+			capacity = size
+			err = f.reserveLocked(capacity)
+		}
+		if err != nil {
+			return err
+		}
+		extent := common.ByteCount(capacity)
+		offset, err := f.fs.allocateSpace(f.inode, extent, f.fs.placement(f.tier, extent))
+		if err == syscall.ENOSPC && capacity > size {
+			extent = common.ByteCount(size)
+			offset, err = f.fs.allocateSpace(f.inode, extent, f.fs.placement(f.tier, extent))
+		}
+		if err != nil {
+			f.settleLocked()
+			return err
+		}
+		f.data = f.fs.device.At(offset, extent)
+		f.offset = offset
+		copy(f.data, p.data)
+		f.fs.dirty.add(offset, common.ByteCount(size), originDaemon)
+		f.settleLocked()
+		f.fs.meta.add()
+	}
+
+	f.dropBufferLocked()
+	delayMaterialized.With(reason).Inc()
+	return nil
+}
+
+// discardBufferLocked drops the buffered data of a removed file and
+// reports whether there was any. The caller holds f.mu for writing.
+func (f *File) discardBufferLocked() bool {
+	if f.pending == nil {
+		return false
+	}
+	f.dropBufferLocked()
+	delayDiscarded.Inc()
+	return true
+}
+
+// dropBufferLocked leaves the buffered state, returning the buffer's
+// bytes to the global budget
+func (f *File) dropBufferLocked() {
+	f.pending.timer.Stop()
+	f.fs.reserveDelayed(-int64(len(f.pending.data)))
+	f.pending = nil
+	delayedFiles.Add(-1)
+}
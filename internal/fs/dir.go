@@ -2,120 +2,411 @@ package fs
 
 import (
 	"context"
+	"math"
 	"os"
+	"path"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 )
 
 // Dir represents a directory in the filesystem
 type Dir struct {
-	nodeAttr
+	nodeAttr // Its lock also protects children and compress
 	children map[string]Node
+	compress string // Compression for files created here, from xattrCompress
+
+	// Extent size of files created beneath, from xattrInitialSize; zero
+	// inherits the nearest ancestor's
+	initialSize  int64
+	verifyWrites bool              // From xattrVerifyWrites; applies to the whole subtree
+	template     ownershipTemplate // Ownership forced on new entries; see template.go
+	tree         treeCounts        // Totals of the subtree beneath; see tree.go
+	lastMeta     uint64            // Batch sequence number of the last entry change; atomic
+}
+
+// noteMeta records seq as the latest metadata mutation of d's entries
+func (d *Dir) noteMeta(seq uint64) {
+	for {
+		last := atomic.LoadUint64(&d.lastMeta)
+		if seq <= last || atomic.CompareAndSwapUint64(&d.lastMeta, last, seq) {
+			return
+		}
+	}
 }
 
 // Attr implements the fs.Node interface
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
-	a.Inode = d.inode
-	a.Mode = d.mode
-	a.Uid = d.uid
-	a.Gid = d.gid
-	a.Size = uint64(d.size)
-	a.Mtime = d.modTime
-	a.Ctime = d.modTime
-	a.Atime = d.modTime
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	d.fillAttr(a)
+	return nil
+}
+
+// Setattr implements the fs.NodeSetattrer interface. Directories have no
+// size to truncate; mode, ownership and times are handled as for files.
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	span := d.fs.beginOp("Setattr", d.inode)
+	parent, name := d.location()
+	defer d.fs.auditOp(setattrOp(req), &req.Header, parent, name, &err)
+	defer d.fs.endOp(span, &err, d, req)
+
+	if req.Valid.Size() {
+		return syscall.EISDIR
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	owner := d.uid
+	err = d.setattr(req, d.fs.clock.Now())
+	d.mode = d.fs.stripSuid(d.mode)
+	if d.uid != owner {
+		d.fs.chargeUsage(owner, 0, -1, false)
+		d.fs.chargeUsage(d.uid, 0, 1, false)
+	}
+	return err
+}
+
+// initialAllocation returns the extent size for files created in d: its
+// own initial size, or the nearest ancestor's, or else the size learned
+// for its top-level directory, or zero for the default
+func (d *Dir) initialAllocation() int64 {
+	for dir := d; dir != nil; {
+		dir.mu.RLock()
+		size, parent := dir.initialSize, dir.parent
+		dir.mu.RUnlock()
+		if size != 0 {
+			return size
+		}
+		dir = parent
+	}
+	return d.fs.learnedAllocation(d.path())
+}
+
+// isReserved reports whether name is reserved for a virtual entry in d
+func (d *Dir) isReserved(name string) bool {
+	return d == d.fs.rootDir && name == controlDirName
+}
+
+// checkName validates a name for a new entry in d
+func (d *Dir) checkName(name string) error {
+	if len(name) > disk.MaxNameLen {
+		return syscall.ENAMETOOLONG
+	}
+	if d.isReserved(name) {
+		return syscall.EPERM
+	}
 	return nil
 }
 
 // Lookup implements the fs.NodeStringLookuper interface
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+func (d *Dir) Lookup(ctx context.Context, name string) (node fs.Node, err error) {
+	span := d.fs.beginOp("Lookup", d.inode)
+	span.SetString("name", name)
+	defer d.fs.endOp(span, &err, d, name)
+
+	if d.isReserved(name) {
+		return d.fs.ctlDir, nil
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	if child, ok := d.children[name]; ok {
 		return child, nil
 	}
 	return nil, syscall.ENOENT
 }
 
-// ReadDirAll implements the fs.HandleReadDirAller interface
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	var dirents []fuse.Dirent
-	for name, node := range d.children {
-		// Determine the type of the node
-		var typ fuse.DirentType
-		if _, ok := node.(*File); ok {
-			typ = fuse.DT_File
-		} else if _, ok := node.(*Dir); ok {
-			typ = fuse.DT_Dir
-		}
+// ReadDirAll implements the fs.HandleReadDirAller interface. It returns
+// the whole directory in name order; readdir goes through dirHandle,
+// which lists in bounded batches instead.
+func (d *Dir) ReadDirAll(ctx context.Context) (dirents []fuse.Dirent, err error) {
+	span := d.fs.beginOp("ReadDirAll", d.inode)
+	defer d.fs.endOp(span, &err, d, nil)
 
-		// Get the inode number
-		var attr fuse.Attr
-		node.(fs.Node).Attr(ctx, &attr)
-
-		dirents = append(dirents, fuse.Dirent{
-			Inode: attr.Inode,
-			Type:  typ,
-			Name:  name,
-		})
-	}
+	dirents, _ = d.direntsAfter(ctx, "", math.MaxInt32, nil)
 	return dirents, nil
 }
 
 // Mkdir implements the fs.NodeMkdirer interface
-func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (node fs.Node, err error) {
+	span := d.fs.beginOp("Mkdir", d.inode)
+	span.SetString("name", req.Name)
+	defer d.fs.auditOp("mkdir", &req.Header, d, req.Name, &err)
+	defer d.fs.endOp(span, &err, d, req)
+
+	if err := d.checkName(req.Name); err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	existing := d.children[req.Name]
+	d.mu.RUnlock()
+	if existing != nil {
+		return nil, syscall.EEXIST
+	}
+
+	inode, gen, err := d.fs.nextInode()
+	if err != nil {
+		return nil, err
+	}
+	mode, uid, gid := d.newOwnership(req.Mode|os.ModeDir, req.Uid, req.Gid)
+
+	now := d.fs.clock.Now()
 	child := &Dir{
 		nodeAttr: nodeAttr{
-			fs:      d.fs,
-			inode:   d.fs.nextInode(),
-			name:    req.Name,
-			mode:    req.Mode | os.ModeDir,
-			uid:     req.Uid,
-			gid:     req.Gid,
-			size:    4096,
-			modTime: time.Now(),
+			fs:         d.fs,
+			parent:     d,
+			inode:      inode,
+			generation: gen,
+			name:       req.Name,
+			mode:       mode,
+			uid:        uid,
+			gid:        gid,
+			size:       4096,
+			modTime:    now,
+			changeTime: now,
 		},
 		children: make(map[string]Node),
 	}
 
+	// Add to directory entries, unless a racing mkdir or create of the
+	// same name got there first
+	d.mu.Lock()
+	if d.children[req.Name] != nil {
+		d.mu.Unlock()
+		d.fs.releaseInode(inode)
+		d.fs.unclaimInode()
+		return nil, syscall.EEXIST
+	}
 	d.children[req.Name] = child
-	d.modTime = time.Now()
-	d.fs.Fsync() // Flush changes to the DAX device
+	d.touch(now)
+	d.mu.Unlock()
+	d.fs.chargeUsage(uid, 0, 1, false)
+	d.fs.tree.add(d, 0, 1)
+	d.fs.indexNode(child.inode, child)
+	d.fs.accountNode(nodeBytes(child, req.Name))
+	d.noteMeta(d.fs.meta.add()) // Batch the metadata flush
 
 	return child, nil
 }
 
+var createRaces = metrics.NewCounter("aethelfs_create_races_total",
+	"Creates that found their name taken by a racing create and opened the existing file")
+
+var _ = registerBehavior(Behavior{
+	Name: "open.O_EXCL", Supported: true, Errno: "EEXIST",
+	Note: "Checked by the kernel's lookup, and again by create under the directory lock",
+})
+
 // Create implements the fs.NodeCreater interface
-func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (node fs.Node, handle fs.Handle, err error) {
+	span := d.fs.beginOp("Create", d.inode)
+	span.SetString("name", req.Name)
+	defer d.fs.auditOp("create", &req.Header, d, req.Name, &err)
+	defer d.fs.endOp(span, &err, d, req)
+
+	if err := d.checkName(req.Name); err != nil {
+		return nil, nil, err
+	}
+	if err := d.fs.checkDegraded(); err != nil {
+		return nil, nil, err
+	}
+	d.mu.RLock()
+	existing := d.children[req.Name]
+	d.mu.RUnlock()
+	if existing != nil {
+		return d.openExisting(existing, req)
+	}
+
 	// Create a new file using the filesystem's CreateFile method
-	child, err := d.fs.CreateFile(req.Name)
+	child, err := d.fs.CreateFile(req.Name, d.initialAllocation())
 	if err != nil {
 		return nil, nil, err
 	}
 
 	// Update the child's attributes based on the request
-	child.nodeAttr.mode = req.Mode
-	child.nodeAttr.uid = req.Uid
-	child.nodeAttr.gid = req.Gid
-	child.nodeAttr.modTime = time.Now()
+	child.nodeAttr.parent = d
+	child.nodeAttr.mode, child.nodeAttr.uid, child.nodeAttr.gid = d.newOwnership(req.Mode, req.Uid, req.Gid)
+	if err := child.chargeCreated(); err != nil {
+		return nil, nil, err
+	}
+	now := d.fs.clock.Now()
+	child.nodeAttr.touch(now)
+	if writable(req.Flags) {
+		child.writers = 1 // Released with the handle returned below
+	}
 
-	// Add to directory entries
+	// Add to directory entries, unless a racing create of the same name
+	// got there first; the loser gives back its file and opens the winner's
+	d.mu.Lock()
+	if existing := d.children[req.Name]; existing != nil {
+		d.mu.Unlock()
+		createRaces.Inc()
+		child.discardCreated()
+		return d.openExisting(existing, req)
+	}
+	child.linkTreeLocked(d) // Not yet reachable, so no lock is needed
 	d.children[req.Name] = child
-	d.modTime = time.Now()
-	d.fs.Fsync() // Flush changes
+	d.touch(now)
+	d.mu.Unlock()
+	d.fs.indexNode(child.inode, child)
+	d.fs.accountNode(nodeBytes(child, req.Name))
+	d.noteMeta(d.fs.meta.add()) // Batch the metadata flush
 
 	return child, child, nil
 }
 
+// openExisting answers a create of a name that already exists: EEXIST
+// with O_EXCL, otherwise an open of the file there, as open(2) with
+// O_CREAT does when the kernel's lookup missed a racing create
+func (d *Dir) openExisting(existing Node, req *fuse.CreateRequest) (fs.Node, fs.Handle, error) {
+	if req.Flags&fuse.OpenExclusive != 0 {
+		return nil, nil, syscall.EEXIST
+	}
+	switch node := existing.(type) {
+	case *File:
+		if writable(req.Flags) {
+			if err := node.addWriter(); err != nil {
+				return nil, nil, err
+			}
+		}
+		return node, node, nil
+	case *Dir:
+		return nil, nil, syscall.EISDIR
+	}
+	return nil, nil, syscall.EEXIST
+}
+
 // Remove implements the fs.NodeRemover interface
-func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if _, ok := d.children[req.Name]; !ok {
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	span := d.fs.beginOp("Remove", d.inode)
+	span.SetString("name", req.Name)
+	defer d.fs.auditOp("remove", &req.Header, d, req.Name, &err)
+	defer d.fs.endOp(span, &err, d, req)
+
+	if d.isReserved(req.Name) {
+		return syscall.EPERM
+	}
+
+	d.mu.Lock()
+	child, ok := d.children[req.Name]
+	if !ok {
+		d.mu.Unlock()
 		return syscall.ENOENT
 	}
+	// rmdir only removes directories, and unlink everything else
+	sub, isDir := child.(*Dir)
+	if req.Dir && !isDir {
+		d.mu.Unlock()
+		return syscall.ENOTDIR
+	}
+	if !req.Dir && isDir {
+		d.mu.Unlock()
+		return syscall.EISDIR
+	}
+	if isDir {
+		// Removing a populated directory would orphan its entries
+		sub.mu.RLock()
+		populated := len(sub.children) > 0
+		sub.mu.RUnlock()
+		if populated {
+			d.mu.Unlock()
+			return syscall.ENOTEMPTY
+		}
+	}
 
+	now := d.fs.clock.Now()
 	delete(d.children, req.Name)
-	d.modTime = time.Now()
-	d.fs.Fsync() // Flush changes to the DAX device
+	d.touch(now)
+	d.unlinkLocked(child, now)
+	d.mu.Unlock()
+	d.fs.accountNode(-nodeBytes(child, req.Name))
+	d.noteMeta(d.fs.meta.add()) // Batch the metadata flush
 
 	return nil
 }
+
+// unlinkLocked retires a child whose entry Remove or Rename just dropped.
+// Unlinking changes the child's link count, so its ctime moves with the
+// parent's times under the parent's lock, which the caller holds.
+func (d *Dir) unlinkLocked(child Node, now time.Time) {
+	switch c := child.(type) {
+	case *File:
+		c.mu.Lock()
+		c.changed(now)
+		c.unlinkTreeLocked(d)
+		c.mu.Unlock()
+		atomic.StoreInt32(&c.unlinked, 1)
+		d.fs.unindexNode(c.inode)
+		d.fs.tombstone(c)
+	case *Dir:
+		c.mu.Lock()
+		c.changed(now)
+		c.mu.Unlock()
+		atomic.StoreInt32(&c.unlinked, 1)
+		d.fs.unindexNode(c.inode)
+		d.fs.chargeUsage(c.uid, 0, -1, false)
+		d.fs.unclaimInode()
+		d.fs.tree.add(d, 0, -1)
+	}
+}
+
+// Fsync implements the fs.NodeFsyncer interface. With the default
+// DirSyncBatch it guarantees every create and unlink in d made before the
+// call is durable, flushing the metadata batch only if one of them is
+// still pending. DirSyncFull also flushes the whole device and DirSyncNone
+// makes it a no-op.
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	span := d.fs.beginOp("Fsync", d.inode)
+	defer d.fs.endOp(span, &err, d, req)
+
+	switch d.fs.opts.DirSync {
+	case DirSyncNone:
+		return nil
+	case DirSyncFull:
+		flushSpan := span.Child("device_flush")
+		err = d.fs.Fsync()
+		flushSpan.SetError(err)
+		flushSpan.End()
+		if err != nil {
+			return err
+		}
+	default:
+		if d.fs.meta.isDurable(atomic.LoadUint64(&d.lastMeta)) {
+			span.SetString("skipped", "durable")
+			return nil
+		}
+	}
+
+	flushSpan := span.Child("meta_flush")
+	err = d.fs.SyncMetadata()
+	flushSpan.SetError(err)
+	flushSpan.End()
+	return err
+}
+
+// walkFiles calls fn for every regular file beneath d with its path
+func (d *Dir) walkFiles(dirPath string, fn func(p string, file *File)) {
+	d.mu.RLock()
+	children := make(map[string]Node, len(d.children))
+	for name, node := range d.children {
+		children[name] = node
+	}
+	d.mu.RUnlock()
+
+	for name, node := range children {
+		switch n := node.(type) {
+		case *File:
+			fn(path.Join(dirPath, name), n)
+		case *Dir:
+			n.walkFiles(path.Join(dirPath, name), fn)
+		}
+	}
+}
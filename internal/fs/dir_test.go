@@ -0,0 +1,263 @@
+package fs_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// racers is how many goroutines race to create one name
+const racers = 32
+
+func TestConcurrentCreateOneName(t *testing.T) {
+	h := newHarness(t)
+	before, err := h.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inodes := make([]uint64, racers)
+	errs := make([]error, racers)
+	var wg sync.WaitGroup
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := h.Create("/file", 0644)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			attr, err := h.Stat(file)
+			inodes[i], errs[i] = attr.Inode, err
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+		if inodes[i] != inodes[0] {
+			t.Fatalf("creates returned inodes %d and %d for one name", inodes[0], inodes[i])
+		}
+	}
+	entries, err := h.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countNamed(entries, "file"); n != 1 {
+		t.Fatalf("%d entries named file, want 1", n)
+	}
+
+	// Once the one file is gone the losers must have left nothing behind
+	file, err := h.File("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Remove("/file"); err != nil {
+		t.Fatal(err)
+	}
+	h.Forget(file)
+	after, _ := h.Statfs()
+	if after.Bfree != before.Bfree || after.Ffree != before.Ffree {
+		t.Errorf("free blocks %d inodes %d after remove, want %d and %d", after.Bfree, after.Ffree, before.Bfree, before.Ffree)
+	}
+	if usage := h.FS.Usage(); len(usage) != 1 || usage[0].Bytes != 0 || usage[0].Inodes != 0 {
+		t.Errorf("usage after remove = %+v, want nothing charged", usage)
+	}
+}
+
+func TestConcurrentMkdirOneName(t *testing.T) {
+	h := newHarness(t)
+	before, err := h.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make([]error, racers)
+	var wg sync.WaitGroup
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Half race a create of the same name
+			if i%2 == 0 {
+				_, errs[i] = h.Mkdir("/name", 0755)
+			} else {
+				_, errs[i] = h.Create("/name", 0644)
+			}
+		}(i)
+	}
+	wg.Wait()
+	node, err := h.Lookup("/name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, madeDir := node.(*fs.Dir)
+	mkdirs := 0
+	for i, err := range errs {
+		mkdir := i%2 == 0
+		switch {
+		case err == nil && mkdir:
+			mkdirs++
+		case err == nil && madeDir:
+			t.Errorf("create over the directory succeeded")
+		case err != nil && mkdir && !fstest.IsErrno(err, syscall.EEXIST):
+			t.Errorf("losing mkdir: %v, want EEXIST", err)
+		case err != nil && !mkdir && !(madeDir && fstest.IsErrno(err, syscall.EISDIR)):
+			t.Errorf("create: %v", err)
+		}
+	}
+	if want := map[bool]int{true: 1, false: 0}[madeDir]; mkdirs != want {
+		t.Errorf("%d mkdirs succeeded, want %d", mkdirs, want)
+	}
+	entries, err := h.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countNamed(entries, "name"); n != 1 {
+		t.Fatalf("%d entries named name, want 1", n)
+	}
+	after, _ := h.Statfs()
+	if used := before.Ffree - after.Ffree; used != 1 {
+		t.Errorf("%d inodes in use after the race, want 1", used)
+	}
+	if usage := h.FS.Usage(); len(usage) != 1 || usage[0].Inodes != 1 {
+		t.Errorf("usage after the race = %+v, want one inode charged", usage)
+	}
+}
+
+// countNamed returns how many entries are called name
+func countNamed(entries []fuse.Dirent, name string) int {
+	n := 0
+	for _, e := range entries {
+		if e.Name == name {
+			n++
+		}
+	}
+	return n
+}
+
+// listPaged lists the directory p through an opendir handle, page bytes
+// of dirents at a time, resuming each read at the offset of the last
+// entry returned, as the kernel does
+func listPaged(t *testing.T, h *fstest.Harness, p string, page int) []string {
+	t.Helper()
+	dir, err := h.Dir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle, err := dir.Open(h.Context(), &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.(fusefs.HandleReleaser).Release(h.Context(), &fuse.ReleaseRequest{Dir: true})
+	reader := handle.(fusefs.HandleReader)
+
+	var names []string
+	var offset int64
+	for {
+		resp := &fuse.ReadResponse{}
+		if err := reader.Read(h.Context(), &fuse.ReadRequest{Dir: true, Offset: offset, Size: page}, resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) == 0 {
+			return names
+		}
+		// Each fuse_dirent is ino, off, namelen and type, then the name
+		// padded to eight bytes
+		for data := resp.Data; len(data) >= 24; {
+			offset = int64(binary.LittleEndian.Uint64(data[8:]))
+			namelen := int(binary.LittleEndian.Uint32(data[16:]))
+			names = append(names, string(data[24:24+namelen]))
+			data = data[24+(namelen+7)&^7:]
+		}
+	}
+}
+
+// TestListingRacesRenameAndRemove lists a large directory in pages while
+// other goroutines rename and delete its entries. Entries left alone
+// must be listed exactly once, and no entry twice.
+func TestListingRacesRenameAndRemove(t *testing.T) {
+	entries := 100000
+	if testing.Short() {
+		entries = 10000
+	}
+	// A device formatted with an inode per block has room for them all
+	opts := testOptions()
+	opts.InodeRatio = 4096
+	h := newHarnessWith(t, 512<<20, opts)
+	if _, err := h.Mkdir("/big", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < entries; i++ {
+		if _, err := h.Create(fmt.Sprintf("/big/%s-%06d", kind(i), i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	mutate := func(name string, fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < entries; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if kind(i) != name {
+					continue
+				}
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	mutate("move", func(i int) error {
+		return h.Rename(fmt.Sprintf("/big/move-%06d", i), fmt.Sprintf("/big/moved-%06d", entries-i))
+	})
+	mutate("drop", func(i int) error {
+		return h.Remove(fmt.Sprintf("/big/drop-%06d", i))
+	})
+
+	for listing := 0; listing < 4; listing++ {
+		seen := make(map[string]bool)
+		for _, name := range listPaged(t, h, "/big", 4096) {
+			if seen[name] {
+				t.Errorf("%s listed twice", name)
+			}
+			seen[name] = true
+		}
+		for i := 0; i < entries; i++ {
+			if name := fmt.Sprintf("keep-%06d", i); kind(i) == "keep" && !seen[name] {
+				t.Errorf("%s, never touched, missing from the listing", name)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// kind sorts the entries of TestListingRacesRenameAndRemove into those
+// left alone, renamed and removed
+func kind(i int) string {
+	return [...]string{"keep", "move", "drop"}[i%3]
+}
@@ -0,0 +1,238 @@
+package fs
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	openDirHandles = metrics.NewGauge("aethelfs_open_dir_handles",
+		"Directory handles opened by opendir and not yet released")
+	largestListing = metrics.NewGauge("aethelfs_readdir_largest_entries",
+		"Entries in the largest directory listed since mount")
+)
+
+// readdirBatch is how many entries a directory handle encodes at a time.
+// A listing holds at most one batch, however large the directory.
+const readdirBatch = 4096
+
+// readdirYield is how many children a listing visits before letting
+// waiting mutations of the directory in, so the time Create, Mkdir and
+// Remove can be held up is bounded by it rather than the directory size
+const readdirYield = 1024
+
+// largestListed backs largestListing, which has no compare-and-swap
+var largestListed int64
+
+// direntPool recycles the candidate slices batches are selected from
+var direntPool = sync.Pool{
+	New: func() interface{} {
+		s := make([]fuse.Dirent, 0, 2*readdirBatch)
+		return &s
+	},
+}
+
+// dirHandle is an open directory. Entries are returned in name order, a
+// batch at a time: each batch holds the readdirBatch smallest names after
+// the last one returned. Entries present for the whole iteration are
+// therefore returned exactly once however the directory changes, while
+// entries added or removed meanwhile may or may not appear. Mutations
+// never wait for a whole batch: see direntsAfter.
+type dirHandle struct {
+	dir *Dir
+
+	mu     sync.Mutex
+	batch  []byte // Encoded dirents with offsets from the start of the listing
+	base   int64  // Listing offset of batch[0]
+	last   string // Name of the last entry in batch
+	listed bool   // A batch has been built since the listing (re)started
+	done   bool   // batch ends the listing
+}
+
+// Open implements the fs.NodeOpener interface for opendir
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	span := d.fs.beginOp("Opendir", d.inode)
+	defer d.fs.endOp(span, &err, d, req)
+
+	openDirHandles.Add(1)
+	return &dirHandle{dir: d}, nil
+}
+
+// Read implements the fs.HandleReader interface for readdir
+func (h *dirHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Offset zero is a fresh listing or rewinddir; an offset before the
+	// current batch is a seekdir back, replayed from the start
+	if req.Offset == 0 || !h.listed || req.Offset < h.base {
+		h.batch, h.base, h.last, h.done = nil, 0, "", false
+		h.listed = true
+		h.next(ctx)
+	}
+	// The kernel only resumes at offsets recorded in earlier dirents, so
+	// slicing a batch never splits an entry it asks for
+	for req.Offset >= h.base+int64(len(h.batch)) && !h.done {
+		h.next(ctx)
+	}
+
+	start := req.Offset - h.base
+	if start >= int64(len(h.batch)) {
+		resp.Data = resp.Data[:0]
+		return nil
+	}
+	end := start + int64(req.Size)
+	if end > int64(len(h.batch)) {
+		end = int64(len(h.batch))
+	}
+	resp.Data = append(resp.Data[:0], h.batch[start:end]...)
+	return nil
+}
+
+// next replaces the batch with the entries following it
+func (h *dirHandle) next(ctx context.Context) {
+	bufp := direntPool.Get().(*[]fuse.Dirent)
+	dirents, complete := h.dir.direntsAfter(ctx, h.last, readdirBatch, (*bufp)[:0])
+
+	h.base += int64(len(h.batch))
+	data := h.batch[:0]
+	for _, dirent := range dirents {
+		data = fuse.AppendDirent(data, dirent)
+	}
+	rebaseDirents(data, h.base)
+	h.batch = data
+	h.done = complete
+	if len(dirents) > 0 {
+		h.last = dirents[len(dirents)-1].Name
+	}
+
+	for i := range dirents {
+		dirents[i] = fuse.Dirent{} // Drop the names for the pool
+	}
+	*bufp = dirents[:0]
+	direntPool.Put(bufp)
+}
+
+// rebaseDirents adds base to the offset of every encoded fuse_dirent in
+// data. fuse.AppendDirent records offsets relative to the buffer it
+// appends to, while the kernel resumes at offsets into the whole listing.
+func rebaseDirents(data []byte, base int64) {
+	const header = 24 // ino, off, namelen, type
+	for i := 0; i+header <= len(data); {
+		off := binary.LittleEndian.Uint64(data[i+8:])
+		binary.LittleEndian.PutUint64(data[i+8:], off+uint64(base))
+		namelen := int(binary.LittleEndian.Uint32(data[i+16:]))
+		i += header + (namelen+7)&^7
+	}
+}
+
+// direntsAfter returns, in name order, the first limit entries named after
+// cursor; names are never empty, so "" lists from the start. complete
+// reports that no entries after those were seen. Selection keeps at most
+// 2*limit candidates in buf, so memory is bounded by the batch rather
+// than the directory, at the price of a pass over the children per batch.
+//
+// The pass drops the directory lock every readdirYield children. Go map
+// iteration tolerates changes between steps: removed entries not yet
+// reached are skipped and added ones may or may not be seen. Candidates
+// removed before the batch is described are left out of it, so a batch
+// may hold fewer than limit entries without being the last.
+func (d *Dir) direntsAfter(ctx context.Context, cursor string, limit int, buf []fuse.Dirent) (dirents []fuse.Dirent, complete bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	noteListing(int64(len(d.children)))
+
+	candidates := buf[:0]
+	var bound string // Names at or past bound cannot make the batch
+	bounded := false
+	consider := func(name string) {
+		if name <= cursor || (bounded && name >= bound) {
+			return
+		}
+		candidates = append(candidates, fuse.Dirent{Name: name})
+		if len(candidates) == 2*limit {
+			sortDirents(candidates)
+			candidates = candidates[:limit]
+			bound, bounded = candidates[limit-1].Name, true
+		}
+	}
+	visited := 0
+	for name := range d.children {
+		consider(name)
+		if visited++; visited%readdirYield == 0 {
+			d.mu.RUnlock()
+			d.mu.RLock()
+		}
+	}
+	// The control directory is hidden unless explicitly exposed
+	exposeCtl := d == d.fs.rootDir && d.fs.opts.ExposeControlDir
+	if exposeCtl {
+		consider(controlDirName)
+	}
+
+	sortDirents(candidates)
+	complete = !bounded && len(candidates) <= limit
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+	dirents = candidates[:0]
+	for _, c := range candidates {
+		if exposeCtl && c.Name == controlDirName {
+			dirents = append(dirents, fuse.Dirent{Inode: ctlDirInode, Type: fuse.DT_Dir, Name: c.Name})
+			continue
+		}
+		if node, ok := d.children[c.Name]; ok {
+			dirents = append(dirents, d.dirent(ctx, c.Name, node))
+		}
+	}
+	return dirents, complete
+}
+
+// dirent describes a child for a listing
+func (d *Dir) dirent(ctx context.Context, name string, node Node) fuse.Dirent {
+	var typ fuse.DirentType
+	if _, ok := node.(*File); ok {
+		typ = fuse.DT_File
+	} else if _, ok := node.(*Dir); ok {
+		typ = fuse.DT_Dir
+	}
+
+	var attr fuse.Attr
+	node.(fs.Node).Attr(ctx, &attr)
+	return fuse.Dirent{Inode: attr.Inode, Type: typ, Name: name}
+}
+
+func sortDirents(dirents []fuse.Dirent) {
+	sort.Slice(dirents, func(i, j int) bool { return dirents[i].Name < dirents[j].Name })
+}
+
+// noteListing records the size of a listed directory
+func noteListing(entries int64) {
+	for {
+		largest := atomic.LoadInt64(&largestListed)
+		if entries <= largest {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&largestListed, largest, entries) {
+			largestListing.Set(entries)
+			return
+		}
+	}
+}
+
+// Release implements the fs.HandleReleaser interface for releasedir
+func (h *dirHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.mu.Lock()
+	h.batch = nil
+	h.mu.Unlock()
+	openDirHandles.Add(-1)
+	return nil
+}
@@ -0,0 +1,270 @@
+package fs
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	flusherBytes = metrics.NewCounterVec("aethelfs_flusher_bytes_total",
+		"Dirty bytes flushed by the background flusher, by origin", "origin")
+	flusherSkippedBytes = metrics.NewCounterVec("aethelfs_flusher_skipped_bytes_total",
+		"Dirty bytes the background flusher left to kernel writeback, by origin", "origin")
+	flusherErrors = metrics.NewCounter("aethelfs_flusher_errors_total",
+		"Background flushes of a dirty range that failed")
+	dirtyBytes = metrics.NewGauge("aethelfs_dirty_bytes",
+		"Bytes written to the device and not yet flushed, including a flush in progress")
+	throttledWrites = metrics.NewCounter("aethelfs_dirty_throttled_writes_total",
+		"Writes that waited for the flusher because dirty bytes reached Options.MaxDirtyBytes")
+	throttleSeconds = metrics.NewHistogram("aethelfs_dirty_throttle_seconds",
+		"Time throttled writes waited for dirty bytes to fall to the low watermark",
+		metrics.ExponentialBuckets(1e-4, 4, 10))
+)
+
+// Who wrote a dirty range
+type dirtyOrigin int
+
+const (
+	// originKernel marks file data delivered by FUSE writes, which the
+	// kernel's writeback already pushes through when WritebackCache is on
+	originKernel dirtyOrigin = iota
+	// originDaemon marks bytes the daemon wrote on its own: metadata and
+	// copies made while growing or relocating an extent
+	originDaemon
+)
+
+func (o dirtyOrigin) String() string {
+	if o == originDaemon {
+		return "daemon"
+	}
+	return "kernel"
+}
+
+// dirtyRange is a device range written since the last background flush
+type dirtyRange struct {
+	offset common.DeviceOffset
+	length common.ByteCount
+	origin dirtyOrigin
+}
+
+// dirtyTracker accumulates ranges written to the device for the
+// background flusher. Taken ranges count as dirty until the flush that
+// took them calls done, so writers throttled on the total are released
+// only once their data is durable.
+type dirtyTracker struct {
+	mu       sync.Mutex
+	ranges   []dirtyRange
+	recorded int64         // Total length of ranges, counting overlaps more than once
+	flushing int64         // Bytes taken by flushes that have not called done
+	low      int64         // Dirty bytes that release throttled writers
+	drained  chan struct{} // Closed once the total falls to low; nil when nobody waits
+	kick     chan struct{} // Asks the flusher for an early pass
+}
+
+// add records [offset, offset+length) as written by origin
+func (t *dirtyTracker) add(offset common.DeviceOffset, length common.ByteCount, origin dirtyOrigin) {
+	if length <= 0 {
+		return
+	}
+	t.mu.Lock()
+	t.ranges = append(t.ranges, dirtyRange{offset: offset, length: length, origin: origin})
+	t.recorded += int64(length)
+	dirtyBytes.Set(t.recorded + t.flushing)
+	t.mu.Unlock()
+}
+
+// bytes returns the total length of the recorded ranges, counting
+// overlaps more than once, and of those being flushed
+func (t *dirtyTracker) bytes() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.recorded + t.flushing
+}
+
+// done reports that a flush has finished with length bytes it took,
+// whether it succeeded or put them back with add
+func (t *dirtyTracker) done(length int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flushing -= length
+	total := t.recorded + t.flushing
+	dirtyBytes.Set(total)
+	if t.drained != nil && total <= t.low {
+		close(t.drained)
+		t.drained = nil
+	}
+}
+
+// over returns a channel that is closed once dirty bytes fall to low, if
+// they are above high, and nil otherwise. It also asks the flusher for an
+// early pass.
+func (t *dirtyTracker) over(high, low int64) <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.recorded+t.flushing <= high {
+		return nil
+	}
+	if t.drained == nil {
+		t.drained = make(chan struct{})
+	}
+	t.low = low
+	select {
+	case t.kick <- struct{}{}:
+	default: // A pass is already requested
+	}
+	return t.drained
+}
+
+// take returns the ranges recorded so far, sorted and with overlapping or
+// adjacent ranges of the same origin merged, and resets the tracker. The
+// caller must pass the length of every range to done once it is flushed.
+func (t *dirtyTracker) take() []dirtyRange {
+	t.mu.Lock()
+	ranges := t.ranges
+	t.ranges = nil
+	t.recorded = 0
+	defer t.mu.Unlock()
+
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].origin != ranges[j].origin {
+			return ranges[i].origin < ranges[j].origin
+		}
+		return ranges[i].offset < ranges[j].offset
+	})
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.origin == last.origin && r.offset <= last.offset.Plus(last.length) {
+			if end := r.offset.Plus(r.length); end > last.offset.Plus(last.length) {
+				last.length = end.Sub(last.offset)
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	for _, r := range merged {
+		t.flushing += int64(r.length)
+	}
+	dirtyBytes.Set(t.flushing)
+	return merged
+}
+
+// throttleDirty makes a writer wait while the dirty bytes exceed
+// Options.MaxDirtyBytes, until the flusher brings them down to
+// Options.DirtyLowBytes. Pacing writers to the flusher keeps a burst from
+// piling up more unflushed data than a crash can afford to lose. Without
+// a background flusher nothing would drain them, so nothing waits.
+func (f *Filesystem) throttleDirty(ctx context.Context) error {
+	high := f.opts.MaxDirtyBytes
+	if high <= 0 || f.opts.FlushInterval <= 0 {
+		return nil
+	}
+	drained := f.dirty.over(high, f.dirtyLowBytes())
+	if drained == nil {
+		return nil
+	}
+	throttledWrites.Inc()
+	start := f.clock.Now()
+	defer func() { throttleSeconds.Observe(f.clock.Now().Sub(start).Seconds()) }()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+// dirtyLowBytes returns the low watermark, half the high one by default
+func (f *Filesystem) dirtyLowBytes() int64 {
+	if f.opts.DirtyLowBytes > 0 {
+		return f.opts.DirtyLowBytes
+	}
+	return f.opts.MaxDirtyBytes / 2
+}
+
+// flusher periodically makes dirty ranges durable. With WritebackCache on
+// and ConservativeFlush off, kernel-originated ranges are skipped: fsync
+// still flushes them, so only the background work is avoided.
+type flusher struct {
+	fs       *Filesystem
+	interval time.Duration
+}
+
+// startFlusher starts the background flusher as a supervised worker,
+// unless Options.FlushInterval disables it
+func (f *Filesystem) startFlusher() {
+	if f.opts.FlushInterval <= 0 {
+		return
+	}
+	fl := &flusher{fs: f, interval: f.opts.FlushInterval}
+	f.workers.start("flusher", fl.run)
+}
+
+// run flushes dirty ranges every interval, early when throttled writers
+// ask for it, and once more when stopped
+func (fl *flusher) run(w *worker) error {
+	ticker := fl.fs.clock.NewTicker(fl.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			w.ran(fl.flushDirty())
+		case <-fl.fs.dirty.kick:
+			w.ran(fl.flushDirty())
+		case <-w.stopping():
+			w.ran(fl.flushDirty())
+			return nil
+		}
+	}
+}
+
+// flushDirty flushes the ranges recorded since the last pass. Ranges that
+// fail stay dirty for the next pass; the first permanent failure is
+// returned. A transient one is simply retried next pass.
+func (fl *flusher) flushDirty() error {
+	var firstErr error
+	skipKernel := fl.fs.opts.WritebackCache && !fl.fs.opts.ConservativeFlush
+	for _, r := range fl.fs.dirty.take() {
+		if skipKernel && r.origin == originKernel {
+			flusherSkippedBytes.With(r.origin.String()).Add(int64(r.length))
+			fl.fs.dirty.done(int64(r.length))
+			continue
+		}
+		noteFlush(flushOriginBackground, int64(r.length))
+		err := fl.fs.device.FlushRange(r.offset, r.length)
+		if err != nil {
+			// Keep it for the next pass
+			fl.fs.dirty.add(r.offset, r.length, r.origin)
+		}
+		fl.fs.dirty.done(int64(r.length))
+		if err != nil {
+			if dax.IsTransient(err) {
+				fl.fs.flushFailed(r.offset, r.length, err)
+				continue
+			}
+			flusherErrors.Inc()
+			if fl.fs.flushFailed(r.offset, r.length, err) {
+				log.Printf("Warning: background flush of %d-%d failed: %v", r.offset, r.offset.Plus(r.length), err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		fl.fs.flushSucceeded(r.offset, r.length)
+		flusherBytes.With(r.origin.String()).Add(int64(r.length))
+	}
+	return firstErr
+}
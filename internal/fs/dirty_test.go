@@ -0,0 +1,104 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+	"aethelfs/internal/metrics"
+)
+
+// gauge reads a counter or gauge from the default registry
+func gauge(name string) int64 {
+	n, _ := metrics.Default.Snapshot()[name].(int64)
+	return n
+}
+
+// throttleOptions turn on throttling at 64KB of dirty data. The flusher's
+// ticker runs on the harness clock, which the tests never advance, so
+// only throttled writers asking for a pass get dirty data flushed.
+func throttleOptions() fs.Options {
+	opts := testOptions()
+	opts.FlushInterval = time.Second
+	opts.MaxDirtyBytes = 64 << 10
+	return opts
+}
+
+func TestDirtyThrottlePacesWriter(t *testing.T) {
+	opts := throttleOptions()
+	h := newHarnessWith(t, 0, opts)
+	file := syncedFile(t, h, 1<<20)
+
+	const chunk = 4 << 10
+	throttled := gauge("aethelfs_dirty_throttled_writes_total")
+	if err := within(t, "throttled writes", func() error {
+		for off := int64(0); off < 1<<20; off += chunk {
+			if n, err := h.WriteAt(file, off, bytes.Repeat([]byte{'w'}, chunk)); err != nil || n != chunk {
+				t.Errorf("write at %d: %d bytes, %v", off, n, err)
+			}
+			if dirty := gauge("aethelfs_dirty_bytes"); dirty > opts.MaxDirtyBytes+chunk {
+				t.Errorf("%d bytes dirty after the write at %d, over the %d byte limit", dirty, off, opts.MaxDirtyBytes)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// Each pass flushes everything, so 1MB against a 64KB limit waits about
+	// once every 17 chunks
+	if n := gauge("aethelfs_dirty_throttled_writes_total") - throttled; n < 8 || n > 32 {
+		t.Errorf("%d of %d writes throttled", n, 1<<20/chunk)
+	}
+	got, err := h.ReadFile("/file")
+	if err != nil || !bytes.Equal(got, bytes.Repeat([]byte{'w'}, 1<<20)) {
+		t.Errorf("file does not hold every write: %v", err)
+	}
+}
+
+func TestDirtyThrottleInterrupted(t *testing.T) {
+	opts := throttleOptions()
+	h := newFaultHarness(t, opts)
+	file := syncedFile(t, h, 1<<20)
+	extent := file.Layout().Extents[0]
+	// Flushes of the file fail without degrading, so dirty bytes never drain
+	h.Faults.FailRange(int64(extent.Offset), int64(extent.Length), syscall.EAGAIN)
+	defer h.Faults.Reset()
+
+	ctx, cancel := context.WithCancel(h.Context())
+	defer cancel()
+	throttled := gauge("aethelfs_dirty_throttled_writes_total")
+	result := make(chan error, 1)
+	go func() {
+		for off := int64(0); ; off += 4 << 10 {
+			req := &fuse.WriteRequest{Header: h.Header, Offset: off, Data: make([]byte, 4<<10), FileFlags: fuse.OpenReadWrite}
+			if err := file.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+				result <- err
+				return
+			}
+		}
+	}()
+
+	if err := within(t, "a throttled write", func() error {
+		for gauge("aethelfs_dirty_throttled_writes_total") == throttled {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		t.Fatalf("write returned %v before it was interrupted", err)
+	default:
+	}
+	cancel()
+	if err := within(t, "the interrupted write", func() error { return <-result }); !fstest.IsErrno(err, syscall.EINTR) {
+		t.Errorf("interrupted write: %v, want EINTR", err)
+	}
+}
@@ -0,0 +1,35 @@
+package fs
+
+import (
+	"sync"
+
+	"aethelfs/internal/common"
+)
+
+// readEpoch counts the reads copying from one generation of a file's
+// extent. Reads pin the current epoch under the file lock and copy after
+// releasing it, so a large read doesn't hold off writers; an operation
+// that moves the file to a new extent starts a new epoch and waits for
+// the old one to drain before freeing the old extent, so a copy never
+// reads space that has been reallocated.
+type readEpoch struct {
+	readers sync.WaitGroup
+}
+
+// pinLocked registers a read of the current extent. The caller holds
+// f.mu and calls Done on the returned epoch once its copy is finished.
+func (f *File) pinLocked() *readEpoch {
+	e := f.epoch
+	e.readers.Add(1)
+	return e
+}
+
+// retireLocked frees an extent the file no longer uses once every read
+// pinned to it has finished. Readers don't need f.mu to finish, so
+// waiting with it held cannot deadlock. The caller holds f.mu for writing.
+func (f *File) retireLocked(offset common.DeviceOffset, length common.ByteCount) {
+	old := f.epoch
+	f.epoch = &readEpoch{}
+	old.readers.Wait()
+	f.fs.freeSpace(f.inode, offset, length)
+}
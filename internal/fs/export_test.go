@@ -0,0 +1,87 @@
+package fs
+
+import "sync/atomic"
+
+// Hooks for the external tests in package fs_test, which drive the
+// filesystem through fstest and cannot reach unexported state.
+
+// Panics returns the handler panics recovered so far
+func (f *Filesystem) Panics() int64 {
+	return atomic.LoadInt64(&f.panics)
+}
+
+// AdvanceEpoch starts a new write epoch and returns the one it ended
+func (f *Filesystem) AdvanceEpoch() (uint64, error) {
+	return f.advanceEpoch()
+}
+
+// Layout returns the extents the file occupies
+func (f *File) Layout() FileLayout {
+	return f.layout()
+}
+
+// RestoreWriteStamps reloads the stamp table from the device and hands
+// the stamps to the files now in the namespace, as the mount scan does
+func (f *Filesystem) RestoreWriteStamps() {
+	f.loadWriteStamps()
+	f.restoreWriteStamps()
+}
+
+// StampEpochs returns the epochs of the file's write stamps, oldest first
+func (f *File) StampEpochs() []uint64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	epochs := []uint64{}
+	for _, s := range f.stamps {
+		epochs = append(epochs, s.epoch)
+	}
+	return epochs
+}
+
+// SetInodeCount sets the highest inode number handed out so far
+func (f *Filesystem) SetInodeCount(n uint64) {
+	atomic.StoreUint64(&f.inodeCount, n)
+}
+
+// MaxIno32 is the highest inode number handed out in 32-bit mode
+const MaxIno32 = maxIno32
+
+// Dedup runs an unthrottled deduplication pass
+func (f *Filesystem) Dedup(dryRun bool) DedupReport {
+	return f.dedup(0, dryRun)
+}
+
+// RunOp runs fn as the body of a handler named op, with the panic
+// recovery and fault handling every handler gets
+func (f *Filesystem) RunOp(op string, fn func()) (err error) {
+	span := f.beginOp(op, 0)
+	defer f.endOp(span, &err, nil, nil)
+	fn()
+	return nil
+}
+
+// MetaGuardFaults returns the stray metadata writes caught so far
+func MetaGuardFaults() int64 {
+	return metaGuardFaults.Value()
+}
+
+// PinRead holds the file's current extent as a read copying from it
+// does, until the returned function is called
+func (f *File) PinRead() func() {
+	f.mu.RLock()
+	epoch := f.pinLocked()
+	f.mu.RUnlock()
+	return epoch.readers.Done
+}
+
+// MetaBarriers returns the metadata flushes fsync and other barriers have
+// forced so far
+func MetaBarriers() int64 {
+	return metaFlushes.With(flushReasonBarrier).Value()
+}
+
+// FlushDirty runs one pass of the background flusher and returns the
+// error it would report to the supervisor
+func (f *Filesystem) FlushDirty() error {
+	return (&flusher{fs: f}).flushDirty()
+}
@@ -0,0 +1,30 @@
+package fs
+
+import (
+	"golang.org/x/sys/cpu"
+
+	"aethelfs/internal/dax"
+)
+
+// persistenceMode names the path barriers and fsync use to make data
+// durable: the device's flush strategy, or msync for devices that cannot
+// be tuned
+func (f *Filesystem) persistenceMode() string {
+	tuner, ok := f.device.(dax.FlushTuner)
+	if !ok {
+		return dax.FlushMsync
+	}
+	return describeFlushStrategy(tuner.FlushStrategy())
+}
+
+// Features reports which optional capabilities this build and host
+// provide. None of the on-device features exist yet, so they are listed
+// as unavailable rather than omitted.
+func Features() map[string]bool {
+	return map[string]bool{
+		"checksums": false,
+		"quotas":    false,
+		"map_sync":  false,           // The device is mapped MAP_SHARED without MAP_SYNC
+		"clflush":   cpu.X86.HasSSE2, // Cache line flushing used by FlushRegion
+	}
+}
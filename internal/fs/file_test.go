@@ -0,0 +1,303 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+func TestReadBoundaries(t *testing.T) {
+	h := newHarness(t)
+	data := []byte("0123456789abcdef")
+	file, err := h.WriteFile("/file", data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+	tests := []struct {
+		name    string
+		offset  int64
+		size    int
+		want    []byte
+		wantErr syscall.Errno
+	}{
+		{"zero length", 4, 0, []byte{}, 0},
+		{"zero length at EOF", size, 0, []byte{}, 0},
+		{"whole file", 0, len(data), data, 0},
+		{"interior", 4, 6, data[4:10], 0},
+		{"ends at EOF", 10, 6, data[10:], 0},
+		{"straddles EOF", 10, 100, data[10:], 0},
+		{"last byte", size - 1, 8, data[size-1:], 0},
+		{"offset at EOF", size, 8, []byte{}, 0},
+		{"offset past EOF", size + 4096, 8, []byte{}, 0},
+		{"far past EOF", 1 << 62, 8, []byte{}, 0},
+		{"oversized request", 0, 1 << 30, data, 0},
+		{"negative offset", -1, 8, nil, syscall.EINVAL},
+		{"negative length", 0, -1, nil, syscall.EINVAL},
+	}
+	// Once while the data is buffered, again from its extent
+	for _, where := range []string{"buffered", "extent"} {
+		if where == "extent" {
+			if err := h.Fsync(file); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tt := range tests {
+			t.Run(where+"/"+tt.name, func(t *testing.T) {
+				got, err := h.ReadAt(file, tt.offset, tt.size)
+				if tt.wantErr != 0 {
+					if !fstest.IsErrno(err, tt.wantErr) {
+						t.Errorf("err = %v, want %v", err, tt.wantErr)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.want) {
+					t.Errorf("read %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// reuseFreed writes a file of 0xFF, deletes it and returns where its
+// extent was, for a new file to be placed on
+func reuseFreed(t *testing.T, h *fstest.Harness, size int) common.DeviceOffset {
+	t.Helper()
+	old, err := h.WriteFile("/old", bytes.Repeat([]byte{0xff}, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Fsync(old); err != nil {
+		t.Fatal(err)
+	}
+	extent := old.Layout().Extents[0].Offset
+	if err := h.Remove("/old"); err != nil {
+		t.Fatal(err)
+	}
+	h.Forget(old)
+	if err := h.FS.SyncFS(); err != nil {
+		t.Fatal(err)
+	}
+	return extent
+}
+
+// checkZero reads the file at p and checks that everything past the
+// first len(head) bytes, which must hold head, reads as zero
+func checkZero(t *testing.T, h *fstest.Harness, p string, head []byte, size int) {
+	t.Helper()
+	got, err := h.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != size {
+		t.Fatalf("%s is %d bytes, want %d", p, len(got), size)
+	}
+	if !bytes.Equal(got[:len(head)], head) {
+		t.Errorf("%s starts %q, want %q", p, got[:len(head)], head)
+	}
+	if i := bytes.IndexByte(got[len(head):], 0xff); i >= 0 {
+		t.Errorf("%s exposes stale bytes at offset %d", p, len(head)+i)
+	}
+}
+
+func TestGrowthExposesZeroes(t *testing.T) {
+	const size = 64 << 10
+	head := []byte("new file")
+	for _, grow := range []string{"truncate", "write"} {
+		t.Run(grow, func(t *testing.T) {
+			h := newHarness(t)
+			extent := reuseFreed(t, h, size)
+			file, err := h.WriteFile("/new", head, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Fsync(file); err != nil {
+				t.Fatal(err)
+			}
+			if got := file.Layout().Extents[0].Offset; got != extent {
+				t.Fatalf("new file placed at %d, want the freed extent at %d", got, extent)
+			}
+			if grow == "truncate" {
+				err = h.Truncate(file, size)
+			} else {
+				_, err = h.WriteAt(file, size-1, []byte{0})
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkZero(t, h, "/new", head, size)
+		})
+	}
+}
+
+func TestShrinkThenGrowZeroes(t *testing.T) {
+	h := newHarness(t)
+	file, err := h.WriteFile("/file", bytes.Repeat([]byte{0xff}, 8192), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Fsync(file); err != nil {
+		t.Fatal(err)
+	}
+	// Shrinking leaves the old bytes in the extent; growing must not show them
+	if err := h.Truncate(file, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Truncate(file, 8192); err != nil {
+		t.Fatal(err)
+	}
+	checkZero(t, h, "/file", bytes.Repeat([]byte{0xff}, 100), 8192)
+}
+
+// TestLargeReadsRaceRelocation copies 1MB reads while files are
+// truncated and regrown, moved between extents by copy-on-write and
+// deduplication, and other files take the space they give up. A read
+// may see a file at any size, but never a byte of another file. The
+// device is mapped, as a real one is, since a read racing a write to the
+// same bytes may tear by design.
+func TestLargeReadsRaceRelocation(t *testing.T) {
+	h, _ := newDeviceHarness(t, testOptions())
+	const size, readSize = 2 << 20, 1 << 20
+	fill := bytes.Repeat([]byte("A"), size)
+	var files []*fs.File
+	for _, p := range []string{"/big", "/twin"} {
+		file, err := h.WriteFile(p, fill, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Fsync(file); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	big, twin := files[0], files[1]
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	run := func(fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for r := 0; r < 4; r++ {
+		file := files[r%2]
+		run(func(i int) error {
+			got, err := h.ReadAt(file, int64(i*65537%size), readSize)
+			if err != nil {
+				return err
+			}
+			for j, b := range got {
+				if b != 'A' && b != 0 {
+					return fmt.Errorf("read returned %q at %d: another file's data", b, j)
+				}
+			}
+			return nil
+		})
+	}
+	// Shrink and regrow one file
+	run(func(i int) error {
+		if err := h.Truncate(big, uint64(i*4096%size)); err != nil {
+			return err
+		}
+		_, err := h.WriteAt(big, 0, fill)
+		return err
+	})
+	// Move the other to a copy of its own and back onto the shared
+	// extent, freeing the copy
+	run(func(i int) error {
+		if _, err := h.WriteAt(twin, 0, fill[:1]); err != nil {
+			return err
+		}
+		if err := h.Fsync(twin); err != nil {
+			return err
+		}
+		h.FS.Dedup(false)
+		return nil
+	})
+	// Other files take whatever space is freed
+	for o := 0; o < 2; o++ {
+		o := o
+		run(func(i int) error {
+			p := fmt.Sprintf("/other%d-%d", o, i%4)
+			other, err := h.WriteFile(p, bytes.Repeat([]byte("Z"), 1<<20), 0644)
+			if err == nil {
+				err = h.Fsync(other)
+			}
+			if err == nil {
+				if err = h.Remove(p); err == nil {
+					h.Forget(other)
+				}
+			}
+			return err
+		})
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestRelocationWaitsForReads moves a file off an extent a read is still
+// copying from. The extent must not be freed, for another file to take,
+// until the read is done.
+func TestRelocationWaitsForReads(t *testing.T) {
+	h := newHarness(t)
+	file, err := h.WriteFile("/file", bytes.Repeat([]byte("A"), 8192), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Fsync(file); err != nil {
+		t.Fatal(err)
+	}
+	free := freeBytes(t, h)
+	release := file.PinRead()
+
+	// Growing past the extent moves the file to a larger one
+	grown := make(chan error, 1)
+	go func() {
+		_, err := h.WriteAt(file, 1<<20, []byte("B"))
+		grown <- err
+	}()
+	select {
+	case err := <-grown:
+		t.Fatalf("relocation finished with a read in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := freeBytes(t, h); got > free {
+		t.Errorf("%d bytes freed with a read still copying from them", got-free)
+	}
+	release()
+	if err := <-grown; err != nil {
+		t.Fatal(err)
+	}
+	if got, err := h.ReadAt(file, 0, 8192); err != nil || !bytes.Equal(got, bytes.Repeat([]byte("A"), 8192)) {
+		t.Errorf("data lost in the move: %v", err)
+	}
+}
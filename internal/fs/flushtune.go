@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"aethelfs/internal/dax"
+)
+
+// calibrationScratch is the size of the scratch extent flush calibration
+// writes to; sizes are timed from 4KB up to it
+const calibrationScratch = 1024 * 1024
+
+// setupFlushStrategy applies opts.FlushStrategy to the device and, in
+// auto mode, calibrates it. Backends that cannot be tuned, such as a
+// fault injection wrapper, keep using msync.
+func (f *Filesystem) setupFlushStrategy() error {
+	strategy := f.opts.FlushStrategy
+	if strategy == "" {
+		strategy = dax.FlushAuto
+	}
+	tuner, ok := f.device.(dax.FlushTuner)
+	if !ok {
+		if strategy != dax.FlushAuto && strategy != dax.FlushMsync {
+			return fmt.Errorf("flush strategy %q is not supported by this device", strategy)
+		}
+		return nil
+	}
+	if err := tuner.SetFlushStrategy(strategy); err != nil {
+		return err
+	}
+
+	if s, _ := tuner.FlushStrategy(); s == dax.FlushAuto {
+		if _, err := f.calibrateFlush(); err != nil {
+			log.Printf("Warning: flush calibration failed, keeping default thresholds: %v", err)
+		}
+	}
+	s, clwbMax := tuner.FlushStrategy()
+	log.Printf("Flush strategy: %s", describeFlushStrategy(s, clwbMax))
+	return nil
+}
+
+// calibrateFlush times both flush methods on a scratch extent borrowed
+// from the allocator, so it is safe while the filesystem is serving
+func (f *Filesystem) calibrateFlush() (dax.Calibration, error) {
+	tuner, ok := f.device.(dax.FlushTuner)
+	if !ok {
+		return dax.Calibration{}, fmt.Errorf("flush strategy cannot be tuned on this device")
+	}
+	offset, err := f.allocateSpace(0, calibrationScratch, f.placement("", calibrationScratch))
+	if err != nil {
+		return dax.Calibration{}, err
+	}
+	defer f.freeSpace(0, offset, calibrationScratch)
+	return tuner.Calibrate(int64(offset), calibrationScratch)
+}
+
+// describeFlushStrategy formats a strategy for logs and the persistence xattr
+func describeFlushStrategy(strategy string, clwbMax int64) string {
+	if strategy == dax.FlushAuto {
+		return fmt.Sprintf("auto (clwb up to %d bytes, msync above)", clwbMax)
+	}
+	return strategy
+}
+
+// ctlFlushCalibrate re-runs flush calibration and reports the samples
+func (f *Filesystem) ctlFlushCalibrate(args json.RawMessage) (interface{}, error) {
+	c, err := f.calibrateFlush()
+	if err != nil {
+		return nil, err
+	}
+	strategy, _ := f.device.(dax.FlushTuner).FlushStrategy()
+	return struct {
+		Strategy string `json:"strategy"`
+		dax.Calibration
+	}{strategy, c}, nil
+}
@@ -6,10 +6,18 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/audit"
+	"aethelfs/internal/clock"
 	"aethelfs/internal/common"
 	"aethelfs/internal/dax"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+	"aethelfs/internal/trace"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
@@ -17,56 +25,309 @@ import (
 
 // Filesystem implements a FUSE filesystem backed by a DAX device
 type Filesystem struct {
-	device     *dax.Device
-	rootDir    *Dir
-	inodeCount uint64
-	nextOffset int64      // Track the next free offset
-	offsetMu   sync.Mutex // Protect offset allocation
-
-	// Simple free space tracking
-	freeSpaces   []freeSpace
-	freeSpacesMu sync.Mutex
+	panics        int64  // Handler panics recovered so far
+	opsStarted    int64  // Operations begun, for the liveness watchdog
+	opsDone       int64  // Operations finished
+	opSeq         uint64 // Keys of the in-flight table
+	metaBytes     int64  // Estimated heap held by nodes, see accountNode
+	metaWarned    int64  // Unix nanoseconds of the last over-threshold warning
+	inodeCount    uint64 // Highest inode number handed out
+	inodesUsed    int64  // Live inodes, counted against the superblock's inode limit
+	inodesWarned  int64  // Unix nanoseconds of the last out of inode space warning
+	prefetching   int64  // Readahead bytes in flight
+	delayedBytes  int64  // Bytes buffered by delayed allocation
+	pinnedBytes   int64  // Device bytes held by pinned files, see pin.go
+	writeEpoch    uint64 // Epoch new writes are stamped with, see writeepoch.go
+	freeListReady int32  // Set once the mount scan has rebuilt the free list
+
+	device    dax.Backend
+	rootDir   *Dir
+	blockSize int64          // Allocation alignment, from the superblock
+	regions   []*region      // Allocation regions in spill order
+	allocMu   sync.Mutex     // Serializes the region allocators
+	held      quarantine     // Freed extents held back from reuse; guarded by allocMu
+	allocLog  *allocLog      // Recent allocator decisions; nil when disabled
+	inodes    inodeTable     // Recycled inode numbers with -ino32
+	growth    growStats      // Per-directory file growth
+	sizes     sizeLearner    // Learned initial allocations
+	dead      tombstones     // Removed files awaiting phase two of delete
+	byInode   sync.Map       // Inode number to live Node, see LookupInode
+	inflight  sync.Map       // Operation key to InFlightOp, for crash dumps
+	depth     queueDepth     // Requests in flight per operation type
+	tree      treeAccounting // Subtree changes not yet propagated
+	usage     usageTable     // Per-uid bytes and inodes
+	stamps    stampTable     // Write stamps saved on the device, see writeepoch.go
+
+	// statsMu is the stats barrier: allocator and namespace mutators hold
+	// it for reading so a snapshot can freeze them all at once
+	statsMu sync.RWMutex
+
+	// renameMu serializes renames, so the directory tree cannot change
+	// shape while one checks ancestry and orders its directory locks
+	renameMu sync.Mutex
+
+	super      *disk.Superblock
+	superMu    sync.Mutex       // Serializes rewrites of the superblock once mounted
+	guard      *metaGuard       // Write protection of the metadata region; nil when off
+	prevMount  disk.MountRecord // Superblock mount record this mount replaced
+	opts       Options
+	meta       *metaBatch          // Coalesces metadata flushes
+	dirty      dirtyTracker        // Ranges written since the last background flush
+	chunks     *chunkCache         // Decompressed chunks of compressed files
+	refs       extentRefs          // Owners of extents shared by deduplication
+	workers    *supervisor         // Background flusher, compactor and the like
+	durability *dax.SelfTestResult // Mount self-test outcome; nil if not run
+	health     flushHealth         // Consecutive flush failures; see degraded.go
+	txns       txnTable            // Open multi-file transactions; see txn.go
+	ctlDir     *ctlDir             // Virtual .aethelfs directory at the root
+	notify     kernelNotify        // Invalidations for changes made outside requests
+	background background          // Holds tooling off while foreground requests wait
+	recovery   []string            // Inconsistencies a recovery mount tolerated
+	crashes    crashDumps          // Crash handler and dumps left by earlier daemons
+
+	clock     clock.Clock // Source of node times and timers
+	mountTime time.Time
+	mountScan *mountScan // Mount-time namespace scan, possibly still running
+
+	gate   chan struct{} // Bounds concurrent handlers; nil when unbounded
+	tracer *trace.Tracer // Operation tracing; nil when disabled
+	audit  *audit.Logger // Namespace mutation audit log; nil when disabled
 }
 
-// Simple free space tracking structure
-type freeSpace struct {
-	offset int64
-	size   int64
+// superblockBytes returns the part of the device the superblock occupies
+func superblockBytes(device dax.Backend) []byte {
+	return device.At(disk.SuperblockOffset, disk.SuperblockOffset+disk.SuperblockSize)
 }
 
 // NewFilesystem creates a new filesystem with the given DAX device
-func NewFilesystem(device *dax.Device) (*Filesystem, error) {
+func NewFilesystem(device dax.Backend, opts Options) (*Filesystem, error) {
 	// Get total DAX device size
-	daxSize := int64(len(device.MmapData()))
+	daxSize := device.Size()
 
 	// Create filesystem
 	fs := &Filesystem{
 		device:     device,
 		inodeCount: 1, // Start with root inode
-		// Reserve space for metadata
-		nextOffset: common.MetadataReservationSize,
-		// Initialize empty free space tracking
-		freeSpaces: make([]freeSpace, 0),
+		inodesUsed: 1,
+		opts:       opts,
+		allocLog:   newAllocLog(opts.AllocLogSize),
+		chunks:     newChunkCache(),
+		clock:      opts.Clock,
+		gate:       newGate(opts),
 	}
+	if fs.clock == nil {
+		fs.clock = clock.Real
+	}
+	fs.workers = newSupervisor(fs.clock)
+	fs.dirty.kick = make(chan struct{}, 1)
+	fs.mountTime = fs.clock.Now()
+	// Format the device if it has never been used, and refuse devices
+	// written with features this binary doesn't understand
+	if daxSize < common.MinDeviceSize {
+		return nil, fmt.Errorf("device too small: %d bytes, need at least %d", daxSize, common.MinDeviceSize)
+	}
+	if err := disk.CheckLabel(opts.Label); err != nil {
+		return nil, err
+	}
+	if opts.Allocator != "" {
+		if err := alloc.CheckKind(opts.Allocator); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Recovery && !opts.ReadOnly {
+		return nil, fmt.Errorf("recovery mounts must be read-only")
+	}
+	super, err := fs.readSuperblock()
+	if err == disk.ErrNoSuperblock && opts.ReadOnly {
+		return nil, fmt.Errorf("cannot mount an unformatted device read-only")
+	} else if err == disk.ErrNoSuperblock {
+		log.Printf("No superblock found, formatting device")
+		blockSize := opts.BlockSize
+		if blockSize == 0 {
+			blockSize = disk.DefaultBlockSize
+		}
+		if err := disk.CheckBlockSize(blockSize); err != nil {
+			return nil, err
+		}
+		super = disk.NewSuperblock(common.Version, uint32(blockSize))
+		super.Label = opts.Label
+		ratio := opts.InodeRatio
+		if ratio == 0 {
+			ratio = disk.DefaultInodeRatio
+		}
+		if ratio < blockSize {
+			return nil, fmt.Errorf("inode ratio %d must be at least the %d byte block size", ratio, blockSize)
+		}
+		super.InodeLimit = uint64(daxSize / ratio)
+		if opts.Allocator == alloc.KindBitmap {
+			bitmap, err := disk.Bitmap(device.At(0, common.ByteCount(daxSize)), blockSize, common.MetadataReservationSize)
+			if err != nil {
+				return nil, err
+			}
+			for i := range bitmap {
+				bitmap[i] = 0
+			}
+			noteFlush(flushOriginSuper, int64(len(bitmap)))
+			if err := device.FlushRange(disk.BitmapOffset, common.ByteCount(len(bitmap))); err != nil {
+				return nil, fmt.Errorf("failed to clear allocation bitmap: %w", err)
+			}
+			super.Features.Incompat |= disk.IncompatBitmapAlloc
+		}
+		if err := disk.WriteSuperblock(superblockBytes(device), super); err != nil {
+			return nil, err
+		}
+		noteFlush(flushOriginSuper, disk.SuperblockSize)
+		if err := device.FlushRange(disk.SuperblockOffset, disk.SuperblockSize); err != nil {
+			return nil, fmt.Errorf("failed to write superblock: %w", err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if err := disk.CheckMountable(super.Features); err != nil {
+		err = fmt.Errorf("cannot mount device formatted by %s: %w", super.CreatorVersion, err)
+		if !fs.tolerate(err) {
+			return nil, err
+		}
+	}
+	if err := checkRemount(super, opts, daxSize); err != nil && !fs.tolerate(err) {
+		return nil, err
+	}
+	fs.super = super
+	if opts.ReadOnly {
+		fs.prevMount = super.LastMount
+	} else if err := fs.recordMount(); err != nil {
+		return nil, err
+	}
+	fs.loadWriteEpoch()
+	fs.loadLearnedSizes()
+	fs.warnRecordedErrors()
+	fs.findCrashDumps()
 
-	// Log available space
-	log.Printf("Filesystem initialized with %d MB available space",
-		(daxSize-fs.nextOffset)/(1024*1024))
+	// The block size is fixed when the device is formatted
+	fs.blockSize = int64(super.BlockSize)
+
+	// Space past the metadata reservation is split into regions
+	regions, err := newRegions(opts.Regions, common.ByteCount(daxSize), common.ByteCount(fs.blockSize))
+	if err != nil {
+		return nil, err
+	}
+	fs.regions = regions
+	if err := fs.setupAllocators(); err != nil {
+		if !fs.tolerate(fmt.Errorf("allocation bitmap: %w; using empty free lists", err)) {
+			return nil, err
+		}
+		for _, r := range fs.regions {
+			r.alloc = alloc.NewFreeList(r.Offset, r.Size)
+		}
+	}
+	if opts.LargeFileRegion != "" && !fs.hasRegion(opts.LargeFileRegion) {
+		return nil, fmt.Errorf("unknown large file region %q", opts.LargeFileRegion)
+	}
+	switch opts.DirSync {
+	case "", DirSyncBatch, DirSyncFull, DirSyncNone:
+	default:
+		return nil, fmt.Errorf("unknown directory sync mode %q", opts.DirSync)
+	}
+	switch opts.SyncMode {
+	case "", SyncModeDefault, SyncModeStrict:
+	default:
+		return nil, fmt.Errorf("unknown sync mode %q", opts.SyncMode)
+	}
+	if opts.SyncMode == SyncModeStrict && opts.WritebackCache {
+		log.Printf("Warning: strict sync mode with the kernel writeback cache only makes " +
+			"writes durable once the kernel sends them")
+	}
+	switch opts.Placement {
+	case "", PlacementPack, PlacementSpread:
+	default:
+		return nil, fmt.Errorf("unknown placement policy %q", opts.Placement)
+	}
+	switch opts.OnFlushErrors {
+	case "", OnFlushErrorsFail, OnFlushErrorsContinue:
+	default:
+		return nil, fmt.Errorf("unknown flush error policy %q", opts.OnFlushErrors)
+	}
+	if opts.MaxDirtyBytes < 0 || opts.DirtyLowBytes < 0 {
+		return nil, fmt.Errorf("dirty byte watermarks must not be negative")
+	}
+	if opts.BackgroundMaxLatency < 0 || opts.BackgroundMaxDefer < 0 {
+		return nil, fmt.Errorf("background latency and defer limits must not be negative")
+	}
+	if opts.ReuseDelay < 0 || opts.ReuseDelayBytes < 0 {
+		return nil, fmt.Errorf("reuse delay must not be negative")
+	}
+	if opts.MaxPinnedBytes < 0 {
+		return nil, fmt.Errorf("pinned byte limit must not be negative")
+	}
+	if opts.WriteEpochInterval < 0 {
+		return nil, fmt.Errorf("write epoch interval must not be negative")
+	}
+	if opts.SlowOpThreshold < 0 || opts.MaxBackground < 0 {
+		return nil, fmt.Errorf("slow operation threshold and max background must not be negative")
+	}
+	if !opts.StaticInitialSize && (opts.InitialSizePercentile < 1 || opts.InitialSizePercentile > 100) {
+		return nil, fmt.Errorf("initial size percentile %d must be between 1 and 100", opts.InitialSizePercentile)
+	}
+	if opts.MaxDirtyBytes > 0 && opts.DirtyLowBytes >= opts.MaxDirtyBytes {
+		return nil, fmt.Errorf("low dirty watermark %d must be below the maximum of %d",
+			opts.DirtyLowBytes, opts.MaxDirtyBytes)
+	}
+
+	fs.meta = newMetaBatch(func() error {
+		size := common.ByteCount(device.Size())
+		noteFlush(flushOriginMetadata, int64(size))
+		if err := device.Flush(); err != nil {
+			fs.flushFailed(0, size, err)
+			return err
+		}
+		fs.flushSucceeded(0, size)
+		return nil
+	}, opts.MetaBatchSize, opts.MetaBatchDelay, fs.clock)
+	fs.ctlDir = newCtlDir(fs)
 
 	// Create the root directory
 	fs.rootDir = &Dir{
 		nodeAttr: nodeAttr{
-			fs:      fs,
-			inode:   1,
-			name:    "/",
-			mode:    0755 | os.ModeDir,
-			uid:     uint32(os.Getuid()),
-			gid:     uint32(os.Getgid()),
-			size:    4096,
-			modTime: time.Now(),
+			fs:    fs,
+			inode: 1,
+			name:  "/",
+			mode:  0755 | os.ModeDir,
+			uid:   uint32(os.Getuid()),
+			gid:   uint32(os.Getgid()),
+			size:  4096,
 		},
 		children: make(map[string]Node),
 	}
+	fs.rootDir.touch(fs.clock.Now())
+	fs.indexNode(fs.rootDir.inode, fs.rootDir)
+
+	fs.accountNode(nodeBytes(fs.rootDir, fs.rootDir.name))
+	fs.loadWriteStamps()
+	fs.scan()
+	if !opts.ReadOnly {
+		if err := fs.setupFlushStrategy(); err != nil {
+			return nil, err
+		}
+		if err := fs.selfTest(); err != nil {
+			return nil, err
+		}
+		fs.startFlusher()
+		fs.startCompactor()
+		fs.startEpochAdvancer()
+		fs.startTreeSettler()
+		fs.startMetaGuard()
+	}
+	metrics.Default.OnCollect(fs.publishGauges)
+
+	// Log available space
+	var available common.ByteCount
+	for _, r := range fs.regionStats() {
+		available += r.FreeBytes
+		if len(fs.regions) > 1 {
+			log.Printf("Region %s: %d MB at offset %d", r.Name, r.Size/(1024*1024), r.Offset)
+		}
+	}
+	log.Printf("Filesystem initialized with %d MB available space", available/(1024*1024))
 
 	return fs, nil
 }
@@ -76,116 +337,227 @@ func (f *Filesystem) Root() (fs.Node, error) {
 	return f.rootDir, nil
 }
 
-// allocateSpace allocates space on the DAX device
-func (f *Filesystem) allocateSpace(size int64) int64 {
-	f.offsetMu.Lock()
-	defer f.offsetMu.Unlock()
+// allocateSpace allocates space on the DAX device, preferring the named
+// region and spilling to the others in configured order when it is full.
+// It fails with ENOSPC when no region can hold the request.
+func (f *Filesystem) allocateSpace(inode uint64, size common.ByteCount, preferred string) (common.DeviceOffset, error) {
+	if size <= 0 {
+		return 0, syscall.EINVAL
+	}
+
+	deviceSize := common.ByteCount(f.device.Size())
+	if size > deviceSize {
+		return 0, syscall.ENOSPC
+	}
+
+	f.statsMu.RLock()
+	defer f.statsMu.RUnlock()
+	f.allocMu.Lock()
+	defer f.allocMu.Unlock()
 
 	// Round up size to alignment boundary
-	alignedSize := ((size + common.BlockAlignmentSize - 1) /
-		common.BlockAlignmentSize) * common.BlockAlignmentSize
-
-	// First try to find space in the free list
-	f.freeSpacesMu.Lock()
-	defer f.freeSpacesMu.Unlock()
-
-	for i, space := range f.freeSpaces {
-		if space.size >= alignedSize {
-			// Found suitable space
-			offset := space.offset
-
-			// Update or remove from free list
-			if space.size > alignedSize {
-				// Shrink the free space
-				f.freeSpaces[i].offset += alignedSize
-				f.freeSpaces[i].size -= alignedSize
-			} else {
-				// Remove this free space
-				f.freeSpaces = append(f.freeSpaces[:i], f.freeSpaces[i+1:]...)
-			}
+	alignedSize := f.alignSize(size)
+
+	// Freed space is only usable once the mount scan has reclaimed it
+	tailOnly := atomic.LoadInt32(&f.freeListReady) == 0
 
-			return offset
+	f.expireQuarantineLocked()
+	if offset, ok := f.allocAnyLocked(inode, alignedSize, preferred, tailOnly); ok {
+		return offset, nil
+	}
+	// Quarantined extents count as free, so they are given up before
+	// reporting the device full
+	if f.drainQuarantineLocked() {
+		if offset, ok := f.allocAnyLocked(inode, alignedSize, preferred, tailOnly); ok {
+			return offset, nil
 		}
 	}
+	return 0, syscall.ENOSPC
+}
 
-	// No suitable free space, allocate at the end
-	offset := f.nextOffset
-
-	// Update next available offset
-	f.nextOffset += alignedSize
-
-	return offset
+// allocAnyLocked allocates from the preferred region, then from the
+// others in spill order. Called with allocMu held.
+func (f *Filesystem) allocAnyLocked(inode uint64, alignedSize common.ByteCount, preferred string, tailOnly bool) (common.DeviceOffset, bool) {
+	for _, r := range f.regions {
+		if r.Name == preferred {
+			if offset, ok := f.allocIn(r, inode, alignedSize, tailOnly); ok {
+				f.allocLog.record(allocOpAlloc, inode, offset, alignedSize, r.Name)
+				return offset, true
+			}
+		}
+	}
+	for _, r := range f.regions {
+		if r.Name == preferred {
+			continue
+		}
+		if offset, ok := f.allocIn(r, inode, alignedSize, tailOnly); ok {
+			if preferred != "" {
+				allocSpills.Inc()
+			}
+			f.allocLog.record(allocOpAlloc, inode, offset, alignedSize, r.Name)
+			return offset, true
+		}
+	}
+	return 0, false
 }
 
-// freeSpace returns space to the pool
-func (f *Filesystem) freeSpace(offset int64, size int64) {
+// freeSpace returns space released by inode to the pool. A shared extent
+// only loses an owner until the last one releases it.
+func (f *Filesystem) freeSpace(inode uint64, offset common.DeviceOffset, size common.ByteCount) {
 	if size <= 0 {
 		return // Nothing to free
 	}
+	if !f.refs.release(offset) {
+		f.allocLog.record(allocOpUnshare, inode, offset, f.alignSize(size), "")
+		return
+	}
 
 	// Round up size to alignment boundary
-	alignedSize := ((size + common.BlockAlignmentSize - 1) / common.BlockAlignmentSize) * common.BlockAlignmentSize
+	alignedSize := f.alignSize(size)
 
-	f.freeSpacesMu.Lock()
-	defer f.freeSpacesMu.Unlock()
+	f.allocLog.record(allocOpFree, inode, offset, alignedSize, "")
 
-	// Add to free list
-	f.freeSpaces = append(f.freeSpaces, freeSpace{
-		offset: offset,
-		size:   alignedSize,
-	})
+	f.statsMu.RLock()
+	defer f.statsMu.RUnlock()
+	f.allocMu.Lock()
+	defer f.allocMu.Unlock()
+
+	for _, r := range f.regions {
+		if r.contains(offset, alignedSize) {
+			if f.reuseDelayed() {
+				f.quarantineLocked(r, inode, offset, alignedSize)
+			} else {
+				r.alloc.Free(offset, alignedSize)
+			}
+			return
+		}
+	}
+	log.Printf("Warning: inode %d freed %d bytes at %d outside every region", inode, alignedSize, offset)
 }
 
-// Fsync flushes filesystem changes to the DAX device
+// Fsync flushes the whole DAX device. A failed flush is logged and
+// reported as EIO so callers never mistake lost data for durable data.
 func (f *Filesystem) Fsync() error {
 	// Check if device is available
 	if f.device == nil {
 		return fmt.Errorf("device not available")
 	}
 
-	// Try to flush, but handle potential errors
-	err := f.device.Flush()
-	if err != nil {
-		// Log the error and continue
-		fmt.Printf("Warning: device flush error: %v\n", err)
+	size := common.ByteCount(f.device.Size())
+	noteFlush(flushOriginDevice, int64(size))
+	if err := f.device.Flush(); err != nil {
+		deviceFlushErrors.Inc()
+		if f.flushFailed(0, size, err) {
+			log.Printf("Warning: device flush error: %v", err)
+		}
+		return syscall.EIO
 	}
+	f.flushSucceeded(0, size)
+	return nil
+}
 
+// flushRange makes [offset, offset+length) of the device durable, reporting
+// failure as EIO. Device.FlushRange handles msync's page alignment.
+func (f *Filesystem) flushRange(offset common.DeviceOffset, length common.ByteCount) error {
+	noteFlush(flushOriginData, int64(length))
+	if err := f.device.FlushRange(offset, length); err != nil {
+		deviceFlushErrors.Inc()
+		if f.flushFailed(offset, length, err) {
+			log.Printf("Warning: device flush error: %v", err)
+		}
+		return syscall.EIO
+	}
+	f.flushSucceeded(offset, length)
 	return nil
 }
 
-// nextInode generates a new inode number
-func (f *Filesystem) nextInode() uint64 {
-	f.inodeCount++
-	return f.inodeCount
+// SyncMetadata is a hard barrier for batched metadata mutations
+func (f *Filesystem) SyncMetadata() error {
+	if err := f.meta.sync(); err != nil {
+		log.Printf("Warning: metadata flush error: %v", err)
+		return syscall.EIO
+	}
+	return nil
 }
 
-// CreateFile creates a new file with the given name
-func (f *Filesystem) CreateFile(name string) (*File, error) {
-	// Use default initial file size from constants
-	initialSize := common.DefaultInitialFileSize
+// Close stops the background workers, then makes everything durable
+// with SyncFS; later mutations flush immediately
+func (f *Filesystem) Close() error {
+	f.logGrowSummary()
+	f.workers.close()
+	err := f.saveLearnedSizes()
+	if serr := f.SyncFS(); err == nil {
+		err = serr
+	}
+	if cerr := f.meta.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// initialAllocation returns the extent size given to new files: the
+// default from constants, except in small-block mode, where tiny files
+// are the reason for the format and get a single block
+func (f *Filesystem) initialAllocation() int64 {
+	if f.blockSize < common.BlockAlignmentSize {
+		return f.blockSize
+	}
+	return common.DefaultInitialFileSize
+}
 
-	// Allocate space for the file
-	offset := f.allocateSpace(initialSize)
+// checkInitialSize validates an initial extent size set on a directory:
+// whole blocks, no larger than a single allocation or file may be
+func (f *Filesystem) checkInitialSize(size int64) error {
+	if size <= 0 || size%f.blockSize != 0 || size > common.MaxAllocationSize || size > f.opts.MaxFileSize {
+		return syscall.EINVAL
+	}
+	return nil
+}
 
-	// Get the data from the DAX device
-	daxData := f.device.MmapData()
+// CreateFile creates a new file with the given name whose extent starts
+// initialSize bytes long; zero uses the filesystem default. With delayed
+// allocation the file starts buffered and gets its extent later.
+func (f *Filesystem) CreateFile(name string, initialSize int64) (*File, error) {
+	if initialSize == 0 {
+		initialSize = f.initialAllocation()
+	}
+	inode, gen, err := f.nextInode()
+	if err != nil {
+		return nil, err
+	}
 
-	// Create a new file object with the DAX slice
+	// Create a new file object
 	file := &File{
 		nodeAttr: nodeAttr{
-			fs:      f,
-			inode:   f.nextInode(),
-			name:    name,
-			mode:    0644,
-			uid:     uint32(os.Getuid()),
-			gid:     uint32(os.Getgid()),
-			size:    0, // Initially empty
-			modTime: time.Now(),
+			fs:         f,
+			inode:      inode,
+			generation: gen,
+			name:       name,
+			mode:       0644,
+			uid:        uint32(os.Getuid()),
+			gid:        uint32(os.Getgid()),
+			size:       0, // Initially empty
 		},
-		data:   daxData[offset : offset+initialSize],
-		offset: offset,
-		size:   0,
+		size:        0,
+		epoch:       &readEpoch{},
+		initialSize: initialSize,
 	}
+	if f.opts.DelayAllocBudget > 0 {
+		file.startDelay()
+	} else {
+		// Allocate space for the file from the DAX device
+		extent := common.ByteCount(initialSize)
+		offset, err := f.allocateSpace(inode, extent, f.placement("", extent))
+		if err != nil {
+			f.releaseInode(inode)
+			f.unclaimInode()
+			return nil, err
+		}
+		file.data = f.device.At(offset, extent)
+		file.offset = offset
+	}
+	file.touch(f.clock.Now())
+	file.stampLocked(0, 0)
 
 	return file, nil
 }
@@ -193,54 +565,52 @@ func (f *Filesystem) CreateFile(name string) (*File, error) {
 // Statfs implements the fs.FS interface and provides filesystem statistics
 func (f *Filesystem) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
 	// Get total device size
-	daxData := f.device.MmapData()
-	totalSize := uint64(len(daxData))
-
-	// Calculate used space with bounds checking
-	// nextOffset tracks space allocation
-	usedOffset := uint64(f.nextOffset)
-	metadataReservation := uint64(common.MetadataReservationSize)
-
-	// Ensure usedOffset is at least as large as the metadata reservation
-	// to prevent underflow in the next calculation
-	if usedOffset < metadataReservation {
-		usedOffset = metadataReservation
-	}
-
-	// Calculate used space (nextOffset minus metadata reservation)
-	usedSpace := usedOffset - metadataReservation
-
-	// Calculate free space with bounds checking
-	var freeSpace uint64
-	if totalSize > usedSpace {
-		freeSpace = totalSize - usedSpace
-	} else {
-		// If we somehow used more than the total (should not happen),
-		// report zero free space
-		freeSpace = 0
+	totalSize := uint64(f.device.Size())
+
+	// Read the region tails and free list under the stats barrier: an
+	// allocation moves space between them, and reading them apart could
+	// count it twice or not at all
+	f.statsMu.Lock()
+	regions := f.regionStats()
+	f.statsMu.Unlock()
+
+	// Calculate used and free space, never letting a bad region count
+	// wrap around. Quarantined extents are reclaimable on demand, so
+	// they count as free.
+	var usedSpace, freeSpace uint64
+	for _, r := range regions {
+		if used := r.AllocatedBytes - r.QuarantinedBytes; used > 0 {
+			usedSpace += uint64(used)
+		}
+		if free := r.FreeBytes + r.QuarantinedBytes; free > 0 {
+			freeSpace += uint64(free)
+		}
 	}
 
-	// Set a reasonable block size that aligns with most filesystem expectations
-	blockSize := uint32(4096)
+	// Report the allocation block size the device was formatted with
+	blockSize := uint32(f.blockSize)
 
-	// Calculate blocks with proper rounding up
+	// Round the total up but free space down: a partial block can't be
+	// allocated
 	totalBlocks := (totalSize + uint64(blockSize) - 1) / uint64(blockSize)
-	freeBlocks := (freeSpace + uint64(blockSize) - 1) / uint64(blockSize)
+	freeBlocks := freeSpace / uint64(blockSize)
 
 	// Sanity check to prevent reporting more free blocks than total
 	if freeBlocks > totalBlocks {
 		freeBlocks = totalBlocks
 	}
+	if usedSpace > totalSize {
+		usedSpace = totalSize
+	}
 
 	// Fill in the response
-	resp.Blocks = totalBlocks         // Total data blocks
-	resp.Bfree = freeBlocks           // Free blocks
-	resp.Bavail = freeBlocks          // Available blocks (same as free for now)
-	resp.Files = uint64(f.inodeCount) // Total files (inodes)
-	resp.Ffree = uint64(1<<63 - 1)    // Free files (practically unlimited)
-	resp.Bsize = blockSize            // Block size
-	resp.Namelen = 255                // Maximum name length
-	resp.Frsize = blockSize           // Fragment size (same as block size)
+	resp.Blocks = totalBlocks                  // Total data blocks
+	resp.Bfree = freeBlocks                    // Free blocks
+	resp.Bavail = freeBlocks                   // Available blocks (same as free for now)
+	resp.Files, resp.Ffree = f.inodeCapacity() // Total and free inodes
+	resp.Bsize = blockSize                     // Block size
+	resp.Namelen = disk.MaxNameLen             // Maximum name length
+	resp.Frsize = blockSize                    // Fragment size (same as block size)
 
 	// Log filesystem statistics if debug mode is enabled
 	if *debugMode {
@@ -249,12 +619,18 @@ func (f *Filesystem) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *
 			freeSpace/(1024*1024),
 			usedSpace/(1024*1024),
 			float64(usedSpace)*100.0/float64(totalSize))
+		if len(f.regions) > 1 {
+			for _, r := range regions {
+				fmt.Printf("  region %s: allocated=%d MB, free=%d MB\n",
+					r.Name, r.AllocatedBytes/(1024*1024), r.FreeBytes/(1024*1024))
+			}
+		}
 	}
 
 	return nil
 }
 
-// Serve serves the filesystem over FUSE
-func Serve(c *fuse.Conn, filesystem *Filesystem) error {
-	return fs.Serve(c, filesystem)
+// walkFiles calls fn for every regular file in the filesystem
+func (f *Filesystem) walkFiles(fn func(p string, file *File)) {
+	f.rootDir.walkFiles("/", fn)
 }
@@ -0,0 +1,120 @@
+package fstest
+
+import (
+	"sync"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+)
+
+// CrashDevice is an in-memory device that also keeps the image a power
+// failure would leave behind: only the bytes a Flush or FlushRange made
+// durable. Every flush is a barrier, counted from one. CrashAt picks a
+// barrier to capture the durable image on both sides of, so a test can
+// remount what a crash just before and just after it would leave.
+type CrashDevice struct {
+	*dax.MemDevice
+	mu       sync.Mutex
+	durable  []byte
+	barriers int
+	at       int    // Barrier to capture around, zero for none
+	before   []byte // Durable image as barrier at began
+	after    []byte // And once it completed
+}
+
+// NewCrashDevice returns a zeroed crash-simulating device of size bytes
+func NewCrashDevice(size int64) *CrashDevice {
+	return &CrashDevice{
+		MemDevice: dax.NewMemDevice(size),
+		durable:   make([]byte, size),
+	}
+}
+
+// Flush implements dax.Backend, making the whole mapping durable
+func (d *CrashDevice) Flush() error {
+	return d.barrier(0, common.ByteCount(d.Size()))
+}
+
+// FlushRange implements dax.Backend
+func (d *CrashDevice) FlushRange(offset common.DeviceOffset, length common.ByteCount) error {
+	return d.barrier(offset, length)
+}
+
+// barrier copies [offset, offset+length) to the durable image,
+// capturing the image around it if it is the barrier asked for
+func (d *CrashDevice) barrier(offset common.DeviceOffset, length common.ByteCount) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.barriers++
+	capture := d.barriers == d.at
+	if capture {
+		d.before = append([]byte(nil), d.durable...)
+	}
+	if src := d.MemDevice.At(offset, length); src != nil {
+		copy(d.durable[offset:], src)
+	}
+	if capture {
+		d.after = append([]byte(nil), d.durable...)
+	}
+	return d.MemDevice.FlushRange(offset, length)
+}
+
+// Barriers returns the number of flushes so far
+func (d *CrashDevice) Barriers() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.barriers
+}
+
+// CrashAt captures the durable image on both sides of barrier n
+func (d *CrashDevice) CrashAt(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.at, d.before, d.after = n, nil, nil
+}
+
+// Captured returns devices holding the images a crash just before and
+// just after the barrier given to CrashAt would leave, or false if that
+// barrier has not been reached
+func (d *CrashDevice) Captured() (before, after *dax.MemDevice, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.before == nil {
+		return nil, nil, false
+	}
+	return imageDevice(d.before), imageDevice(d.after), true
+}
+
+// Crash returns a device holding what a crash now would leave
+func (d *CrashDevice) Crash() *dax.MemDevice {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return imageDevice(d.durable)
+}
+
+// imageDevice returns an in-memory device with a copy of image
+func imageDevice(image []byte) *dax.MemDevice {
+	device := dax.NewMemDevice(int64(len(image)))
+	copy(device.At(0, common.ByteCount(len(image))), image)
+	return device
+}
+
+// NewWithCrash is New on a CrashDevice, kept in Crash, so a test can
+// remount what a crash at any barrier would leave with Remount
+func NewWithCrash(size int64, opts fs.Options) (*Harness, error) {
+	h, err := newHarness(size)
+	if err != nil {
+		return nil, err
+	}
+	h.Crash = NewCrashDevice(h.Device.Size())
+	h.Device = h.Crash.MemDevice
+	return h, h.mount(h.Crash, opts)
+}
+
+// Remount mounts device, such as a crash image, with a harness of its
+// own sharing this one's clock
+func (h *Harness) Remount(device *dax.MemDevice, opts fs.Options) (*Harness, error) {
+	other := &Harness{Device: device, Clock: h.Clock, ctx: h.ctx}
+	return other, other.mount(device, opts)
+}
@@ -0,0 +1,437 @@
+// Package fstest drives the filesystem's FUSE handlers directly, without
+// the kernel or /dev/fuse. A Harness mounts a Filesystem on an in-memory
+// device with a fake clock and builds the fuse request structs the kernel
+// would send, so permissions, errno mapping, timestamps and allocation can
+// be exercised by plain go test in CI containers. Tests that need the
+// kernel's own behavior, such as its caches, still belong to a separate
+// integration tier that mounts for real.
+package fstest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"aethelfs/internal/clock"
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+)
+
+// DefaultSize is the device size New uses when given zero
+const DefaultSize = 64 * 1024 * 1024
+
+// Epoch is the time the fake clock of a new Harness starts at
+var Epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Harness is a mounted filesystem whose handlers are called directly.
+// Requests carry the identity in Header, root by default; As returns a
+// harness acting as another user.
+type Harness struct {
+	FS     *fs.Filesystem
+	Device *dax.MemDevice
+	Faults *dax.FaultDevice // Set by NewWithFaults
+	Crash  *CrashDevice     // Set by NewWithCrash
+	Clock  *clock.Fake
+	Header fuse.Header
+	ctx    context.Context
+}
+
+// New formats and mounts an in-memory device of size bytes (DefaultSize
+// if zero). Background workers that would race a test are turned off
+// unless opts sets them; opts.Clock is replaced by the harness clock.
+func New(size int64, opts fs.Options) (*Harness, error) {
+	h, err := newHarness(size)
+	if err != nil {
+		return nil, err
+	}
+	return h, h.mount(h.Device, opts)
+}
+
+// NewWithFaults is New with the device wrapped in a FaultDevice, kept in
+// Faults, so a test can make its flushes fail, panic or corrupt data
+func NewWithFaults(size int64, opts fs.Options) (*Harness, error) {
+	h, err := newHarness(size)
+	if err != nil {
+		return nil, err
+	}
+	h.Faults = dax.NewFaultDevice(h.Device)
+	return h, h.mount(h.Faults, opts)
+}
+
+// newHarness returns an unmounted harness over a zeroed in-memory device
+func newHarness(size int64) (*Harness, error) {
+	if size == 0 {
+		size = DefaultSize
+	}
+	if size < common.MinDeviceSize {
+		return nil, fmt.Errorf("device of %d bytes is below the %d byte minimum", size, common.MinDeviceSize)
+	}
+	return &Harness{
+		Device: dax.NewMemDevice(size),
+		Clock:  clock.NewFake(Epoch),
+		ctx:    context.Background(),
+	}, nil
+}
+
+// mount mounts the filesystem on device with the harness clock
+func (h *Harness) mount(device dax.Backend, opts fs.Options) error {
+	opts.Clock = h.Clock
+	filesystem, err := fs.NewFilesystem(device, opts)
+	if err != nil {
+		return err
+	}
+	h.FS = filesystem
+	return nil
+}
+
+// Mount mounts the filesystem on an existing device, such as a
+// file-backed dax.Device for benchmarks, with opts as given, including
+// its clock. Device and Clock are left nil, so Advance cannot be used.
+func Mount(device dax.Backend, opts fs.Options) (*Harness, error) {
+	filesystem, err := fs.NewFilesystem(device, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Harness{FS: filesystem, ctx: context.Background()}, nil
+}
+
+// NewDefault is New with fs.DefaultOptions, minus the background flusher
+// and compactor
+func NewDefault() (*Harness, error) {
+	opts := fs.DefaultOptions()
+	opts.FlushInterval = 0
+	opts.CompactRate = 0
+	return New(0, opts)
+}
+
+// Close unmounts the filesystem, making everything durable first
+func (h *Harness) Close() error {
+	return h.FS.Close()
+}
+
+// As returns a harness sharing the filesystem whose requests come from
+// uid and gid
+func (h *Harness) As(uid, gid uint32) *Harness {
+	other := *h
+	other.Header = fuse.Header{Uid: uid, Gid: gid, Pid: h.Header.Pid}
+	return &other
+}
+
+// Context returns the context handlers are called with
+func (h *Harness) Context() context.Context {
+	return h.ctx
+}
+
+// Errno returns the errno the kernel would return to the caller for a
+// handler error, using the same mapping as the FUSE server
+func Errno(err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	return syscall.Errno(fuse.ToErrno(err))
+}
+
+// IsErrno reports whether err reaches the caller as want
+func IsErrno(err error, want syscall.Errno) bool {
+	return Errno(err) == want
+}
+
+// Lookup resolves p from the root through each directory's Lookup
+// handler, as the kernel does for an uncached path
+func (h *Harness) Lookup(p string) (fusefs.Node, error) {
+	node, err := h.FS.Root()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range split(p) {
+		dir, ok := node.(fusefs.NodeStringLookuper) // Also the control directory
+		if !ok {
+			return nil, syscall.ENOTDIR
+		}
+		if node, err = dir.Lookup(h.ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// Dir resolves p to a directory
+func (h *Harness) Dir(p string) (*fs.Dir, error) {
+	node, err := h.Lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := node.(*fs.Dir)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+	return dir, nil
+}
+
+// File resolves p to a regular file
+func (h *Harness) File(p string) (*fs.File, error) {
+	node, err := h.Lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := node.(*fs.File)
+	if !ok {
+		return nil, syscall.EISDIR
+	}
+	return file, nil
+}
+
+// parent resolves the directory containing p and returns it with p's
+// last component
+func (h *Harness) parent(p string) (*fs.Dir, string, error) {
+	names := split(p)
+	if len(names) == 0 {
+		return nil, "", syscall.EEXIST
+	}
+	dir, err := h.Dir(path.Join(names[:len(names)-1]...))
+	return dir, names[len(names)-1], err
+}
+
+// Mkdir creates the directory p
+func (h *Harness) Mkdir(p string, mode os.FileMode) (*fs.Dir, error) {
+	dir, name, err := h.parent(p)
+	if err != nil {
+		return nil, err
+	}
+	node, err := dir.Mkdir(h.ctx, &fuse.MkdirRequest{Header: h.Header, Name: name, Mode: mode | os.ModeDir})
+	if err != nil {
+		return nil, err
+	}
+	return node.(*fs.Dir), nil
+}
+
+// Create creates the regular file p, opened for reading and writing
+func (h *Harness) Create(p string, mode os.FileMode) (*fs.File, error) {
+	dir, name, err := h.parent(p)
+	if err != nil {
+		return nil, err
+	}
+	req := &fuse.CreateRequest{Header: h.Header, Name: name, Mode: mode, Flags: fuse.OpenReadWrite}
+	node, _, err := dir.Create(h.ctx, req, &fuse.CreateResponse{})
+	if err != nil {
+		return nil, err
+	}
+	return node.(*fs.File), nil
+}
+
+// Remove removes the file or empty directory p
+func (h *Harness) Remove(p string) error {
+	dir, name, err := h.parent(p)
+	if err != nil {
+		return err
+	}
+	node, err := dir.Lookup(h.ctx, name)
+	if err != nil {
+		return err
+	}
+	_, isDir := node.(*fs.Dir)
+	return dir.Remove(h.ctx, &fuse.RemoveRequest{Header: h.Header, Name: name, Dir: isDir})
+}
+
+// Rename moves the file or directory from to the path to, replacing a
+// file there
+func (h *Harness) Rename(from, to string) error {
+	src, oldName, err := h.parent(from)
+	if err != nil {
+		return err
+	}
+	dst, newName, err := h.parent(to)
+	if err != nil {
+		return err
+	}
+	return src.Rename(h.ctx, &fuse.RenameRequest{Header: h.Header, OldName: oldName, NewName: newName}, dst)
+}
+
+// WriteAt writes data to file at off and returns the bytes accepted
+func (h *Harness) WriteAt(file *fs.File, off int64, data []byte) (int, error) {
+	req := &fuse.WriteRequest{Header: h.Header, Offset: off, Data: data, FileFlags: fuse.OpenReadWrite}
+	resp := &fuse.WriteResponse{}
+	err := file.Write(h.ctx, req, resp)
+	return resp.Size, err
+}
+
+// ReadAt reads up to size bytes of file at off
+func (h *Harness) ReadAt(file *fs.File, off int64, size int) ([]byte, error) {
+	req := &fuse.ReadRequest{Header: h.Header, Offset: off, Size: size, FileFlags: fuse.OpenReadOnly}
+	resp := &fuse.ReadResponse{}
+	if err := file.Read(h.ctx, req, resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// ReadFile reads the whole of the file at p
+func (h *Harness) ReadFile(p string) ([]byte, error) {
+	file, err := h.File(p)
+	if err != nil {
+		return nil, err
+	}
+	attr, err := h.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	// Reads are clamped to a maximum size, as the kernel splits them
+	data := make([]byte, 0, attr.Size)
+	for int64(len(data)) < int64(attr.Size) {
+		chunk, err := h.ReadAt(file, int64(len(data)), int(attr.Size)-len(data))
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// WriteFile creates the file at p, or truncates an existing one, and
+// writes data to it
+func (h *Harness) WriteFile(p string, data []byte, mode os.FileMode) (*fs.File, error) {
+	file, err := h.File(p)
+	if IsErrno(err, syscall.ENOENT) {
+		file, err = h.Create(p, mode)
+	} else if err == nil {
+		err = h.Truncate(file, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.WriteAt(file, 0, data); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Fsync makes file durable
+func (h *Harness) Fsync(file *fs.File) error {
+	return file.Fsync(h.ctx, &fuse.FsyncRequest{Header: h.Header})
+}
+
+// Fdatasync makes file's data durable as fdatasync(2) does
+func (h *Harness) Fdatasync(file *fs.File) error {
+	return file.Fsync(h.ctx, &fuse.FsyncRequest{Header: h.Header, Flags: 1})
+}
+
+// Forget drops the kernel's last reference to node, as when it is
+// evicted from the inode cache; a removed file is purged then
+func (h *Harness) Forget(node fusefs.Node) {
+	if forgetter, ok := node.(fusefs.NodeForgetter); ok {
+		forgetter.Forget()
+	}
+}
+
+// Statfs returns the filesystem statistics df reports
+func (h *Harness) Statfs() (fuse.StatfsResponse, error) {
+	var resp fuse.StatfsResponse
+	err := h.FS.Statfs(h.ctx, &fuse.StatfsRequest{Header: h.Header}, &resp)
+	return resp, err
+}
+
+// Stat returns the attributes of node
+func (h *Harness) Stat(node fusefs.Node) (fuse.Attr, error) {
+	var attr fuse.Attr
+	err := node.Attr(h.ctx, &attr)
+	return attr, err
+}
+
+// Setattr sends a setattr request to node, which must handle it, and
+// returns the attributes after it as the server does, from node's Attr
+func (h *Harness) Setattr(node fusefs.Node, req *fuse.SetattrRequest) (fuse.Attr, error) {
+	setter, ok := node.(fusefs.NodeSetattrer)
+	if !ok {
+		return fuse.Attr{}, syscall.ENOSYS
+	}
+	req.Header = h.Header
+	resp := &fuse.SetattrResponse{}
+	if err := setter.Setattr(h.ctx, req, resp); err != nil {
+		return resp.Attr, err
+	}
+	err := node.Attr(h.ctx, &resp.Attr)
+	return resp.Attr, err
+}
+
+// Getxattr reads the extended attribute name of node
+func (h *Harness) Getxattr(node fusefs.Node, name string) ([]byte, error) {
+	getter, ok := node.(fusefs.NodeGetxattrer)
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+	resp := &fuse.GetxattrResponse{}
+	err := getter.Getxattr(h.ctx, &fuse.GetxattrRequest{Header: h.Header, Name: name}, resp)
+	return resp.Xattr, err
+}
+
+// Setxattr sets the extended attribute name of node to value
+func (h *Harness) Setxattr(node fusefs.Node, name string, value []byte) error {
+	setter, ok := node.(fusefs.NodeSetxattrer)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	return setter.Setxattr(h.ctx, &fuse.SetxattrRequest{Header: h.Header, Name: name, Xattr: value})
+}
+
+// Removexattr removes the extended attribute name of node
+func (h *Harness) Removexattr(node fusefs.Node, name string) error {
+	remover, ok := node.(fusefs.NodeRemovexattrer)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	return remover.Removexattr(h.ctx, &fuse.RemovexattrRequest{Header: h.Header, Name: name})
+}
+
+// Truncate sets the size of file
+func (h *Harness) Truncate(file *fs.File, size uint64) error {
+	_, err := h.Setattr(file, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: size})
+	return err
+}
+
+// Chmod sets the permission bits of node
+func (h *Harness) Chmod(node fusefs.Node, mode os.FileMode) error {
+	_, err := h.Setattr(node, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: mode})
+	return err
+}
+
+// Chown sets the owner of node
+func (h *Harness) Chown(node fusefs.Node, uid, gid uint32) error {
+	_, err := h.Setattr(node, &fuse.SetattrRequest{Valid: fuse.SetattrUid | fuse.SetattrGid, Uid: uid, Gid: gid})
+	return err
+}
+
+// ReadDir lists the directory p through its ReadDirAll handler
+func (h *Harness) ReadDir(p string) ([]fuse.Dirent, error) {
+	dir, err := h.Dir(p)
+	if err != nil {
+		return nil, err
+	}
+	return dir.ReadDirAll(h.ctx)
+}
+
+// Advance moves the harness clock forward, firing the timers due by then
+func (h *Harness) Advance(d time.Duration) {
+	h.Clock.Advance(d)
+}
+
+// split returns the components of p
+func split(p string) []string {
+	var names []string
+	for _, name := range strings.Split(path.Clean("/"+p), "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
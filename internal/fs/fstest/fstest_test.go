@@ -0,0 +1,215 @@
+package fstest_test
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/fs/fstest"
+)
+
+func newHarness(t *testing.T) *fstest.Harness {
+	t.Helper()
+	h, err := fstest.NewDefault()
+	if err != nil {
+		t.Fatalf("NewDefault: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	h := newHarness(t)
+	if _, err := h.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte("aethelfs"), 20000)
+	file, err := h.WriteFile("/dir/file", want, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.ReadFile("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read back %d bytes differing from the %d written", len(got), len(want))
+	}
+	attr, err := h.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Size != uint64(len(want)) {
+		t.Errorf("size = %d, want %d", attr.Size, len(want))
+	}
+
+	entries, err := h.ReadDir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "file" || entries[0].Type != fuse.DT_File {
+		t.Errorf("listing = %+v, want the one file", entries)
+	}
+}
+
+func TestErrnos(t *testing.T) {
+	h := newHarness(t)
+	if _, err := h.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Create("/dir/file", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Mkdir("/dir/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// remove sends an rmdir or an unlink whatever name is
+	remove := func(name string, rmdir bool) error {
+		dir, err := h.Dir("/dir")
+		if err != nil {
+			return err
+		}
+		return dir.Remove(h.Context(), &fuse.RemoveRequest{Header: h.Header, Name: name, Dir: rmdir})
+	}
+	tests := []struct {
+		name string
+		op   func() error
+		want syscall.Errno
+	}{
+		{"lookup missing", func() error { _, err := h.Lookup("/missing"); return err }, syscall.ENOENT},
+		{"remove missing", func() error { return h.Remove("/dir/missing") }, syscall.ENOENT},
+		{"remove populated directory", func() error { return h.Remove("/dir") }, syscall.ENOTEMPTY},
+		{"name too long", func() error { _, err := h.Create("/"+strings.Repeat("n", 256), 0644); return err }, syscall.ENAMETOOLONG},
+		{"reserved name", func() error { _, err := h.Create("/.aethelfs", 0644); return err }, syscall.EPERM},
+		{"remove reserved name", func() error { return h.Remove("/.aethelfs") }, syscall.EPERM},
+		{"rmdir file", func() error { return remove("file", true) }, syscall.ENOTDIR},
+		{"unlink directory", func() error { return remove("sub", false) }, syscall.EISDIR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); !fstest.IsErrno(err, tt.want) {
+				t.Errorf("got %v (%d), want %v", err, fstest.Errno(err), tt.want)
+			}
+		})
+	}
+	for _, p := range []string{"/dir/file", "/dir/sub"} {
+		if _, err := h.Lookup(p); err != nil {
+			t.Errorf("%s after refused removes: %v", p, err)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	h := newHarness(t)
+	file, err := h.Create("/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Chown(file, 1000, 1000); err != nil {
+		t.Fatalf("root chown: %v", err)
+	}
+	owner, other := h.As(1000, 1000), h.As(2000, 2000)
+
+	if err := other.Chmod(file, 0666); !fstest.IsErrno(err, syscall.EPERM) {
+		t.Errorf("chmod by another user: %v, want EPERM", err)
+	}
+	if err := owner.Chmod(file, 0600); err != nil {
+		t.Errorf("chmod by the owner: %v", err)
+	}
+	if err := owner.Chown(file, 2000, 1000); !fstest.IsErrno(err, syscall.EPERM) {
+		t.Errorf("owner giving the file away: %v, want EPERM", err)
+	}
+	_, err = other.Setattr(file, &fuse.SetattrRequest{Valid: fuse.SetattrMtimeNow})
+	if !fstest.IsErrno(err, syscall.EACCES) {
+		t.Errorf("touch by a user who may not write: %v, want EACCES", err)
+	}
+
+	attr, err := h.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Uid != 1000 || attr.Mode.Perm() != 0600 {
+		t.Errorf("uid %d mode %v, want 1000 and 0600", attr.Uid, attr.Mode.Perm())
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	h := newHarness(t)
+	if _, err := h.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	file, err := h.Create("/dir/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := h.Dir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := h.Clock.Now()
+
+	h.Advance(time.Second)
+	if _, err := h.WriteAt(file, 0, []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	written := h.Clock.Now()
+	attr, _ := h.Stat(file)
+	if !attr.Mtime.Equal(written) || !attr.Ctime.Equal(written) {
+		t.Errorf("after write mtime %v ctime %v, want both %v", attr.Mtime, attr.Ctime, written)
+	}
+	dirAttr, _ := h.Stat(dir)
+	if !dirAttr.Mtime.Equal(created) {
+		t.Errorf("directory mtime %v moved with a write to a file in it, want %v", dirAttr.Mtime, created)
+	}
+
+	h.Advance(time.Second)
+	if err := h.Chmod(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	attr, _ = h.Stat(file)
+	if !attr.Mtime.Equal(written) || !attr.Ctime.Equal(h.Clock.Now()) {
+		t.Errorf("after chmod mtime %v ctime %v, want %v and %v", attr.Mtime, attr.Ctime, written, h.Clock.Now())
+	}
+
+	h.Advance(time.Second)
+	if _, err := h.Create("/dir/other", 0644); err != nil {
+		t.Fatal(err)
+	}
+	dirAttr, _ = h.Stat(dir)
+	if !dirAttr.Mtime.Equal(h.Clock.Now()) {
+		t.Errorf("directory mtime %v after a create, want %v", dirAttr.Mtime, h.Clock.Now())
+	}
+}
+
+func TestRemoveReturnsSpace(t *testing.T) {
+	h := newHarness(t)
+	before, err := h.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := h.WriteFile("/file", make([]byte, 1<<20), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	during, _ := h.Statfs()
+	if during.Bfree >= before.Bfree {
+		t.Fatalf("free blocks %d after writing 1MB, want fewer than %d", during.Bfree, before.Bfree)
+	}
+
+	if err := h.Remove("/file"); err != nil {
+		t.Fatal(err)
+	}
+	// The extent is freed once the kernel forgets the file
+	h.Forget(file)
+	after, _ := h.Statfs()
+	if after.Bfree != before.Bfree {
+		t.Errorf("free blocks %d after remove, want the %d free before", after.Bfree, before.Bfree)
+	}
+	if after.Ffree != before.Ffree {
+		t.Errorf("free inodes %d after remove, want the %d free before", after.Ffree, before.Ffree)
+	}
+}
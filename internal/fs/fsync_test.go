@@ -0,0 +1,182 @@
+package fs_test
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// syncedFile creates a file of size bytes whose extent and metadata are
+// already durable
+func syncedFile(t testing.TB, h *fstest.Harness, size int) *fs.File {
+	t.Helper()
+	file, err := h.WriteFile("/file", bytes.Repeat([]byte{0x5a}, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Fsync(file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFdatasyncSkipsMetadataFlush(t *testing.T) {
+	h := newHarness(t)
+	file := syncedFile(t, h, 16<<10)
+
+	tests := []struct {
+		name      string
+		n         int
+		sync      func(*fs.File) error
+		wantFlush bool
+	}{
+		// An overwrite at the start of the file batches an mtime update
+		{"fdatasync after overwrite", 4 << 10, h.Fdatasync, false},
+		{"fsync after overwrite", 4 << 10, h.Fsync, true},
+		// The size is needed to read the data back, so it is flushed
+		{"fdatasync after growth", 20 << 10, h.Fdatasync, true},
+		{"fdatasync after a synced growth", 20 << 10, h.Fdatasync, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := h.WriteAt(file, 0, bytes.Repeat([]byte{'d'}, tt.n)); err != nil {
+				t.Fatal(err)
+			}
+			before := fs.MetaBarriers()
+			if err := tt.sync(file); err != nil {
+				t.Fatal(err)
+			}
+			if flushed := fs.MetaBarriers() != before; flushed != tt.wantFlush {
+				t.Errorf("metadata flushed: %v, want %v", flushed, tt.wantFlush)
+			}
+		})
+	}
+}
+
+func TestFdatasyncDataDurable(t *testing.T) {
+	h := newCrashHarness(t, crashOptions(alloc.KindFreeList))
+	file := syncedFile(t, h, 16<<10)
+	extent := file.Layout().Extents[0].Offset
+
+	written := bytes.Repeat([]byte("new!"), 1024)
+	if _, err := h.WriteAt(file, 4096, written); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Fdatasync(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Crash.Crash().At(extent.Plus(4096), common.ByteCount(len(written))); !bytes.Equal(got, written) {
+		t.Error("data not durable after fdatasync")
+	}
+}
+
+func TestFsyncFlushFailure(t *testing.T) {
+	h := newFaultHarness(t, testOptions())
+	file := syncedFile(t, h, 16<<10)
+	extent := file.Layout().Extents[0]
+	if _, err := h.WriteAt(file, 0, []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Faults.FailRange(int64(extent.Offset), int64(extent.Length), syscall.EIO)
+	if err := h.Fsync(file); !fstest.IsErrno(err, syscall.EIO) {
+		t.Errorf("fsync with the extent's flush failing: %v, want EIO", err)
+	}
+	if err := h.Fdatasync(file); !fstest.IsErrno(err, syscall.EIO) {
+		t.Errorf("fdatasync with the extent's flush failing: %v, want EIO", err)
+	}
+	// close(2) reports nothing the caller could act on, so the same
+	// failure leaves flush and release succeeding
+	if err := file.Flush(h.Context(), &fuse.FlushRequest{Header: h.Header}); err != nil {
+		t.Errorf("flush with the device flush failing: %v", err)
+	}
+	if err := file.Release(h.Context(), &fuse.ReleaseRequest{Header: h.Header}); err != nil {
+		t.Errorf("release with the device flush failing: %v", err)
+	}
+	if h.Faults.Failures() == 0 {
+		t.Fatal("no flush failed")
+	}
+
+	h.Faults.Reset()
+	if err := h.Fsync(file); err != nil {
+		t.Errorf("fsync once the device recovers: %v", err)
+	}
+}
+
+func TestFsyncTransientFlushFailure(t *testing.T) {
+	opts := testOptions()
+	opts.FlushErrorLimit = 2
+	h := newFaultHarness(t, opts)
+	file := syncedFile(t, h, 16<<10)
+	extent := file.Layout().Extents[0]
+
+	h.Faults.FailRange(int64(extent.Offset), int64(extent.Length), syscall.EAGAIN)
+	for i := 0; i < 2*opts.FlushErrorLimit; i++ {
+		if _, err := h.WriteAt(file, 0, []byte("retried")); err != nil {
+			t.Fatal(err)
+		}
+		// The data is not durable however often it was retried
+		if err := h.Fsync(file); !fstest.IsErrno(err, syscall.EIO) {
+			t.Fatalf("fsync %d with the flush failing transiently: %v, want EIO", i, err)
+		}
+		if err := h.FS.FlushDirty(); err != nil {
+			t.Fatalf("background flush %d reported %v for a transient failure", i, err)
+		}
+	}
+	if state := h.FS.Degraded(); state != nil {
+		t.Fatalf("degraded by transient failures: %+v", state)
+	}
+
+	// A permanent failure of the same range is reported and escalates
+	h.Faults.Reset()
+	h.Faults.FailRange(int64(extent.Offset), int64(extent.Length), syscall.EIO)
+	if _, err := h.WriteAt(file, 0, []byte("lost")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.FS.FlushDirty(); err == nil {
+		t.Error("background flush reported nothing for a permanent failure")
+	}
+	if err := h.Fsync(file); !fstest.IsErrno(err, syscall.EIO) {
+		t.Errorf("fsync with the flush failing: %v, want EIO", err)
+	}
+	if h.FS.Degraded() == nil {
+		t.Error("not degraded by permanent failures")
+	}
+}
+
+// benchmarkSync times a 4KB overwrite followed by sync
+func benchmarkSync(b *testing.B, sync func(*fstest.Harness, *fs.File) error) {
+	h, err := fstest.New(0, testOptions())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer h.Close()
+	file := syncedFile(b, h, 1<<20)
+	block := bytes.Repeat([]byte{0xa5}, 4096)
+
+	b.SetBytes(int64(len(block)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := h.WriteAt(file, 0, block); err != nil {
+			b.Fatal(err)
+		}
+		if err := sync(h, file); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteFdatasync(b *testing.B) {
+	benchmarkSync(b, (*fstest.Harness).Fdatasync)
+}
+
+func BenchmarkWriteFsync(b *testing.B) {
+	benchmarkSync(b, (*fstest.Harness).Fsync)
+}
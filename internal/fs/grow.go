@@ -0,0 +1,128 @@
+package fs
+
+import (
+	"encoding/json"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	fileGrows = metrics.NewCounter("aethelfs_file_grows_total",
+		"Times a file outgrew its extent and was copied to a larger one")
+	growCopyBytes = metrics.NewCounter("aethelfs_grow_copy_bytes_total",
+		"Bytes copied while relocating growing files")
+	growsPerFile = metrics.NewHistogram("aethelfs_file_grows",
+		"Grows a file went through before its last writer closed it",
+		metrics.ExponentialBuckets(1, 2, 8))
+	finalSizeRatio = metrics.NewHistogram("aethelfs_file_size_initial_ratio",
+		"File size when its last writer closed it, as a multiple of the initial allocation",
+		metrics.ExponentialBuckets(0.25, 2, 16))
+)
+
+// Heuristic thresholds for the per-directory grow warning
+const (
+	growWarnFiles   = 16 // Closed files before a directory is judged
+	growWarnAverage = 4  // Average grows per file that triggers the warning
+)
+
+// growStats aggregates grows per directory so workloads that would benefit
+// from preallocation can be pointed out
+type growStats struct {
+	mu   sync.Mutex
+	dirs map[string]*dirGrowth
+}
+
+// dirGrowth is the grow history of files closed in one directory
+type dirGrowth struct {
+	Dir    string `json:"dir"`
+	Files  int64  `json:"files"`
+	Grows  int64  `json:"grows"`
+	Copied int64  `json:"copied_bytes"`
+	warned bool
+}
+
+// recordGrow counts a relocation that copied n bytes
+func (f *File) recordGrow(n int64) {
+	atomic.AddInt32(&f.grows, 1)
+	atomic.AddInt64(&f.growCopied, n)
+	fileGrows.Inc()
+	growCopyBytes.Add(n)
+}
+
+// closeGrowth records a file's grow history when its last writer closes it
+// and warns once per directory whose files grow egregiously
+func (f *File) closeGrowth() {
+	grows := int64(atomic.SwapInt32(&f.grows, 0))
+	copied := atomic.SwapInt64(&f.growCopied, 0)
+	f.mu.RLock()
+	size := f.size
+	f.mu.RUnlock()
+
+	growsPerFile.Observe(float64(grows))
+	finalSizeRatio.Observe(float64(size) / float64(f.initialSize))
+
+	dir := path.Dir(f.path())
+	g := &f.fs.growth
+	g.mu.Lock()
+	if g.dirs == nil {
+		g.dirs = make(map[string]*dirGrowth)
+	}
+	d := g.dirs[dir]
+	if d == nil {
+		d = &dirGrowth{Dir: dir}
+		g.dirs[dir] = d
+	}
+	d.Files++
+	d.Grows += grows
+	d.Copied += copied
+	warn := !d.warned && d.Files >= growWarnFiles && d.Grows >= growWarnAverage*d.Files
+	if warn {
+		d.warned = true
+	}
+	average := float64(d.Grows) / float64(d.Files)
+	g.mu.Unlock()
+	f.fs.learnFinalSize(dir, size)
+
+	if warn {
+		log.Printf("Files in %s grew an average of %.1f times; consider fallocate or a larger initial size", dir, average)
+	}
+}
+
+// GrowReport summarizes file growth since mount
+type GrowReport struct {
+	Grows       int64        `json:"grows"`
+	CopiedBytes int64        `json:"copied_bytes"`
+	Dirs        []*dirGrowth `json:"dirs"` // Most grows first
+}
+
+// growReport returns the grow counters and per-directory history
+func (f *Filesystem) growReport() GrowReport {
+	r := GrowReport{Grows: fileGrows.Value(), CopiedBytes: growCopyBytes.Value()}
+	f.growth.mu.Lock()
+	for _, d := range f.growth.dirs {
+		c := *d
+		r.Dirs = append(r.Dirs, &c)
+	}
+	f.growth.mu.Unlock()
+	sort.Slice(r.Dirs, func(i, j int) bool { return r.Dirs[i].Grows > r.Dirs[j].Grows })
+	return r
+}
+
+// ctlGrow reports file growth
+func (f *Filesystem) ctlGrow(args json.RawMessage) (interface{}, error) {
+	return f.growReport(), nil
+}
+
+// logGrowSummary prints the one-line growth summary at unmount
+func (f *Filesystem) logGrowSummary() {
+	r := f.growReport()
+	if r.Grows == 0 {
+		return
+	}
+	log.Printf("File growth: %d grows copied %d MB", r.Grows, r.CopiedBytes/(1024*1024))
+}
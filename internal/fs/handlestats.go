@@ -0,0 +1,142 @@
+package fs
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// ioSizeClasses are the upper bounds of the I/O size classes handles
+// count requests in; larger requests fall in a final class
+var ioSizeClasses = [...]int64{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// ioSizeCounts counts requests per size class, the last being over 1MB
+type ioSizeCounts [len(ioSizeClasses) + 1]int64
+
+// add counts one request of n bytes
+func (c *ioSizeCounts) add(n int64) {
+	i := 0
+	for i < len(ioSizeClasses) && n > ioSizeClasses[i] {
+		i++
+	}
+	atomic.AddInt64(&c[i], 1)
+}
+
+// labels maps the non-empty classes to their counts, e.g. "<=4K": 12
+func (c *ioSizeCounts) labels() map[string]int64 {
+	var m map[string]int64
+	for i := range c {
+		n := atomic.LoadInt64(&c[i])
+		if n == 0 {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]int64)
+		}
+		m[ioSizeLabel(i)] = n
+	}
+	return m
+}
+
+// ioSizeLabel names size class i
+func ioSizeLabel(i int) string {
+	if i == len(ioSizeClasses) {
+		return ">1M"
+	}
+	if b := ioSizeClasses[i]; b >= 1<<20 {
+		return fmt.Sprintf("<=%dM", b>>20)
+	}
+	return fmt.Sprintf("<=%dK", ioSizeClasses[i]>>10)
+}
+
+// handleStats are one open handle's counters, updated with atomics on
+// the data path
+type handleStats struct {
+	opened       time.Time
+	reads        int64
+	writes       int64
+	bytesRead    int64
+	bytesWritten int64
+	fsyncs       int64
+	sizes        ioSizeCounts
+}
+
+// handleTable holds the counters of a file's open handles
+type handleTable struct {
+	mu      sync.Mutex
+	handles map[fuse.HandleID]*handleStats
+}
+
+// get returns handle h's counters, creating them on first use
+func (t *handleTable) get(h fuse.HandleID, now time.Time) *handleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.handles == nil {
+		t.handles = make(map[fuse.HandleID]*handleStats)
+	}
+	s, ok := t.handles[h]
+	if !ok {
+		s = &handleStats{opened: now}
+		t.handles[h] = s
+	}
+	return s
+}
+
+// take removes and returns handle h's counters, or nil if it did no I/O
+func (t *handleTable) take(h fuse.HandleID) *handleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.handles[h]
+	delete(t.handles, h)
+	return s
+}
+
+// recordIO counts a read or write of n bytes on handle h
+func (f *File) recordIO(h fuse.HandleID, write bool, n int64) {
+	s := f.handles.get(h, f.fs.clock.Now())
+	if write {
+		atomic.AddInt64(&s.writes, 1)
+		atomic.AddInt64(&s.bytesWritten, n)
+	} else {
+		atomic.AddInt64(&s.reads, 1)
+		atomic.AddInt64(&s.bytesRead, n)
+	}
+	s.sizes.add(n)
+}
+
+// recordFsync counts an fsync on handle h
+func (f *File) recordFsync(h fuse.HandleID) {
+	atomic.AddInt64(&f.handles.get(h, f.fs.clock.Now()).fsyncs, 1)
+}
+
+// releaseHandle folds a released handle's counters into the file's heat
+// stats and, in debug mode, logs them. The first read, write or fsync
+// stands in for the open, which FUSE does not tell us the handle of.
+func (f *File) releaseHandle(req *fuse.ReleaseRequest) {
+	s := f.handles.take(req.Handle)
+	if s == nil {
+		return
+	}
+	f.heat.fold(s)
+	if !IsDebugEnabled() {
+		return
+	}
+
+	var sizes []string
+	for i := range s.sizes {
+		if n := atomic.LoadInt64(&s.sizes[i]); n > 0 {
+			sizes = append(sizes, fmt.Sprintf("%s:%d", ioSizeLabel(i), n))
+		}
+	}
+	log.Printf("handle released: inode=%d handle=%d pid=%d flags=%v reads=%d bytes_read=%d writes=%d bytes_written=%d fsyncs=%d sizes=%s active=%s",
+		f.inode, req.Handle, req.Pid, req.Flags,
+		atomic.LoadInt64(&s.reads), atomic.LoadInt64(&s.bytesRead),
+		atomic.LoadInt64(&s.writes), atomic.LoadInt64(&s.bytesWritten),
+		atomic.LoadInt64(&s.fsyncs), strings.Join(sizes, ","),
+		f.fs.clock.Now().Sub(s.opened).Round(time.Millisecond))
+}
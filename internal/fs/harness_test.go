@@ -0,0 +1,66 @@
+package fs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// testOptions are the default options minus the background workers that
+// would race a test
+func testOptions() fs.Options {
+	opts := fs.DefaultOptions()
+	opts.FlushInterval = 0
+	opts.CompactRate = 0
+	return opts
+}
+
+// newHarness mounts a default-sized in-memory filesystem, unmounted when
+// the test ends
+func newHarness(t *testing.T) *fstest.Harness {
+	t.Helper()
+	return newHarnessWith(t, 0, testOptions())
+}
+
+// newHarnessWith mounts an in-memory device of size bytes with opts
+func newHarnessWith(t *testing.T, size int64, opts fs.Options) *fstest.Harness {
+	t.Helper()
+	h, err := fstest.New(size, opts)
+	if err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// newDeviceHarness mounts a file-backed device mapped outside the Go heap,
+// as a real one is, unmounted when the test ends. It skips the test where
+// the file cannot be mapped.
+func newDeviceHarness(t *testing.T, opts fs.Options) (*fstest.Harness, *dax.Device) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "device")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fstest.DefaultSize); err != nil {
+		t.Fatal(err)
+	}
+	device, err := dax.NewDevice(path)
+	if err != nil {
+		t.Skipf("file-backed device unavailable: %v", err)
+	}
+	h, err := fstest.Mount(device, opts)
+	if err != nil {
+		device.Close()
+		t.Fatalf("mount: %v", err)
+	}
+	t.Cleanup(func() {
+		h.Close()
+		device.Close()
+	})
+	return h, device
+}
@@ -0,0 +1,185 @@
+package fs
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Sliding-window granularity for access counters; top can report windows
+// of up to heatBuckets*heatBucketSpan
+const (
+	heatBuckets    = 12
+	heatBucketSpan = 10 * time.Second
+)
+
+// heatBucket holds the accesses made during one heatBucketSpan
+type heatBucket struct {
+	epoch        int64 // Bucket start in heatBucketSpan units
+	reads        int64
+	writes       int64
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// heatStats are per-file access counters updated with atomics on the data path
+type heatStats struct {
+	reads        int64
+	writes       int64
+	bytesRead    int64
+	bytesWritten int64
+	lastAccess   int64 // Unix nanoseconds
+	buckets      [heatBuckets]heatBucket
+
+	// Totals of released handles; see handlestats.go
+	handles       int64
+	handleFsyncs  int64
+	handleIOSizes ioSizeCounts
+}
+
+// HeatSnapshot is a point-in-time copy of a file's access counters
+type HeatSnapshot struct {
+	Path         string    `json:"path,omitempty"`
+	Inode        uint64    `json:"inode"`
+	Reads        int64     `json:"reads"`
+	Writes       int64     `json:"writes"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesWritten int64     `json:"bytes_written"`
+	LastAccess   time.Time `json:"last_access"`
+
+	// Lifetime totals of released handles that did I/O, omitted from
+	// windowed reports
+	Handles int64            `json:"handles,omitempty"`
+	Fsyncs  int64            `json:"fsyncs,omitempty"`
+	IOSizes map[string]int64 `json:"io_sizes,omitempty"`
+}
+
+// record counts one read or write of n bytes
+func (h *heatStats) record(write bool, n int64) {
+	now := time.Now()
+	atomic.StoreInt64(&h.lastAccess, now.UnixNano())
+	if write {
+		atomic.AddInt64(&h.writes, 1)
+		atomic.AddInt64(&h.bytesWritten, n)
+	} else {
+		atomic.AddInt64(&h.reads, 1)
+		atomic.AddInt64(&h.bytesRead, n)
+	}
+
+	// Rotate the bucket for this span if it still holds an older one.
+	// Racing rotations may lose a handful of counts at span boundaries.
+	epoch := now.UnixNano() / int64(heatBucketSpan)
+	b := &h.buckets[epoch%heatBuckets]
+	if old := atomic.LoadInt64(&b.epoch); old != epoch && atomic.CompareAndSwapInt64(&b.epoch, old, epoch) {
+		atomic.StoreInt64(&b.reads, 0)
+		atomic.StoreInt64(&b.writes, 0)
+		atomic.StoreInt64(&b.bytesRead, 0)
+		atomic.StoreInt64(&b.bytesWritten, 0)
+	}
+	if write {
+		atomic.AddInt64(&b.writes, 1)
+		atomic.AddInt64(&b.bytesWritten, n)
+	} else {
+		atomic.AddInt64(&b.reads, 1)
+		atomic.AddInt64(&b.bytesRead, n)
+	}
+}
+
+// snapshot copies the counters. A window > 0 restricts the counts to
+// accesses made within the most recent window.
+func (h *heatStats) snapshot(inode uint64, window time.Duration) HeatSnapshot {
+	snap := HeatSnapshot{Inode: inode}
+	if last := atomic.LoadInt64(&h.lastAccess); last != 0 {
+		snap.LastAccess = time.Unix(0, last)
+	}
+
+	if window <= 0 {
+		snap.Reads = atomic.LoadInt64(&h.reads)
+		snap.Writes = atomic.LoadInt64(&h.writes)
+		snap.BytesRead = atomic.LoadInt64(&h.bytesRead)
+		snap.BytesWritten = atomic.LoadInt64(&h.bytesWritten)
+		snap.Handles = atomic.LoadInt64(&h.handles)
+		snap.Fsyncs = atomic.LoadInt64(&h.handleFsyncs)
+		snap.IOSizes = h.handleIOSizes.labels()
+		return snap
+	}
+
+	spans := int64((window + heatBucketSpan - 1) / heatBucketSpan)
+	if spans > heatBuckets {
+		spans = heatBuckets
+	}
+	now := time.Now().UnixNano() / int64(heatBucketSpan)
+	for i := range h.buckets {
+		b := &h.buckets[i]
+		if epoch := atomic.LoadInt64(&b.epoch); epoch > now-spans && epoch <= now {
+			snap.Reads += atomic.LoadInt64(&b.reads)
+			snap.Writes += atomic.LoadInt64(&b.writes)
+			snap.BytesRead += atomic.LoadInt64(&b.bytesRead)
+			snap.BytesWritten += atomic.LoadInt64(&b.bytesWritten)
+		}
+	}
+	return snap
+}
+
+// reset clears all counters
+func (h *heatStats) reset() {
+	atomic.StoreInt64(&h.reads, 0)
+	atomic.StoreInt64(&h.writes, 0)
+	atomic.StoreInt64(&h.bytesRead, 0)
+	atomic.StoreInt64(&h.bytesWritten, 0)
+	atomic.StoreInt64(&h.lastAccess, 0)
+	atomic.StoreInt64(&h.handles, 0)
+	atomic.StoreInt64(&h.handleFsyncs, 0)
+	for i := range h.handleIOSizes {
+		atomic.StoreInt64(&h.handleIOSizes[i], 0)
+	}
+	for i := range h.buckets {
+		atomic.StoreInt64(&h.buckets[i].epoch, 0)
+	}
+}
+
+// Metrics top can rank files by
+const (
+	heatByBytes  = "bytes"
+	heatByReads  = "reads"
+	heatByWrites = "writes"
+)
+
+// hottest returns the n files with the highest metric over window
+func (f *Filesystem) hottest(n int, metric string, window time.Duration) []HeatSnapshot {
+	var snaps []HeatSnapshot
+	f.walkFiles(func(p string, file *File) {
+		snap := file.heat.snapshot(file.inode, window)
+		snap.Path = p
+		snaps = append(snaps, snap)
+	})
+
+	score := func(s HeatSnapshot) int64 {
+		switch metric {
+		case heatByReads:
+			return s.Reads
+		case heatByWrites:
+			return s.Writes
+		default:
+			return s.BytesRead + s.BytesWritten
+		}
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return score(snaps[i]) > score(snaps[j])
+	})
+
+	if n > 0 && len(snaps) > n {
+		snaps = snaps[:n]
+	}
+	return snaps
+}
+
+// fold adds a released handle's fsyncs and I/O sizes to the file's
+// totals. Its reads and writes were already counted as they happened.
+func (h *heatStats) fold(s *handleStats) {
+	atomic.AddInt64(&h.handles, 1)
+	atomic.AddInt64(&h.handleFsyncs, atomic.LoadInt64(&s.fsyncs))
+	for i := range s.sizes {
+		atomic.AddInt64(&h.handleIOSizes[i], atomic.LoadInt64(&s.sizes[i]))
+	}
+}
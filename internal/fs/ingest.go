@@ -0,0 +1,244 @@
+package fs
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	ingestedFiles = metrics.NewCounter("aethelfs_ingested_files_total",
+		"Files and directories created by bulk ingest")
+	ingestErrors = metrics.NewCounter("aethelfs_ingest_errors_total",
+		"Bulk ingest entries that failed")
+)
+
+// ingestBatchBytes bounds the file data IngestTar buffers before handing
+// a batch to Ingest
+const ingestBatchBytes = 8 * 1024 * 1024
+
+// IngestEntry is one file or directory to create. Missing parent
+// directories are created with mode 0755 and the entry's owner.
+type IngestEntry struct {
+	Path  string      `json:"path"` // Relative to the filesystem root
+	Mode  os.FileMode `json:"mode"` // Includes os.ModeDir for directories
+	Uid   uint32      `json:"uid"`
+	Gid   uint32      `json:"gid"`
+	Mtime int64       `json:"mtime"` // Unix nanoseconds; zero keeps the creation time
+	Size  int64       `json:"size"`  // Must equal len(Data)
+	Data  []byte      `json:"data,omitempty"`
+}
+
+// IngestResult is the outcome of one IngestEntry
+type IngestResult struct {
+	Path  string `json:"path"`
+	Error string `json:"error,omitempty"`
+}
+
+// Ingest creates entries directly, bypassing the kernel round trip per
+// file. Namespace mutations share metadata batches and the device is
+// flushed once at the end, so every entry reported without an error is
+// durable when Ingest returns nil.
+func (f *Filesystem) Ingest(entries []IngestEntry) ([]IngestResult, error) {
+	results := make([]IngestResult, len(entries))
+	for i := range entries {
+		results[i].Path = entries[i].Path
+		if err := f.ingestOne(&entries[i]); err != nil {
+			ingestErrors.Inc()
+			results[i].Error = err.Error()
+			continue
+		}
+		ingestedFiles.Inc()
+	}
+
+	if err := f.Fsync(); err != nil {
+		return results, err
+	}
+	return results, f.SyncMetadata()
+}
+
+// ingestOne creates a single entry
+func (f *Filesystem) ingestOne(e *IngestEntry) error {
+	p := path.Clean("/" + e.Path)
+	if p == "/" {
+		return syscall.EEXIST
+	}
+	if !e.Mode.IsDir() && !e.Mode.IsRegular() {
+		return syscall.EOPNOTSUPP
+	}
+	if e.Size != int64(len(e.Data)) {
+		return fmt.Errorf("size %d does not match %d bytes of data", e.Size, len(e.Data))
+	}
+
+	hdr := fuse.Header{Uid: e.Uid, Gid: e.Gid}
+	parent, err := f.ingestDirs(path.Dir(p), hdr)
+	if err != nil {
+		return err
+	}
+	name := path.Base(p)
+
+	ctx := context.Background()
+	if e.Mode.IsDir() {
+		if existing, err := parent.Lookup(ctx, name); err == nil {
+			if _, ok := existing.(*Dir); ok {
+				return nil // Already created as a parent of an earlier entry
+			}
+			return syscall.EEXIST
+		}
+		node, err := parent.Mkdir(ctx, &fuse.MkdirRequest{Header: hdr, Name: name, Mode: e.Mode})
+		if err != nil {
+			return err
+		}
+		if e.Mtime != 0 {
+			dir := node.(*Dir)
+			dir.mu.Lock()
+			dir.modTime = time.Unix(0, e.Mtime)
+			dir.changed(f.clock.Now())
+			dir.mu.Unlock()
+		}
+		f.notifyEntry(parent, name)
+		return nil
+	}
+
+	if _, err := parent.Lookup(ctx, name); err == nil {
+		return syscall.EEXIST
+	}
+	node, _, err := parent.Create(ctx, &fuse.CreateRequest{Header: hdr, Name: name, Mode: e.Mode},
+		&fuse.CreateResponse{})
+	if err != nil {
+		return err
+	}
+	file := node.(*File)
+	if len(e.Data) > 0 {
+		req := &fuse.WriteRequest{Header: hdr, Data: e.Data}
+		if err := file.Write(ctx, req, &fuse.WriteResponse{}); err != nil {
+			return err
+		}
+		if err := file.drainStaged(); err != nil {
+			return err
+		}
+	}
+	if e.Mtime != 0 {
+		file.mu.Lock()
+		file.modTime = time.Unix(0, e.Mtime)
+		file.changed(f.clock.Now())
+		file.mu.Unlock()
+	}
+	f.notifyEntry(parent, name)
+	return nil
+}
+
+// ingestDirs returns the directory at p, creating any missing components
+func (f *Filesystem) ingestDirs(p string, hdr fuse.Header) (*Dir, error) {
+	dir := f.rootDir
+	ctx := context.Background()
+	for _, name := range strings.Split(strings.Trim(p, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		node, err := dir.Lookup(ctx, name)
+		if err == nil {
+			next, ok := node.(*Dir)
+			if !ok {
+				return nil, syscall.ENOTDIR
+			}
+			dir = next
+			continue
+		}
+		node, err = dir.Mkdir(ctx, &fuse.MkdirRequest{Header: hdr, Name: name, Mode: os.ModeDir | 0755})
+		if err != nil {
+			return nil, err
+		}
+		f.notifyEntry(dir, name)
+		dir = node.(*Dir)
+	}
+	return dir, nil
+}
+
+// IngestTar creates the regular files and directories of a tar stream,
+// skipping other entry types, and returns how many entries it created
+// and how many failed. It backs the -preload flag.
+func (f *Filesystem) IngestTar(r io.Reader) (created, failed int, err error) {
+	tr := tar.NewReader(r)
+	var batch []IngestEntry
+	var batchBytes int64
+
+	flush := func() error {
+		results, err := f.Ingest(batch)
+		for _, res := range results {
+			if res.Error != "" {
+				failed++
+				log.Printf("Warning: ingest %s: %s", res.Path, res.Error)
+				continue
+			}
+			created++
+		}
+		batch, batchBytes = batch[:0], 0
+		return err
+	}
+
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return created, failed, err
+		}
+		e := IngestEntry{
+			Path:  h.Name,
+			Mode:  h.FileInfo().Mode(),
+			Uid:   uint32(h.Uid),
+			Gid:   uint32(h.Gid),
+			Mtime: h.ModTime.UnixNano(),
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+		case tar.TypeReg:
+			e.Size = h.Size
+			if e.Data, err = io.ReadAll(tr); err != nil {
+				return created, failed, err
+			}
+		default:
+			log.Printf("Warning: ingest skipping %s: unsupported tar entry type %q", h.Name, h.Typeflag)
+			continue
+		}
+		batch = append(batch, e)
+		batchBytes += e.Size
+		if batchBytes >= ingestBatchBytes {
+			if err := flush(); err != nil {
+				return created, failed, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		err = flush()
+	}
+	return created, failed, err
+}
+
+// ctlIngest creates one frame of entries. Clients send a large ingest as
+// a sequence of frames, each a single request line.
+func (f *Filesystem) ctlIngest(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Entries []IngestEntry `json:"entries"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	return f.Ingest(params.Entries)
+}
@@ -0,0 +1,202 @@
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/metrics"
+)
+
+// inodeTable recycles inode numbers in 32-bit mode. By default numbers
+// come from Filesystem.inodeCount and are never reused. With Ino32 they
+// stay below 2^32, which some 32-bit applications and NFSv3 clients
+// require, and below the numbers reserved for the control directory:
+// numbers released when an unlinked node is forgotten are handed
+// out again, oldest first, each reuse bumping the number's generation.
+type inodeTable struct {
+	mu   sync.Mutex
+	free []uint64          // Released numbers, oldest first
+	gens map[uint64]uint32 // Generation of every number reused so far
+}
+
+// maxIno32 is the highest inode number handed out in 32-bit mode; those
+// above it are the control directory's
+const maxIno32 = ctlDirInode - 1
+
+// inodeWarnInterval limits how often running out of inodes is logged
+const inodeWarnInterval = time.Minute
+
+var inodeDenials = metrics.NewCounter("aethelfs_inode_denials_total",
+	"Creates refused with ENOSPC because every inode the device was formatted for is in use")
+
+// claimInode counts a new node against the inode limit fixed at format
+// time, failing with ENOSPC once every inode is in use. The limit stands
+// for the metadata region inodes are kept in, which can fill while data
+// space remains; creates then fail cleanly instead of writing past it.
+func (f *Filesystem) claimInode() error {
+	limit := int64(f.super.InodeLimit)
+	for {
+		used := atomic.LoadInt64(&f.inodesUsed)
+		if limit > 0 && used >= limit {
+			inodeDenials.Inc()
+			now := time.Now().UnixNano()
+			last := atomic.LoadInt64(&f.inodesWarned)
+			if now-last >= int64(inodeWarnInterval) && atomic.CompareAndSwapInt64(&f.inodesWarned, last, now) {
+				log.Printf("Warning: out of inode space, grow metadata region: all %d inodes are in use; "+
+					"reformat with a smaller -inode-ratio to hold more files", limit)
+			}
+			return syscall.ENOSPC
+		}
+		if atomic.CompareAndSwapInt64(&f.inodesUsed, used, used+1) {
+			return nil
+		}
+	}
+}
+
+// unclaimInode gives back an inode counted by claimInode once its node is
+// removed, or was never linked
+func (f *Filesystem) unclaimInode() {
+	atomic.AddInt64(&f.inodesUsed, -1)
+}
+
+// inodeCapacity returns the total and free inodes statfs reports. Devices
+// formatted without an inode limit report as many free as fit an int64.
+func (f *Filesystem) inodeCapacity() (total, free uint64) {
+	used := uint64(atomic.LoadInt64(&f.inodesUsed))
+	limit := f.super.InodeLimit
+	if limit == 0 {
+		return used, uint64(1<<63 - 1)
+	}
+	if used >= limit {
+		return limit, 0
+	}
+	return limit, limit - used
+}
+
+// nextInode allocates an inode number and returns it with its generation.
+// It fails with ENOSPC once the device's inode limit is reached, and in
+// 32-bit mode once every number up to maxIno32 is live.
+func (f *Filesystem) nextInode() (uint64, uint32, error) {
+	if err := f.claimInode(); err != nil {
+		return 0, 0, err
+	}
+	f.statsMu.RLock()
+	defer f.statsMu.RUnlock()
+	if !f.opts.Ino32 {
+		return atomic.AddUint64(&f.inodeCount, 1), 0, nil
+	}
+
+	t := &f.inodes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if atomic.LoadUint64(&f.inodeCount) < maxIno32 {
+		return atomic.AddUint64(&f.inodeCount, 1), 0, nil
+	}
+	if len(t.free) == 0 {
+		log.Printf("Warning: 32-bit inode space exhausted; remount without -ino32 to create more files")
+		f.unclaimInode()
+		return 0, 0, syscall.ENOSPC
+	}
+	ino := t.free[0]
+	t.free = t.free[1:]
+	if t.gens == nil {
+		t.gens = make(map[uint64]uint32)
+	}
+	t.gens[ino]++
+	return ino, t.gens[ino], nil
+}
+
+// releaseInode returns an inode number for reuse. It is called once the
+// kernel has forgotten an unlinked node, so no open handle still reports
+// the number.
+func (f *Filesystem) releaseInode(ino uint64) {
+	if !f.opts.Ino32 {
+		return
+	}
+	f.inodes.mu.Lock()
+	f.inodes.free = append(f.inodes.free, ino)
+	f.inodes.mu.Unlock()
+}
+
+// forget releases n's inode number if it has been unlinked
+func (n *nodeAttr) forget() {
+	if atomic.LoadInt32(&n.unlinked) != 0 {
+		n.fs.releaseInode(n.inode)
+	}
+}
+
+// Forget implements the fs.NodeForgetter interface. An unlinked file's
+// extent is freed here, when no handle can read it any more.
+func (f *File) Forget() {
+	if atomic.LoadInt32(&f.unlinked) != 0 {
+		f.fs.purge(f)
+	}
+	f.forget()
+}
+
+// Forget implements the fs.NodeForgetter interface
+func (d *Dir) Forget() {
+	d.forget()
+}
+
+// ErrStaleInode is returned by LookupInode for numbers that are not, or
+// are no longer, in use
+var ErrStaleInode = errors.New("no such inode")
+
+// indexNode makes n reachable through LookupInode
+func (f *Filesystem) indexNode(ino uint64, n Node) {
+	f.byInode.Store(ino, n)
+}
+
+// unindexNode removes an unlinked node from the index
+func (f *Filesystem) unindexNode(ino uint64) {
+	f.byInode.Delete(ino)
+}
+
+// LookupInode returns the live node with inode number ino. Unlinked nodes
+// are removed from the index when they are unlinked, so a lookup after
+// unlink fails with ErrStaleInode even while handles keep the node open.
+func (f *Filesystem) LookupInode(ino uint64) (Node, error) {
+	if n, ok := f.byInode.Load(ino); ok {
+		return n.(Node), nil
+	}
+	return nil, fmt.Errorf("inode %d: %w", ino, ErrStaleInode)
+}
+
+// ctlInode describes the node with a given inode number
+func (f *Filesystem) ctlInode(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Ino uint64 `json:"ino"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	n, err := f.LookupInode(params.Ino)
+	if err != nil {
+		return nil, err
+	}
+
+	info := struct {
+		Ino  uint64 `json:"ino"`
+		Path string `json:"path"`
+		Type string `json:"type"`
+		Size int64  `json:"size"`
+	}{Ino: params.Ino}
+	switch node := n.(type) {
+	case *File:
+		node.mu.RLock()
+		info.Type, info.Size = "file", node.sizeWithStaged(node.size)
+		node.mu.RUnlock()
+		info.Path = node.path()
+	case *Dir:
+		info.Type, info.Path = "dir", node.path()
+	}
+	return info, nil
+}
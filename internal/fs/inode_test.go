@@ -0,0 +1,56 @@
+package fs_test
+
+import (
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+func TestIno32StopsBelowControlInodes(t *testing.T) {
+	opts := testOptions()
+	opts.Ino32 = true
+	h := newHarnessWith(t, 0, opts)
+	h.FS.SetInodeCount(fs.MaxIno32 - 2)
+
+	ctl, err := h.Lookup("/.aethelfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctlAttr, err := h.Stat(ctl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last *fs.File
+	for i, want := range []uint64{fs.MaxIno32 - 1, fs.MaxIno32} {
+		file, err := h.Create("/"+string(rune('a'+i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attr, _ := h.Stat(file)
+		if attr.Inode != want {
+			t.Errorf("inode %d, want %d", attr.Inode, want)
+		}
+		if attr.Inode >= ctlAttr.Inode {
+			t.Errorf("inode %d reaches the control directory's %d", attr.Inode, ctlAttr.Inode)
+		}
+		last = file
+	}
+	if _, err := h.Create("/c", 0644); !fstest.IsErrno(err, syscall.ENOSPC) {
+		t.Fatalf("create with the 32-bit space used up: %v, want ENOSPC", err)
+	}
+
+	// A forgotten number is handed out again
+	if err := h.Remove("/b"); err != nil {
+		t.Fatal(err)
+	}
+	h.Forget(last)
+	file, err := h.Create("/c", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr, _ := h.Stat(file); attr.Inode != fs.MaxIno32 {
+		t.Errorf("reused inode %d, want %d", attr.Inode, fs.MaxIno32)
+	}
+}
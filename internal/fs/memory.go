@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"aethelfs/internal/metrics"
+)
+
+var metadataBytes = metrics.NewGauge("aethelfs_metadata_bytes",
+	"Estimated heap bytes held by in-memory inodes and names")
+
+// Rough per-node heap costs: the node struct plus its entry in the
+// parent's children map
+const (
+	mapEntryOverhead = 48
+	fileNodeBytes    = int64(unsafe.Sizeof(File{})) + mapEntryOverhead
+	dirNodeBytes     = int64(unsafe.Sizeof(Dir{})) + mapEntryOverhead
+)
+
+// metadataWarnInterval rate-limits the over-threshold warning
+const metadataWarnInterval = time.Minute
+
+// nodeBytes estimates the heap held by node and its name
+func nodeBytes(node Node, name string) int64 {
+	switch node.(type) {
+	case *Dir:
+		return dirNodeBytes + int64(len(name))
+	default:
+		return fileNodeBytes + int64(len(name))
+	}
+}
+
+// accountNode adds delta bytes of in-memory metadata and warns when the
+// total grows past MetadataWarnBytes. Nodes are not persisted in the
+// metadata region, so there is nothing to reload an evicted node from:
+// the threshold only tells the operator memory is running short.
+func (f *Filesystem) accountNode(delta int64) {
+	total := atomic.AddInt64(&f.metaBytes, delta)
+	metadataBytes.Set(total)
+
+	threshold := f.opts.MetadataWarnBytes
+	if threshold <= 0 || total <= threshold || delta <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&f.metaWarned)
+	if now-last >= int64(metadataWarnInterval) && atomic.CompareAndSwapInt64(&f.metaWarned, last, now) {
+		log.Printf("Warning: in-memory metadata is %d MB, over the %d MB warning threshold",
+			total/(1024*1024), threshold/(1024*1024))
+	}
+}
+
+// MetadataBytes returns the estimated heap held by in-memory metadata
+func (f *Filesystem) MetadataBytes() int64 {
+	return atomic.LoadInt64(&f.metaBytes)
+}
@@ -0,0 +1,55 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMetadataWarnBytes creates more nodes than the warning threshold
+// allows: the daemon warns once, and every node stays reachable since
+// nothing is evicted
+func TestMetadataWarnBytes(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	opts := testOptions()
+	opts.MetadataWarnBytes = 64 << 10
+	h := newHarnessWith(t, 0, opts)
+	base := h.FS.MetadataBytes()
+
+	const files = 1000
+	for i := 0; i < files; i++ {
+		if _, err := h.Create(fmt.Sprintf("/file%d", i), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grown := h.FS.MetadataBytes()
+	if grown <= opts.MetadataWarnBytes || grown-base < files*int64(len("file0")) {
+		t.Fatalf("metadata grew from %d to %d bytes for %d files", base, grown, files)
+	}
+	if n := gauge("aethelfs_metadata_bytes"); n != grown {
+		t.Errorf("gauge reads %d bytes, want %d", n, grown)
+	}
+	if n := strings.Count(logged.String(), "warning threshold"); n != 1 {
+		t.Errorf("%d warnings logged, want 1:\n%s", n, logged.String())
+	}
+	for i := 0; i < files; i++ {
+		if _, err := h.Lookup(fmt.Sprintf("/file%d", i)); err != nil {
+			t.Fatalf("lookup over the threshold: %v", err)
+		}
+	}
+
+	for i := 0; i < files; i++ {
+		if err := h.Remove(fmt.Sprintf("/file%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := h.FS.MetadataBytes(); n != base {
+		t.Errorf("%d bytes of metadata after removing every file, want %d", n, base)
+	}
+}
@@ -0,0 +1,150 @@
+package fs
+
+import (
+	"log"
+	"os"
+	"unsafe"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+)
+
+var metaGuardFaults = metrics.NewCounter("aethelfs_metadata_guard_faults_total",
+	"Stray writes into the write-protected metadata region caught in a handler")
+
+// guardRange is a page-aligned part of the metadata reservation
+type guardRange struct {
+	offset common.DeviceOffset
+	length common.ByteCount
+}
+
+// contains reports whether off lies within r
+func (r guardRange) contains(off common.DeviceOffset) bool {
+	return off >= r.offset && off < r.offset.Plus(r.length)
+}
+
+// metaGuard keeps the metadata reservation read-only while mounted, so a
+// stray store from the data path faults at the instruction making it
+// instead of surfacing as corruption at the next mount. The superblock
+// page is writable only inside writeSuperLocked. A bitmap allocator's
+// bitmap, which every allocation and free writes, is left writable.
+type metaGuard struct {
+	device dax.Protector
+	base   uintptr      // Address device offset 0 is mapped at
+	ranges []guardRange // Read-only while mounted
+	super  guardRange   // The superblock's pages, if guarded
+	stamps guardRange   // The write stamp table, if guarded
+}
+
+// startMetaGuard write-protects the metadata reservation when
+// Options.ProtectMetadata asks for it and the device can. Failing to is
+// not fatal: the mount goes on unguarded.
+func (f *Filesystem) startMetaGuard() {
+	device, ok := f.device.(dax.Protector)
+	if !f.opts.ProtectMetadata || !ok {
+		return
+	}
+	page := common.ByteCount(os.Getpagesize())
+	alignDown := func(n common.ByteCount) common.ByteCount { return n / page * page }
+	alignUp := func(n common.ByteCount) common.ByteCount { return (n + page - 1) / page * page }
+
+	end := alignDown(common.MetadataReservationSize)
+	g := &metaGuard{
+		device: device,
+		base:   uintptr(unsafe.Pointer(&f.device.At(0, 1)[0])),
+	}
+	if allocatorKind(f.super) == alloc.KindBitmap {
+		bitmap, err := disk.Bitmap(f.device.At(0, common.ByteCount(f.device.Size())), f.blockSize, common.MetadataReservationSize)
+		if err != nil {
+			log.Printf("Warning: metadata region not write-protected: %v", err)
+			return
+		}
+		lo := alignDown(disk.BitmapOffset)
+		hi := alignUp(disk.BitmapOffset + common.ByteCount(len(bitmap)))
+		g.ranges = append(g.ranges, guardRange{0, lo}, guardRange{common.DeviceOffset(hi), end - hi})
+	} else {
+		g.ranges = append(g.ranges, guardRange{0, end})
+	}
+	if super := alignUp(disk.SuperblockOffset + disk.SuperblockSize); super <= g.ranges[0].length {
+		g.super = guardRange{0, super}
+	}
+	if offset, ok := f.stampTableOffset(); ok && common.ByteCount(offset)%page == 0 {
+		g.stamps = guardRange{offset, disk.StampTableSize}
+	}
+
+	for _, r := range g.ranges {
+		if r.length <= 0 {
+			continue
+		}
+		if err := device.Protect(r.offset, r.length, false); err != nil {
+			g.unprotect()
+			log.Printf("Warning: metadata region not write-protected: %v", err)
+			return
+		}
+	}
+	f.guard = g
+}
+
+// unprotect makes the whole reservation writable again
+func (g *metaGuard) unprotect() {
+	for _, r := range g.ranges {
+		if r.length > 0 {
+			g.device.Protect(r.offset, r.length, true)
+		}
+	}
+}
+
+// lift makes r writable for a store into it and returns the function
+// that protects it again. A nil guard or an unguarded range lifts nothing.
+func (g *metaGuard) lift(r guardRange, what string) (func(), error) {
+	if g == nil || r.length <= 0 {
+		return func() {}, nil
+	}
+	if err := g.device.Protect(r.offset, r.length, true); err != nil {
+		return nil, err
+	}
+	return func() {
+		if err := g.device.Protect(r.offset, r.length, false); err != nil {
+			log.Printf("Warning: %s left writable: %v", what, err)
+		}
+	}, nil
+}
+
+// writeSuperLocked stores f.super on the device and flushes it, lifting
+// the guard from the superblock for just the store. The caller holds
+// superMu, or the filesystem is still being mounted.
+func (f *Filesystem) writeSuperLocked() error {
+	var r guardRange
+	if f.guard != nil {
+		r = f.guard.super
+	}
+	restore, err := f.guard.lift(r, "superblock")
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if err := disk.WriteSuperblock(superblockBytes(f.device), f.super); err != nil {
+		return err
+	}
+	noteFlush(flushOriginSuper, disk.SuperblockSize)
+	return f.device.FlushRange(disk.SuperblockOffset, disk.SuperblockSize)
+}
+
+// faultOffset returns the guarded device offset a recovered fault panic
+// hit, if it hit one
+func (g *metaGuard) faultOffset(r interface{}) (common.DeviceOffset, bool) {
+	fault, ok := r.(interface{ Addr() uintptr })
+	if g == nil || !ok || fault.Addr() < g.base {
+		return 0, false
+	}
+	off := common.DeviceOffset(fault.Addr() - g.base)
+	for _, r := range g.ranges {
+		if r.contains(off) {
+			return off, true
+		}
+	}
+	return 0, false
+}
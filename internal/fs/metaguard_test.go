@@ -0,0 +1,72 @@
+package fs_test
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// newGuardedHarness mounts a file-backed device, the only kind that can
+// write-protect the metadata region
+func newGuardedHarness(t *testing.T) (*fstest.Harness, *dax.Device) {
+	t.Helper()
+	opts := testOptions()
+	opts.ProtectMetadata = true
+	return newDeviceHarness(t, opts)
+}
+
+func TestMetaGuardCatchesStrayWrite(t *testing.T) {
+	h, device := newGuardedHarness(t)
+	super := append([]byte(nil), device.At(disk.SuperblockOffset, disk.SuperblockSize)...)
+	faults := fs.MetaGuardFaults()
+
+	err := h.FS.RunOp("stray", func() {
+		device.At(disk.SuperblockOffset, 1)[0] ^= 0xff
+	})
+	if !fstest.IsErrno(err, syscall.EIO) {
+		t.Fatalf("stray write into the superblock: %v, want EIO", err)
+	}
+	if got := h.FS.Panics(); got != 1 {
+		t.Errorf("%d handler panics recovered, want 1", got)
+	}
+	if got := fs.MetaGuardFaults() - faults; got != 1 {
+		t.Errorf("%d guard faults counted, want 1", got)
+	}
+	if got := device.At(disk.SuperblockOffset, disk.SuperblockSize); !bytes.Equal(got, super) {
+		t.Error("superblock changed by the caught write")
+	}
+
+	// The mount goes on serving, and the superblock can still be written
+	data := bytes.Repeat([]byte("data"), 1024)
+	if _, err := h.WriteFile("/file", data, 0644); err != nil {
+		t.Fatalf("write after the fault: %v", err)
+	}
+	if err := h.FS.SyncFS(); err != nil {
+		t.Fatalf("sync after the fault: %v", err)
+	}
+	if got, err := h.ReadFile("/file"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read after the fault: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestMetaGuardIgnoresDataFaults(t *testing.T) {
+	h, device := newGuardedHarness(t)
+	faults := fs.MetaGuardFaults()
+
+	// A store to the data region is not the guard's to catch
+	err := h.FS.RunOp("data", func() {
+		device.At(common.DeviceOffset(common.MetadataReservationSize), 1)[0] = 1
+	})
+	if err != nil {
+		t.Fatalf("write into the data region: %v", err)
+	}
+	if got := fs.MetaGuardFaults() - faults; got != 0 {
+		t.Errorf("%d guard faults counted for a data write, want 0", got)
+	}
+}
@@ -0,0 +1,201 @@
+package fs
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+)
+
+// progressInterval is how often mount progress is reported while scanning
+const progressInterval = time.Second
+
+// Mount scan phases
+const (
+	PhaseInodes   = "inodes"   // Walking the namespace
+	PhaseFreeList = "freelist" // Rebuilding the free list from file extents
+	PhaseDone     = "done"
+)
+
+// MountProgress describes how far the mount-time scan has got
+type MountProgress struct {
+	Phase          string  `json:"phase"`
+	InodesLoaded   int64   `json:"inodes_loaded"`
+	InodesTotal    int64   `json:"inodes_total"`
+	ExtentsIndexed int64   `json:"extents_indexed"`
+	Percent        float64 `json:"percent"`
+}
+
+// mountScan tracks the scan with atomics so the reporter can sample it
+type mountScan struct {
+	inodes  int64
+	total   int64
+	extents int64
+	phase   atomic.Value // string
+}
+
+// progress samples the scan state. The namespace walk accounts for the
+// first half of the percentage and free list reconstruction for the rest.
+func (s *mountScan) progress() MountProgress {
+	p := MountProgress{
+		Phase:          s.phase.Load().(string),
+		InodesLoaded:   atomic.LoadInt64(&s.inodes),
+		InodesTotal:    atomic.LoadInt64(&s.total),
+		ExtentsIndexed: atomic.LoadInt64(&s.extents),
+	}
+	switch {
+	case p.Phase == PhaseDone:
+		p.Percent = 100
+	case p.InodesTotal > 0:
+		p.Percent = 50 * float64(p.InodesLoaded) / float64(p.InodesTotal)
+		if p.Phase == PhaseFreeList {
+			p.Percent = 50 + 50*float64(p.ExtentsIndexed)/float64(p.InodesTotal)
+		}
+	}
+	if p.Percent > 100 {
+		p.Percent = 100
+	}
+	return p
+}
+
+// MountProgress reports the state of the mount-time scan
+func (f *Filesystem) MountProgress() MountProgress {
+	return f.mountScan.progress()
+}
+
+// extent is an allocated range of the device
+type extent struct {
+	offset common.DeviceOffset
+	size   common.ByteCount
+}
+
+// scan walks the namespace and rebuilds the free list from the extents it
+// finds, reporting progress every second through opts.Progress. With
+// FastMount the free list is rebuilt in the background and allocation is
+// append-only until it is ready.
+func (f *Filesystem) scan() {
+	s := &mountScan{total: int64(atomic.LoadUint64(&f.inodeCount))}
+	s.phase.Store(PhaseInodes)
+	f.mountScan = s
+	f.restoreWriteStamps()
+	if f.opts.ReadOnly {
+		// The writer owns the allocation state; there is nothing to rebuild
+		s.phase.Store(PhaseDone)
+		return
+	}
+	f.recoverTombstones()
+
+	done := make(chan struct{})
+	if f.opts.Progress != nil {
+		go func() {
+			ticker := time.NewTicker(progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					f.opts.Progress(s.progress())
+				case <-done:
+					f.opts.Progress(s.progress())
+					return
+				}
+			}
+		}()
+	}
+
+	// Only the space below each region's high-water mark can hold gaps;
+	// anything allocated while the scan runs lands above it
+	f.allocMu.Lock()
+	bounds := make([]extent, len(f.regions))
+	for i, r := range f.regions {
+		bounds[i] = extent{offset: r.Offset, size: r.alloc.HighWater().Sub(r.Offset)}
+	}
+	f.allocMu.Unlock()
+
+	var extents []extent
+	f.walkFiles(func(p string, file *File) {
+		file.mu.RLock()
+		if len(file.data) > 0 {
+			if int64(file.offset)%f.blockSize != 0 {
+				log.Printf("Warning: inode %d extent at %d is not aligned to the %d byte block size",
+					file.inode, file.offset, f.blockSize)
+			}
+			extents = append(extents, extent{offset: file.offset, size: f.alignSize(file.capacity())})
+		}
+		file.mu.RUnlock()
+		atomic.AddInt64(&s.inodes, 1)
+	})
+	// Files removed during the walk keep their space until purged
+	extents = append(extents, f.tombstoneExtents()...)
+	// Directories are not visited by walkFiles; count the walk as complete
+	atomic.StoreInt64(&s.inodes, s.total)
+
+	rebuild := func() {
+		s.phase.Store(PhaseFreeList)
+		start := time.Now()
+		f.rebuildFreeList(extents, bounds, &s.extents)
+		s.phase.Store(PhaseDone)
+		atomic.StoreInt32(&f.freeListReady, 1)
+		close(done)
+		log.Printf("Free list rebuilt from %d extents in %v", len(extents), time.Since(start))
+	}
+
+	if f.opts.FastMount {
+		log.Printf("Fast mount: allocating append-only until the free list is rebuilt")
+		go rebuild()
+		return
+	}
+	rebuild()
+}
+
+// rebuildFreeList derives free extents from the gaps between allocated
+// extents within each region's allocated bounds and hands them to the
+// region's allocator. Extents freed while the scan ran may also be gaps;
+// the allocators tolerate the overlap.
+func (f *Filesystem) rebuildFreeList(extents []extent, bounds []extent, indexed *int64) {
+	sort.Slice(extents, func(i, j int) bool { return extents[i].offset < extents[j].offset })
+
+	gaps := make([][]alloc.Extent, len(bounds))
+	for i, b := range bounds {
+		cursor, limit := b.offset, b.offset.Plus(b.size)
+		for _, e := range extents {
+			if e.offset >= limit {
+				break
+			}
+			if e.offset.Plus(e.size) <= b.offset {
+				continue
+			}
+			if e.offset > cursor {
+				gaps[i] = append(gaps[i], alloc.Extent{Offset: cursor, Size: e.offset.Sub(cursor)})
+			}
+			if end := e.offset.Plus(e.size); end > cursor {
+				cursor = end
+			}
+			atomic.AddInt64(indexed, 1)
+		}
+		if limit > cursor {
+			gaps[i] = append(gaps[i], alloc.Extent{Offset: cursor, Size: limit.Sub(cursor)})
+		}
+	}
+
+	f.statsMu.RLock()
+	defer f.statsMu.RUnlock()
+	f.allocMu.Lock()
+	defer f.allocMu.Unlock()
+	for i, r := range f.regions {
+		r.alloc.Reclaim(gaps[i])
+	}
+}
+
+// alignSize rounds size up to the device's block size. Sizes reaching it
+// are bounded by the device, far from overflowing.
+func (f *Filesystem) alignSize(size common.ByteCount) common.ByteCount {
+	aligned, err := common.AlignUp(size, common.ByteCount(f.blockSize))
+	if err != nil {
+		panic(fmt.Sprintf("aligning %d bytes: %v", size, err))
+	}
+	return aligned
+}
@@ -0,0 +1,127 @@
+package fs
+
+import (
+	"fmt"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+)
+
+// MountConfig is the effective configuration of this mount together with
+// what the superblock recorded about the previous one
+type MountConfig struct {
+	Options
+	Label         string           `json:"label"`
+	Mount         disk.MountRecord `json:"mount"`
+	MountFlags    []string         `json:"mount_flags"`
+	PreviousMount disk.MountRecord `json:"previous_mount"`
+}
+
+// mountFlagNames names the disk.MountRecord flag bits
+var mountFlagNames = []struct {
+	bit  uint32
+	name string
+}{
+	{disk.MountQuotas, "quotas"},
+	{disk.MountExclusiveWrite, "exclusive_write"},
+	{disk.MountWritebackCache, "writeback_cache"},
+	{disk.MountNoSuid, "no_suid"},
+	{disk.MountNoDeviceNodes, "no_device_nodes"},
+	{disk.MountSpreadPlacement, "spread_placement"},
+}
+
+// checkRemount rejects options the device's format cannot honor
+func checkRemount(super *disk.Superblock, opts Options, deviceSize int64) error {
+	if opts.BlockSize != 0 && opts.BlockSize != int64(super.BlockSize) {
+		return fmt.Errorf("%w: device was formatted with %d byte blocks, %d requested",
+			disk.ErrIncompatibleOption, super.BlockSize, opts.BlockSize)
+	}
+	if opts.ReadOnly && opts.Label != "" && opts.Label != super.Label {
+		return fmt.Errorf("%w: the label cannot be changed on a read-only mount", disk.ErrIncompatibleOption)
+	}
+	if opts.Allocator != "" && opts.Allocator != allocatorKind(super) {
+		return fmt.Errorf("%w: device was formatted with the %s allocator, %s requested",
+			disk.ErrIncompatibleOption, allocatorKind(super), opts.Allocator)
+	}
+	if opts.InodeRatio > 0 && super.InodeLimit != 0 && uint64(deviceSize/opts.InodeRatio) != super.InodeLimit {
+		return fmt.Errorf("%w: device was formatted for %d inodes, inode ratio %d gives %d",
+			disk.ErrIncompatibleOption, super.InodeLimit, opts.InodeRatio, deviceSize/opts.InodeRatio)
+	}
+	return nil
+}
+
+// allocatorKind returns the allocator a device was formatted with
+func allocatorKind(super *disk.Superblock) string {
+	if super.Features.Incompat&disk.IncompatBitmapAlloc != 0 {
+		return alloc.KindBitmap
+	}
+	return alloc.KindFreeList
+}
+
+// recordMount stores this mount's label and effective options in the
+// superblock, keeping the previous record for the config report
+func (f *Filesystem) recordMount() error {
+	f.prevMount = f.super.LastMount
+	if f.opts.Label != "" {
+		f.super.Label = f.opts.Label
+	}
+
+	rec := disk.MountRecord{
+		Time:          f.clock.Now(),
+		Count:         f.prevMount.Count + 1,
+		DirSync:       f.opts.DirSync,
+		FlushStrategy: f.opts.FlushStrategy,
+		Version:       common.Version,
+	}
+	if len(f.opts.UidQuota) > 0 {
+		rec.Flags |= disk.MountQuotas
+	}
+	if f.opts.ExclusiveWrite {
+		rec.Flags |= disk.MountExclusiveWrite
+	}
+	if f.opts.WritebackCache {
+		rec.Flags |= disk.MountWritebackCache
+	}
+	if f.opts.NoSuid {
+		rec.Flags |= disk.MountNoSuid
+	}
+	if f.opts.NoDeviceNodes {
+		rec.Flags |= disk.MountNoDeviceNodes
+	}
+	if f.opts.Placement == PlacementSpread {
+		rec.Flags |= disk.MountSpreadPlacement
+	}
+	f.super.LastMount = rec
+
+	if err := f.writeSuperLocked(); err != nil {
+		return fmt.Errorf("failed to record mount in superblock: %w", err)
+	}
+	return nil
+}
+
+// Config returns the effective configuration of this mount
+func (f *Filesystem) Config() MountConfig {
+	cfg := MountConfig{
+		Options:       f.opts,
+		Label:         f.super.Label,
+		Mount:         f.super.LastMount,
+		PreviousMount: f.prevMount,
+		MountFlags:    []string{},
+	}
+	for _, fl := range mountFlagNames {
+		if cfg.Mount.Flags&fl.bit != 0 {
+			cfg.MountFlags = append(cfg.MountFlags, fl.name)
+		}
+	}
+	return cfg
+}
+
+// FSName is the filesystem name shown by mount and in /proc/mounts:
+// "aethelfs", or "aethelfs:label" for a labelled device
+func FSName(label string) string {
+	if label == "" {
+		return "aethelfs"
+	}
+	return "aethelfs:" + label
+}
@@ -2,8 +2,12 @@ package fs
 
 import (
 	"os"
+	"path"
+	"sync"
+	"syscall"
 	"time"
 
+	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 )
 
@@ -12,14 +16,173 @@ type Node interface {
 	fs.Node
 }
 
-// nodeAttr contains common attributes for files and directories
+// nodeAttr contains common attributes for files and directories. Its
+// lock protects the attributes and whatever state the embedding node
+// adds; the helpers below expect the caller to hold it.
 type nodeAttr struct {
-	fs      *Filesystem // Reference to the filesystem
-	inode   uint64      // Inode number
-	name    string      // Name of the file/directory
-	mode    os.FileMode // File mode/permissions
-	uid     uint32      // User ID
-	gid     uint32      // Group ID
-	size    int64       // Size in bytes
-	modTime time.Time   // Last modification time
+	unlinked int32 // Set once removed from its directory; atomic
+
+	mu sync.RWMutex
+
+	fs         *Filesystem // Reference to the filesystem
+	parent     *Dir        // Containing directory; nil for the root. Set with name by Rename
+	inode      uint64      // Inode number
+	generation uint32      // Reuses of the inode number, with -ino32
+	name       string      // Name of the file/directory
+	mode       os.FileMode // File mode/permissions
+	uid        uint32      // User ID
+	gid        uint32      // Group ID
+	size       int64       // Size in bytes
+
+	// Timestamps follow POSIX: modTime changes with the contents (data, or
+	// a directory's entries) and changeTime with the contents or the
+	// inode's attributes. Both are set under the node's lock.
+	modTime    time.Time // Last modification time
+	changeTime time.Time // Last status change time
+}
+
+// fillAttr copies the attributes into a. Atime is not tracked and reads
+// as the modification time. The caller holds the node's lock.
+func (n *nodeAttr) fillAttr(a *fuse.Attr) {
+	a.Inode = n.inode
+	a.Mode = n.mode
+	a.Uid = n.uid
+	a.Gid = n.gid
+	a.Size = uint64(n.size)
+	a.Mtime = n.modTime
+	a.Ctime = n.changeTime
+	a.Atime = n.modTime
+}
+
+// isOwner reports whether the caller owns n or is root
+func (n *nodeAttr) isOwner(hdr *fuse.Header) bool {
+	return hdr.Uid == 0 || hdr.Uid == n.uid
+}
+
+// mayWrite reports whether n's permission bits let the caller write it.
+// Supplementary groups are not sent with FUSE requests, so only the
+// caller's primary group is considered.
+func (n *nodeAttr) mayWrite(hdr *fuse.Header) bool {
+	switch {
+	case hdr.Uid == 0:
+		return true
+	case hdr.Uid == n.uid:
+		return n.mode&0200 != 0
+	case hdr.Gid == n.gid:
+		return n.mode&0020 != 0
+	}
+	return n.mode&0002 != 0
+}
+
+// checkSetattr returns the error setattr would refuse req with, changing
+// nothing, so that callers with changes of their own, such as a file's
+// size, can refuse the whole request before making any of them.
+//   - Only the owner or root may change the mode.
+//   - Only root may change the owner. The owner may change the group to
+//     its own primary group.
+//   - The owner or root may set any time; setting it to the current time
+//     only needs write permission, as with utimes(path, NULL).
+func (n *nodeAttr) checkSetattr(req *fuse.SetattrRequest) error {
+	hdr := &req.Header
+	if req.Valid.Mode() && !n.isOwner(hdr) {
+		return syscall.EPERM
+	}
+	uid, gid := chownArgs(req)
+	if uid != nil && *uid != n.uid && hdr.Uid != 0 {
+		return syscall.EPERM
+	}
+	if gid != nil && *gid != n.gid && hdr.Uid != 0 && (hdr.Uid != n.uid || *gid != hdr.Gid) {
+		return syscall.EPERM
+	}
+	if req.Valid.MtimeNow() {
+		if !n.isOwner(hdr) && !n.mayWrite(hdr) {
+			return syscall.EACCES
+		}
+	} else if req.Valid.Mtime() && !n.isOwner(hdr) {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// chownArgs returns the owner and group req sets, nil for either it leaves
+func chownArgs(req *fuse.SetattrRequest) (uid, gid *uint32) {
+	if req.Valid.Uid() {
+		uid = &req.Uid
+	}
+	if req.Valid.Gid() {
+		gid = &req.Gid
+	}
+	return uid, gid
+}
+
+// chown gives n a new owner and/or group; nil leaves either unchanged. A
+// chown by anyone but root clears setuid and setgid.
+func (n *nodeAttr) chown(hdr *fuse.Header, uid, gid *uint32, now time.Time) {
+	if uid != nil {
+		n.uid = *uid
+	}
+	if gid != nil {
+		n.gid = *gid
+	}
+	if hdr.Uid != 0 {
+		n.mode &^= os.ModeSetuid | os.ModeSetgid
+	}
+	n.changed(now)
+}
+
+// setattr applies the mode, ownership and time changes of req, which are
+// common to every node type, once checkSetattr allows all of them. The
+// caller holds the node's lock and moves any usage charge if the owner
+// changed.
+func (n *nodeAttr) setattr(req *fuse.SetattrRequest, now time.Time) error {
+	if err := n.checkSetattr(req); err != nil {
+		return err
+	}
+	if req.Valid.Mode() {
+		n.mode = n.mode&os.ModeType | req.Mode&^os.ModeType
+		n.changed(now)
+	}
+	if req.Valid.Uid() || req.Valid.Gid() {
+		uid, gid := chownArgs(req)
+		n.chown(&req.Header, uid, gid, now)
+	}
+	switch {
+	case req.Valid.MtimeNow():
+		n.touch(now)
+	case req.Valid.Mtime():
+		n.modTime = req.Mtime
+		n.changed(now)
+	}
+	return nil
+}
+
+// touch records a content change made at now, which is also a status
+// change. The caller must hold the node's lock.
+func (n *nodeAttr) touch(now time.Time) {
+	n.modTime = now
+	n.changeTime = now
+}
+
+// changed records an attribute change made at now. The caller must hold
+// the node's lock.
+func (n *nodeAttr) changed(now time.Time) {
+	n.changeTime = now
+}
+
+// location returns the node's directory and its name there. Rename moves
+// nodes, so callers not holding the node's lock read them through this.
+func (n *nodeAttr) location() (*Dir, string) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.parent, n.name
+}
+
+// path returns the node's absolute path within the mount. The caller must
+// not hold the lock of the node or its ancestors.
+func (n *nodeAttr) path() string {
+	parent, name := n.location()
+	if parent == nil {
+		return "/"
+	}
+	return path.Join(parent.path(), name)
 }
@@ -0,0 +1,102 @@
+package fs
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"syscall"
+
+	"aethelfs/internal/metrics"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Kinds of kernel notification, named in failure logs
+const (
+	notifyData  = "data"  // File contents and attributes changed
+	notifyEntry = "entry" // A directory entry was added or replaced
+)
+
+var kernelNotifies = metrics.NewCounterVec("aethelfs_kernel_notify_total",
+	"Cache invalidations for changes made by the daemon itself, by result: sent, not_cached, unsupported or failed", "result")
+
+// kernelNotifier is the part of the FUSE server that pushes invalidations
+// to the kernel
+type kernelNotifier interface {
+	InvalidateNodeData(node fs.Node) error
+	InvalidateEntry(parent fs.Node, name string) error
+}
+
+// kernelNotify lets changes the daemon makes on its own, such as control
+// socket ingests and transaction commits, reach the kernel's caches. The
+// kernel raises inotify events for the invalidations it translates, so
+// watchers see them as they would a change made through the mount.
+type kernelNotify struct {
+	server   atomic.Value // kernelNotifier; unset until Serve starts
+	disabled int32        // Atomic; set once the kernel refuses notifications
+}
+
+// Serve serves the filesystem over FUSE, sending the kernel invalidations
+// for the changes made outside its requests while it runs
+func Serve(c *fuse.Conn, filesystem *Filesystem) error {
+	server := fs.New(c, nil)
+	filesystem.notify.server.Store(kernelNotifier(server))
+	return server.Serve(filesystem)
+}
+
+// notifyData tells the kernel the contents and attributes of nodes have
+// changed. It must not be called with the nodes' locks held: the kernel
+// may write back dirty pages before dropping them.
+func (f *Filesystem) notifyData(nodes ...fs.Node) {
+	server := f.notifier()
+	if server == nil {
+		return
+	}
+	for _, node := range nodes {
+		f.notifyResult(notifyData, server.InvalidateNodeData(node))
+	}
+}
+
+// notifyEntry tells the kernel name in dir has changed, dropping any
+// negative entry it cached, along with dir's own contents and attributes.
+// dir's lock must not be held.
+func (f *Filesystem) notifyEntry(dir *Dir, name string) {
+	server := f.notifier()
+	if server == nil {
+		return
+	}
+	f.notifyResult(notifyEntry, server.InvalidateEntry(dir, name))
+	f.notifyResult(notifyData, server.InvalidateNodeData(dir))
+}
+
+// notifier returns the FUSE server, or nil before Serve or after the
+// kernel refused notifications
+func (f *Filesystem) notifier() kernelNotifier {
+	if atomic.LoadInt32(&f.notify.disabled) != 0 {
+		return nil
+	}
+	server, _ := f.notify.server.Load().(kernelNotifier)
+	return server
+}
+
+// notifyResult counts the outcome of one notification. The kernel has
+// nothing to drop for a node it never looked up, which is not an error;
+// a kernel without notification support turns them off for the mount.
+func (f *Filesystem) notifyResult(kind string, err error) {
+	switch {
+	case err == nil:
+		kernelNotifies.With("sent").Inc()
+	case errors.Is(err, fuse.ErrNotCached):
+		kernelNotifies.With("not_cached").Inc()
+	case errors.Is(err, syscall.ENOSYS):
+		kernelNotifies.With("unsupported").Inc()
+		if atomic.CompareAndSwapInt32(&f.notify.disabled, 0, 1) {
+			log.Printf("Warning: kernel does not support FUSE notifications; " +
+				"watchers will not see changes made through the control socket")
+		}
+	default:
+		kernelNotifies.With("failed").Inc()
+		log.Printf("Warning: failed to notify the kernel of a %s change: %v", kind, err)
+	}
+}
@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// writable reports whether an open with flags may write to the file
+func writable(flags fuse.OpenFlags) bool {
+	return !flags.IsReadOnly()
+}
+
+// exclusiveLocked reports whether at most one writable handle may be open
+// on f. The caller must hold f.mu.
+func (f *File) exclusiveLocked() bool {
+	return f.exclusive || f.fs.opts.ExclusiveWrite
+}
+
+var _ = registerBehavior(Behavior{
+	Name: "open.exclusive-write", Supported: true, Errno: "EBUSY",
+	Note: "A second writable open of a file with user.aethelfs.exclusive-write set, or of any file under ExclusiveWrite, is refused",
+})
+
+// Open implements the fs.NodeOpener interface. The file is its own handle;
+// opening only accounts for writers so single-writer files can refuse a
+// second one with EBUSY. Reads are never restricted; read-only opens
+// prefetch what earlier ones read first.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (handle fs.Handle, err error) {
+	span := f.fs.beginOp("Open", f.inode)
+	defer f.fs.endOp(span, &err, f, req)
+
+	if !writable(req.Flags) {
+		f.prefetchHint()
+		return f, nil
+	}
+	if err := f.addWriter(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// addWriter counts a writable open, refusing it with EBUSY if the file
+// takes a single writer and has one
+func (f *File) addWriter() error {
+	if f.fs.opts.ReadOnly {
+		return syscall.EROFS
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.writers > 0 && f.exclusiveLocked() {
+		return syscall.EBUSY
+	}
+	f.writers++
+	return nil
+}
+
+// releaseWriter drops the writer count taken by Open or Create. FUSE sends
+// Release for every handle, including those of processes that died
+// without closing, so the count cannot leak.
+func (f *File) releaseWriter(flags fuse.OpenFlags) {
+	if !writable(flags) {
+		return
+	}
+	f.mu.Lock()
+	if f.writers > 0 {
+		f.writers--
+	}
+	last := f.writers == 0
+	f.mu.Unlock()
+	if last {
+		f.closeGrowth()
+	}
+}
@@ -0,0 +1,198 @@
+package fs
+
+import (
+	"log"
+	"path"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/audit"
+	"aethelfs/internal/trace"
+
+	"bazil.org/fuse"
+)
+
+// SetTracer enables operation tracing; nil disables it
+func (f *Filesystem) SetTracer(t *trace.Tracer) {
+	f.tracer = t
+}
+
+// newGate returns the semaphore bounding concurrent handlers, or nil when
+// they are unbounded. Serialize is a debugging aid that runs handlers one
+// at a time so their interleaving can't hide ordering bugs.
+func newGate(opts Options) chan struct{} {
+	switch {
+	case opts.Serialize:
+		log.Printf("Warning: serializing all operations; this is a debugging aid and will be slow")
+		return make(chan struct{}, 1)
+	case opts.MaxParallel > 0:
+		log.Printf("Limiting operations to %d in flight", opts.MaxParallel)
+		return make(chan struct{}, opts.MaxParallel)
+	}
+	return nil
+}
+
+// InFlightOp is a FUSE operation being handled, as a crash dump lists it
+type InFlightOp struct {
+	Op    string    `json:"op"`
+	Inode uint64    `json:"inode"`
+	Start time.Time `json:"start"`
+}
+
+// opSpan is a FUSE operation in flight: its span, nil when tracing is
+// disabled, and its key in the in-flight table
+type opSpan struct {
+	*trace.Span
+	id       uint64
+	op       string
+	inode    uint64
+	start    time.Time
+	inFlight int64 // Requests in flight when it arrived, it included
+	fault    bool  // The goroutine's panic-on-fault setting, restored by endOp
+}
+
+// beginOp counts a FUSE operation on the given inode and starts its span.
+// The span is nil, costing a single nil check, when tracing is disabled.
+// With a concurrency gate it first waits for a slot, held until endOp.
+func (f *Filesystem) beginOp(op string, inode uint64) opSpan {
+	opsTotal.With(op).Inc()
+	atomic.AddInt64(&f.opsStarted, 1)
+	id := atomic.AddUint64(&f.opSeq, 1)
+	s := opSpan{id: id, op: op, inode: inode, start: f.clock.Now(), inFlight: f.depth.begin(op)}
+	f.inflight.Store(id, InFlightOp{Op: op, Inode: inode, Start: s.start})
+	if f.gate != nil {
+		f.gate <- struct{}{}
+	}
+	opsInFlight.Add(1)
+	if f.guard != nil {
+		// A stray write into the metadata region panics this handler,
+		// recovered by endOp, rather than crashing the daemon
+		s.fault = debug.SetPanicOnFault(true)
+	}
+	if f.tracer == nil {
+		return s
+	}
+	s.Span = f.tracer.Start(op)
+	s.SetInt("inode", int64(inode))
+	s.SetInt("in_flight", s.inFlight)
+	return s
+}
+
+// endOp finishes an operation span, recording the handler's error. It is
+// meant to be deferred with a pointer to the handler's named result, and
+// also recovers a panic in the handler, failing just that request with EIO.
+// node and req are only described in the panic dump.
+func (f *Filesystem) endOp(span opSpan, err *error, node Node, req interface{}) {
+	if r := recover(); r != nil {
+		*err = f.handlePanic(r, node, req)
+	}
+	if f.guard != nil {
+		debug.SetPanicOnFault(span.fault)
+	}
+	opsInFlight.Add(-1)
+	if f.gate != nil {
+		<-f.gate
+	}
+	atomic.AddInt64(&f.opsDone, 1)
+	f.inflight.Delete(span.id)
+	f.depth.end(span.op)
+	f.logSlowOp(span)
+	if span.Span == nil {
+		return
+	}
+	span.SetError(*err)
+	span.End()
+}
+
+// logSlowOp logs an operation that took at least Options.SlowOpThreshold,
+// with the requests in flight when it arrived and now, so a convoy behind
+// one slow request shows as many slow operations that arrived together
+func (f *Filesystem) logSlowOp(span opSpan) {
+	threshold := f.opts.SlowOpThreshold
+	if threshold <= 0 {
+		return
+	}
+	elapsed := f.clock.Now().Sub(span.start)
+	if elapsed < threshold {
+		return
+	}
+	slowOps.With(span.op).Inc()
+	log.Printf("Slow %s on inode %d took %v with %d requests in flight (%d now, backpressure %d%%)",
+		span.op, span.inode, elapsed.Round(time.Microsecond), span.inFlight,
+		atomic.LoadInt64(&f.depth.inFlight), f.backpressure())
+}
+
+// inFlightOps returns the operations being handled, oldest first
+func (f *Filesystem) inFlightOps() []InFlightOp {
+	var ops []InFlightOp
+	f.inflight.Range(func(_, v interface{}) bool {
+		ops = append(ops, v.(InFlightOp))
+		return true
+	})
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Start.Before(ops[j].Start) })
+	return ops
+}
+
+// OpCounts returns how many traced operations have started and finished.
+// Operations in flight with none finishing means the serve loop is stuck.
+func (f *Filesystem) OpCounts() (started, done int64) {
+	return atomic.LoadInt64(&f.opsStarted), atomic.LoadInt64(&f.opsDone)
+}
+
+// SetAuditLog enables audit records for namespace mutations; nil disables it
+func (f *Filesystem) SetAuditLog(l *audit.Logger) {
+	f.audit = l
+}
+
+// auditOp records a mutation of name within dir on behalf of the request's
+// caller. It is meant to be deferred with a pointer to the handler's error
+// so the path is only computed when auditing is enabled.
+func (f *Filesystem) auditOp(op string, hdr *fuse.Header, dir *Dir, name string, err *error) {
+	if f.audit == nil {
+		return
+	}
+
+	result := "ok"
+	if *err != nil {
+		result = (*err).Error()
+	}
+
+	p := "/" + name
+	if dir != nil {
+		p = path.Join(dir.path(), name)
+	}
+
+	f.audit.Log(audit.Record{
+		Time:   time.Now(),
+		Op:     op,
+		Path:   p,
+		Uid:    hdr.Uid,
+		Gid:    hdr.Gid,
+		Pid:    hdr.Pid,
+		Result: result,
+	})
+}
+
+// setattrOp names the attribute changes requested by a Setattr
+func setattrOp(req *fuse.SetattrRequest) string {
+	var ops []string
+	if req.Valid.Size() {
+		ops = append(ops, "truncate")
+	}
+	if req.Valid.Mode() {
+		ops = append(ops, "chmod")
+	}
+	if req.Valid.Uid() || req.Valid.Gid() {
+		ops = append(ops, "chown")
+	}
+	if req.Valid.Atime() || req.Valid.Mtime() {
+		ops = append(ops, "utimes")
+	}
+	if len(ops) == 0 {
+		return "setattr"
+	}
+	return strings.Join(ops, ",")
+}
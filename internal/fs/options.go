@@ -0,0 +1,305 @@
+package fs
+
+import (
+	"time"
+
+	"aethelfs/internal/clock"
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+)
+
+// Directory fsync modes
+const (
+	DirSyncBatch = "batch" // Flush the metadata batch if the directory has pending changes
+	DirSyncFull  = "full"  // Also flush the whole device
+	DirSyncNone  = "none"  // No durability guarantee, for benchmarking
+)
+
+// Write durability modes
+const (
+	SyncModeDefault = "default" // Writes are durable after fsync or a background flush
+	SyncModeStrict  = "strict"  // Writes are durable before they are acknowledged
+)
+
+// Options controls tunable filesystem behavior
+type Options struct {
+	// MetaBatchSize is the number of metadata mutations that may accumulate
+	// before a device flush is forced. Values <= 1 flush every mutation.
+	MetaBatchSize int `json:"meta_batch_size"`
+
+	// MetaBatchDelay is the longest a metadata mutation may wait for a flush
+	MetaBatchDelay time.Duration `json:"meta_batch_delay_ns"`
+
+	// MaxFileSize is the largest size a file may be written or truncated to
+	MaxFileSize int64 `json:"max_file_size"`
+
+	// ExposeControlDir lists the virtual .aethelfs directory in the root
+	ExposeControlDir bool `json:"expose_control_dir"`
+
+	// BlockSize is the allocation alignment used when formatting a new
+	// device; zero means disk.DefaultBlockSize. Mounting a formatted device
+	// with a different non-zero block size fails with
+	// disk.ErrIncompatibleOption.
+	BlockSize int64 `json:"block_size,omitempty"`
+
+	// Allocator selects alloc.KindFreeList or alloc.KindBitmap when
+	// formatting a new device; empty means the free list. Mounting a
+	// formatted device with a different allocator fails with
+	// disk.ErrIncompatibleOption.
+	Allocator string `json:"allocator,omitempty"`
+
+	// InodeRatio is the device bytes per inode when formatting a new
+	// device, fixing how many files and directories it can hold; zero
+	// means disk.DefaultInodeRatio. It may be no smaller than the block
+	// size. Mounting a formatted device with a ratio giving a different
+	// limit fails with disk.ErrIncompatibleOption.
+	InodeRatio int64 `json:"inode_ratio,omitempty"`
+
+	// ReadOnly serves a device another daemon may be writing, e.g. for
+	// backups. Nothing is written to the device: it is not formatted, the
+	// mount is not recorded, and writes fail with EROFS.
+	ReadOnly bool `json:"read_only,omitempty"`
+
+	// Recovery mounts a damaged device to salvage what it can: each
+	// inconsistency in its metadata is logged and tolerated instead of
+	// failing the mount; see recovery.go. It requires ReadOnly.
+	Recovery bool `json:"recovery,omitempty"`
+
+	// CrashDir is where crash dumps are written and looked for at mount;
+	// see crashdump.go. Empty disables them.
+	CrashDir string `json:"crash_dir,omitempty"`
+
+	// Clock stamps node times and drives timers; nil is the system clock.
+	// Tests substitute a clock.Fake to control time.
+	Clock clock.Clock `json:"-"`
+
+	// Label names the device in the superblock and in the mount's fsname.
+	// Empty keeps the label already stored.
+	Label string `json:"label,omitempty"`
+
+	// Regions splits the device into named allocation regions. Empty means
+	// a single region covering the whole device.
+	Regions []Region `json:"regions,omitempty"`
+
+	// Files at least LargeFileThreshold bytes are placed in LargeFileRegion
+	// unless tagged with a tier xattr. Zero or an empty region disables it.
+	LargeFileThreshold int64  `json:"large_file_threshold,omitempty"`
+	LargeFileRegion    string `json:"large_file_region,omitempty"`
+
+	// Placement selects where in a region new extents go: PlacementPack
+	// fills from the start, PlacementSpread hashes the inode to a starting
+	// offset to spread concurrently written files over an interleave set
+	Placement string `json:"placement"`
+
+	// AllocLogSize is the number of recent allocations and frees kept for
+	// debugging. Zero disables the log.
+	AllocLogSize int `json:"alloc_log_size"`
+
+	// MaxPanics makes the daemon exit once this many handler panics have
+	// been recovered. Zero keeps serving indefinitely.
+	MaxPanics int `json:"max_panics"`
+
+	// Readahead is how far past a sequential read the device is
+	// prefetched. Zero disables readahead.
+	Readahead int64 `json:"readahead"`
+
+	// NoPrefetchHints turns off recording the chunks a file's opens read
+	// first and prefetching them on later opens; see prefetchhint.go
+	NoPrefetchHints bool `json:"no_prefetch_hints"`
+
+	// FlushInterval is how often the background flusher makes dirty ranges
+	// durable. Zero disables it, leaving durability to fsync.
+	FlushInterval time.Duration `json:"flush_interval_ns"`
+
+	// FlushStrategy selects how ranges are made durable: dax.FlushMsync,
+	// dax.FlushCLWB, or dax.FlushAuto to pick per range size from a
+	// calibration run at mount
+	FlushStrategy string `json:"flush_strategy"`
+
+	// SyncMode selects when writes become durable: SyncModeDefault or
+	// SyncModeStrict. Strict mode only covers writes that reach the daemon,
+	// so it is pointless with the kernel's writeback cache on.
+	SyncMode string `json:"sync_mode"`
+
+	// WritebackCache tells the flusher the kernel mount uses writeback
+	// caching, so file data ranges can be left to kernel writeback
+	WritebackCache bool `json:"writeback_cache"`
+
+	// FlushErrorLimit degrades the filesystem after this many consecutive
+	// flush failures in one region; see degraded.go. Zero never degrades.
+	FlushErrorLimit int `json:"flush_error_limit"`
+
+	// OnFlushErrors selects what writes do once degraded:
+	// OnFlushErrorsFail or OnFlushErrorsContinue
+	OnFlushErrors string `json:"on_flush_errors"`
+
+	// RequireDurable fails the mount unless the persistence self-test
+	// passes; see selftest.go. Without it a failure is only logged.
+	RequireDurable bool `json:"require_durable"`
+
+	// MaxDirtyBytes throttles writes once this many bytes await the
+	// background flusher: they wait until it brings the dirty bytes down
+	// to DirtyLowBytes, half of MaxDirtyBytes if zero. Zero never
+	// throttles, nor does a disabled flusher.
+	MaxDirtyBytes int64 `json:"max_dirty_bytes"`
+	DirtyLowBytes int64 `json:"dirty_low_bytes,omitempty"`
+
+	// ReuseDelay holds freed extents back from reuse this long, and
+	// ReuseDelayBytes holds at most this many bytes, so deleted data stays
+	// intact for recovery; see quarantine.go. Either alone enables the
+	// delay; zero for both reuses space at once.
+	ReuseDelay      time.Duration `json:"reuse_delay_ns,omitempty"`
+	ReuseDelayBytes int64         `json:"reuse_delay_bytes,omitempty"`
+
+	// MaxPinnedBytes limits the device bytes pinned files may hold, so
+	// one user cannot pin the whole device; see pin.go. Zero disables
+	// pinning. PinPrefault faults in every file as it is pinned.
+	MaxPinnedBytes int64 `json:"max_pinned_bytes"`
+	PinPrefault    bool  `json:"pin_prefault"`
+
+	// WriteEpochInterval advances the write epoch files stamp their writes
+	// with this often, for incremental backups; see writeepoch.go. Zero
+	// leaves it to the advance-epoch control command.
+	WriteEpochInterval time.Duration `json:"write_epoch_interval_ns,omitempty"`
+
+	// StaticInitialSize gives new files the default initial allocation
+	// instead of one learned from the InitialSizePercentile of the sizes
+	// recent files in the same top-level directory reached; see
+	// sizelearn.go. An initial-size xattr overrides either.
+	StaticInitialSize     bool `json:"static_initial_size"`
+	InitialSizePercentile int  `json:"initial_size_percentile"`
+
+	// VerifyWrites reads back every write after flushing it, failing
+	// mismatches with EIO; see verify.go. It is slow, for qualifying new
+	// hardware. The verify-writes xattr turns it on for one subtree.
+	VerifyWrites bool `json:"verify_writes"`
+
+	// ProtectMetadata keeps the metadata reservation read-only while
+	// mounted, lifting it only to rewrite the superblock, so stray writes
+	// fault instead of corrupting it; see metaguard.go
+	ProtectMetadata bool `json:"protect_metadata"`
+
+	// ConservativeFlush makes the flusher flush every dirty range,
+	// including those kernel writeback already covers
+	ConservativeFlush bool `json:"conservative_flush"`
+
+	// CompactRate bounds the bytes per second background compaction moves
+	// to merge fragmented free space; see compact.go. Zero disables it.
+	CompactRate int64 `json:"compact_rate"`
+
+	// CompactThreshold starts compaction when the largest free extent is
+	// below this fraction of all free space
+	CompactThreshold float64 `json:"compact_threshold"`
+
+	// BackgroundMaxLatency holds background tasks such as compaction and
+	// deduplication off while reads and writes average longer than this;
+	// see priority.go. Zero ignores latency.
+	BackgroundMaxLatency time.Duration `json:"background_max_latency_ns"`
+
+	// BackgroundMaxQueue holds background tasks off while more than this
+	// many FUSE requests are in flight. Negative ignores the queue.
+	BackgroundMaxQueue int `json:"background_max_queue"`
+
+	// BackgroundMaxDefer bounds how long a background task holds off
+	// before each chunk of work, so it cannot be starved outright
+	BackgroundMaxDefer time.Duration `json:"background_max_defer_ns"`
+
+	// MetadataWarnBytes logs a warning, at most once a minute, while heap
+	// used by in-memory inodes is over this many bytes. Nothing is evicted:
+	// the namespace lives only in memory. Zero never warns.
+	MetadataWarnBytes int64 `json:"metadata_warn_bytes"`
+
+	// NoSuid strips setuid and setgid bits from files, and setuid from
+	// directories, at create and chmod, whatever the kernel mount flags
+	NoSuid bool `json:"no_suid"`
+
+	// NoDeviceNodes makes mknod of character and block devices fail with
+	// EPERM, even for root
+	NoDeviceNodes bool `json:"no_device_nodes"`
+
+	// ExclusiveWrite allows at most one writable handle per file, as if
+	// every file had the exclusive-write xattr set
+	ExclusiveWrite bool `json:"exclusive_write"`
+
+	// DelayAllocBudget bounds the memory new files may buffer their data
+	// in before being given an extent; see delalloc.go. Zero allocates an
+	// extent at create.
+	DelayAllocBudget int64 `json:"delay_alloc_budget"`
+
+	// CoalesceAppends stages small sequential appends to every file, as if
+	// each had the coalesce xattr set
+	CoalesceAppends bool `json:"coalesce_appends"`
+
+	// Serialize runs one operation at a time, for debugging ordering
+	// problems. It overrides MaxParallel.
+	Serialize bool `json:"serialize"`
+
+	// MaxParallel bounds the operations handled concurrently. Zero is
+	// unbounded.
+	MaxParallel int `json:"max_parallel"`
+
+	// Ino32 keeps inode numbers below 2^32 by recycling the numbers of
+	// removed files
+	Ino32 bool `json:"ino32"`
+
+	// DirSync selects what fsync on a directory guarantees: DirSyncBatch,
+	// DirSyncFull or DirSyncNone
+	DirSync string `json:"dir_sync"`
+
+	// UidQuota limits the device bytes charged to each listed uid; growth
+	// past the limit fails with EDQUOT
+	UidQuota map[uint32]int64 `json:"uid_quota,omitempty"`
+
+	// MaxBackground is the kernel's background queue limit the daemon
+	// mounted with, against which the backpressure gauge compares the
+	// requests in flight; zero leaves the gauge at zero
+	MaxBackground int `json:"max_background,omitempty"`
+
+	// SlowOpThreshold logs operations taking at least this long, with the
+	// requests in flight at the time; zero disables the log
+	SlowOpThreshold time.Duration `json:"slow_op_threshold_ns,omitempty"`
+
+	// ControlSocket is the absolute path of the daemon's control socket,
+	// published in the control directory for clients to discover
+	ControlSocket string `json:"control_socket,omitempty"`
+
+	// FastMount rebuilds the free list in the background after mount;
+	// allocation is append-only until it is ready
+	FastMount bool `json:"fast_mount"`
+
+	// Progress, if set, receives mount scan progress every second and once
+	// more when the scan completes
+	Progress func(MountProgress) `json:"-"`
+}
+
+// DefaultOptions returns the options used when none are specified
+func DefaultOptions() Options {
+	return Options{
+		MetaBatchSize:  64,
+		MetaBatchDelay: 5 * time.Millisecond,
+		MaxFileSize:    common.DefaultMaxFileSize,
+		FlushInterval:  5 * time.Second,
+		DirSync:        DirSyncBatch,
+		SyncMode:       SyncModeDefault,
+		Placement:      PlacementPack,
+		OnFlushErrors:  OnFlushErrorsFail,
+		FlushStrategy:  dax.FlushAuto,
+		Readahead:      8 * 1024 * 1024,
+
+		DelayAllocBudget: 64 * 1024 * 1024,
+
+		CompactRate:      16 * 1024 * 1024,
+		CompactThreshold: 0.5,
+
+		BackgroundMaxLatency: 5 * time.Millisecond,
+		BackgroundMaxDefer:   time.Second,
+
+		FlushErrorLimit: 8,
+		MaxDirtyBytes:   1024 * 1024 * 1024,
+
+		ProtectMetadata: true,
+		SlowOpThreshold: time.Second,
+
+		InitialSizePercentile: 70,
+	}
+}
@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"aethelfs/internal/metrics"
+)
+
+var handlerPanics = metrics.NewCounter("aethelfs_handler_panics_total",
+	"FUSE handler panics recovered and failed with EIO")
+
+// panicAllocRecords is how much of the allocation log a panic dump includes
+const panicAllocRecords = 32
+
+// handlePanic logs a recovered handler panic with the request, the node's
+// state and the stack, and returns the error the request fails with. After
+// Options.MaxPanics panics the daemon crashes, writing a crash dump through
+// the crash handler, rather than keep serving from state that may be
+// corrupt.
+func (f *Filesystem) handlePanic(r interface{}, node Node, req interface{}) error {
+	n := atomic.AddInt64(&f.panics, 1)
+	handlerPanics.Inc()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Recovered panic in FUSE handler: %v\n", r)
+	if off, ok := f.guard.faultOffset(r); ok {
+		metaGuardFaults.Inc()
+		fmt.Fprintf(&b, "stray write into the write-protected metadata region at device offset %d\n", off)
+	}
+	fmt.Fprintf(&b, "request: %v\n", req)
+	fmt.Fprintf(&b, "node: %s\n", describeNode(node))
+	if records := f.allocLog.dump(panicAllocRecords); len(records) > 0 {
+		b.WriteString("recent allocations:\n")
+		for _, rec := range records {
+			fmt.Fprintf(&b, "  #%d %s inode=%d offset=%d size=%d region=%s\n",
+				rec.Seq, rec.Op, rec.Inode, rec.Offset, rec.Size, rec.Region)
+		}
+	}
+	b.Write(debug.Stack())
+	log.Print(b.String())
+
+	if max := int64(f.opts.MaxPanics); max > 0 && n >= max {
+		f.crash(fmt.Sprintf("%d handler panics, the last: %v", n, r), debug.Stack())
+	}
+	return syscall.EIO
+}
+
+// describeNode summarizes a node for a panic dump. The handler may have
+// panicked while holding the node's lock, so it is only tried.
+func describeNode(node Node) string {
+	switch n := node.(type) {
+	case *File:
+		if !n.mu.TryRLock() {
+			return fmt.Sprintf("file inode=%d name=%q (locked)", n.inode, n.name)
+		}
+		defer n.mu.RUnlock()
+		return fmt.Sprintf("file inode=%d name=%q size=%d offset=%d capacity=%d tier=%q",
+			n.inode, n.name, n.size, n.offset, len(n.data), n.tier)
+	case *Dir:
+		if !n.mu.TryRLock() {
+			return fmt.Sprintf("dir inode=%d name=%q (locked)", n.inode, n.name)
+		}
+		defer n.mu.RUnlock()
+		return fmt.Sprintf("dir inode=%d name=%q entries=%d", n.inode, n.name, len(n.children))
+	case nil:
+		return "none"
+	default:
+		return fmt.Sprintf("%T", node)
+	}
+}
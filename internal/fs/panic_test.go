@@ -0,0 +1,84 @@
+package fs_test
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"time"
+
+	"aethelfs/internal/fs/fstest"
+)
+
+// within fails the test if op does not return in time, which here means
+// a lock was left held by a recovered panic
+func within(t *testing.T, what string, op func() error) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not return: a lock is still held", what)
+		return nil
+	}
+}
+
+func TestPanicInHandlerKeepsServing(t *testing.T) {
+	opts := testOptions()
+	opts.VerifyWrites = true // Flushes each write while holding the file's lock
+	h, err := fstest.NewWithFaults(0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// Unmounting would wait on a lock a failure left held
+		if !t.Failed() {
+			h.Close()
+		}
+	})
+
+	victim, err := h.WriteFile("/victim", []byte("before"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bystander, err := h.WriteFile("/bystander", []byte("bystander"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Faults.PanicNthFlush(1)
+	_, err = h.WriteAt(victim, 0, []byte("panics"))
+	if !fstest.IsErrno(err, syscall.EIO) {
+		t.Fatalf("write hitting the injected panic: %v, want EIO", err)
+	}
+	if n := h.FS.Panics(); n != 1 {
+		t.Fatalf("%d panics recovered, want 1", n)
+	}
+
+	// The panicking request held the file's lock; it must have been released
+	if err := within(t, "write after the panic", func() error {
+		_, err := h.WriteAt(victim, 0, []byte("after!"))
+		return err
+	}); err != nil {
+		t.Fatalf("write after the panic: %v", err)
+	}
+	var got []byte
+	if err := within(t, "read after the panic", func() (err error) {
+		got, err = h.ReadAt(victim, 0, 64)
+		return err
+	}); err != nil {
+		t.Fatalf("read after the panic: %v", err)
+	}
+	if !bytes.Equal(got, []byte("after!")) {
+		t.Errorf("read %q after the panic, want %q", got, "after!")
+	}
+
+	// Other files were never affected
+	if _, err := h.WriteAt(bystander, 0, []byte("still")); err != nil {
+		t.Errorf("write to another file: %v", err)
+	}
+	if got, err := h.ReadFile("/bystander"); err != nil || string(got) != "stillnder" {
+		t.Errorf("read of another file = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,188 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"syscall"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/control"
+	"aethelfs/internal/metrics"
+)
+
+// materializePin names pins in the delayed allocation metrics
+const materializePin = "pin"
+
+var (
+	pinnedBytesGauge = metrics.NewGauge("aethelfs_pinned_bytes",
+		"Device bytes held by pinned files")
+	pinDenials = metrics.NewCounter("aethelfs_pin_denials_total",
+		"Pins and pinned file growth refused because MaxPinnedBytes was reached")
+	pinPrefaultBytes = metrics.NewCounter("aethelfs_pin_prefault_bytes_total",
+		"Bytes of pinned files faulted in at pin time")
+)
+
+// pin marks a read-critical file, such as model weights or an index,
+// non-relocatable: compaction, deduplication and compression leave its
+// extent where it is, and only the file's own writes move it. A buffered
+// file is first given its extent and a compressed one expanded, so reads
+// take the direct path. With prefault the extent is faulted in before pin
+// returns. The pinned flag is file metadata, like the tier. The bytes
+// pinned files hold are limited to MaxPinnedBytes; as with quota charges,
+// growth of a pinned file is reserved before its extent is allocated and
+// settled once it is known.
+func (f *File) pin(prefault bool) error {
+	if f.fs.opts.MaxPinnedBytes == 0 {
+		return syscall.ENOTSUP
+	}
+	if err := f.materialize(materializePin); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if !f.pinned {
+		if err := f.inflateLocked(0); err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		f.pinned = true
+		if err := f.reservePinLocked(int64(f.capacity())); err != nil {
+			f.pinned = false
+			f.mu.Unlock()
+			return err
+		}
+		f.changed(f.fs.clock.Now())
+	}
+	offset, length := f.offset, f.capacity()
+	f.mu.Unlock()
+
+	if prefault && length > 0 {
+		if err := f.fs.device.Prefetch(int64(offset), int64(length)); err != nil {
+			return err
+		}
+		pinPrefaultBytes.Add(int64(length))
+	}
+	return nil
+}
+
+// unpin lets background work relocate the file again
+func (f *File) unpin() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.pinned {
+		return
+	}
+	f.pinned = false
+	f.settlePinLocked()
+	f.changed(f.fs.clock.Now())
+}
+
+// reservePinLocked counts growing a pinned file's extent to capacity
+// bytes against MaxPinnedBytes up front, failing with EDQUOT if that
+// would pass it. The caller holds f.mu for writing.
+func (f *File) reservePinLocked(capacity int64) error {
+	if !f.pinned {
+		return nil
+	}
+	delta := int64(f.fs.alignSize(common.ByteCount(capacity))) - f.pinCharge
+	if delta <= 0 {
+		return nil
+	}
+	if err := f.fs.chargePinned(delta, true); err != nil {
+		return err
+	}
+	f.pinCharge += delta
+	return nil
+}
+
+// settlePinLocked brings the pinned count in line with the extent the
+// file actually holds, or releases it once the file is unpinned. The
+// caller holds f.mu for writing.
+func (f *File) settlePinLocked() {
+	var want int64
+	if f.pinned {
+		want = f.footprint()
+	}
+	if delta := want - f.pinCharge; delta != 0 {
+		f.fs.chargePinned(delta, false)
+		f.pinCharge += delta
+	}
+}
+
+// chargePinned adds delta bytes to the pinned total. With enforce, an
+// increase that would pass MaxPinnedBytes fails with EDQUOT instead.
+func (f *Filesystem) chargePinned(delta int64, enforce bool) error {
+	for {
+		cur := atomic.LoadInt64(&f.pinnedBytes)
+		if enforce && delta > 0 && f.opts.MaxPinnedBytes > 0 && cur+delta > f.opts.MaxPinnedBytes {
+			pinDenials.Inc()
+			return syscall.EDQUOT
+		}
+		if atomic.CompareAndSwapInt64(&f.pinnedBytes, cur, cur+delta) {
+			return nil
+		}
+	}
+}
+
+// PinnedFile is one pinned file and the device bytes it holds
+type PinnedFile struct {
+	Path  string `json:"path"`
+	Inode uint64 `json:"inode"`
+	Bytes int64  `json:"bytes"`
+}
+
+// PinnedFiles lists the pinned files by path
+func (f *Filesystem) PinnedFiles() []PinnedFile {
+	out := []PinnedFile{}
+	f.walkFiles(func(p string, file *File) {
+		file.mu.RLock()
+		if file.pinned {
+			out = append(out, PinnedFile{Path: p, Inode: file.inode, Bytes: file.footprint()})
+		}
+		file.mu.RUnlock()
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// ctlPin pins a file, optionally prefaulting it
+func (f *Filesystem) ctlPin(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Path     string `json:"path"`
+		Prefault bool   `json:"prefault"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	file, err := f.lookupFile(params.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.pin(params.Prefault || f.opts.PinPrefault); err != nil {
+		return nil, fmt.Errorf("%s: %w", params.Path, err)
+	}
+	return map[string]int64{"pinned_bytes": atomic.LoadInt64(&f.pinnedBytes)}, nil
+}
+
+// ctlUnpin unpins a file
+func (f *Filesystem) ctlUnpin(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Path string `json:"path"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	file, err := f.lookupFile(params.Path)
+	if err != nil {
+		return nil, err
+	}
+	file.unpin()
+	return map[string]int64{"pinned_bytes": atomic.LoadInt64(&f.pinnedBytes)}, nil
+}
+
+// ctlPinned lists the pinned files
+func (f *Filesystem) ctlPinned(args json.RawMessage) (interface{}, error) {
+	return f.PinnedFiles(), nil
+}
@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"math/bits"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+// Placement policies: where in a region new extents are searched for
+const (
+	PlacementPack   = "pack"   // First fit from the start of the region, for locality
+	PlacementSpread = "spread" // From an offset hashed from the inode
+)
+
+var spreadWraps = metrics.NewCounter("aethelfs_alloc_spread_wraps_total",
+	"Spread allocations that found no room past their hashed offset and wrapped around")
+
+// allocIn allocates size bytes for inode in region r under the placement
+// policy. Spreading starts each file's search at an offset hashed from
+// its inode, so files created together land across the region, and across
+// the stripes of an interleave set, instead of packed at its start. While
+// the mount scan runs only the tail is usable and both policies pack.
+// Called with allocMu held.
+func (f *Filesystem) allocIn(r *region, inode uint64, size common.ByteCount, tailOnly bool) (common.DeviceOffset, bool) {
+	if f.opts.Placement != PlacementSpread || tailOnly {
+		return r.alloc.Alloc(size, tailOnly)
+	}
+	from := f.spreadOffset(r, inode)
+	offset, ok := r.alloc.AllocFrom(size, from)
+	if ok && offset < from {
+		spreadWraps.Inc()
+	}
+	return offset, ok
+}
+
+// spreadOffset maps inode to a block-aligned offset within r. Inode
+// numbers are mostly sequential, so they are mixed with a Fibonacci hash
+// whose high bits pick the block; consecutive inodes then land far apart.
+func (f *Filesystem) spreadOffset(r *region, inode uint64) common.DeviceOffset {
+	blocks := uint64(int64(r.Size) / f.blockSize)
+	if blocks == 0 {
+		return r.Offset
+	}
+	block, _ := bits.Mul64(inode*0x9E3779B97F4A7C15, blocks)
+	return r.Offset.Plus(common.ByteCount(int64(block) * f.blockSize))
+}
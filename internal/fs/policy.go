@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"aethelfs/internal/metrics"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// Mount-wide policies, labels of the policy counters
+const (
+	policyNoSuid        = "no_suid"
+	policyNoDeviceNodes = "no_device_nodes"
+)
+
+var policyEnforced = metrics.NewCounterVec("aethelfs_policy_enforced_total",
+	"Requests changed or refused by a mount-wide policy: setuid/setgid bits stripped, device nodes refused", "policy")
+
+// stripSuid removes the setuid and setgid bits from mode under NoSuid,
+// whatever the kernel mount flags. Directories keep setgid: on them it
+// only passes the group on to new entries.
+func (f *Filesystem) stripSuid(mode os.FileMode) os.FileMode {
+	if !f.opts.NoSuid {
+		return mode
+	}
+	bits := os.ModeSetuid
+	if mode&os.ModeDir == 0 {
+		bits |= os.ModeSetgid
+	}
+	if mode&bits != 0 {
+		policyEnforced.With(policyNoSuid).Inc()
+	}
+	return mode &^ bits
+}
+
+var _ = registerBehavior(Behavior{
+	Name: "mknod", Supported: false, Errno: "ENOSYS",
+	Note: "Special files cannot be stored; device nodes fail with EPERM under NoDeviceNodes",
+})
+
+// Mknod implements the fs.NodeMknoder interface. Special files cannot be
+// stored, so mknod fails as it did without a handler; NoDeviceNodes
+// refuses device nodes with EPERM, even for root, so the policy holds if
+// they are ever supported.
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (node fs.Node, err error) {
+	span := d.fs.beginOp("Mknod", d.inode)
+	span.SetString("name", req.Name)
+	defer d.fs.auditOp("mknod", &req.Header, d, req.Name, &err)
+	defer d.fs.endOp(span, &err, d, req)
+
+	if req.Mode&os.ModeDevice != 0 && d.fs.opts.NoDeviceNodes {
+		policyEnforced.With(policyNoDeviceNodes).Inc()
+		return nil, syscall.EPERM
+	}
+	return nil, syscall.ENOSYS
+}
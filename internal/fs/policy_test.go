@@ -0,0 +1,102 @@
+package fs_test
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"aethelfs/internal/fs/fstest"
+)
+
+func TestNoSuid(t *testing.T) {
+	const suid = os.ModeSetuid | os.ModeSetgid
+	tests := []struct {
+		name string
+		op   func(h *fstest.Harness) (fusefs.Node, error)
+		dir  bool
+	}{
+		{"create", func(h *fstest.Harness) (fusefs.Node, error) {
+			return h.Create("/file", 0755|suid)
+		}, false},
+		{"mkdir", func(h *fstest.Harness) (fusefs.Node, error) {
+			return h.Mkdir("/dir", 0755|suid)
+		}, true},
+		{"chmod of a file", func(h *fstest.Harness) (fusefs.Node, error) {
+			file, err := h.Create("/file", 0755)
+			if err == nil {
+				err = h.Chmod(file, 0755|suid)
+			}
+			return file, err
+		}, false},
+		{"chmod of a directory", func(h *fstest.Harness) (fusefs.Node, error) {
+			dir, err := h.Mkdir("/dir", 0755)
+			if err == nil {
+				err = h.Chmod(dir, 0755|suid)
+			}
+			return dir, err
+		}, true},
+	}
+	for _, tt := range tests {
+		for _, noSuid := range []bool{false, true} {
+			opts := testOptions()
+			opts.NoSuid = noSuid
+			h := newHarnessWith(t, 0, opts)
+			node, err := tt.op(h)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			attr, err := h.Stat(node)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := suid
+			if noSuid {
+				// Directories keep setgid, which only passes on the group
+				want = 0
+				if tt.dir {
+					want = os.ModeSetgid
+				}
+			}
+			if got := attr.Mode & suid; got != want {
+				t.Errorf("%s with NoSuid %v: set-id bits %v, want %v", tt.name, noSuid, got, want)
+			}
+			if attr.Mode.Perm() != 0755 {
+				t.Errorf("%s with NoSuid %v: permissions %v, want 0755", tt.name, noSuid, attr.Mode.Perm())
+			}
+		}
+	}
+}
+
+func TestNoDeviceNodes(t *testing.T) {
+	tests := []struct {
+		mode          os.FileMode
+		noDeviceNodes bool
+		errno         syscall.Errno
+	}{
+		{os.ModeDevice | 0600, true, syscall.EPERM},
+		{os.ModeDevice | os.ModeCharDevice | 0600, true, syscall.EPERM},
+		{os.ModeDevice | 0600, false, syscall.ENOSYS},
+		// Special files are not stored either way
+		{os.ModeNamedPipe | 0600, true, syscall.ENOSYS},
+	}
+	for _, tt := range tests {
+		opts := testOptions()
+		opts.NoDeviceNodes = tt.noDeviceNodes
+		h := newHarnessWith(t, 0, opts)
+		root, err := h.Dir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The harness speaks as root, whom the policy refuses too
+		req := &fuse.MknodRequest{Header: h.Header, Name: "node", Mode: tt.mode, Rdev: 0x0801}
+		if _, err := root.Mknod(h.Context(), req); !fstest.IsErrno(err, tt.errno) {
+			t.Errorf("mknod %v with NoDeviceNodes %v: %v, want %v", tt.mode, tt.noDeviceNodes, err, tt.errno)
+		}
+		if _, err := h.Lookup("/node"); !fstest.IsErrno(err, syscall.ENOENT) {
+			t.Errorf("mknod %v left an entry: %v", tt.mode, err)
+		}
+	}
+}
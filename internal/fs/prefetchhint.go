@@ -0,0 +1,162 @@
+package fs
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+// Access hints prefetch, when a file is opened for reading, the chunks
+// earlier opens read first. The hint is the first hintMaxChunks distinct
+// hintChunkSize chunks an open touched, in order. It is recorded once
+// and replayed on later opens; a replay whose reads mostly miss the hint
+// drops it, and the next open records a new one.
+const (
+	hintChunkSize = 1024 * 1024
+	hintMaxChunks = 64
+)
+
+var (
+	hintPrefetchBytes = metrics.NewCounter("aethelfs_prefetch_hint_bytes_total",
+		"Bytes prefetched at open from recorded access hints")
+	hintHits = metrics.NewCounter("aethelfs_prefetch_hint_hits_total",
+		"Chunks read after open that the access hint had prefetched")
+	hintMisses = metrics.NewCounter("aethelfs_prefetch_hint_misses_total",
+		"Chunks read after open that the access hint had not prefetched")
+	hintRebuilds = metrics.NewCounter("aethelfs_prefetch_hint_rebuilds_total",
+		"Access hints dropped for re-recording because most reads missed them")
+)
+
+// accessHint records and replays the order a file's chunks are first read
+type accessHint struct {
+	active int32 // Non-zero while recording or scoring; atomic
+
+	mu        sync.Mutex
+	order     []uint32        // Chunk indices in first-read order
+	recording bool            // Appending to order
+	seen      map[uint32]bool // Chunks in order, while recording
+	hinted    map[uint32]bool // Chunks the current replay prefetched
+	scored    map[uint32]bool // Chunks read during the replay so far
+	hits      int
+}
+
+// opened starts a new open and returns the chunks to prefetch, if a hint
+// has been recorded
+func (h *accessHint) opened() []uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Score the previous replay; a hint that mostly missed is rebuilt
+	if misses := len(h.scored) - h.hits; h.hinted != nil && misses > h.hits {
+		h.order = nil
+		hintRebuilds.Inc()
+	}
+	h.hinted, h.scored, h.hits = nil, nil, 0
+	// An unfinished recording is still a hint
+	h.recording, h.seen = false, nil
+
+	if len(h.order) == 0 {
+		h.recording = true
+		h.seen = make(map[uint32]bool)
+		atomic.StoreInt32(&h.active, 1)
+		return nil
+	}
+	h.hinted = make(map[uint32]bool, len(h.order))
+	for _, c := range h.order {
+		h.hinted[c] = true
+	}
+	h.scored = make(map[uint32]bool, len(h.order))
+	atomic.StoreInt32(&h.active, 1)
+	return append([]uint32(nil), h.order...)
+}
+
+// touched notes a read of chunks first through last
+func (h *accessHint) touched(first, last uint32) {
+	if atomic.LoadInt32(&h.active) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := first; c <= last; c++ {
+		switch {
+		case h.recording:
+			if !h.seen[c] {
+				h.seen[c] = true
+				h.order = append(h.order, c)
+			}
+			if len(h.order) == hintMaxChunks {
+				h.recording, h.seen = false, nil
+				atomic.StoreInt32(&h.active, 0)
+				return
+			}
+		case h.scored != nil:
+			if h.scored[c] {
+				continue
+			}
+			h.scored[c] = true
+			if h.hinted[c] {
+				h.hits++
+				hintHits.Inc()
+			} else {
+				hintMisses.Inc()
+			}
+			// The hint only predicts as many chunks as it holds
+			if len(h.scored) == len(h.hinted) {
+				atomic.StoreInt32(&h.active, 0)
+				return
+			}
+		}
+	}
+}
+
+// prefetchHint starts an open of f for reading: it prefetches the chunks
+// of a recorded hint, merging neighbours into one range, or starts
+// recording one. Buffered and compressed files are not hinted.
+func (f *File) prefetchHint() {
+	if f.fs.opts.NoPrefetchHints {
+		return
+	}
+	f.mu.Lock()
+	if f.hint == nil {
+		f.hint = &accessHint{}
+	}
+	h := f.hint
+	f.mu.Unlock()
+
+	chunks := h.opened()
+	if len(chunks) == 0 {
+		return
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.comp != nil || f.pending != nil {
+		return
+	}
+	for i := 0; i < len(chunks); {
+		j := i + 1
+		for j < len(chunks) && chunks[j] == chunks[j-1]+1 {
+			j++
+		}
+		start := int64(chunks[i]) * hintChunkSize
+		end := (int64(chunks[j-1]) + 1) * hintChunkSize
+		if end > f.size {
+			end = f.size
+		}
+		if start < end {
+			f.fs.prefetch(f.offset.Plus(common.ByteCount(start)), common.ByteCount(end-start))
+			hintPrefetchBytes.Add(end - start)
+		}
+		i = j
+	}
+}
+
+// hintLocked notes a read of [offset, end) for the file's access hint.
+// The caller must hold f.mu for reading.
+func (f *File) hintLocked(offset, end int64) {
+	if f.hint == nil || end <= offset {
+		return
+	}
+	f.hint.touched(uint32(offset/hintChunkSize), uint32((end-1)/hintChunkSize))
+}
@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/metrics"
+)
+
+// Background tasks that go through the executor, named in metrics
+const (
+	taskCompact = "compact"
+	taskDedup   = "dedup"
+)
+
+var (
+	backgroundDeferrals = metrics.NewCounterVec("aethelfs_background_deferrals_total",
+		"Times a background task held off because foreground requests were queued or slow, by task", "task")
+	backgroundDeferredMillis = metrics.NewCounterVec("aethelfs_background_deferred_milliseconds_total",
+		"Time background tasks spent holding off for foreground requests, by task", "task")
+)
+
+// backgroundPoll is how often a deferred task looks again for a quiet
+// moment
+const backgroundPoll = 10 * time.Millisecond
+
+// backgroundWindow is the shortest interval foreground latency is averaged
+// over; checks within it reuse the last verdict
+const backgroundWindow = 100 * time.Millisecond
+
+// background is the executor tooling such as compaction and deduplication
+// does its device work through, so it gets what foreground requests leave
+// over. A task asks before each chunk of work; the executor holds it off
+// while more than BackgroundMaxQueue FUSE requests are in flight or while
+// reads and writes have lately averaged longer than BackgroundMaxLatency,
+// then paces it to the task's own byte rate. A task is held off for at
+// most BackgroundMaxDefer per chunk, so steady foreground load slows
+// background work down without stopping it.
+type background struct {
+	mu        sync.Mutex
+	checked   time.Time // Start of the current latency window
+	lastCount uint64    // ioLatency totals at checked
+	lastSum   float64
+	slow      bool // Verdict of the last complete window
+}
+
+// foregroundBusy reports whether background work should hold off now
+func (f *Filesystem) foregroundBusy() bool {
+	if limit := f.opts.BackgroundMaxQueue; limit >= 0 {
+		if atomic.LoadInt64(&f.opsStarted)-atomic.LoadInt64(&f.opsDone) > int64(limit) {
+			return true
+		}
+	}
+	return f.foregroundSlow()
+}
+
+// foregroundSlow reports whether reads and writes averaged longer than
+// BackgroundMaxLatency over the last complete window
+func (f *Filesystem) foregroundSlow() bool {
+	limit := f.opts.BackgroundMaxLatency
+	if limit <= 0 {
+		return false
+	}
+	b := &f.background
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := f.clock.Now()
+	if now.Sub(b.checked) < backgroundWindow {
+		return b.slow
+	}
+	count, sum := ioLatency.Count(), ioLatency.Sum()
+	ops, total := count-b.lastCount, sum-b.lastSum
+	b.checked, b.lastCount, b.lastSum = now, count, sum
+	b.slow = ops > 0 && time.Duration(total/float64(ops)*float64(time.Second)) > limit
+	return b.slow
+}
+
+// yieldBackground holds task off while the foreground is busy, for at most
+// BackgroundMaxDefer. It returns false if stop closed meanwhile; a nil
+// stop never closes.
+func (f *Filesystem) yieldBackground(task string, stop <-chan struct{}) bool {
+	if !f.foregroundBusy() {
+		return true
+	}
+	backgroundDeferrals.With(task).Inc()
+	start := f.clock.Now()
+	defer func() { backgroundDeferredMillis.With(task).Add(f.clock.Now().Sub(start).Milliseconds()) }()
+	for f.clock.Now().Sub(start) < f.opts.BackgroundMaxDefer {
+		if !f.backgroundSleep(backgroundPoll, stop) {
+			return false
+		}
+		if !f.foregroundBusy() {
+			break
+		}
+	}
+	return true
+}
+
+// paceBackground waits as long as moving n bytes takes at rate bytes per
+// second; zero rate does not wait. It returns false if stop closed
+// meanwhile.
+func (f *Filesystem) paceBackground(n, rate int64, stop <-chan struct{}) bool {
+	if rate <= 0 || n <= 0 {
+		return true
+	}
+	return f.backgroundSleep(time.Duration(float64(n)/float64(rate)*float64(time.Second)), stop)
+}
+
+// backgroundSleep waits d on the filesystem's clock unless stop closes
+// first
+func (f *Filesystem) backgroundSleep(d time.Duration, stop <-chan struct{}) bool {
+	done := make(chan struct{})
+	t := f.clock.AfterFunc(d, func() { close(done) })
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-stop:
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+// allocOpRelease marks a quarantined extent returned to the pool
+const allocOpRelease = "release"
+
+// Why quarantined extents were released
+const (
+	releaseExpired  = "expired"   // Held for the whole ReuseDelay
+	releaseFull     = "full"      // Pushed out by ReuseDelayBytes
+	releaseLowSpace = "low_space" // An allocation would otherwise fail
+)
+
+var (
+	quarantineBytes = metrics.NewGauge("aethelfs_quarantine_bytes",
+		"Freed bytes held back from reuse by the reuse delay")
+	quarantineReleased = metrics.NewCounterVec("aethelfs_quarantine_released_bytes_total",
+		"Quarantined bytes returned to the pool, by reason: expired, full or low_space", "reason")
+)
+
+// quarantined is a freed extent held back from reuse
+type quarantined struct {
+	region *region
+	inode  uint64
+	offset common.DeviceOffset
+	size   common.ByteCount
+	freed  time.Time
+}
+
+// quarantine holds freed extents back from reuse for Options.ReuseDelay,
+// or until more than Options.ReuseDelayBytes are held, so the data of a
+// deleted file stays intact for a while for recovery and for debugging
+// use-after-free bugs. Held extents still count as free space: when an
+// allocation would fail, they are all released first. The queue lives in
+// memory only; a remount rebuilds the free list and releases everything.
+// Guarded by allocMu.
+type quarantine struct {
+	queue []quarantined // Oldest first
+	bytes common.ByteCount
+}
+
+// reuseDelayed reports whether freed extents are quarantined
+func (f *Filesystem) reuseDelayed() bool {
+	return f.opts.ReuseDelay > 0 || f.opts.ReuseDelayBytes > 0
+}
+
+// quarantineLocked holds a freed extent of r back from reuse. Called with
+// allocMu held.
+func (f *Filesystem) quarantineLocked(r *region, inode uint64, offset common.DeviceOffset, size common.ByteCount) {
+	f.held.queue = append(f.held.queue, quarantined{
+		region: r,
+		inode:  inode,
+		offset: offset,
+		size:   size,
+		freed:  f.clock.Now(),
+	})
+	f.held.bytes += size
+	f.expireQuarantineLocked()
+}
+
+// expireQuarantineLocked releases the extents held for the whole delay,
+// then the oldest while more than the byte limit are held. Expiry is
+// checked as extents are freed and allocated, so an idle filesystem keeps
+// them past the delay, still counted as free.
+func (f *Filesystem) expireQuarantineLocked() {
+	if delay := f.opts.ReuseDelay; delay > 0 {
+		now := f.clock.Now()
+		for len(f.held.queue) > 0 && now.Sub(f.held.queue[0].freed) >= delay {
+			f.releaseOldestLocked(releaseExpired)
+		}
+	}
+	if limit := f.opts.ReuseDelayBytes; limit > 0 {
+		for int64(f.held.bytes) > limit {
+			f.releaseOldestLocked(releaseFull)
+		}
+	}
+	quarantineBytes.Set(int64(f.held.bytes))
+}
+
+// drainQuarantineLocked releases every held extent so an allocation can
+// use them. It reports whether there were any.
+func (f *Filesystem) drainQuarantineLocked() bool {
+	if len(f.held.queue) == 0 {
+		return false
+	}
+	for len(f.held.queue) > 0 {
+		f.releaseOldestLocked(releaseLowSpace)
+	}
+	quarantineBytes.Set(0)
+	return true
+}
+
+// releaseOldestLocked returns the oldest held extent to its region
+func (f *Filesystem) releaseOldestLocked(reason string) {
+	q := f.held.queue[0]
+	f.held.queue[0] = quarantined{}
+	f.held.queue = f.held.queue[1:]
+	f.held.bytes -= q.size
+	q.region.alloc.Free(q.offset, q.size)
+	f.allocLog.record(allocOpRelease, q.inode, q.offset, q.size, q.region.Name)
+	quarantineReleased.With(reason).Add(int64(q.size))
+}
+
+// quarantinedIn returns the bytes held back in r. Called with allocMu held.
+func (f *Filesystem) quarantinedIn(r *region) common.ByteCount {
+	var n common.ByteCount
+	for _, q := range f.held.queue {
+		if q.region == r {
+			n += q.size
+		}
+	}
+	return n
+}
+
+// ParseReuseDelay parses a -reuse-delay value: a duration such as 10m
+// holds freed extents that long, a plain byte count holds at most that
+// many bytes. Zero or empty disables the delay.
+func ParseReuseDelay(spec string) (delay time.Duration, limit int64, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return 0, 0, nil
+	}
+	if n, err := strconv.ParseInt(spec, 0, 64); err == nil {
+		if n < 0 {
+			return 0, 0, fmt.Errorf("reuse delay must not be negative")
+		}
+		return 0, n, nil
+	}
+	delay, err = time.ParseDuration(spec)
+	if err != nil {
+		return 0, 0, fmt.Errorf("reuse delay %q is neither a duration nor a byte count", spec)
+	}
+	if delay < 0 {
+		return 0, 0, fmt.Errorf("reuse delay must not be negative")
+	}
+	return delay, 0, nil
+}
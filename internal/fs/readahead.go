@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+
+	"bazil.org/fuse"
+)
+
+// readaheadBudget bounds the bytes of prefetch in flight across all files
+// so a handful of streaming readers can't flood the device
+const readaheadBudget = 256 * 1024 * 1024
+
+var (
+	readaheadBytes = metrics.NewCounter("aethelfs_readahead_bytes_total",
+		"Bytes prefetched ahead of sequential reads")
+	readaheadSkipped = metrics.NewCounter("aethelfs_readahead_skipped_total",
+		"Prefetches dropped because the global readahead budget was exhausted")
+)
+
+// seqStream tracks one handle's read position
+type seqStream struct {
+	next   int64 // Offset a sequential read would start at
+	window int64 // End of the range already prefetched
+}
+
+// readaheadState detects sequential access per open handle
+type readaheadState struct {
+	mu      sync.Mutex
+	streams map[fuse.HandleID]*seqStream
+}
+
+// observe records a read of [offset, offset+length) on handle h and
+// returns the file range to prefetch, if any. A read is sequential when it
+// starts where the handle's previous read ended; prefetch is issued once
+// less than half of ahead remains in the window.
+func (r *readaheadState) observe(h fuse.HandleID, offset, length, ahead int64) (start, end int64, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.streams == nil {
+		r.streams = make(map[fuse.HandleID]*seqStream)
+	}
+	s, seen := r.streams[h]
+	if !seen {
+		s = &seqStream{}
+		r.streams[h] = s
+	}
+	sequential := seen && offset == s.next
+	s.next = offset + length
+	if !sequential {
+		s.window = s.next
+		return 0, 0, false
+	}
+	if s.window-s.next > ahead/2 {
+		return 0, 0, false
+	}
+
+	start = s.window
+	if start < s.next {
+		start = s.next
+	}
+	end = s.next + ahead
+	s.window = end
+	return start, end, true
+}
+
+// forget drops the state of a released handle
+func (r *readaheadState) forget(h fuse.HandleID) {
+	r.mu.Lock()
+	delete(r.streams, h)
+	r.mu.Unlock()
+}
+
+// readaheadLocked prefetches past a read that ended at end when handle h
+// is reading sequentially. The caller must hold f.mu for reading.
+func (f *File) readaheadLocked(h fuse.HandleID, offset, end int64) {
+	ahead := f.fs.opts.Readahead
+	if ahead <= 0 || f.comp != nil || f.pending != nil {
+		return
+	}
+	start, stop, ok := f.ra.observe(h, offset, end-offset, ahead)
+	if !ok {
+		return
+	}
+	if stop > f.size {
+		stop = f.size
+	}
+	if start >= stop {
+		return
+	}
+	f.fs.prefetch(f.offset.Plus(common.ByteCount(start)), common.ByteCount(stop-start))
+}
+
+// prefetch faults in a device range in the background, within the global
+// readahead budget
+func (f *Filesystem) prefetch(offset common.DeviceOffset, n common.ByteCount) {
+	length := int64(n)
+	if atomic.AddInt64(&f.prefetching, length) > readaheadBudget {
+		atomic.AddInt64(&f.prefetching, -length)
+		readaheadSkipped.Inc()
+		return
+	}
+	go func() {
+		defer atomic.AddInt64(&f.prefetching, -length)
+		if err := f.device.Prefetch(int64(offset), length); err == nil {
+			readaheadBytes.Add(length)
+		}
+	}()
+}
@@ -0,0 +1,66 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"aethelfs/internal/control"
+	"aethelfs/internal/disk"
+)
+
+// RefreshReport is what a read-only mount saw when it re-read the device
+type RefreshReport struct {
+	RefreshedAt time.Time        `json:"refreshed_at"`
+	Label       string           `json:"label"`
+	WriterMount disk.MountRecord `json:"writer_mount"` // The serving daemon's mount record
+	Changed     bool             `json:"changed"`      // The writer remounted since the last refresh
+	Regions     []RegionStats    `json:"regions"`
+}
+
+// Refresh re-reads the superblock a read-only mount was started from. The
+// writer updates it at every mount, so a changed mount record means the
+// device was remounted underneath us. Allocation state needs no refresh:
+// a bitmap device's bitmap is read straight from the shared mapping.
+func (f *Filesystem) Refresh() (RefreshReport, error) {
+	if !f.opts.ReadOnly {
+		return RefreshReport{}, fmt.Errorf("refresh only applies to read-only mounts")
+	}
+	super, err := disk.ReadSuperblock(superblockBytes(f.device))
+	if err != nil {
+		return RefreshReport{}, err
+	}
+	if super.BlockSize != f.super.BlockSize || super.Features != f.super.Features {
+		return RefreshReport{}, fmt.Errorf("device was reformatted; remount to follow it")
+	}
+
+	f.statsMu.Lock()
+	changed := !super.LastMount.Time.Equal(f.super.LastMount.Time)
+	*f.super = *super
+	f.statsMu.Unlock()
+	f.loadWriteEpoch()
+
+	return RefreshReport{
+		RefreshedAt: f.clock.Now(),
+		Label:       super.Label,
+		WriterMount: super.LastMount,
+		Changed:     changed,
+		Regions:     f.regionStats(),
+	}, nil
+}
+
+// ctlRefresh re-reads the device's metadata on a read-only mount
+func (f *Filesystem) ctlRefresh(args json.RawMessage) (interface{}, error) {
+	return f.Refresh()
+}
+
+// writing wraps a control command that modifies the device so a read-only
+// mount refuses it
+func (f *Filesystem) writing(fn control.HandlerFunc) control.HandlerFunc {
+	return func(args json.RawMessage) (interface{}, error) {
+		if f.opts.ReadOnly {
+			return nil, fmt.Errorf("read-only mount")
+		}
+		return fn(args)
+	}
+}
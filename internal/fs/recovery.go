@@ -0,0 +1,48 @@
+package fs
+
+import (
+	"log"
+
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+)
+
+var recoveryProblems = metrics.NewCounter("aethelfs_recovery_problems_total",
+	"Metadata inconsistencies a recovery mount logged and tolerated")
+
+// readSuperblock reads the superblock, or with Options.Recovery decodes
+// whatever is readable of a damaged one, tolerating each problem
+func (f *Filesystem) readSuperblock() (*disk.Superblock, error) {
+	if !f.opts.Recovery {
+		return disk.ReadSuperblock(superblockBytes(f.device))
+	}
+	super, problems, err := disk.ReadSuperblockLenient(superblockBytes(f.device))
+	for _, p := range problems {
+		f.tolerateMsg(p)
+	}
+	return super, err
+}
+
+// tolerate records err as an inconsistency and reports whether the mount
+// may carry on regardless, which only a recovery mount does. A recovery
+// mount is read-only, so nothing it tolerates is made worse on the device.
+func (f *Filesystem) tolerate(err error) bool {
+	if !f.opts.Recovery {
+		return false
+	}
+	f.tolerateMsg(err.Error())
+	return true
+}
+
+// tolerateMsg logs and keeps one tolerated inconsistency. Only called
+// while mounting, before anything else can see f.recovery.
+func (f *Filesystem) tolerateMsg(msg string) {
+	log.Printf("Recovery: ignoring %s", msg)
+	recoveryProblems.Inc()
+	f.recovery = append(f.recovery, msg)
+}
+
+// RecoveryProblems returns the inconsistencies a recovery mount tolerated
+func (f *Filesystem) RecoveryProblems() []string {
+	return append([]string(nil), f.recovery...)
+}
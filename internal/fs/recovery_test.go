@@ -0,0 +1,103 @@
+package fs_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/fs/fstest"
+)
+
+// TestRecoveryMount damages the superblock and the allocation bitmap of
+// a device: a normal mount refuses it, and a recovery mount mounts it
+// read-only, reports both problems and leaves the device as it was
+func TestRecoveryMount(t *testing.T) {
+	opts := testOptions()
+	opts.Allocator = alloc.KindBitmap
+	opts.Label = "salvage"
+	h, err := fstest.New(0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteFile("/file", bytes.Repeat([]byte("data"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	image := h.Device.At(0, common.ByteCount(h.Device.Size()))
+	super := image[disk.SuperblockOffset : disk.SuperblockOffset+disk.SuperblockSize]
+	label := bytes.Index(super, []byte("salvage"))
+	if label < 0 {
+		t.Fatal("label not found in the superblock")
+	}
+	super[label] ^= 0x20
+	for i := 0; i < 64; i++ {
+		image[disk.BitmapOffset+i] = 0xff
+	}
+	damaged := append([]byte(nil), image...)
+
+	if _, err := fstest.Mount(h.Device, testOptions()); err == nil {
+		t.Fatal("normal mount of a damaged device succeeded")
+	}
+	if _, err := disk.ReadSuperblock(image); err == nil {
+		t.Fatal("damaged superblock read without error")
+	}
+	super[label] ^= 0x20
+	if _, err := fstest.Mount(h.Device, testOptions()); err == nil {
+		t.Fatal("normal mount of a device with a damaged bitmap succeeded")
+	}
+	copy(image, damaged)
+
+	recovery := testOptions()
+	recovery.Recovery = true
+	if _, err := fstest.Mount(h.Device, recovery); err == nil {
+		t.Error("recovery mount without read-only succeeded")
+	}
+	recovery.ReadOnly = true
+	r, err := fstest.Mount(h.Device, recovery)
+	if err != nil {
+		t.Fatalf("recovery mount: %v", err)
+	}
+	problems := r.FS.Health().Recovery
+	for _, want := range []string{"superblock checksum", "allocation bitmap"} {
+		if !strings.Contains(strings.Join(problems, "\n"), want) {
+			t.Errorf("health reports %q, want a %s problem", problems, want)
+		}
+	}
+	if !r.FS.Config().Options.ReadOnly {
+		t.Error("recovery mount is not read-only")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(image, damaged) {
+		t.Error("recovery mount wrote to the device")
+	}
+}
+
+// TestRecoveryMountIntact checks that a recovery mount of a healthy
+// device reports nothing
+func TestRecoveryMountIntact(t *testing.T) {
+	h, err := fstest.New(0, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions()
+	opts.Recovery, opts.ReadOnly = true, true
+	r, err := fstest.Mount(h.Device, opts)
+	if err != nil {
+		t.Fatalf("recovery mount: %v", err)
+	}
+	defer r.Close()
+	if problems := r.FS.Health().Recovery; len(problems) != 0 {
+		t.Errorf("recovery mount of a healthy device reports %q", problems)
+	}
+}
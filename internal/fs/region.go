@@ -0,0 +1,209 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+)
+
+var allocSpills = metrics.NewCounter("aethelfs_alloc_region_spills_total",
+	"Allocations placed outside their preferred region because it was full")
+
+// DefaultRegion names the single region used when none are configured
+const DefaultRegion = "default"
+
+// Region is a named range of the device that allocations can be steered
+// to, e.g. the faster interleave set of a pmem namespace
+type Region struct {
+	Name   string              `json:"name"`
+	Offset common.DeviceOffset `json:"offset"`
+	Size   common.ByteCount    `json:"size"`
+}
+
+// region is a Region with its own allocator
+type region struct {
+	Region
+	alloc alloc.Allocator // Protected by Filesystem.allocMu
+}
+
+// end returns the first offset past the region
+func (r *region) end() common.DeviceOffset {
+	return r.Offset.Plus(r.Size)
+}
+
+// contains reports whether [offset, offset+size) lies within the region
+func (r *region) contains(offset common.DeviceOffset, size common.ByteCount) bool {
+	return offset >= r.Offset && size >= 0 && r.end().Sub(offset) >= size
+}
+
+// RegionStats reports the utilization of one region
+type RegionStats struct {
+	Region
+	AllocatedBytes common.ByteCount `json:"allocated_bytes"`
+	FreeBytes      common.ByteCount `json:"free_bytes"`
+	FreeListBytes  common.ByteCount `json:"free_list_bytes"` // Free bytes below the high-water mark
+
+	// QuarantinedBytes are freed but held back from reuse; they are part
+	// of AllocatedBytes, and count as free in statfs
+	QuarantinedBytes common.ByteCount `json:"quarantined_bytes,omitempty"`
+}
+
+// ParseRegions parses a comma-separated list of name=OFFSET+SIZE regions.
+// Offsets and sizes accept the usual 0x and 0 prefixes.
+func ParseRegions(spec string) ([]Region, error) {
+	var regions []Region
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, extent, ok := strings.Cut(field, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid region %q (want name=OFFSET+SIZE)", field)
+		}
+		off, size, ok := strings.Cut(extent, "+")
+		o, err1 := strconv.ParseInt(off, 0, 64)
+		s, err2 := strconv.ParseInt(size, 0, 64)
+		if !ok || err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid region %q (want name=OFFSET+SIZE)", field)
+		}
+		regions = append(regions, Region{Name: name, Offset: common.DeviceOffset(o), Size: common.ByteCount(s)})
+	}
+	return regions, nil
+}
+
+// newRegions validates the configured regions against the device. With
+// none configured a single region covers everything past the metadata
+// reservation, starting at the first block boundary.
+func newRegions(configured []Region, deviceSize, blockSize common.ByteCount) ([]*region, error) {
+	if len(configured) == 0 {
+		start, err := common.AlignUp(common.MetadataReservationSize, blockSize)
+		if err != nil || start > deviceSize-blockSize {
+			return nil, fmt.Errorf("device too small: %d bytes leave no %d byte block after the metadata reservation",
+				deviceSize, blockSize)
+		}
+		r := &region{Region: Region{
+			Name:   DefaultRegion,
+			Offset: common.DeviceOffset(start),
+			Size:   deviceSize - start,
+		}}
+		return []*region{r}, nil
+	}
+
+	regions := make([]*region, 0, len(configured))
+	names := make(map[string]bool)
+	for _, c := range configured {
+		switch {
+		case names[c.Name]:
+			return nil, fmt.Errorf("duplicate region %q", c.Name)
+		case c.Size < blockSize:
+			return nil, fmt.Errorf("region %q is smaller than one %d byte block", c.Name, blockSize)
+		case c.Offset < common.MetadataReservationSize:
+			return nil, fmt.Errorf("region %q overlaps the metadata reservation", c.Name)
+		case int64(c.Offset)%int64(blockSize) != 0:
+			return nil, fmt.Errorf("region %q is not aligned to the %d byte block size", c.Name, blockSize)
+		case !common.InRange(c.Offset, c.Size, deviceSize):
+			return nil, fmt.Errorf("region %q extends past the end of the device", c.Name)
+		}
+		names[c.Name] = true
+		regions = append(regions, &region{Region: c})
+	}
+
+	// Check for overlaps in offset order, but keep the configured order
+	// as the spill order
+	sorted := append([]*region(nil), regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Offset < sorted[i-1].end() {
+			return nil, fmt.Errorf("regions %q and %q overlap", sorted[i-1].Name, sorted[i].Name)
+		}
+	}
+	return regions, nil
+}
+
+// hasRegion reports whether name is a configured region
+func (f *Filesystem) hasRegion(name string) bool {
+	for _, r := range f.regions {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// placement picks the preferred region for a file of the given size. An
+// explicit tier wins, then the size threshold; "" means no preference.
+func (f *Filesystem) placement(tier string, size common.ByteCount) string {
+	if tier != "" {
+		return tier
+	}
+	if f.opts.LargeFileRegion != "" && f.opts.LargeFileThreshold > 0 && int64(size) >= f.opts.LargeFileThreshold {
+		return f.opts.LargeFileRegion
+	}
+	return ""
+}
+
+// setupAllocators gives every region the allocator the device was
+// formatted with. Bitmap allocators share the bitmap in the metadata
+// reservation, so their state is the device's.
+func (f *Filesystem) setupAllocators() error {
+	var bitmap []byte
+	if allocatorKind(f.super) == alloc.KindBitmap {
+		var err error
+		bitmap, err = disk.Bitmap(f.device.At(0, common.ByteCount(f.device.Size())), f.blockSize, common.MetadataReservationSize)
+		if err != nil {
+			return err
+		}
+		if err := disk.CheckBitmap(bitmap, f.blockSize, common.MetadataReservationSize, f.device.Size()); err != nil {
+			return err
+		}
+	}
+	for _, r := range f.regions {
+		if bitmap == nil {
+			r.alloc = alloc.NewFreeList(r.Offset, r.Size)
+			continue
+		}
+		b, err := alloc.NewBitmap(bitmap, r.Offset, r.Size, common.ByteCount(f.blockSize))
+		if err != nil {
+			return fmt.Errorf("region %q: %w", r.Name, err)
+		}
+		r.alloc = b
+	}
+	return nil
+}
+
+// regionStats reports per-region utilization
+func (f *Filesystem) regionStats() []RegionStats {
+	f.allocMu.Lock()
+	defer f.allocMu.Unlock()
+	stats := make([]RegionStats, len(f.regions))
+	for i, r := range f.regions {
+		a := r.alloc.Stats()
+		stats[i] = RegionStats{
+			Region:         r.Region,
+			AllocatedBytes: a.Allocated,
+			FreeBytes:      a.Free,
+			FreeListBytes:  a.Reusable,
+
+			QuarantinedBytes: f.quarantinedIn(r),
+		}
+	}
+	return stats
+}
+
+// freeList returns the free extents below every region's high-water mark
+func (f *Filesystem) freeList() []alloc.Extent {
+	f.allocMu.Lock()
+	defer f.allocMu.Unlock()
+	var free []alloc.Extent
+	for _, r := range f.regions {
+		free = append(free, r.alloc.FreeExtents()...)
+	}
+	return free
+}
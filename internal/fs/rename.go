@@ -0,0 +1,204 @@
+package fs
+
+import (
+	"context"
+	"syscall"
+
+	"aethelfs/internal/metrics"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+var renameBarriers = metrics.NewCounter("aethelfs_rename_barriers_total",
+	"Renames over an existing file that first made the source's data durable")
+
+var (
+	_ = registerBehavior(Behavior{
+		Name: "rename.replace-durable", Supported: true,
+		Note: "Renaming a file over another first makes the source's data durable",
+	})
+	_ = registerBehavior(Behavior{
+		Name: "rename.RENAME_NOREPLACE", Supported: false, Errno: "EINVAL",
+		Note: "The FUSE request carries no rename flags",
+	})
+	_ = registerBehavior(Behavior{
+		Name: "rename.RENAME_EXCHANGE", Supported: false, Errno: "EINVAL",
+		Note: "The FUSE request carries no rename flags",
+	})
+)
+
+// Rename implements the fs.NodeRenamer interface. A rename replacing an
+// existing file first makes the source's data durable, so the classic
+// write-temp-then-rename update shows the old or the new contents after
+// a crash, never a mix: the rename is only recorded in the metadata batch
+// once the data it publishes has been flushed. Renames are serialized by
+// renameMu; the directories are locked ancestor first, as Remove locks a
+// parent before its child, and unrelated ones in inode order.
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	span := d.fs.beginOp("Rename", d.inode)
+	span.SetString("name", req.OldName)
+	span.SetString("new_name", req.NewName)
+	defer d.fs.auditOp("rename", &req.Header, d, req.OldName, &err)
+	defer d.fs.endOp(span, &err, d, req)
+
+	target, ok := newDir.(*Dir)
+	if !ok || d.isReserved(req.OldName) {
+		return syscall.EPERM
+	}
+	if err := target.checkName(req.NewName); err != nil {
+		return err
+	}
+
+	d.fs.renameMu.Lock()
+	defer d.fs.renameMu.Unlock()
+
+	// The barrier runs before the directory locks are taken, so only
+	// other renames wait on it. A create or unlink may swap either entry
+	// meanwhile; then the entries are looked up and flushed again.
+	var src, dst Node
+	var unlock func()
+	for {
+		d.mu.RLock()
+		src, ok = d.children[req.OldName]
+		d.mu.RUnlock()
+		if !ok {
+			return syscall.ENOENT
+		}
+		target.mu.RLock()
+		dst = target.children[req.NewName]
+		target.mu.RUnlock()
+
+		if file, isFile := src.(*File); isFile && dst != nil && dst != src {
+			barrierSpan := span.Child("barrier")
+			err := file.barrier()
+			barrierSpan.SetError(err)
+			barrierSpan.End()
+			if err != nil {
+				return err
+			}
+			renameBarriers.Inc()
+		}
+
+		unlock = lockDirs(d, target)
+		if d.children[req.OldName] == src && target.children[req.NewName] == dst {
+			break
+		}
+		unlock()
+	}
+	defer func() {
+		if unlock != nil {
+			unlock()
+		}
+	}()
+
+	if dst == src {
+		return nil
+	}
+	if err := checkRenameTarget(src, dst, target); err != nil {
+		return err
+	}
+
+	now := d.fs.clock.Now()
+	delete(d.children, req.OldName)
+	target.children[req.NewName] = src
+	d.touch(now)
+	if target != d {
+		target.touch(now)
+	}
+	switch n := src.(type) {
+	case *File:
+		n.mu.Lock()
+		n.unlinkTreeLocked(d)
+		n.parent, n.name = target, req.NewName
+		n.linkTreeLocked(target)
+		n.changed(now)
+		n.mu.Unlock()
+	case *Dir:
+		d.fs.moveTree(n, d, target)
+		n.mu.Lock()
+		n.parent, n.name = target, req.NewName
+		n.changed(now)
+		n.mu.Unlock()
+	}
+	if dst != nil {
+		target.unlinkLocked(dst, now)
+	}
+	unlock()
+	unlock = nil
+
+	delta := nodeBytes(src, req.NewName) - nodeBytes(src, req.OldName)
+	if dst != nil {
+		delta -= nodeBytes(dst, req.NewName)
+	}
+	d.fs.accountNode(delta)
+	seq := d.fs.meta.add() // Batch the metadata flush
+	d.noteMeta(seq)
+	target.noteMeta(seq)
+	return nil
+}
+
+// checkRenameTarget applies rename(2)'s rules for moving src over dst in
+// target, dst being nil when nothing is replaced: a directory may only
+// replace an empty directory and may not move beneath itself, and a file
+// may not replace a directory. Called with renameMu and the directory
+// locks held.
+func checkRenameTarget(src, dst Node, target *Dir) error {
+	dstDir, dstIsDir := dst.(*Dir)
+	srcDir, srcIsDir := src.(*Dir)
+	if !srcIsDir {
+		if dstIsDir {
+			return syscall.EISDIR
+		}
+		return nil
+	}
+	if target == srcDir || isAncestor(srcDir, target) {
+		return syscall.EINVAL
+	}
+	if dst == nil {
+		return nil
+	}
+	if !dstIsDir {
+		return syscall.ENOTDIR
+	}
+	dstDir.mu.RLock()
+	populated := len(dstDir.children) > 0
+	dstDir.mu.RUnlock()
+	if populated {
+		return syscall.ENOTEMPTY
+	}
+	return nil
+}
+
+// lockDirs locks the directories a rename changes and returns the
+// function unlocking them. Called with renameMu held, so parent pointers
+// are stable.
+func lockDirs(a, b *Dir) func() {
+	if a == b {
+		a.mu.Lock()
+		return a.mu.Unlock
+	}
+	first, second := a, b
+	switch {
+	case isAncestor(a, b):
+	case isAncestor(b, a), b.inode < a.inode:
+		first, second = b, a
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	return func() {
+		second.mu.Unlock()
+		first.mu.Unlock()
+	}
+}
+
+// isAncestor reports whether a is above d in the tree. Called with
+// renameMu held.
+func isAncestor(a, d *Dir) bool {
+	for dir := d.parent; dir != nil; dir = dir.parent {
+		if dir == a {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"aethelfs/internal/fs/fstest"
+)
+
+// TestRenameOverUnderGate renames files over others with the concurrency
+// gate on. The durability barrier a rename-over runs must not wait for a
+// second gate slot while holding the first.
+func TestRenameOverUnderGate(t *testing.T) {
+	tests := []struct {
+		name        string
+		serialize   bool
+		maxParallel int
+	}{
+		{"serialize", true, 0},
+		{"max-parallel", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions()
+			opts.Serialize = tt.serialize
+			opts.MaxParallel = tt.maxParallel
+			h, err := fstest.New(0, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				// Unmounting would hang on a request left holding the gate
+				if !t.Failed() {
+					h.Close()
+				}
+			})
+
+			const pairs = 4
+			for i := 0; i < pairs; i++ {
+				for _, p := range []string{"/tmp%d", "/dst%d"} {
+					p = fmt.Sprintf(p, i)
+					if _, err := h.WriteFile(p, []byte(p), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if err := within(t, "renames over existing files", func() error {
+				var wg sync.WaitGroup
+				errs := make(chan error, pairs)
+				for i := 0; i < pairs; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						errs <- h.Rename(fmt.Sprintf("/tmp%d", i), fmt.Sprintf("/dst%d", i))
+					}(i)
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < pairs; i++ {
+				want := fmt.Sprintf("/tmp%d", i)
+				if got, err := h.ReadFile(fmt.Sprintf("/dst%d", i)); err != nil || !bytes.Equal(got, []byte(want)) {
+					t.Errorf("/dst%d reads %q, %v after the rename", i, got, err)
+				}
+			}
+		})
+	}
+}
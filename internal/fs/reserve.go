@@ -0,0 +1,247 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/control"
+	"aethelfs/internal/metrics"
+)
+
+// materializeReserve names reservations in the delayed allocation metrics
+const materializeReserve = "reserve"
+
+var (
+	reservations = metrics.NewCounter("aethelfs_reservations_total",
+		"Contiguous reservations made through the reserve xattr or control command")
+	reserveDenials = metrics.NewCounter("aethelfs_reserve_denials_total",
+		"Reservations refused with ENOSPC because no free extent was large enough")
+	reservedReleasedBytes = metrics.NewCounter("aethelfs_reserve_released_bytes_total",
+		"Extent bytes past the file size given back when a reservation was released")
+)
+
+var _ = registerBehavior(Behavior{
+	Name: "fallocate", Supported: false, Errno: "EOPNOTSUPP",
+	Note: "The FUSE library has no fallocate handler; set user.aethelfs.reserve to reserve contiguous space",
+})
+
+// reserveSpace makes the file's extent cover [offset, offset+length) in
+// one contiguous piece, so an application such as a database laying out
+// a segment never meets ENOSPC or a relocation mid-write. A file's data
+// always lives in one extent, so this grows it in a single allocation,
+// or fails with ENOSPC leaving the file as it was. Reserved space counts
+// in st_blocks and against quotas like any extent capacity. Truncating
+// the file or releasing the reservation gives back what the extent holds
+// past the file's size.
+func (f *File) reserveSpace(offset, length int64) error {
+	if length <= 0 {
+		return syscall.EINVAL
+	}
+	if err := checkExtent(offset, length, f.fs.opts.MaxFileSize); err != nil {
+		return err
+	}
+	if err := f.fs.checkDegraded(); err != nil {
+		return err
+	}
+	if err := f.materialize(materializeReserve); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := offset + length
+	capacity := f.fs.alignSize(common.ByteCount(end))
+	if f.comp != nil {
+		if err := f.inflateLocked(capacity); err != nil {
+			return err
+		}
+	}
+	if capacity > f.capacity() {
+		if err := f.reserveLocked(int64(capacity)); err != nil {
+			return err
+		}
+		defer f.settleLocked()
+
+		newOffset, err := f.fs.allocateSpace(f.inode, capacity, f.fs.placement(f.tier, capacity))
+		if err != nil {
+			if err == syscall.ENOSPC {
+				reserveDenials.Inc()
+			}
+			return err
+		}
+		newData := f.fs.device.At(newOffset, capacity)
+		copy(newData, f.data[:f.size])
+		f.fs.dirty.add(newOffset, common.ByteCount(f.size), originDaemon)
+
+		oldOffset, oldLength := f.offset, f.capacity()
+		f.data = newData
+		f.offset = newOffset
+		if oldLength > 0 {
+			f.recordGrow(f.size)
+			f.retireLocked(oldOffset, oldLength)
+		}
+		f.fs.meta.add()
+	}
+	if end > f.reserved {
+		f.reserved = end
+	}
+	reservations.Inc()
+	f.changed(f.fs.clock.Now())
+	return nil
+}
+
+// releaseReservationLocked gives back the blocks of the extent past the
+// file's size, keeping at least one. Shared and compressed extents are
+// left whole. The caller holds f.mu for writing.
+func (f *File) releaseReservationLocked() {
+	f.reserved = 0
+	keep := f.fs.alignSize(common.ByteCount(f.size))
+	if keep == 0 {
+		keep = f.fs.alignSize(1)
+	}
+	capacity := f.capacity()
+	if keep >= capacity || f.comp != nil || f.fs.refs.shared(f.offset) {
+		return
+	}
+	f.retireLocked(f.offset.Plus(keep), capacity-keep)
+	f.data = f.data[:keep:keep]
+	reservedReleasedBytes.Add(int64(capacity - keep))
+	f.settleLocked()
+	f.fs.meta.add()
+}
+
+// releaseReservation releases the file's reservation, if it has one
+func (f *File) releaseReservation() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reserved == 0 {
+		return false
+	}
+	f.releaseReservationLocked()
+	f.changed(f.fs.clock.Now())
+	return true
+}
+
+// largestFree returns the largest extent an allocation could be given
+// now: the biggest free-list extent or untouched region tail
+func (f *Filesystem) largestFree() common.ByteCount {
+	f.statsMu.Lock()
+	regions := f.regionStats()
+	free := f.freeList()
+	f.statsMu.Unlock()
+
+	var largest common.ByteCount
+	for _, r := range regions {
+		if tail := r.FreeBytes - r.FreeListBytes; tail > largest {
+			largest = tail
+		}
+	}
+	for _, e := range free {
+		if e.Size > largest {
+			largest = e.Size
+		}
+	}
+	return largest
+}
+
+// ReserveInfo is the reservation state of a file, read back through the
+// reserve xattr. LargestAvailable lets a caller refused with ENOSPC
+// retry with what would fit.
+type ReserveInfo struct {
+	ReservedEnd      int64            `json:"reserved_end"` // Logical end reserved up to; zero if none
+	Capacity         common.ByteCount `json:"capacity"`
+	LargestAvailable common.ByteCount `json:"largest_available"`
+}
+
+// reserveInfo describes the file's reservation
+func (f *File) reserveInfo() ReserveInfo {
+	f.mu.RLock()
+	info := ReserveInfo{ReservedEnd: f.reserved, Capacity: f.capacity()}
+	f.mu.RUnlock()
+	info.LargestAvailable = f.fs.largestFree()
+	return info
+}
+
+// parseReserve parses a reserve xattr value: LENGTH, reserving from
+// offset zero, or OFFSET:LENGTH
+func parseReserve(value string) (offset, length int64, err error) {
+	lengthStr := value
+	if i := strings.IndexByte(value, ':'); i >= 0 {
+		if offset, err = strconv.ParseInt(value[:i], 10, 64); err != nil {
+			return 0, 0, err
+		}
+		lengthStr = value[i+1:]
+	}
+	length, err = strconv.ParseInt(lengthStr, 10, 64)
+	return offset, length, err
+}
+
+// FileLayout describes where a file's data lives on the device. Data is
+// always one extent; Extents lists it so the format can grow.
+type FileLayout struct {
+	Size        int64          `json:"size"`
+	ReservedEnd int64          `json:"reserved_end,omitempty"`
+	Region      string         `json:"region,omitempty"`
+	Compressed  bool           `json:"compressed,omitempty"`
+	Shared      bool           `json:"shared,omitempty"`
+	Extents     []LayoutExtent `json:"extents"`
+}
+
+// LayoutExtent maps a logical range of a file onto the device
+type LayoutExtent struct {
+	Logical int64               `json:"logical"`
+	Offset  common.DeviceOffset `json:"offset"`
+	Length  common.ByteCount    `json:"length"`
+}
+
+// layout describes the file's extent
+func (f *File) layout() FileLayout {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	l := FileLayout{
+		Size:        f.size,
+		ReservedEnd: f.reserved,
+		Compressed:  f.comp != nil,
+		Extents:     []LayoutExtent{},
+	}
+	if capacity := f.capacity(); capacity > 0 {
+		l.Region = f.fs.flushRegion(f.offset, capacity)
+		l.Shared = f.fs.refs.shared(f.offset)
+		l.Extents = append(l.Extents, LayoutExtent{Offset: f.offset, Length: capacity})
+	}
+	return l
+}
+
+// ctlReserve reserves contiguous space for a file, or releases its
+// reservation when length is zero. A refusal reports the largest extent
+// available.
+func (f *Filesystem) ctlReserve(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Path   string `json:"path"`
+		Offset int64  `json:"offset"`
+		Length int64  `json:"length"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	file, err := f.lookupFile(params.Path)
+	if err != nil {
+		return nil, err
+	}
+	if params.Length == 0 {
+		file.releaseReservation()
+		return file.layout(), nil
+	}
+	if err := file.reserveSpace(params.Offset, params.Length); err != nil {
+		if err == syscall.ENOSPC {
+			return nil, fmt.Errorf("%s: no free extent of %d bytes; the largest available is %d: %w",
+				params.Path, params.Offset+params.Length, f.largestFree(), err)
+		}
+		return nil, fmt.Errorf("%s: %w", params.Path, err)
+	}
+	return file.layout(), nil
+}
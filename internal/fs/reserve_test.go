@@ -0,0 +1,209 @@
+package fs_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// layoutOf reads the file's layout the way an application would, through
+// the layout xattr
+func layoutOf(t *testing.T, h *fstest.Harness, file *fs.File) fs.FileLayout {
+	t.Helper()
+	data, err := h.Getxattr(file, "user.aethelfs.layout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var l fs.FileLayout
+	if err := json.Unmarshal(data, &l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// reserveOf reads the file's reservation through the reserve xattr
+func reserveOf(t *testing.T, h *fstest.Harness, file *fs.File) fs.ReserveInfo {
+	t.Helper()
+	data, err := h.Getxattr(file, "user.aethelfs.reserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info fs.ReserveInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// checkReserved checks the file is one extent of at least end bytes,
+// reserved up to end and charged for all of it in st_blocks
+func checkReserved(t *testing.T, h *fstest.Harness, file *fs.File, end int64) fs.FileLayout {
+	t.Helper()
+	l := layoutOf(t, h, file)
+	if len(l.Extents) != 1 || int64(l.Extents[0].Length) < end || l.ReservedEnd != end {
+		t.Fatalf("layout %+v, want one extent of at least %d bytes reserved to %d", l, end, end)
+	}
+	attr, err := h.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(l.Extents[0].Length) / 512; attr.Blocks != want {
+		t.Errorf("st_blocks %d for a %d byte extent, want %d", attr.Blocks, l.Extents[0].Length, want)
+	}
+	return l
+}
+
+func TestReserveContiguous(t *testing.T) {
+	h := newHarness(t)
+	file, err := h.Create("/segment", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := freeBytes(t, h)
+	if err := h.Setxattr(file, "user.aethelfs.reserve", []byte("4194304")); err != nil {
+		t.Fatal(err)
+	}
+	l := checkReserved(t, h, file, 4<<20)
+	if used := free - freeBytes(t, h); used < 4<<20 {
+		t.Errorf("reserving 4MB used %d bytes", used)
+	}
+	if attr, _ := h.Stat(file); attr.Size != 0 {
+		t.Errorf("reserving set the size to %d", attr.Size)
+	}
+
+	// Writing inside the reservation never moves the extent
+	for off := int64(0); off < 4<<20; off += 1 << 20 {
+		if _, err := h.WriteAt(file, off, make([]byte, 64<<10)); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Fsync(file); err != nil {
+			t.Fatal(err)
+		}
+		if got := layoutOf(t, h, file).Extents; len(got) != 1 || got[0].Offset != l.Extents[0].Offset {
+			t.Fatalf("write at %d moved the reserved extent to %+v", off, got)
+		}
+	}
+
+	// Reserving past the end regrows it into a single extent
+	if err := h.Setxattr(file, "user.aethelfs.reserve", []byte("8388608:1048576")); err != nil {
+		t.Fatal(err)
+	}
+	checkReserved(t, h, file, 9<<20)
+	if got, err := h.ReadAt(file, 3<<20, 4); err != nil || len(got) != 4 {
+		t.Errorf("data written before regrowing reads %v, %v", got, err)
+	}
+
+	for _, value := range []string{"", "x", "-1", "0:-5", "1:x"} {
+		if err := h.Setxattr(file, "user.aethelfs.reserve", []byte(value)); !fstest.IsErrno(err, syscall.EINVAL) {
+			t.Errorf("reserve %q: %v, want EINVAL", value, err)
+		}
+	}
+}
+
+func TestReserveFragmented(t *testing.T) {
+	h := newHarnessWith(t, smallDevice, testOptions())
+	const chunk = 256 << 10
+
+	// Fill the device, then free every other file so the free space is
+	// many extents none larger than a chunk
+	var files []*fs.File
+	for i := 0; ; i++ {
+		file, err := h.WriteFile(fmt.Sprintf("/fill%d", i), make([]byte, chunk), 0644)
+		if err == nil {
+			err = h.Fsync(file)
+		}
+		if fstest.IsErrno(err, syscall.ENOSPC) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	for i := 0; i < len(files); i += 2 {
+		if err := h.Remove(fmt.Sprintf("/fill%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		h.Forget(files[i])
+	}
+
+	file, err := h.Create("/segment", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free := freeBytes(t, h)
+	if free < 2*chunk {
+		t.Fatalf("only %d bytes free after the removals", free)
+	}
+	if err := h.Setxattr(file, "user.aethelfs.reserve", []byte(fmt.Sprint(2*chunk))); !fstest.IsErrno(err, syscall.ENOSPC) {
+		t.Fatalf("reserving %d bytes with %d free in pieces: %v, want ENOSPC", 2*chunk, free, err)
+	}
+	info := reserveOf(t, h, file)
+	if info.LargestAvailable < chunk || info.LargestAvailable >= 2*chunk {
+		t.Errorf("largest available %d after a refusal, want the %d byte holes", info.LargestAvailable, chunk)
+	}
+	if l := layoutOf(t, h, file); l.ReservedEnd != 0 || info.ReservedEnd != 0 {
+		t.Errorf("refused reservation left %+v", l)
+	}
+
+	// What the refusal reported fits
+	if err := h.Setxattr(file, "user.aethelfs.reserve", []byte(fmt.Sprint(int64(info.LargestAvailable)))); err != nil {
+		t.Fatalf("reserving the largest available %d bytes: %v", info.LargestAvailable, err)
+	}
+	checkReserved(t, h, file, int64(info.LargestAvailable))
+}
+
+func TestReserveReleased(t *testing.T) {
+	tests := []struct {
+		name    string
+		release func(h *fstest.Harness, file *fs.File) error
+	}{
+		{"truncate", func(h *fstest.Harness, file *fs.File) error {
+			return h.Truncate(file, 10000)
+		}},
+		{"removexattr", func(h *fstest.Harness, file *fs.File) error {
+			return h.Removexattr(file, "user.aethelfs.reserve")
+		}},
+		{"reserve zero", func(h *fstest.Harness, file *fs.File) error {
+			return h.Setxattr(file, "user.aethelfs.reserve", []byte("0"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			file, err := h.WriteFile("/segment", make([]byte, 10000), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Setxattr(file, "user.aethelfs.reserve", []byte("4194304")); err != nil {
+				t.Fatal(err)
+			}
+			reserved := checkReserved(t, h, file, 4<<20)
+
+			if err := tt.release(h, file); err != nil {
+				t.Fatal(err)
+			}
+			l := layoutOf(t, h, file)
+			if l.ReservedEnd != 0 || len(l.Extents) != 1 || l.Extents[0].Length >= reserved.Extents[0].Length ||
+				l.Extents[0].Length < 10000 || l.Extents[0].Offset != reserved.Extents[0].Offset {
+				t.Errorf("layout %+v after release, want the start of the reserved extent holding the data", l)
+			}
+			attr, err := h.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := uint64(l.Extents[0].Length) / 512; attr.Blocks != want || attr.Size != 10000 {
+				t.Errorf("size %d, st_blocks %d after release, want 10000 and %d", attr.Size, attr.Blocks, want)
+			}
+			if err := h.Removexattr(file, "user.aethelfs.reserve"); err != fuse.ErrNoXattr {
+				t.Errorf("removexattr with nothing reserved: %v, want ENODATA", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package fs
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"aethelfs/internal/dax"
+)
+
+// selfTestScratch is the size of the scratch extent the mount self-test
+// writes its pattern to
+const selfTestScratch = 64 * 1024
+
+// selfTest checks the persistence path on a scratch extent borrowed from
+// the allocator and logs the verdict. With RequireDurable a failure fails
+// the mount. Backends that cannot run it, such as a fault injection
+// wrapper, are not tested.
+func (f *Filesystem) selfTest() error {
+	tester, ok := f.device.(dax.SelfTester)
+	if !ok {
+		if f.opts.RequireDurable {
+			return fmt.Errorf("durability cannot be verified on this device")
+		}
+		return nil
+	}
+	offset, err := f.allocateSpace(0, selfTestScratch, f.placement("", selfTestScratch))
+	if err != nil {
+		return fmt.Errorf("no space for the persistence self-test: %v", err)
+	}
+	defer f.freeSpace(0, offset, selfTestScratch)
+
+	r := tester.SelfTest(int64(offset), selfTestScratch)
+	f.durability = &r
+	if r.Passed {
+		log.Printf("Persistence self-test passed (%s flush, %s backing, MAP_SYNC %t)", r.Strategy, r.Backing, r.MapSync)
+		return nil
+	}
+	problems := strings.Join(r.Problems, "; ")
+	if f.opts.RequireDurable {
+		return fmt.Errorf("persistence self-test failed: %s", problems)
+	}
+	log.Printf("Warning: persistence self-test failed, data may not be durable: %s", problems)
+	return nil
+}
@@ -0,0 +1,221 @@
+package fs
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+)
+
+// Bounds and pacing of the learned initial allocation
+const (
+	learnWindow     = 256         // Final sizes kept per directory
+	learnMinSamples = 16          // Files closed before a learned size is used
+	learnRecompute  = 16          // Files closed between recomputations
+	learnMinSize    = 4 * 1024    // Smallest learned allocation
+	learnMaxSize    = 1024 * 1024 // Largest learned allocation
+)
+
+// sizeLearner picks the initial allocation of new files from the sizes
+// files recently reached when their last writer closed them, per
+// top-level directory, so a directory of small files stops wasting space
+// and one of large files stops growing them. Sizes learned before the
+// last unmount seed it until enough files close again.
+type sizeLearner struct {
+	mu    sync.Mutex
+	dirs  map[string]*sizeHistory     // By top-level directory path
+	seeds map[uint64]disk.LearnedSize // From the superblock, by disk.HashDir
+}
+
+// sizeHistory is the recent final sizes of one top-level directory's files
+type sizeHistory struct {
+	sizes   []int64 // Ring of the last learnWindow sizes
+	next    int     // Ring position the next size goes in
+	samples int64   // Sizes recorded since mount
+	seed    disk.LearnedSize
+	learned int64 // Zero until learnMinSamples sizes are recorded
+}
+
+// topLevel returns the top-level directory of the absolute path p, or "/"
+// for the root itself
+func topLevel(p string) string {
+	rest := strings.TrimPrefix(p, "/")
+	if rest == "" {
+		return "/"
+	}
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		rest = rest[:i]
+	}
+	return "/" + rest
+}
+
+// loadLearnedSizes seeds the learner with the sizes the superblock holds
+func (f *Filesystem) loadLearnedSizes() {
+	l := &f.sizes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seeds = make(map[uint64]disk.LearnedSize, len(f.super.LearnedSizes))
+	for _, ls := range f.super.LearnedSizes {
+		l.seeds[ls.DirHash] = ls
+	}
+}
+
+// historyLocked returns dir's history, creating it with any seed for it.
+// The caller holds l.mu.
+func (l *sizeLearner) historyLocked(dir string) *sizeHistory {
+	h := l.dirs[dir]
+	if h == nil {
+		if l.dirs == nil {
+			l.dirs = make(map[string]*sizeHistory)
+		}
+		h = &sizeHistory{seed: l.seeds[disk.HashDir(dir)]}
+		l.dirs[dir] = h
+	}
+	return h
+}
+
+// size returns the allocation learned for the history, or zero when there
+// is neither enough to go on nor a seed
+func (h *sizeHistory) size() int64 {
+	if h.learned != 0 {
+		return h.learned
+	}
+	return int64(h.seed.Size)
+}
+
+// learnedAllocation returns the initial allocation learned for files
+// created in the directory at path p, or zero for the default
+func (f *Filesystem) learnedAllocation(p string) int64 {
+	if f.opts.StaticInitialSize {
+		return 0
+	}
+	l := &f.sizes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.historyLocked(topLevel(p)).size()
+}
+
+// learnFinalSize records the size a file at path p reached when its last
+// writer closed it, recomputing its directory's learned allocation every
+// learnRecompute files
+func (f *Filesystem) learnFinalSize(p string, size int64) {
+	if f.opts.StaticInitialSize || f.opts.ReadOnly {
+		return
+	}
+	l := &f.sizes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	h := l.historyLocked(topLevel(p))
+	if len(h.sizes) < learnWindow {
+		h.sizes = append(h.sizes, size)
+	} else {
+		h.sizes[h.next] = size
+	}
+	h.next = (h.next + 1) % learnWindow
+	h.samples++
+	if h.samples >= learnMinSamples && h.samples%learnRecompute == 0 {
+		h.learned = f.percentileAllocation(h.sizes)
+	}
+}
+
+// percentileAllocation returns the InitialSizePercentile of sizes, rounded
+// up to whole blocks and clamped to the learned allocation bounds. The
+// lower bound is no larger than the default, so small-block mode keeps
+// its single-block files.
+func (f *Filesystem) percentileAllocation(sizes []int64) int64 {
+	sorted := append([]int64(nil), sizes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(float64(f.opts.InitialSizePercentile)/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	size, lower := sorted[i], int64(learnMinSize)
+	if def := f.initialAllocation(); def < lower {
+		lower = def
+	}
+	if size < lower {
+		size = lower
+	}
+	if size > learnMaxSize {
+		size = learnMaxSize
+	}
+	return int64(f.alignSize(common.ByteCount(size)))
+}
+
+// learnedSizes returns the allocation learned for each top-level
+// directory files have been created or closed in, for stats
+func (f *Filesystem) learnedSizes() map[string]int64 {
+	l := &f.sizes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var sizes map[string]int64
+	for dir, h := range l.dirs {
+		if size := h.size(); size != 0 {
+			if sizes == nil {
+				sizes = make(map[string]int64)
+			}
+			sizes[dir] = size
+		}
+	}
+	return sizes
+}
+
+// saveLearnedSizes records the learned allocations in the superblock at
+// unmount, keeping the MaxLearnedSizes learned from the most files.
+// Seeds of directories no file was closed in this mount are kept.
+func (f *Filesystem) saveLearnedSizes() error {
+	if f.opts.StaticInitialSize || f.opts.ReadOnly {
+		return nil
+	}
+	l := &f.sizes
+	l.mu.Lock()
+	merged := make(map[uint64]disk.LearnedSize, len(l.seeds))
+	for hash, seed := range l.seeds {
+		merged[hash] = seed
+	}
+	changed := false
+	for dir, h := range l.dirs {
+		if h.learned == 0 {
+			continue
+		}
+		samples := int64(h.seed.Samples) + h.samples
+		if samples > math.MaxUint32 {
+			samples = math.MaxUint32
+		}
+		hash := disk.HashDir(dir)
+		merged[hash] = disk.LearnedSize{DirHash: hash, Size: uint32(h.learned), Samples: uint32(samples)}
+		changed = true
+	}
+	l.mu.Unlock()
+	if !changed {
+		return nil
+	}
+
+	sizes := make([]disk.LearnedSize, 0, len(merged))
+	for _, ls := range merged {
+		sizes = append(sizes, ls)
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Samples != sizes[j].Samples {
+			return sizes[i].Samples > sizes[j].Samples
+		}
+		return sizes[i].DirHash < sizes[j].DirHash
+	})
+	if len(sizes) > disk.MaxLearnedSizes {
+		sizes = sizes[:disk.MaxLearnedSizes]
+	}
+
+	f.superMu.Lock()
+	defer f.superMu.Unlock()
+	prev := f.super.LearnedSizes
+	f.super.LearnedSizes = sizes
+	if err := f.writeSuperLocked(); err != nil {
+		f.super.LearnedSizes = prev
+		return fmt.Errorf("failed to record learned initial sizes in superblock: %w", err)
+	}
+	return nil
+}
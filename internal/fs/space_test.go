@@ -0,0 +1,273 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/fs/fstest"
+)
+
+// smallDevice is a device with a few MB of data space
+const smallDevice = 4 << 20
+
+// freeBytes returns the data space statfs reports free
+func freeBytes(t *testing.T, h *fstest.Harness) int64 {
+	t.Helper()
+	st, err := h.Statfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(st.Bfree) * int64(st.Bsize)
+}
+
+func TestWritePastCapacity(t *testing.T) {
+	h := newHarnessWith(t, smallDevice, testOptions())
+	free := freeBytes(t, h)
+	file, err := h.Create("/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(file, 0, make([]byte, free+1)); !fstest.IsErrno(err, syscall.ENOSPC) {
+		t.Fatalf("write of one byte more than is free: %v, want ENOSPC", err)
+	}
+	// The failed write takes nothing, and a smaller one still fits
+	if got := freeBytes(t, h); got != free {
+		t.Errorf("%d bytes free after the failed write, want %d", got, free)
+	}
+	if attr, _ := h.Stat(file); attr.Size != 0 {
+		t.Errorf("size %d after the failed write, want 0", attr.Size)
+	}
+	if _, err := h.WriteAt(file, 0, []byte("fits")); err != nil {
+		t.Errorf("small write after ENOSPC: %v", err)
+	}
+}
+
+func TestWriteOffsetOverflow(t *testing.T) {
+	h := newHarnessWith(t, smallDevice, testOptions())
+	file, err := h.WriteFile("/file", []byte("contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		offset int64
+		want   syscall.Errno
+	}{
+		{"end overflows int64", math.MaxInt64 - 2, syscall.EFBIG},
+		{"offset at the int64 limit", math.MaxInt64, syscall.EFBIG},
+		{"negative offset", math.MinInt64, syscall.EINVAL},
+		{"past the device", smallDevice, syscall.ENOSPC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := h.WriteAt(file, tt.offset, make([]byte, 16)); !fstest.IsErrno(err, tt.want) {
+				t.Errorf("write at %d: %v, want %v", tt.offset, err, tt.want)
+			}
+		})
+	}
+	got, err := h.ReadFile("/file")
+	if err != nil || string(got) != "contents" {
+		t.Errorf("file reads %q, %v after the rejected writes", got, err)
+	}
+}
+
+func TestWriteFillsDevice(t *testing.T) {
+	h := newHarnessWith(t, smallDevice, testOptions())
+	free := freeBytes(t, h)
+	data := bytes.Repeat([]byte{0xa5}, int(free))
+	file, err := h.Create("/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(file, 0, data); err != nil {
+		t.Fatalf("write of exactly the %d bytes free: %v", free, err)
+	}
+	if err := h.Fsync(file); err != nil {
+		t.Fatal(err)
+	}
+	if got := freeBytes(t, h); got != 0 {
+		t.Errorf("%d bytes free after filling the device, want 0", got)
+	}
+	if _, err := h.WriteAt(file, free, []byte{1}); !fstest.IsErrno(err, syscall.ENOSPC) {
+		t.Errorf("write past a full device: %v, want ENOSPC", err)
+	}
+	got, err := h.ReadFile("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes differing from the %d written", len(got), len(data))
+	}
+}
+
+func TestStatfsUnderChurn(t *testing.T) {
+	h := newHarness(t)
+	free := freeBytes(t, h)
+	const workers, rounds, fileSize = 4, 100, 200 << 10
+	// Each worker holds at most two files, each within two allocations
+	budget := int64(workers * 2 * 2 * (fileSize + 64<<10))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(w)}, fileSize)
+			for i := 0; i < rounds; i++ {
+				p := fmt.Sprintf("/w%d-%d", w, i%2)
+				file, err := h.WriteFile(p, data[:(i*4099)%fileSize+1], 0644)
+				if err == nil {
+					err = h.Fsync(file)
+				}
+				if err == nil && i%3 == 0 {
+					if err = h.Remove(p); err == nil {
+						h.Forget(file)
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	checked := make(chan int)
+	go func() {
+		n := 0
+		defer func() { checked <- n }()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			st, err := h.Statfs()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			n++
+			got := int64(st.Bfree) * int64(st.Bsize)
+			switch {
+			case st.Bfree > st.Blocks || st.Bavail > st.Bfree:
+				t.Errorf("statfs: %d blocks, %d free, %d available", st.Blocks, st.Bfree, st.Bavail)
+				return
+			case got > free || got < free-budget:
+				t.Errorf("statfs: %d bytes free, want between %d and %d", got, free-budget, free)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	if n := <-checked; n == 0 {
+		t.Error("statfs never ran during the churn")
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// With the churn over, what is left is exactly accounted for
+	for w := 0; w < workers; w++ {
+		for i := 0; i < 2; i++ {
+			p := fmt.Sprintf("/w%d-%d", w, i)
+			file, err := h.File(p)
+			if fstest.IsErrno(err, syscall.ENOENT) {
+				continue
+			}
+			if err == nil {
+				err = h.Remove(p)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.Forget(file)
+		}
+	}
+	if err := h.FS.SyncFS(); err != nil {
+		t.Fatal(err)
+	}
+	if got := freeBytes(t, h); got != free {
+		t.Errorf("%d bytes free after the churn, want %d", got, free)
+	}
+}
+
+func TestDeviceTooSmall(t *testing.T) {
+	for _, size := range []int64{0, 4096, common.MetadataReservationSize, common.MinDeviceSize - 1} {
+		if h, err := fstest.Mount(dax.NewMemDevice(size), testOptions()); err == nil {
+			h.Close()
+			t.Errorf("mounted a %d byte device", size)
+		}
+
+		// A backing file that small must not be mapped as if it were larger
+		path := filepath.Join(t.TempDir(), "device")
+		if err := os.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if device, err := dax.NewDevice(path); err == nil {
+			device.Close()
+			t.Errorf("opened a %d byte backing file", size)
+		}
+	}
+}
+
+func TestStatfsBoundarySizes(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int64
+		blocks, free uint64
+	}{
+		{"reservation plus one block", common.MinDeviceSize, 257, 1},
+		{"one byte short of two blocks", common.MinDeviceSize + 4095, 258, 1},
+		{"reservation plus two blocks", common.MinDeviceSize + 4096, 258, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := fstest.Mount(dax.NewMemDevice(tt.size), testOptions())
+			if err != nil {
+				t.Fatalf("mount: %v", err)
+			}
+			defer h.Close()
+			st, err := h.Statfs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if st.Blocks != tt.blocks || st.Bfree != tt.free || st.Bavail != tt.free {
+				t.Fatalf("statfs: %d blocks, %d free, %d available; want %d, %d free",
+					st.Blocks, st.Bfree, st.Bavail, tt.blocks, tt.free)
+			}
+
+			// Exactly the free blocks can be written, and no more. Small
+			// writes are buffered, so the failure may only come with fsync.
+			free := int64(tt.free) * int64(st.Bsize)
+			file, err := h.WriteFile("/file", make([]byte, free), 0644)
+			if err == nil {
+				err = h.Fsync(file)
+			}
+			if err != nil {
+				t.Fatalf("write of the %d bytes free: %v", free, err)
+			}
+			if got := freeBytes(t, h); got != 0 {
+				t.Errorf("%d bytes free after filling the device, want 0", got)
+			}
+			_, err = h.WriteAt(file, free, []byte{1})
+			if err == nil {
+				err = h.Fsync(file)
+			}
+			if !fstest.IsErrno(err, syscall.ENOSPC) {
+				t.Errorf("write of one byte past the free space: %v, want ENOSPC", err)
+			}
+		})
+	}
+}
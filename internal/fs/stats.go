@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/dax"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	opsTotal = metrics.NewCounterVec("aethelfs_ops_total",
+		"FUSE operations handled, by operation type", "op")
+	opsInFlight = metrics.NewGauge("aethelfs_ops_in_flight",
+		"FUSE operations currently being handled")
+	bytesRead = metrics.NewCounter("aethelfs_read_bytes_total",
+		"Bytes returned by Read")
+	bytesWritten = metrics.NewCounter("aethelfs_written_bytes_total",
+		"Bytes accepted by Write")
+	deviceFlushErrors = metrics.NewCounter("aethelfs_device_flush_errors_total",
+		"Device flushes that failed")
+	statsViolations = metrics.NewCounter("aethelfs_stats_invariant_violations_total",
+		"Stats snapshots whose allocator accounting did not add up")
+
+	// Allocator gauges, refreshed from a snapshot on every scrape
+	allocatedBytesGauge = metrics.NewGauge("aethelfs_allocated_bytes",
+		"Bytes allocated to files")
+	freeBytesGauge = metrics.NewGauge("aethelfs_free_bytes",
+		"Bytes available for allocation")
+	freeExtentsGauge = metrics.NewGauge("aethelfs_free_list_extents",
+		"Extents on the free list")
+	inodesGauge = metrics.NewGauge("aethelfs_inodes",
+		"Inodes allocated")
+	inodesUsedGauge = metrics.NewGauge("aethelfs_inodes_used",
+		"Live files and directories, counted against the inode limit")
+	dirtyBytesGauge = metrics.NewGauge("aethelfs_dirty_bytes",
+		"Bytes written but not yet flushed by the background flusher")
+)
+
+// Stats is a point-in-time summary of filesystem state. The allocator
+// fields are copied together under the stats barrier, so they always
+// describe one instant.
+type Stats struct {
+	TakenAt           time.Time              `json:"taken_at"`
+	UptimeSeconds     float64                `json:"uptime_seconds"`
+	Mount             MountProgress          `json:"mount"`
+	Inodes            uint64                 `json:"inodes"`
+	InodesUsed        int64                  `json:"inodes_used"`
+	InodeLimit        uint64                 `json:"inode_limit,omitempty"`           // Zero if unlimited
+	LearnedSizes      map[string]int64       `json:"learned_initial_sizes,omitempty"` // By top-level directory
+	MetadataBytes     int64                  `json:"metadata_bytes"`
+	DirtyBytes        int64                  `json:"dirty_bytes"`
+	DeviceBytes       int64                  `json:"device_bytes"`
+	MetadataReserved  int64                  `json:"metadata_reserved"`
+	Allocator         string                 `json:"allocator"`
+	NextOffset        common.DeviceOffset    `json:"next_offset"`
+	AllocatedBytes    common.ByteCount       `json:"allocated_bytes"`
+	FreeBytes         common.ByteCount       `json:"free_bytes"`
+	FreeListExtents   int                    `json:"free_list_extents"`
+	FreeListBytes     common.ByteCount       `json:"free_list_bytes"`
+	QuarantinedBytes  common.ByteCount       `json:"quarantined_bytes"`
+	PinnedBytes       int64                  `json:"pinned_bytes"`
+	LargestFreeExtent common.ByteCount       `json:"largest_free_extent"`
+	Regions           []RegionStats          `json:"regions"`
+	Flush             FlushEfficiency        `json:"flush"`
+	QueueDepth        QueueDepth             `json:"queue_depth"`
+	SelfTest          *dax.SelfTestResult    `json:"self_test,omitempty"`
+	Degraded          *DegradedState         `json:"degraded,omitempty"`
+	Violations        []string               `json:"violations,omitempty"`
+	Metrics           map[string]interface{} `json:"metrics,omitempty"`
+}
+
+// Stats returns a consistent summary of the filesystem together with the
+// metrics registry. Both the control socket and the stats endpoint serve it.
+func (f *Filesystem) Stats() Stats {
+	s := f.snapshot()
+	s.Metrics = metrics.Default.Snapshot()
+	return s
+}
+
+// snapshot copies the allocator and namespace counters. Mutators hold the
+// stats barrier for reading, so taking it for writing briefly freezes
+// them and the copy is internally consistent. The accounting identities
+// are then checked outside the barrier.
+func (f *Filesystem) snapshot() Stats {
+	s := Stats{
+		TakenAt:          f.clock.Now(),
+		UptimeSeconds:    f.clock.Now().Sub(f.mountTime).Seconds(),
+		Mount:            f.MountProgress(),
+		DeviceBytes:      f.device.Size(),
+		MetadataReserved: common.MetadataReservationSize,
+		Allocator:        allocatorKind(f.super),
+		SelfTest:         f.durability,
+		Degraded:         f.Degraded(),
+	}
+
+	f.statsMu.Lock()
+	s.Inodes = atomic.LoadUint64(&f.inodeCount)
+	s.InodesUsed = atomic.LoadInt64(&f.inodesUsed)
+	s.InodeLimit = f.super.InodeLimit
+	s.MetadataBytes = f.MetadataBytes()
+	s.Regions = f.regionStats()
+	freeList := f.freeList()
+	f.statsMu.Unlock()
+
+	s.DirtyBytes = f.dirty.bytes()
+	s.PinnedBytes = atomic.LoadInt64(&f.pinnedBytes)
+	s.LearnedSizes = f.learnedSizes()
+	s.Flush = f.flushEfficiency()
+	s.QueueDepth = f.queueDepthReport()
+	s.FreeListExtents = len(freeList)
+	for _, r := range s.Regions {
+		s.AllocatedBytes += r.AllocatedBytes
+		s.FreeBytes += r.FreeBytes
+		s.FreeListBytes += r.FreeListBytes
+		s.QuarantinedBytes += r.QuarantinedBytes
+		if tail := r.FreeBytes - r.FreeListBytes; tail > s.LargestFreeExtent {
+			s.LargestFreeExtent = tail
+		}
+		if end := r.Offset.Plus(r.AllocatedBytes + r.FreeListBytes); end > s.NextOffset {
+			s.NextOffset = end
+		}
+	}
+	for _, space := range freeList {
+		if space.Size > s.LargestFreeExtent {
+			s.LargestFreeExtent = space.Size
+		}
+	}
+
+	s.Violations = checkInvariants(s, freeList)
+	if len(s.Violations) > 0 {
+		statsViolations.Inc()
+	}
+	return s
+}
+
+// checkInvariants verifies the accounting identities of a snapshot
+func checkInvariants(s Stats, freeList []alloc.Extent) []string {
+	var violations []string
+	for _, r := range s.Regions {
+		if r.AllocatedBytes < 0 || r.FreeBytes < 0 {
+			violations = append(violations, fmt.Sprintf("region %s: negative accounting (allocated %d, free %d)",
+				r.Name, r.AllocatedBytes, r.FreeBytes))
+		}
+		if r.AllocatedBytes+r.FreeBytes != r.Size {
+			violations = append(violations, fmt.Sprintf("region %s: allocated %d + free %d != size %d",
+				r.Name, r.AllocatedBytes, r.FreeBytes, r.Size))
+		}
+	}
+
+	sort.Slice(freeList, func(i, j int) bool { return freeList[i].Offset < freeList[j].Offset })
+	for i := 1; i < len(freeList); i++ {
+		prev := freeList[i-1]
+		if freeList[i].Offset < prev.End() {
+			violations = append(violations, fmt.Sprintf("free extents %d+%d and %d+%d overlap",
+				prev.Offset, prev.Size, freeList[i].Offset, freeList[i].Size))
+		}
+	}
+	return violations
+}
+
+// publishGauges refreshes the allocator gauges from a fresh snapshot. It
+// runs before every metrics scrape.
+func (f *Filesystem) publishGauges() {
+	s := f.snapshot()
+	allocatedBytesGauge.Set(int64(s.AllocatedBytes))
+	freeBytesGauge.Set(int64(s.FreeBytes))
+	freeExtentsGauge.Set(int64(s.FreeListExtents))
+	inodesGauge.Set(int64(s.Inodes))
+	inodesUsedGauge.Set(s.InodesUsed)
+	dirtyBytesGauge.Set(s.DirtyBytes)
+	pinnedBytesGauge.Set(s.PinnedBytes)
+	writeAmplification.Set(int64(s.Flush.Amplification * 1000))
+	f.publishQueueDepth()
+}
@@ -0,0 +1,216 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"aethelfs/internal/clock"
+	"aethelfs/internal/metrics"
+)
+
+// Worker states reported by the workers control command
+const (
+	workerRunning    = "running"
+	workerPaused     = "paused"     // Running, but holding off its work
+	workerRestarting = "restarting" // Failed; waiting out the backoff
+	workerExited     = "exited"     // Returned without error; not restarted
+	workerStopped    = "stopped"    // Stopped by Close
+)
+
+// Restart backoff for failed workers. It doubles per failure and starts
+// over once a run has lasted workerStableRun.
+const (
+	workerBackoffMin = time.Second
+	workerBackoffMax = time.Minute
+	workerStableRun  = 5 * time.Minute
+)
+
+var workerCrashes = metrics.NewCounterVec("aethelfs_worker_crashes_total",
+	"Background worker runs that returned an error or panicked, by worker", "worker")
+
+// WorkerStatus describes one supervised background worker
+type WorkerStatus struct {
+	Name        string    `json:"name"`
+	State       string    `json:"state"`
+	Started     time.Time `json:"started"`
+	LastRun     time.Time `json:"last_run"`             // Last completed unit of work
+	LastError   string    `json:"last_error,omitempty"` // Reported by a run or a crash
+	LastErrorAt time.Time `json:"last_error_at"`
+	Crashes     int       `json:"crashes"`
+}
+
+// worker is one supervised background goroutine. Its run function loops
+// until stopping() is closed and reports progress through ran and pause.
+// Returning an error or panicking counts as a crash and is restarted
+// after a backoff; returning nil ends the worker.
+type worker struct {
+	sup  *supervisor
+	run  func(w *worker) error
+	stop chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	status WorkerStatus
+}
+
+// stopping returns a channel closed when the worker must return
+func (w *worker) stopping() <-chan struct{} {
+	return w.stop
+}
+
+// ran records a completed unit of work. A non-nil err is kept as the last
+// error without restarting the worker.
+func (w *worker) ran(err error) {
+	now := w.sup.clock.Now()
+	w.mu.Lock()
+	w.status.LastRun = now
+	if err != nil {
+		w.status.LastError = err.Error()
+		w.status.LastErrorAt = now
+	}
+	w.mu.Unlock()
+}
+
+// pause marks the worker as holding off its work, or resuming it
+func (w *worker) pause(paused bool) {
+	w.mu.Lock()
+	if paused {
+		w.status.State = workerPaused
+	} else {
+		w.status.State = workerRunning
+	}
+	w.mu.Unlock()
+}
+
+// setState records a state change
+func (w *worker) setState(state string) {
+	w.mu.Lock()
+	w.status.State = state
+	w.mu.Unlock()
+}
+
+// loop runs the worker, restarting it after failures, until it is
+// stopped or returns cleanly
+func (w *worker) loop() {
+	defer close(w.done)
+
+	backoff := workerBackoffMin
+	for {
+		started := w.sup.clock.Now()
+		err := w.runOnce()
+		select {
+		case <-w.stop:
+			w.setState(workerStopped)
+			return
+		default:
+		}
+		if err == nil {
+			w.setState(workerExited)
+			return
+		}
+
+		if w.sup.clock.Now().Sub(started) >= workerStableRun {
+			backoff = workerBackoffMin
+		}
+		w.mu.Lock()
+		w.status.State = workerRestarting
+		w.status.LastError = err.Error()
+		w.status.LastErrorAt = w.sup.clock.Now()
+		w.status.Crashes++
+		w.mu.Unlock()
+		workerCrashes.With(w.status.Name).Inc()
+		log.Printf("Warning: background worker %s failed, restarting in %v: %v", w.status.Name, backoff, err)
+
+		wake := make(chan struct{})
+		timer := w.sup.clock.AfterFunc(backoff, func() { close(wake) })
+		select {
+		case <-wake:
+		case <-w.stop:
+			timer.Stop()
+			w.setState(workerStopped)
+			return
+		}
+		if backoff *= 2; backoff > workerBackoffMax {
+			backoff = workerBackoffMax
+		}
+	}
+}
+
+// runOnce calls run, turning a panic into an error
+func (w *worker) runOnce() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Background worker %s panicked: %v\n%s", w.status.Name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	w.setState(workerRunning)
+	return w.run(w)
+}
+
+// supervisor owns the filesystem's long-running background workers
+type supervisor struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	workers []*worker
+}
+
+// newSupervisor returns a supervisor with no workers
+func newSupervisor(clk clock.Clock) *supervisor {
+	return &supervisor{clock: clk}
+}
+
+// start launches run as a worker named name. Workers are stopped in the
+// reverse of the order they were started, so a worker may rely on those
+// started before it until it has stopped.
+func (s *supervisor) start(name string, run func(w *worker) error) {
+	w := &worker{
+		sup:    s,
+		run:    run,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		status: WorkerStatus{Name: name, State: workerRunning, Started: s.clock.Now()},
+	}
+	s.mu.Lock()
+	s.workers = append(s.workers, w)
+	s.mu.Unlock()
+	go w.loop()
+}
+
+// statuses reports every worker, in start order
+func (s *supervisor) statuses() []WorkerStatus {
+	s.mu.Lock()
+	workers := append([]*worker(nil), s.workers...)
+	s.mu.Unlock()
+
+	statuses := make([]WorkerStatus, 0, len(workers))
+	for _, w := range workers {
+		w.mu.Lock()
+		statuses = append(statuses, w.status)
+		w.mu.Unlock()
+	}
+	return statuses
+}
+
+// close stops the workers, last started first, waiting for each to
+// return before stopping the next
+func (s *supervisor) close() {
+	s.mu.Lock()
+	workers := s.workers
+	s.workers = nil
+	s.mu.Unlock()
+
+	for i := len(workers) - 1; i >= 0; i-- {
+		close(workers[i].stop)
+		<-workers[i].done
+	}
+}
+
+// ctlWorkers reports the state of the background workers
+func (f *Filesystem) ctlWorkers(args json.RawMessage) (interface{}, error) {
+	return f.workers.statuses(), nil
+}
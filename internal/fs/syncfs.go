@@ -0,0 +1,81 @@
+package fs
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	syncfsSeconds = metrics.NewHistogram("aethelfs_syncfs_seconds",
+		"Duration of whole-filesystem syncs", metrics.ExponentialBuckets(1e-4, 4, 10))
+	syncfsErrors = metrics.NewCounter("aethelfs_syncfs_errors_total",
+		"Whole-filesystem syncs that failed")
+)
+
+// SyncFS makes everything written so far durable: buffered and staged
+// file data is written to its extents, the metadata batch is flushed,
+// and the whole device is flushed, after which no dirty range is left
+// for the background flusher. It returns once the device flush has
+// completed and is the barrier shutdown uses. Errors are reported as EIO
+// after every step has been tried, so one bad file does not leave the
+// rest unsynced.
+func (f *Filesystem) SyncFS() (err error) {
+	if f.opts.ReadOnly {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		syncfsSeconds.Observe(time.Since(start).Seconds())
+		if err != nil {
+			syncfsErrors.Inc()
+		}
+	}()
+
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f.walkFiles(func(p string, file *File) {
+		if err := file.drainStaged(); err != nil {
+			log.Printf("Warning: syncfs could not write staged appends of %s: %v", p, err)
+			keep(err)
+		}
+		if err := file.materialize(materializeSync); err != nil {
+			log.Printf("Warning: syncfs could not allocate an extent for %s: %v", p, err)
+			keep(err)
+		}
+	})
+	f.settleTree()
+	keep(f.saveWriteStamps())
+	keep(f.SyncMetadata())
+
+	// Take the dirty ranges before the flush that covers them: a range
+	// recorded after the take is left for the flusher, never dropped
+	ranges := f.dirty.take()
+	flushErr := f.Fsync()
+	var taken int64
+	for _, r := range ranges {
+		if flushErr != nil {
+			f.dirty.add(r.offset, r.length, r.origin)
+		}
+		taken += int64(r.length)
+	}
+	f.dirty.done(taken)
+	keep(flushErr)
+	return firstErr
+}
+
+// ctlSyncFS runs SyncFS for scripts that need the mount durable, e.g.
+// before a hardware snapshot
+func (f *Filesystem) ctlSyncFS(args json.RawMessage) (interface{}, error) {
+	start := time.Now()
+	if err := f.SyncFS(); err != nil {
+		return nil, err
+	}
+	return map[string]int64{"duration_ns": time.Since(start).Nanoseconds()}, nil
+}
@@ -0,0 +1,71 @@
+package fs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// TestStrictSyncDurableOnAck crashes right after a write is acknowledged.
+// Strict mode has made it durable by then; the default mode has not.
+func TestStrictSyncDurableOnAck(t *testing.T) {
+	for _, mode := range []string{fs.SyncModeStrict, fs.SyncModeDefault} {
+		t.Run(mode, func(t *testing.T) {
+			opts := crashOptions(alloc.KindFreeList)
+			opts.SyncMode = mode
+			h := newCrashHarness(t, opts)
+			file, err := h.WriteFile("/file", bytes.Repeat([]byte("old!"), 1024), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := h.Fsync(file); err != nil {
+				t.Fatal(err)
+			}
+			extent := file.Layout().Extents[0].Offset
+
+			written := bytes.Repeat([]byte("new!"), 256)
+			if _, err := h.WriteAt(file, 1024, written); err != nil {
+				t.Fatal(err)
+			}
+			got := h.Crash.Crash().At(extent.Plus(1024), common.ByteCount(len(written)))
+			if durable := bytes.Equal(got, written); durable != (mode == fs.SyncModeStrict) {
+				t.Errorf("acknowledged write durable: %v", durable)
+			}
+			if data, err := h.ReadFile("/file"); err != nil || !bytes.Equal(data[1024:1024+len(written)], written) {
+				t.Errorf("read back %v", err)
+			}
+		})
+	}
+}
+
+func TestStrictSyncNewFile(t *testing.T) {
+	opts := crashOptions(alloc.KindFreeList)
+	opts.SyncMode = fs.SyncModeStrict
+	h := newCrashHarness(t, opts)
+	// Not even a new file's first write is left buffered
+	written := bytes.Repeat([]byte("data"), 1024)
+	file, err := h.WriteFile("/file", written, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents := file.Layout().Extents
+	if len(extents) == 0 {
+		t.Fatal("write acknowledged with the data still buffered")
+	}
+	if got := h.Crash.Crash().At(extents[0].Offset, common.ByteCount(len(written))); !bytes.Equal(got, written) {
+		t.Error("acknowledged write of a new file not durable")
+	}
+}
+
+func TestUnknownSyncModeRefused(t *testing.T) {
+	opts := testOptions()
+	opts.SyncMode = "eventual"
+	if h, err := fstest.New(0, opts); err == nil {
+		h.Close()
+		t.Error("mounted with an unknown sync mode")
+	}
+}
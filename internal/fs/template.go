@@ -0,0 +1,217 @@
+package fs
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Ownership template xattrs. Set by root on a directory, they apply to
+// every file and directory created beneath it, however deep, unless a
+// nearer directory sets its own: force-uid and force-gid replace the
+// creator's ids, and force-mode-mask, in octal, clears permission bits
+// like a umask the creator cannot lower.
+const (
+	xattrForceUid      = "user.aethelfs.force-uid"
+	xattrForceGid      = "user.aethelfs.force-gid"
+	xattrForceModeMask = "user.aethelfs.force-mode-mask"
+
+	// Read-only JSON of the template that applies in a directory and
+	// which directory each part comes from
+	xattrEffectivePolicy = "user.aethelfs.effective-policy"
+)
+
+// Which parts of an ownershipTemplate are set
+const (
+	templateUid uint8 = 1 << iota
+	templateGid
+	templateMask
+)
+
+// ownershipTemplate is a directory's own template xattrs
+type ownershipTemplate struct {
+	set  uint8
+	uid  uint32
+	gid  uint32
+	mask os.FileMode
+}
+
+// EffectivePolicy is the template applied to entries created in a
+// directory, with the path of the directory that set each part
+type EffectivePolicy struct {
+	Uid          *uint32 `json:"uid,omitempty"`
+	UidFrom      string  `json:"uid_from,omitempty"`
+	Gid          *uint32 `json:"gid,omitempty"`
+	GidFrom      string  `json:"gid_from,omitempty"`
+	ModeMask     string  `json:"mode_mask,omitempty"`
+	ModeMaskFrom string  `json:"mode_mask_from,omitempty"`
+	Setgid       bool    `json:"setgid"` // New entries take the directory's group
+}
+
+// effectiveTemplate merges the templates of d and its ancestors, each
+// part from the nearest directory setting it, and returns the directories
+// the parts come from
+func (d *Dir) effectiveTemplate() (ownershipTemplate, map[uint8]*Dir) {
+	var merged ownershipTemplate
+	from := make(map[uint8]*Dir)
+	for dir := d; dir != nil && merged.set != templateUid|templateGid|templateMask; {
+		dir.mu.RLock()
+		t, parent := dir.template, dir.parent
+		dir.mu.RUnlock()
+
+		fresh := t.set &^ merged.set
+		if fresh&templateUid != 0 {
+			merged.uid, from[templateUid] = t.uid, dir
+		}
+		if fresh&templateGid != 0 {
+			merged.gid, from[templateGid] = t.gid, dir
+		}
+		if fresh&templateMask != 0 {
+			merged.mask, from[templateMask] = t.mask, dir
+		}
+		merged.set |= fresh
+		dir = parent
+	}
+	return merged, from
+}
+
+// effectivePolicy reports the template applied to entries created in d
+func (d *Dir) effectivePolicy() EffectivePolicy {
+	t, from := d.effectiveTemplate()
+	d.mu.RLock()
+	p := EffectivePolicy{Setgid: d.mode&os.ModeSetgid != 0}
+	d.mu.RUnlock()
+	if t.set&templateUid != 0 {
+		p.Uid, p.UidFrom = &t.uid, from[templateUid].path()
+	}
+	if t.set&templateGid != 0 {
+		p.Gid, p.GidFrom = &t.gid, from[templateGid].path()
+	}
+	if t.set&templateMask != 0 {
+		p.ModeMask, p.ModeMaskFrom = formatModeMask(t.mask), from[templateMask].path()
+	}
+	return p
+}
+
+// newOwnership returns the mode and ids of an entry created in d by a
+// request for mode, uid and gid. A setgid directory passes on its group,
+// and setgid itself to subdirectories; the template then overrides the
+// ids, so force-gid wins over setgid, and masks the permissions. NoSuid
+// strips what setuid and setgid bits remain.
+func (d *Dir) newOwnership(mode os.FileMode, uid, gid uint32) (os.FileMode, uint32, uint32) {
+	d.mu.RLock()
+	if d.mode&os.ModeSetgid != 0 {
+		gid = d.gid
+		if mode&os.ModeDir != 0 {
+			mode |= os.ModeSetgid
+		}
+	}
+	d.mu.RUnlock()
+
+	t, _ := d.effectiveTemplate()
+	if t.set&templateUid != 0 {
+		uid = t.uid
+	}
+	if t.set&templateGid != 0 {
+		gid = t.gid
+	}
+	return d.fs.stripSuid(mode &^ t.mask), uid, gid
+}
+
+// formatModeMask renders a mode mask in octal
+func formatModeMask(mask os.FileMode) string {
+	return "0" + strconv.FormatUint(uint64(mask), 8)
+}
+
+// getTemplateXattrLocked reads one of d's template xattrs. The caller holds
+// d.mu for reading.
+func (d *Dir) getTemplateXattrLocked(name string) ([]byte, error) {
+	var bit uint8
+	var value string
+	switch name {
+	case xattrForceUid:
+		bit, value = templateUid, strconv.FormatUint(uint64(d.template.uid), 10)
+	case xattrForceGid:
+		bit, value = templateGid, strconv.FormatUint(uint64(d.template.gid), 10)
+	case xattrForceModeMask:
+		bit, value = templateMask, formatModeMask(d.template.mask)
+	}
+	if d.template.set&bit == 0 {
+		return nil, fuse.ErrNoXattr
+	}
+	return []byte(value), nil
+}
+
+// setTemplateXattr sets one of d's template xattrs. Only root may: the
+// template hands out ownership on others' behalf.
+func (d *Dir) setTemplateXattr(hdr *fuse.Header, name string, value []byte) error {
+	if hdr.Uid != 0 {
+		return syscall.EPERM
+	}
+	var id uint64
+	var err error
+	if name == xattrForceModeMask {
+		id, err = strconv.ParseUint(string(value), 8, 32)
+		if err == nil && id > uint64(os.ModePerm) {
+			return syscall.EINVAL
+		}
+	} else {
+		id, err = strconv.ParseUint(string(value), 10, 32)
+	}
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch name {
+	case xattrForceUid:
+		d.template.uid = uint32(id)
+		d.template.set |= templateUid
+	case xattrForceGid:
+		d.template.gid = uint32(id)
+		d.template.set |= templateGid
+	case xattrForceModeMask:
+		d.template.mask = os.FileMode(id)
+		d.template.set |= templateMask
+	}
+	d.changed(d.fs.clock.Now())
+	return nil
+}
+
+// removeTemplateXattrLocked clears one of d's template xattrs. The caller
+// holds d.mu and has checked the requester is root.
+func (d *Dir) removeTemplateXattrLocked(name string) error {
+	bit := map[string]uint8{
+		xattrForceUid:      templateUid,
+		xattrForceGid:      templateGid,
+		xattrForceModeMask: templateMask,
+	}[name]
+	if d.template.set&bit == 0 {
+		return fuse.ErrNoXattr
+	}
+	d.template.set &^= bit
+	return nil
+}
+
+// listTemplateXattrsLocked appends the template xattrs d sets. The caller
+// holds d.mu for reading.
+func (d *Dir) listTemplateXattrsLocked(resp *fuse.ListxattrResponse) {
+	if d.template.set&templateUid != 0 {
+		resp.Append(xattrForceUid)
+	}
+	if d.template.set&templateGid != 0 {
+		resp.Append(xattrForceGid)
+	}
+	if d.template.set&templateMask != 0 {
+		resp.Append(xattrForceModeMask)
+	}
+}
+
+// effectivePolicyXattr renders xattrEffectivePolicy
+func (d *Dir) effectivePolicyXattr() ([]byte, error) {
+	return json.Marshal(d.effectivePolicy())
+}
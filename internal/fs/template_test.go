@@ -0,0 +1,192 @@
+package fs_test
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// user is the unprivileged identity entries are created as
+const user = 1000
+
+// mkdirs creates each directory, writable by anyone
+func mkdirs(t *testing.T, h *fstest.Harness, dirs ...string) {
+	t.Helper()
+	for _, p := range dirs {
+		dir, err := h.Mkdir(p, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Chmod(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// setTemplate sets template xattrs on the directory p as root
+func setTemplate(t *testing.T, h *fstest.Harness, p string, xattrs map[string]string) {
+	t.Helper()
+	dir, err := h.Dir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range xattrs {
+		if err := h.Setxattr(dir, "user.aethelfs."+name, []byte(value)); err != nil {
+			t.Fatalf("set %s on %s: %v", name, p, err)
+		}
+	}
+}
+
+// checkOwner checks the ids and permissions of node
+func checkOwner(t *testing.T, h *fstest.Harness, node fusefs.Node, uid, gid uint32, perm os.FileMode) fuse.Attr {
+	t.Helper()
+	attr, err := h.Stat(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr.Uid != uid || attr.Gid != gid || attr.Mode.Perm() != perm {
+		t.Errorf("inode %d owned by %d:%d with mode %o, want %d:%d with %o",
+			attr.Inode, attr.Uid, attr.Gid, attr.Mode.Perm(), uid, gid, perm)
+	}
+	return attr
+}
+
+// policy reads the effective-policy xattr of the directory p
+func policy(t *testing.T, h *fstest.Harness, p string) fs.EffectivePolicy {
+	t.Helper()
+	dir, err := h.Dir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := h.Getxattr(dir, "user.aethelfs.effective-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got fs.EffectivePolicy
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("effective policy %s: %v", raw, err)
+	}
+	return got
+}
+
+func TestTemplateInheritedAtDepth(t *testing.T) {
+	h := newHarness(t)
+	mkdirs(t, h, "/svc", "/svc/a", "/svc/a/b", "/svc/a/b/c")
+	setTemplate(t, h, "/svc", map[string]string{"force-uid": "500", "force-gid": "600", "force-mode-mask": "027"})
+	as := h.As(user, user)
+
+	file, err := as.Create("/svc/a/b/c/file", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, h, file, 500, 600, 0640)
+	dir, err := as.Mkdir("/svc/a/b/c/dir", 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, h, dir, 500, 600, 0750)
+
+	// A nearer directory overrides one part, the rest still comes from above
+	setTemplate(t, h, "/svc/a/b", map[string]string{"force-gid": "700"})
+	file, err = as.Create("/svc/a/b/c/other", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, h, file, 500, 700, 0640)
+	got := policy(t, h, "/svc/a/b/c")
+	if got.Uid == nil || *got.Uid != 500 || got.UidFrom != "/svc" ||
+		got.Gid == nil || *got.Gid != 700 || got.GidFrom != "/svc/a/b" ||
+		got.ModeMask != "027" || got.ModeMaskFrom != "/svc" {
+		t.Errorf("effective policy = %+v", got)
+	}
+
+	// Outside the subtree nothing is forced
+	mkdirs(t, h, "/free")
+	file, err = as.Create("/free/file", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, h, file, user, user, 0666)
+	if got := policy(t, h, "/free"); got.Uid != nil || got.Gid != nil || got.ModeMask != "" {
+		t.Errorf("effective policy outside the subtree = %+v", got)
+	}
+}
+
+func TestTemplateAndSetgid(t *testing.T) {
+	h := newHarness(t)
+	mkdirs(t, h, "/shared")
+	shared, err := h.Dir("/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Chown(shared, 0, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Chmod(shared, os.ModeSetgid|0777); err != nil {
+		t.Fatal(err)
+	}
+	as := h.As(user, user)
+
+	// A setgid directory passes on its group, and setgid to subdirectories
+	file, err := as.Create("/shared/file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, h, file, user, 300, 0644)
+	sub, err := as.Mkdir("/shared/sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr := checkOwner(t, h, sub, user, 300, 0755); attr.Mode&os.ModeSetgid == 0 {
+		t.Error("subdirectory of a setgid directory is not setgid")
+	}
+	if !policy(t, h, "/shared").Setgid {
+		t.Error("effective policy does not report setgid")
+	}
+
+	// force-gid wins over setgid, which is still passed on
+	setTemplate(t, h, "/shared", map[string]string{"force-gid": "600"})
+	file, err = as.Create("/shared/forced", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOwner(t, h, file, user, 600, 0644)
+	sub, err = as.Mkdir("/shared/forced-sub", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr := checkOwner(t, h, sub, user, 600, 0755); attr.Mode&os.ModeSetgid == 0 {
+		t.Error("setgid not passed on under force-gid")
+	}
+}
+
+func TestTemplateRootOnly(t *testing.T) {
+	h := newHarness(t)
+	mkdirs(t, h, "/dir")
+	dir, err := h.Dir("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.As(user, user).Setxattr(dir, "user.aethelfs.force-uid", []byte("0")); !fstest.IsErrno(err, syscall.EPERM) {
+		t.Errorf("force-uid set by a user: %v, want EPERM", err)
+	}
+	for name, value := range map[string]string{
+		"force-uid":       "alice",
+		"force-gid":       "-1",
+		"force-mode-mask": "1777",
+	} {
+		if err := h.Setxattr(dir, "user.aethelfs."+name, []byte(value)); !fstest.IsErrno(err, syscall.EINVAL) {
+			t.Errorf("%s set to %q: %v, want EINVAL", name, value, err)
+		}
+	}
+	if _, err := h.Getxattr(dir, "user.aethelfs.force-uid"); err == nil {
+		t.Error("refused template left set")
+	}
+}
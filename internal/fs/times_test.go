@@ -0,0 +1,145 @@
+package fs_test
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// TestTimestampRules runs each operation against /a/file, /a/sub and /b
+// and checks which of their timestamps it moved: a directory's mtime and
+// ctime on any change to its entries, a node's ctime alone on a change
+// to its attributes or link count, and nothing on failure
+func TestTimestampRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    func(h *fstest.Harness, file *fs.File) error
+		errno syscall.Errno
+		moved string // The timestamps expected to move, in stamp order
+	}{
+		{"create", func(h *fstest.Harness, _ *fs.File) error {
+			_, err := h.Create("/a/new", 0644)
+			return err
+		}, 0, "a.mtime a.ctime"},
+		{"mkdir", func(h *fstest.Harness, _ *fs.File) error {
+			_, err := h.Mkdir("/a/new", 0755)
+			return err
+		}, 0, "a.mtime a.ctime"},
+		{"unlink", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Remove("/a/file")
+		}, 0, "a.mtime a.ctime file.ctime"},
+		{"rmdir", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Remove("/a/sub")
+		}, 0, "a.mtime a.ctime"},
+		{"rename within a directory", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Rename("/a/file", "/a/moved")
+		}, 0, "a.mtime a.ctime file.ctime"},
+		{"rename across directories", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Rename("/a/file", "/b/file")
+		}, 0, "a.mtime a.ctime b.mtime b.ctime file.ctime"},
+		{"write", func(h *fstest.Harness, file *fs.File) error {
+			_, err := h.WriteAt(file, 0, []byte("new"))
+			return err
+		}, 0, "file.mtime file.ctime"},
+		{"truncate", func(h *fstest.Harness, file *fs.File) error {
+			return h.Truncate(file, 1)
+		}, 0, "file.mtime file.ctime"},
+		{"chmod", func(h *fstest.Harness, file *fs.File) error {
+			return h.Chmod(file, 0600)
+		}, 0, "file.ctime"},
+		{"chown", func(h *fstest.Harness, file *fs.File) error {
+			return h.Chown(file, 1000, 1000)
+		}, 0, "file.ctime"},
+		{"utimes", func(h *fstest.Harness, file *fs.File) error {
+			_, err := h.Setattr(file, &fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: fstest.Epoch.Add(-time.Hour)})
+			return err
+		}, 0, "file.mtime file.ctime"},
+		{"setxattr", func(h *fstest.Harness, file *fs.File) error {
+			return h.Setxattr(file, "user.aethelfs.coalesce", []byte("1"))
+		}, 0, "file.ctime"},
+		{"chmod of a directory", func(h *fstest.Harness, _ *fs.File) error {
+			dir, err := h.Dir("/a")
+			if err != nil {
+				return err
+			}
+			return h.Chmod(dir, 0700)
+		}, 0, "a.ctime"},
+		{"failed mkdir", func(h *fstest.Harness, _ *fs.File) error {
+			_, err := h.Mkdir("/a/sub", 0755)
+			return err
+		}, syscall.EEXIST, ""},
+		{"failed unlink", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Remove("/a/missing")
+		}, syscall.ENOENT, ""},
+		{"failed rmdir", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Remove("/a")
+		}, syscall.ENOTEMPTY, ""},
+		{"failed setxattr", func(h *fstest.Harness, file *fs.File) error {
+			return h.Setxattr(file, "user.aethelfs.coalesce", []byte("maybe"))
+		}, syscall.EINVAL, ""},
+		{"failed rename", func(h *fstest.Harness, _ *fs.File) error {
+			return h.Rename("/a/missing", "/b/missing")
+		}, syscall.ENOENT, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(t)
+			if _, err := h.Mkdir("/a", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := h.Mkdir("/a/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := h.Mkdir("/b", 0755); err != nil {
+				t.Fatal(err)
+			}
+			file, err := h.WriteFile("/a/file", []byte("contents"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, _ := h.Dir("/a")
+			b, _ := h.Dir("/b")
+			nodes := []struct {
+				name string
+				node fusefs.Node
+			}{{"a", a}, {"b", b}, {"file", file}}
+
+			stamps := func() []time.Time {
+				var times []time.Time
+				for _, n := range nodes {
+					attr, err := h.Stat(n.node)
+					if err != nil {
+						t.Fatal(err)
+					}
+					times = append(times, attr.Mtime, attr.Ctime)
+				}
+				return times
+			}
+			before := stamps()
+			h.Advance(time.Second)
+
+			if err := tt.op(h, file); tt.errno != 0 && !fstest.IsErrno(err, tt.errno) {
+				t.Fatalf("%s: %v, want %v", tt.name, err, tt.errno)
+			} else if tt.errno == 0 && err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+
+			var moved []string
+			for i, after := range stamps() {
+				if !after.Equal(before[i]) {
+					moved = append(moved, nodes[i/2].name+[]string{".mtime", ".ctime"}[i%2])
+				}
+			}
+			if got := strings.Join(moved, " "); got != tt.moved {
+				t.Errorf("moved %q, want %q", got, tt.moved)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"log"
+	"sync"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	tombstonesPending = metrics.NewGauge("aethelfs_tombstones",
+		"Removed files whose extents have not been freed yet")
+	tombstonesRecovered = metrics.NewCounter("aethelfs_tombstones_recovered_total",
+		"Interrupted deletes completed at mount")
+)
+
+// tombstones holds files that have been unlinked but whose extents are
+// still allocated. Deletes run in two phases so a crash between them
+// can't leave a directory entry pointing at reused space:
+//
+//  1. Remove drops the entry and tombstones the file. The batched
+//     metadata flush makes that durable.
+//  2. Once the kernel forgets the file, and so no handle can still read
+//     it, purge flushes metadata again and frees the extent.
+//
+// Tombstones found at mount are deletes interrupted between the phases;
+// recovery finishes them before the free list is rebuilt.
+type tombstones struct {
+	mu    sync.Mutex
+	files map[uint64]*File
+}
+
+// tombstone records phase one of deleting file
+func (f *Filesystem) tombstone(file *File) {
+	f.dead.mu.Lock()
+	if f.dead.files == nil {
+		f.dead.files = make(map[uint64]*File)
+	}
+	f.dead.files[file.inode] = file
+	f.dead.mu.Unlock()
+	tombstonesPending.Add(1)
+}
+
+// purge completes the delete of a tombstoned file, freeing its extent
+// only once the tombstone itself is durable. A failed metadata flush
+// leaves the tombstone for a later purge or mount-time recovery. Files
+// without an extent, such as those still buffered by delayed allocation,
+// have no space that could be reused and skip the flush.
+func (f *Filesystem) purge(file *File) {
+	f.dead.mu.Lock()
+	_, ok := f.dead.files[file.inode]
+	f.dead.mu.Unlock()
+	if !ok {
+		return
+	}
+	file.mu.Lock()
+	file.discardBufferLocked()
+	hasExtent := len(file.data) > 0
+	file.mu.Unlock()
+	if hasExtent {
+		if err := f.SyncMetadata(); err != nil {
+			log.Printf("Warning: leaving inode %d tombstoned: %v", file.inode, err)
+			return
+		}
+	}
+
+	file.mu.Lock()
+	offset, length := file.offset, file.capacity()
+	file.data = nil
+	file.comp = nil
+	file.offset = 0
+	file.size = 0
+	file.settleLocked()
+	file.mu.Unlock()
+	f.chargeUsage(file.uid, 0, -1, false)
+	f.unclaimInode()
+	if length > 0 {
+		f.freeSpace(file.inode, offset, length)
+	}
+	f.purgeStaged(file.inode)
+
+	f.dead.mu.Lock()
+	delete(f.dead.files, file.inode)
+	f.dead.mu.Unlock()
+	tombstonesPending.Add(-1)
+	f.meta.add()
+}
+
+// recoverTombstones completes every interrupted delete and returns how
+// many there were
+func (f *Filesystem) recoverTombstones() int {
+	f.dead.mu.Lock()
+	files := make([]*File, 0, len(f.dead.files))
+	for _, file := range f.dead.files {
+		files = append(files, file)
+	}
+	f.dead.mu.Unlock()
+
+	for _, file := range files {
+		f.purge(file)
+	}
+	if len(files) > 0 {
+		tombstonesRecovered.Add(int64(len(files)))
+		log.Printf("Completed %d interrupted deletes", len(files))
+	}
+	return len(files)
+}
+
+// tombstoneExtents returns the extents still held by tombstoned files
+func (f *Filesystem) tombstoneExtents() []extent {
+	f.dead.mu.Lock()
+	defer f.dead.mu.Unlock()
+	var extents []extent
+	for _, file := range f.dead.files {
+		file.mu.RLock()
+		if len(file.data) > 0 {
+			extents = append(extents, extent{offset: file.offset, size: f.alignSize(file.capacity())})
+		}
+		file.mu.RUnlock()
+	}
+	return extents
+}
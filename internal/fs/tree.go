@@ -0,0 +1,169 @@
+package fs
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	treeSettles = metrics.NewCounter("aethelfs_tree_settles_total",
+		"Times pending subtree accounting was propagated to ancestors")
+	treeSettledDirs = metrics.NewCounter("aethelfs_tree_settled_dirs_total",
+		"Directories whose pending subtree changes were propagated")
+)
+
+// Virtual xattrs on directories reporting their subtree: the bytes charged
+// to every file beneath and the number of files and directories beneath
+const (
+	xattrTreeBytes  = "user.aethelfs.tree-bytes"
+	xattrTreeInodes = "user.aethelfs.tree-inodes"
+)
+
+// treeCounts are the totals of a directory's subtree, itself excluded.
+// Bytes are what the files are charged, block-aligned extent sizes, as
+// du counts them.
+type treeCounts struct {
+	bytes  int64 // Atomic
+	inodes int64 // Atomic
+}
+
+// treeAccounting keeps each directory's subtree totals so a recursive size
+// query is one xattr read instead of a walk. A change is recorded against
+// the directory it happens in and propagated to the ancestors later, in a
+// batch: a busy directory's writes cost one walk up the tree per settle
+// instead of one each. settle runs every FlushInterval, before syncfs,
+// and before a subtree xattr is read, so what a reader sees is exact.
+type treeAccounting struct {
+	mu      sync.Mutex
+	pending map[*Dir]*treeCounts // Changes not yet propagated, by the directory they happened in
+}
+
+// add records bytes and inodes, either of which may be negative, as
+// changed directly beneath dir
+func (t *treeAccounting) add(dir *Dir, bytes, inodes int64) {
+	if dir == nil || (bytes == 0 && inodes == 0) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[*Dir]*treeCounts)
+	}
+	c := t.pending[dir]
+	if c == nil {
+		c = &treeCounts{}
+		t.pending[dir] = c
+	}
+	c.bytes += bytes
+	c.inodes += inodes
+}
+
+// settleTree propagates the pending changes to each directory they
+// happened in and its ancestors. It holds renameMu, which every change of
+// a parent pointer is made under, so the walk sees a stable tree and a
+// rename cannot move a directory between the walks of one batch. A
+// removed directory keeps its parent pointer, so changes recorded in it
+// before its removal still reach the ancestors that counted them.
+func (f *Filesystem) settleTree() {
+	f.renameMu.Lock()
+	defer f.renameMu.Unlock()
+	t := &f.tree
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	for dir, c := range pending {
+		if c.bytes == 0 && c.inodes == 0 {
+			continue
+		}
+		for d := dir; d != nil; d = d.parent {
+			atomic.AddInt64(&d.tree.bytes, c.bytes)
+			atomic.AddInt64(&d.tree.inodes, c.inodes)
+		}
+	}
+	treeSettles.Inc()
+	treeSettledDirs.Add(int64(len(pending)))
+}
+
+// startTreeSettler settles the subtree accounting every FlushInterval,
+// bounding both the pending batch and how stale the totals get
+func (f *Filesystem) startTreeSettler() {
+	interval := f.opts.FlushInterval
+	if interval <= 0 {
+		return
+	}
+	f.workers.start("tree", func(w *worker) error {
+		ticker := f.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				f.settleTree()
+				w.ran(nil)
+			case <-w.stopping():
+				return nil
+			}
+		}
+	})
+}
+
+// treeXattr reads a subtree total of d after settling what is pending
+func (d *Dir) treeXattr(name string) []byte {
+	d.fs.settleTree()
+	counter := &d.tree.bytes
+	if name == xattrTreeInodes {
+		counter = &d.tree.inodes
+	}
+	return []byte(strconv.FormatInt(atomic.LoadInt64(counter), 10))
+}
+
+// linkTreeLocked counts a file being entered in dir in dir's subtree.
+// Its charge is counted from then on as it changes. The caller holds
+// f.mu for writing, or f is not yet reachable.
+func (f *File) linkTreeLocked(dir *Dir) {
+	f.inTree = true
+	f.treeBytes = f.charged
+	f.fs.tree.add(dir, f.treeBytes, 1)
+}
+
+// unlinkTreeLocked takes a file leaving dir out of dir's subtree. The
+// caller holds f.mu for writing.
+func (f *File) unlinkTreeLocked(dir *Dir) {
+	if !f.inTree {
+		return
+	}
+	f.inTree = false
+	f.fs.tree.add(dir, -f.treeBytes, -1)
+	f.treeBytes = 0
+}
+
+// noteTreeLocked passes a change of the file's charge on to its
+// directory's subtree. The caller holds f.mu for writing.
+func (f *File) noteTreeLocked() {
+	if !f.inTree {
+		return
+	}
+	if delta := f.charged - f.treeBytes; delta != 0 {
+		f.fs.tree.add(f.parent, delta, 0)
+		f.treeBytes = f.charged
+	}
+}
+
+// moveTree moves a directory's subtree, and the directory itself, from
+// one parent's totals to another's. Called by Rename with renameMu held,
+// so no settle runs between reading the totals and recording the move;
+// changes still pending within the subtree are propagated along the new
+// path when they settle.
+func (f *Filesystem) moveTree(d, from, to *Dir) {
+	bytes := atomic.LoadInt64(&d.tree.bytes)
+	inodes := atomic.LoadInt64(&d.tree.inodes) + 1
+	f.tree.add(from, -bytes, -inodes)
+	f.tree.add(to, bytes, inodes)
+}
@@ -0,0 +1,186 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// treeXattr reads a subtree total of the directory p
+func treeXattr(t *testing.T, h *fstest.Harness, p, name string) int64 {
+	t.Helper()
+	dir, err := h.Dir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := h.Getxattr(dir, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// walkTree totals the subtree of the directory p the slow way, as du
+// does, and checks every directory's totals in it against the walk
+func walkTree(t *testing.T, h *fstest.Harness, p string) (bytes, inodes int64) {
+	t.Helper()
+	entries, err := h.ReadDir(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		child := path.Join(p, e.Name)
+		node, err := h.Lookup(child)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch node := node.(type) {
+		case *fs.File:
+			bytes += charge(t, h, node)
+			inodes++
+		case *fs.Dir:
+			b, n := walkTree(t, h, child)
+			bytes, inodes = bytes+b, inodes+n+1
+		}
+	}
+	if got := treeBytes(t, h, p); got != bytes {
+		t.Errorf("%s tree-bytes = %d, walk found %d", p, got, bytes)
+	}
+	if got := treeXattr(t, h, p, "user.aethelfs.tree-inodes"); got != inodes {
+		t.Errorf("%s tree-inodes = %d, walk found %d", p, got, inodes)
+	}
+	return bytes, inodes
+}
+
+// syncAndWalk makes the totals exact with a syncfs and checks them
+func syncAndWalk(t *testing.T, h *fstest.Harness) {
+	t.Helper()
+	if err := h.FS.SyncFS(); err != nil {
+		t.Fatal(err)
+	}
+	walkTree(t, h, "/")
+}
+
+func TestTreeTotalsAcrossRenameAndUnlink(t *testing.T) {
+	h := newHarness(t)
+	for _, dir := range []string{"/a", "/a/b", "/c"} {
+		if _, err := h.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, p := range []string{"/a/one", "/a/b/two", "/a/b/three", "/c/four"} {
+		if _, err := h.WriteFile(p, bytes.Repeat([]byte("x"), 10000*(i+1)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	syncAndWalk(t, h)
+	before := treeBytes(t, h, "/")
+
+	// A file moving between directories, and over another file
+	if err := h.Rename("/a/b/two", "/c/two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Rename("/a/one", "/c/four"); err != nil {
+		t.Fatal(err)
+	}
+	syncAndWalk(t, h)
+	if got := treeBytes(t, h, "/"); got >= before {
+		t.Errorf("root tree-bytes %d after a file was replaced, want below %d", got, before)
+	}
+
+	// A directory moving with its subtree, then its file growing
+	if err := h.Rename("/a/b", "/c/b"); err != nil {
+		t.Fatal(err)
+	}
+	three, err := h.File("/c/b/three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(three, 200000, []byte("grown")); err != nil {
+		t.Fatal(err)
+	}
+	syncAndWalk(t, h)
+
+	// Unlinks, of a file and of an emptied directory
+	if err := h.Remove("/c/b/three"); err != nil {
+		t.Fatal(err)
+	}
+	h.Forget(three)
+	if err := h.Remove("/c/b"); err != nil {
+		t.Fatal(err)
+	}
+	syncAndWalk(t, h)
+	if got := treeXattr(t, h, "/a", "user.aethelfs.tree-inodes"); got != 0 {
+		t.Errorf("emptied /a has %d inodes beneath it", got)
+	}
+}
+
+func TestTreeTotalsConvergeAfterChurn(t *testing.T) {
+	h := newHarness(t)
+	const workers, rounds = 4, 50
+	if _, err := h.Mkdir("/shared", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		dir := fmt.Sprintf("/shared/w%d", w)
+		if _, err := h.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(w int, dir string) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				p := fmt.Sprintf("%s/f%d", dir, i%7)
+				file, err := h.File(p)
+				if err != nil {
+					file, err = h.Create(p, 0644)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := h.WriteAt(file, int64(i*4096), bytes.Repeat([]byte{byte(w)}, 5000)); err != nil {
+					errs <- err
+					return
+				}
+				switch i % 5 {
+				case 3:
+					if err := h.Remove(p); err != nil {
+						errs <- err
+						return
+					}
+				case 4:
+					// Moves land in the shared parent, racing the others
+					if err := h.Rename(p, fmt.Sprintf("/shared/w%d-%d", w, i)); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if i%10 == 0 {
+					if err := h.FS.SyncFS(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w, dir)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	syncAndWalk(t, h)
+}
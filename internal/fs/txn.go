@@ -0,0 +1,401 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/control"
+	"aethelfs/internal/metrics"
+
+	"bazil.org/fuse/fs"
+)
+
+// txnIdleTimeout aborts transactions nobody has touched for this long, so
+// a client that died mid-transaction does not hold staging space forever
+const txnIdleTimeout = 10 * time.Minute
+
+var (
+	txnOutcomes = metrics.NewCounterVec("aethelfs_txn_total",
+		"Finished transactions by outcome: committed, aborted or expired", "outcome")
+	txnStagedBytes = metrics.NewGauge("aethelfs_txn_staged_bytes",
+		"Device bytes held by staging extents of open transactions")
+)
+
+// txnTable holds the open transactions. Transactions are not tied to a
+// control connection, so a script can stage with one aethelfsctl call and
+// commit with another.
+type txnTable struct {
+	mu   sync.Mutex
+	next uint64
+	open map[uint64]*txn
+}
+
+// txn is a set of whole-file replacements that commit together. The new
+// contents are written to staging extents no file points at; commit
+// swaps them in.
+type txn struct {
+	id      uint64
+	started time.Time
+	touched time.Time
+	staged  map[string]*stagedFile // By cleaned path
+}
+
+// stagedFile is the new contents of one file in a staging extent
+type stagedFile struct {
+	inode    uint64 // File the extent is staged for, for the allocation log
+	offset   common.DeviceOffset
+	capacity common.ByteCount
+	size     int64
+	purged   bool // The file was deleted and the extent freed
+}
+
+// TxnInfo describes an open transaction
+type TxnInfo struct {
+	ID      uint64           `json:"id"`
+	Started time.Time        `json:"started"`
+	Files   map[string]int64 `json:"files"` // Staged size by path
+}
+
+// TxnBegin opens a transaction and returns its id
+func (f *Filesystem) TxnBegin() uint64 {
+	f.expireTxns()
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.open == nil {
+		t.open = make(map[uint64]*txn)
+	}
+	t.next++
+	now := f.clock.Now()
+	t.open[t.next] = &txn{id: t.next, started: now, touched: now, staged: make(map[string]*stagedFile)}
+	return t.next
+}
+
+// TxnStage sets the new contents of the regular file at p, or with
+// appendData adds data to what is already staged for it, so contents
+// larger than one control request can be sent in pieces. The data is
+// durable in its staging extent when TxnStage returns; the file itself
+// is unchanged until commit.
+func (f *Filesystem) TxnStage(id uint64, p string, data []byte, appendData bool) (err error) {
+	if err := f.checkDegraded(); err != nil {
+		return err
+	}
+	p = path.Clean("/" + p)
+	file, err := f.lookupFile(p)
+	if err != nil {
+		return err
+	}
+
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx, ok := t.open[id]
+	if !ok {
+		return fmt.Errorf("no open transaction %d", id)
+	}
+	tx.touched = f.clock.Now()
+
+	s := tx.staged[p]
+	if s != nil && s.purged && appendData {
+		return fmt.Errorf("%s was removed: %w", p, syscall.ENOENT)
+	}
+	if s != nil && !appendData {
+		f.freeStaged(s)
+		delete(tx.staged, p)
+		s = nil
+	}
+	if s == nil {
+		// Only register it once the data is in place, so a failed stage
+		// does not leave an empty file to commit
+		s = &stagedFile{inode: file.inode}
+		defer func() {
+			if err != nil {
+				f.freeStaged(s)
+			} else {
+				tx.staged[p] = s
+			}
+		}()
+	}
+	size := s.size + int64(len(data))
+	if size > f.opts.MaxFileSize {
+		return syscall.EFBIG
+	}
+	if size > int64(s.capacity) {
+		// Grow geometrically so staging in pieces copies each byte a
+		// bounded number of times
+		capacity := 2 * s.capacity
+		if capacity < common.ByteCount(size) {
+			capacity = common.ByteCount(size)
+		}
+		capacity = f.alignSize(capacity)
+		offset, aerr := f.allocateSpace(file.inode, capacity, f.placement("", capacity))
+		if aerr != nil {
+			return aerr
+		}
+		if s.size > 0 {
+			copy(f.device.At(offset, capacity), f.device.At(s.offset, common.ByteCount(s.size)))
+			if err := f.flushRange(offset, common.ByteCount(s.size)); err != nil {
+				f.freeSpace(file.inode, offset, capacity)
+				return err
+			}
+		}
+		f.freeStaged(s)
+		s.offset, s.capacity, s.size = offset, capacity, size-int64(len(data))
+		txnStagedBytes.Add(int64(capacity))
+	}
+
+	end := s.offset.Plus(common.ByteCount(s.size))
+	copy(f.device.At(end, common.ByteCount(len(data))), data)
+	if err := f.flushRange(end, common.ByteCount(len(data))); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
+// TxnCommit replaces the contents of every staged file at once. All the
+// files are locked, in inode order, before any is changed, so a reader
+// sees either none or all of the new contents. The swap only touches the
+// in-memory extent pointers; the metadata batch is then synced so the
+// commit is durable when TxnCommit returns. If any file cannot take its
+// new contents nothing is changed and the transaction stays open.
+func (f *Filesystem) TxnCommit(id uint64) error {
+	// Deferred first so it runs once every lock is released
+	var committed []fs.Node
+	defer func() { f.notifyData(committed...) }()
+
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx, ok := t.open[id]
+	if !ok {
+		return fmt.Errorf("no open transaction %d", id)
+	}
+	tx.touched = f.clock.Now()
+
+	type target struct {
+		file   *File
+		staged *stagedFile
+	}
+	targets := make([]target, 0, len(tx.staged))
+	seen := make(map[uint64]string)
+	for p, s := range tx.staged {
+		if s.purged {
+			// Whatever is at p now is not the file staged for
+			return fmt.Errorf("%s was removed: %w", p, syscall.ENOENT)
+		}
+		file, err := f.lookupFile(p)
+		if err != nil {
+			return err
+		}
+		if other, ok := seen[file.inode]; ok {
+			return fmt.Errorf("%s and %s are the same file", other, p)
+		}
+		seen[file.inode] = p
+		// Buffered and staged writes must reach the old extent first so
+		// none lands on the new contents after the swap
+		if err := file.drainStaged(); err != nil {
+			return err
+		}
+		if err := file.materialize(materializeSync); err != nil {
+			return err
+		}
+		targets = append(targets, target{file, s})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].file.inode < targets[j].file.inode })
+
+	for _, tg := range targets {
+		tg.file.mu.Lock()
+		defer tg.file.mu.Unlock()
+	}
+	for _, tg := range targets {
+		file := tg.file
+		switch {
+		case atomic.LoadInt32(&file.unlinked) != 0:
+			return fmt.Errorf("%s was removed: %w", seen[file.inode], syscall.ENOENT)
+		case file.pending != nil:
+			return fmt.Errorf("%s was rewritten during commit: %w", seen[file.inode], syscall.EAGAIN)
+		}
+	}
+	for i, tg := range targets {
+		if err := tg.file.reserveLocked(int64(tg.staged.capacity)); err != nil {
+			for _, undo := range targets[:i+1] {
+				undo.file.settleLocked()
+			}
+			return err
+		}
+	}
+
+	now := f.clock.Now()
+	for _, tg := range targets {
+		file, s := tg.file, tg.staged
+		if file.comp != nil {
+			f.chunks.invalidate(file.inode)
+			file.comp = nil
+		}
+		oldOffset, oldCapacity := file.offset, file.capacity()
+		changed := s.size
+		if file.size > changed {
+			changed = file.size
+		}
+		file.stampLocked(0, changed)
+		file.data = f.device.At(s.offset, s.capacity)
+		file.offset = s.offset
+		file.size = s.size
+		file.incompressible = false
+		file.modTime = now
+		file.changeTime = now
+		if oldCapacity > 0 {
+			file.retireLocked(oldOffset, oldCapacity)
+		}
+		file.settleLocked()
+		txnStagedBytes.Add(-int64(s.capacity))
+	}
+	f.meta.add()
+	delete(t.open, id)
+	txnOutcomes.With("committed").Inc()
+	for _, tg := range targets {
+		committed = append(committed, tg.file)
+	}
+	return f.SyncMetadata()
+}
+
+// TxnAbort discards a transaction and frees its staging extents
+func (f *Filesystem) TxnAbort(id uint64) error {
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx, ok := t.open[id]
+	if !ok {
+		return fmt.Errorf("no open transaction %d", id)
+	}
+	f.dropTxn(tx)
+	txnOutcomes.With("aborted").Inc()
+	return nil
+}
+
+// Txns lists the open transactions
+func (f *Filesystem) Txns() []TxnInfo {
+	f.expireTxns()
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	infos := make([]TxnInfo, 0, len(t.open))
+	for _, tx := range t.open {
+		info := TxnInfo{ID: tx.id, Started: tx.started, Files: make(map[string]int64)}
+		for p, s := range tx.staged {
+			info.Files[p] = s.size
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// expireTxns aborts transactions idle for longer than txnIdleTimeout
+func (f *Filesystem) expireTxns() {
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := f.clock.Now()
+	for _, tx := range t.open {
+		if now.Sub(tx.touched) > txnIdleTimeout {
+			log.Printf("Warning: aborting transaction %d, idle since %v", tx.id, tx.touched.Format(time.RFC3339))
+			f.dropTxn(tx)
+			txnOutcomes.With("expired").Inc()
+		}
+	}
+}
+
+// dropTxn frees a transaction's staging extents and forgets it. Called
+// with txns.mu held.
+func (f *Filesystem) dropTxn(tx *txn) {
+	for _, s := range tx.staged {
+		f.freeStaged(s)
+	}
+	delete(f.txns.open, tx.id)
+}
+
+// purgeStaged frees the staging extents of open transactions for a file
+// being purged. The entries stay, marked, so committing them fails
+// instead of emptying a file created at the same path since.
+func (f *Filesystem) purgeStaged(inode uint64) {
+	t := &f.txns
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tx := range t.open {
+		for _, s := range tx.staged {
+			if s.inode == inode {
+				f.freeStaged(s)
+				s.purged = true
+			}
+		}
+	}
+}
+
+// freeStaged releases a staging extent
+func (f *Filesystem) freeStaged(s *stagedFile) {
+	if s.capacity == 0 {
+		return
+	}
+	f.freeSpace(s.inode, s.offset, s.capacity)
+	txnStagedBytes.Add(-int64(s.capacity))
+	s.offset, s.capacity, s.size = 0, 0, 0
+}
+
+// lookupFile resolves p to a regular file
+func (f *Filesystem) lookupFile(p string) (*File, error) {
+	node, err := f.lookupPath(p)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := node.(*File)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+	return file, nil
+}
+
+// ctlTxn runs one transaction step: begin, stage, commit, abort or list
+func (f *Filesystem) ctlTxn(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Op     string `json:"op"`
+		ID     uint64 `json:"id"`
+		Path   string `json:"path"`
+		Data   []byte `json:"data"`
+		Append bool   `json:"append"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	switch params.Op {
+	case "begin":
+		return map[string]uint64{"id": f.TxnBegin()}, nil
+	case "stage":
+		if err := f.TxnStage(params.ID, params.Path, params.Data, params.Append); err != nil {
+			return nil, err
+		}
+		return map[string]int{"staged": len(params.Data)}, nil
+	case "commit":
+		if err := f.TxnCommit(params.ID); err != nil {
+			return nil, err
+		}
+		return map[string]uint64{"committed": params.ID}, nil
+	case "abort":
+		if err := f.TxnAbort(params.ID); err != nil {
+			return nil, err
+		}
+		return map[string]uint64{"aborted": params.ID}, nil
+	case "list", "":
+		return f.Txns(), nil
+	}
+	return nil, fmt.Errorf("unknown transaction op %q (want begin, stage, commit, abort or list)", params.Op)
+}
@@ -0,0 +1,61 @@
+package fs_test
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestTxnStagingFreedWhenFilePurged(t *testing.T) {
+	h := newHarness(t)
+	empty := freeBytes(t, h)
+	file, err := h.WriteFile("/a", []byte("old contents"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := h.FS.TxnBegin()
+	if err := h.FS.TxnStage(id, "/a", bytes.Repeat([]byte("x"), 1<<20), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the file frees its staging too, without waiting for an
+	// abort or the idle timeout
+	if err := h.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	h.Forget(file)
+	if got := freeBytes(t, h); got != empty {
+		t.Errorf("%d bytes free after the staged file was deleted, want %d", got, empty)
+	}
+
+	// A file created at the path since must not be emptied by the commit
+	if _, err := h.WriteFile("/a", []byte("recreated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.FS.TxnCommit(id); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("commit after the staged file was deleted: %v, want ENOENT", err)
+	}
+	if got, _ := h.ReadFile("/a"); string(got) != "recreated" {
+		t.Errorf("/a reads %q after the failed commit", got)
+	}
+	if err := h.FS.TxnStage(id, "/a", []byte("more"), true); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("append to the deleted file's staging: %v, want ENOENT", err)
+	}
+
+	// Aborting must not free the staging a second time
+	if err := h.FS.TxnAbort(id); err != nil {
+		t.Fatal(err)
+	}
+	recreated, err := h.File("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+	h.Forget(recreated)
+	if got := freeBytes(t, h); got != empty {
+		t.Errorf("%d bytes free once everything is gone, want %d", got, empty)
+	}
+}
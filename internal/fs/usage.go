@@ -0,0 +1,191 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+var (
+	uidBytes = metrics.NewGaugeVec("aethelfs_uid_bytes",
+		"Device bytes allocated to files owned by each uid", "uid")
+	uidInodes = metrics.NewGaugeVec("aethelfs_uid_inodes",
+		"Files and directories owned by each uid", "uid")
+	quotaDenials = metrics.NewCounter("aethelfs_quota_denials_total",
+		"Allocations refused with EDQUOT because the owner reached its byte limit")
+)
+
+// UidUsage is the space and inodes charged to one uid
+type UidUsage struct {
+	Uid    uint32 `json:"uid"`
+	Bytes  int64  `json:"bytes"`
+	Inodes int64  `json:"inodes"`
+	Limit  int64  `json:"limit,omitempty"` // Zero when the uid has no limit
+}
+
+// usageTable charges allocated bytes and inodes to the owning uid. A
+// file is charged the block-aligned size of its extent, so a file sharing
+// a deduplicated extent is charged for all of it. The root directory is
+// not charged.
+type usageTable struct {
+	mu    sync.Mutex
+	users map[uint32]*UidUsage
+}
+
+// ParseUidQuota parses per-uid byte limits of the form uid=BYTES,...
+func ParseUidQuota(spec string) (map[uint32]int64, error) {
+	limits := make(map[uint32]int64)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		uid, limit, ok := strings.Cut(field, "=")
+		u, err1 := strconv.ParseUint(uid, 10, 32)
+		l, err2 := strconv.ParseInt(limit, 0, 64)
+		if !ok || err1 != nil || err2 != nil || l < 0 {
+			return nil, fmt.Errorf("invalid uid quota %q (want uid=BYTES)", field)
+		}
+		limits[uint32(u)] = l
+	}
+	return limits, nil
+}
+
+// chargeUsage adds bytes and inodes, either of which may be negative, to
+// uid. With enforce set, growth that would take uid past its limit fails
+// with EDQUOT and nothing is charged.
+func (f *Filesystem) chargeUsage(uid uint32, bytes, inodes int64, enforce bool) error {
+	t := &f.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.users == nil {
+		t.users = make(map[uint32]*UidUsage)
+	}
+	u, ok := t.users[uid]
+	if !ok {
+		u = &UidUsage{Uid: uid}
+		t.users[uid] = u
+	}
+	if limit, ok := f.opts.UidQuota[uid]; ok && enforce && bytes > 0 && u.Bytes+bytes > limit {
+		quotaDenials.Inc()
+		return syscall.EDQUOT
+	}
+	u.Bytes += bytes
+	u.Inodes += inodes
+
+	label := strconv.FormatUint(uint64(uid), 10)
+	uidBytes.With(label).Set(u.Bytes)
+	uidInodes.With(label).Set(u.Inodes)
+	return nil
+}
+
+// Usage returns the usage of every uid that has been charged, ordered by uid
+func (f *Filesystem) Usage() []UidUsage {
+	f.usage.mu.Lock()
+	out := make([]UidUsage, 0, len(f.usage.users))
+	for _, u := range f.usage.users {
+		entry := *u
+		entry.Limit = f.opts.UidQuota[u.Uid]
+		out = append(out, entry)
+	}
+	f.usage.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Uid < out[j].Uid })
+	return out
+}
+
+// ctlUsage reports per-uid usage
+func (f *Filesystem) ctlUsage(args json.RawMessage) (interface{}, error) {
+	return f.Usage(), nil
+}
+
+// footprint is the device space held by the file's extent. The caller
+// holds f.mu.
+func (f *File) footprint() int64 {
+	if len(f.data) == 0 {
+		return 0
+	}
+	return int64(f.fs.alignSize(f.capacity()))
+}
+
+// chargeCreated charges a new, not yet linked file and its initial
+// extent to its owner. If the owner is over its limit the file is
+// discarded and EDQUOT returned.
+func (f *File) chargeCreated() error {
+	size := f.footprint()
+	if err := f.fs.chargeUsage(f.uid, size, 1, true); err != nil {
+		f.releaseCreated()
+		return err
+	}
+	f.charged = size
+	return nil
+}
+
+// releaseCreated gives back the extent, buffer and inode CreateFile took
+// for a file that never got a directory entry
+func (f *File) releaseCreated() {
+	if f.pending != nil {
+		f.dropBufferLocked()
+	}
+	f.fs.freeSpace(f.inode, f.offset, f.capacity())
+	f.fs.releaseInode(f.inode)
+	f.fs.unclaimInode()
+}
+
+// discardCreated undoes a create that lost a race for its name: the
+// charge chargeCreated made, then what CreateFile took
+func (f *File) discardCreated() {
+	f.fs.chargeUsage(f.uid, -f.charged, -1, false)
+	f.charged = 0
+	f.releaseCreated()
+}
+
+// reserveLocked charges the owner up front for growing the extent to
+// capacity bytes, failing with EDQUOT if that would pass its limit.
+// settleLocked corrects the charge once the extent is known. Growth of a
+// pinned file is reserved against MaxPinnedBytes too. The caller holds
+// f.mu for writing.
+func (f *File) reserveLocked(capacity int64) error {
+	if err := f.reservePinLocked(capacity); err != nil {
+		return err
+	}
+	delta := int64(f.fs.alignSize(common.ByteCount(capacity))) - f.charged
+	if delta <= 0 {
+		return nil
+	}
+	if err := f.fs.chargeUsage(f.uid, delta, 0, true); err != nil {
+		f.settlePinLocked()
+		return err
+	}
+	f.charged += delta
+	f.noteTreeLocked()
+	return nil
+}
+
+// settleLocked brings the owner's charge, and the pinned count, in line
+// with the extent the file actually holds. The caller holds f.mu for
+// writing.
+func (f *File) settleLocked() {
+	if delta := f.footprint() - f.charged; delta != 0 {
+		f.fs.chargeUsage(f.uid, delta, 0, false)
+		f.charged += delta
+		f.noteTreeLocked()
+	}
+	f.settlePinLocked()
+}
+
+// moveChargeLocked moves the file's charge from its previous owner to
+// its current one after a chown. The new owner's limit is not enforced,
+// as with chown on other filesystems. The caller holds f.mu for writing.
+func (f *File) moveChargeLocked(from uint32) {
+	f.fs.chargeUsage(from, -f.charged, -1, false)
+	f.fs.chargeUsage(f.uid, f.charged, 1, false)
+}
@@ -0,0 +1,73 @@
+package fs_test
+
+import (
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+
+	"aethelfs/internal/fs/fstest"
+)
+
+// fuzzDeviceSize keeps the device small enough that writes far into a
+// file run out of space instead of memory
+const fuzzDeviceSize = 8 << 20
+
+// FuzzRequestValidation sends reads, writes and truncates with arbitrary
+// offsets and sizes. Each must be answered, successfully or with an
+// errno, without a handler panic.
+func FuzzRequestValidation(f *testing.F) {
+	f.Add(uint8(0), int64(0), int64(4096), uint16(0))
+	f.Add(uint8(0), int64(-1), int64(1), uint16(0))
+	f.Add(uint8(0), int64(1<<62), int64(1<<62), uint16(0))
+	f.Add(uint8(1), int64(0), int64(0), uint16(512))
+	f.Add(uint8(1), int64(1<<63-1), int64(0), uint16(1))
+	f.Add(uint8(1), int64(fuzzDeviceSize), int64(0), uint16(4096))
+	f.Add(uint8(1), int64(-4096), int64(0), uint16(4096))
+	f.Add(uint8(2), int64(0), int64(-1), uint16(0))
+	f.Add(uint8(2), int64(0), int64(1<<40), uint16(0))
+
+	h, err := fstest.New(fuzzDeviceSize, testOptions())
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer h.Close()
+	file, err := h.WriteFile("/file", []byte("seed contents"), 0644)
+	if err != nil {
+		f.Fatal(err)
+	}
+	allowed := map[syscall.Errno]bool{
+		syscall.EINVAL: true, syscall.EFBIG: true, syscall.ENOSPC: true, syscall.EDQUOT: true,
+	}
+
+	f.Fuzz(func(t *testing.T, op uint8, offset, size int64, length uint16) {
+		panics := h.FS.Panics()
+		var err error
+		switch op % 3 {
+		case 0:
+			var data []byte
+			data, err = h.ReadAt(file, offset, int(size))
+			if err == nil && int64(len(data)) > size {
+				t.Errorf("read of %d bytes at %d returned %d", size, offset, len(data))
+			}
+		case 1:
+			var n int
+			n, err = h.WriteAt(file, offset, make([]byte, length))
+			if err == nil && n != int(length) {
+				t.Errorf("write of %d bytes at %d accepted %d", length, offset, n)
+			}
+		case 2:
+			_, err = h.Setattr(file, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: uint64(size)})
+		}
+		if h.FS.Panics() != panics {
+			t.Fatalf("op %d offset %d size %d length %d panicked", op%3, offset, size, length)
+		}
+		if err != nil && !allowed[fstest.Errno(err)] {
+			t.Errorf("op %d offset %d size %d length %d: %v", op%3, offset, size, length, err)
+		}
+		// Keep the file small for the next input
+		if err := h.Truncate(file, 0); err != nil {
+			t.Fatalf("truncate: %v", err)
+		}
+	})
+}
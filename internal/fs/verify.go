@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"bytes"
+	"log"
+	"syscall"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/metrics"
+)
+
+// materializeVerify names verified writes in the delayed allocation metrics
+const materializeVerify = "verify"
+
+// verifyContext is how many bytes around the first difference a mismatch
+// report shows
+const verifyContext = 16
+
+var (
+	verifiedWrites = metrics.NewCounter("aethelfs_verified_writes_total",
+		"Writes flushed and read back because write verification was on for them")
+	verifyMismatches = metrics.NewCounter("aethelfs_verify_mismatches_total",
+		"Verified writes whose flushed data read back differently, failed with EIO")
+)
+
+// verifiesWrites reports whether writes to f are verified: everywhere
+// with Options.VerifyWrites, or beneath a directory with the
+// verify-writes xattr set
+func (f *File) verifiesWrites() bool {
+	if f.fs.opts.VerifyWrites {
+		return true
+	}
+	for dir, _ := f.location(); dir != nil; {
+		dir.mu.RLock()
+		verify, parent := dir.verifyWrites, dir.parent
+		dir.mu.RUnlock()
+		if verify {
+			return true
+		}
+		dir = parent
+	}
+	return false
+}
+
+// prepareVerify puts the file's data in its extent before a verified
+// write, since a write that is staged or buffered cannot be read back
+// from the device
+func (f *File) prepareVerify() error {
+	if err := f.drainStaged(); err != nil {
+		return err
+	}
+	return f.materialize(materializeVerify)
+}
+
+// verifyWriteLocked flushes what a write just copied to [offset,
+// offset+len(data)) of the file and reads it back from the device,
+// failing with EIO and logging a mismatch report if it differs from data.
+// The flush writes the cache lines back and fences them; where it also
+// evicts them, as CLFLUSH does, the read comes from the device itself.
+// The caller holds f.mu.
+func (f *File) verifyWriteLocked(offset int64, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	length := common.ByteCount(len(data))
+	devOffset := f.offset.Plus(common.ByteCount(offset))
+	if err := f.fs.flushRange(devOffset, length); err != nil {
+		return err
+	}
+	f.noteFileFlush(int64(length))
+	verifiedWrites.Inc()
+
+	got := f.fs.device.At(devOffset, length)
+	if bytes.Equal(got, data) {
+		return nil
+	}
+	verifyMismatches.Inc()
+	f.logMismatch(offset, devOffset, data, got)
+	return syscall.EIO
+}
+
+// logMismatch reports a verified write that read back differently: where
+// it landed, how many bytes differ, and the bytes around the first. The
+// caller holds f.mu.
+func (f *File) logMismatch(offset int64, devOffset common.DeviceOffset, want, got []byte) {
+	first, differ := -1, 0
+	for i := range want {
+		if want[i] != got[i] {
+			if first < 0 {
+				first = i
+			}
+			differ++
+		}
+	}
+	lo, hi := first-verifyContext/2, first+verifyContext/2
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(want) {
+		hi = len(want)
+	}
+	log.Printf("Write verification failed for inode %d (%s): %d of %d bytes at offset %d (device offset %d) read back differently",
+		f.inode, f.name, differ, len(want), offset, devOffset)
+	log.Printf("  first difference at offset %d (device offset %d)", offset+int64(first), devOffset.Plus(common.ByteCount(first)))
+	log.Printf("  wrote %x", want[lo:hi])
+	log.Printf("  read  %x", got[lo:hi])
+}
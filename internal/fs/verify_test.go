@@ -0,0 +1,99 @@
+package fs_test
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// newFaultHarness mounts a device whose flushes a test can corrupt
+func newFaultHarness(t *testing.T, opts fs.Options) *fstest.Harness {
+	t.Helper()
+	h, err := fstest.NewWithFaults(0, opts)
+	if err != nil {
+		t.Fatalf("mount: %v", err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestVerifyWritesCatchesCorruption(t *testing.T) {
+	h := newFaultHarness(t, testOptions())
+	checked, err := h.Mkdir("/checked", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Setxattr(checked, "user.aethelfs.verify-writes", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Mkdir("/checked/nested", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Mkdir("/plain", 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("verify"), 1000)
+
+	// Every data flush loses a write between the flush and the read back
+	h.Faults.CorruptEveryNthFlush(1)
+	for _, path := range []string{"/checked/file", "/checked/nested/file"} {
+		if _, err := h.WriteFile(path, data, 0644); !fstest.IsErrno(err, syscall.EIO) {
+			t.Errorf("corrupted write to %s: %v, want EIO", path, err)
+		}
+	}
+	if h.Faults.Corrupted() == 0 {
+		t.Fatal("no flush corrupted")
+	}
+
+	// Outside the subtree writes are not flushed, so not read back
+	corrupted := h.Faults.Corrupted()
+	if _, err := h.WriteFile("/plain/file", data, 0644); err != nil {
+		t.Errorf("unverified write: %v", err)
+	}
+	if got := h.Faults.Corrupted(); got != corrupted {
+		t.Errorf("unverified write flushed %d data ranges", got-corrupted)
+	}
+
+	h.Faults.CorruptEveryNthFlush(0)
+	if _, err := h.WriteFile("/checked/file", data, 0644); err != nil {
+		t.Fatalf("verified write with the media healthy: %v", err)
+	}
+	if got, err := h.ReadFile("/checked/file"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("read back %d bytes, %v", len(got), err)
+	}
+
+	// Clearing the attribute stops verification
+	if err := h.Setxattr(checked, "user.aethelfs.verify-writes", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+	h.Faults.CorruptEveryNthFlush(1)
+	if _, err := h.WriteFile("/checked/other", data, 0644); err != nil {
+		t.Errorf("write after verification was turned off: %v", err)
+	}
+}
+
+func TestVerifyWritesEverywhere(t *testing.T) {
+	opts := testOptions()
+	opts.VerifyWrites = true
+	h := newFaultHarness(t, opts)
+	file, err := h.WriteFile("/file", []byte("first"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt every second data flush from here on: one write passes, the
+	// next reads back corrupted
+	h.Faults.CorruptEveryNthFlush(2)
+	if _, err := h.WriteAt(file, 0, []byte("second")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := h.WriteAt(file, 100, []byte("third")); !fstest.IsErrno(err, syscall.EIO) {
+		t.Errorf("corrupted write: %v, want EIO", err)
+	}
+	if got := h.Faults.Corrupted(); got != 1 {
+		t.Errorf("%d flushes corrupted, want 1", got)
+	}
+}
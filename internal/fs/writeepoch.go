@@ -0,0 +1,401 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aethelfs/internal/alloc"
+	"aethelfs/internal/common"
+	"aethelfs/internal/control"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/metrics"
+)
+
+// maxWriteStamps bounds the stamps a file keeps. Past it the two oldest
+// are merged, so a query may report more than was written, never less.
+const maxWriteStamps = 8
+
+var (
+	writeEpochGauge = metrics.NewGauge("aethelfs_write_epoch",
+		"Current filesystem write epoch")
+	epochAdvances = metrics.NewCounter("aethelfs_write_epoch_advances_total",
+		"Write epochs started, by the schedule or the advance-epoch command")
+)
+
+// writeStamp is the span of a file written during one write epoch
+type writeStamp struct {
+	epoch      uint64
+	start, end int64
+}
+
+// loadWriteEpoch resumes the write epoch the superblock recorded. A device
+// that never advanced it starts at epoch 1.
+func (f *Filesystem) loadWriteEpoch() {
+	epoch := f.super.WriteEpoch
+	if epoch == 0 {
+		epoch = 1
+	}
+	atomic.StoreUint64(&f.writeEpoch, epoch)
+	writeEpochGauge.Set(int64(epoch))
+}
+
+// currentEpoch returns the write epoch new writes are stamped with
+func (f *Filesystem) currentEpoch() uint64 {
+	return atomic.LoadUint64(&f.writeEpoch)
+}
+
+// advanceEpoch starts a new write epoch and returns the one it ended.
+// The new epoch is recorded in the superblock before any write can be
+// stamped with it, so epochs keep increasing across remounts. An
+// incremental backup advances the epoch, then copies what changed since
+// the epoch the previous backup ended; writes racing the advance are
+// stamped with the ended epoch and covered by this backup. The ended
+// epoch's stamps are then saved to the device.
+func (f *Filesystem) advanceEpoch() (uint64, error) {
+	prev, err := f.startEpoch()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.saveWriteStamps(); err != nil {
+		log.Printf("Warning: write stamps of epoch %d not saved: %v", prev, err)
+	}
+	return prev, nil
+}
+
+// startEpoch records the next write epoch in the superblock and makes it
+// current, returning the one it ended
+func (f *Filesystem) startEpoch() (uint64, error) {
+	f.superMu.Lock()
+	defer f.superMu.Unlock()
+	prev := f.currentEpoch()
+	f.super.WriteEpoch = prev + 1
+	if err := f.writeSuperLocked(); err != nil {
+		f.super.WriteEpoch = prev
+		return 0, fmt.Errorf("failed to record write epoch in superblock: %w", err)
+	}
+	atomic.StoreUint64(&f.writeEpoch, prev+1)
+	writeEpochGauge.Set(int64(prev + 1))
+	epochAdvances.Inc()
+	return prev, nil
+}
+
+// startEpochAdvancer advances the write epoch every WriteEpochInterval,
+// unless the interval is zero and only the control command advances it
+func (f *Filesystem) startEpochAdvancer() {
+	interval := f.opts.WriteEpochInterval
+	if interval <= 0 {
+		return
+	}
+	f.workers.start("epoch", func(w *worker) error {
+		ticker := f.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				_, err := f.advanceEpoch()
+				w.ran(err)
+			case <-w.stopping():
+				return nil
+			}
+		}
+	})
+}
+
+// stampLocked records that [start, end) of the file was written in the
+// current epoch. A file keeps one stamp per epoch covering everything
+// written in it, so most writes only compare the epoch and widen the
+// span. Stamps belong to the file, not its extent, so relocation by
+// compaction, deduplication or growth leaves them alone. The caller holds
+// f.mu for writing.
+func (f *File) stampLocked(start, end int64) {
+	epoch := f.fs.currentEpoch()
+	if n := len(f.stamps); n > 0 && f.stamps[n-1].epoch == epoch {
+		s := &f.stamps[n-1]
+		if start < s.start {
+			s.start = start
+		}
+		if end > s.end {
+			s.end = end
+		}
+		return
+	}
+	f.trimStampsLocked(maxWriteStamps - 1)
+	f.stamps = append(f.stamps, writeStamp{epoch: epoch, start: start, end: end})
+}
+
+// trimStampsLocked merges the oldest stamps until at most n are left. The
+// caller holds f.mu for writing.
+func (f *File) trimStampsLocked(n int) {
+	for len(f.stamps) > n {
+		oldest, next := f.stamps[0], &f.stamps[1]
+		if oldest.start < next.start {
+			next.start = oldest.start
+		}
+		if oldest.end > next.end {
+			next.end = oldest.end
+		}
+		copy(f.stamps, f.stamps[1:])
+		f.stamps = f.stamps[:len(f.stamps)-1]
+	}
+}
+
+// stampTable is the write stamps saved in the table at the end of the
+// metadata reservation, so changed-since still knows what was written
+// before a remount. The table is rewritten whole when an epoch ends, on
+// syncfs and at unmount; a crash loses the stamps made since.
+type stampTable struct {
+	mu    sync.Mutex                           // Serializes rewrites of the table
+	saved map[common.DeviceOffset][]writeStamp // Loaded at mount, by extent, until the scan restores them
+}
+
+// stampTableOffset returns where the device's write stamp table starts,
+// or false when it keeps none because its allocation bitmap reaches it
+func (f *Filesystem) stampTableOffset() (common.DeviceOffset, bool) {
+	offset := common.DeviceOffset(disk.StampTableOffset(common.MetadataReservationSize))
+	if allocatorKind(f.super) == alloc.KindBitmap {
+		bitmap, err := disk.Bitmap(f.device.At(0, common.ByteCount(f.device.Size())), f.blockSize, common.MetadataReservationSize)
+		if err != nil || disk.BitmapOffset+common.DeviceOffset(len(bitmap)) > offset {
+			return 0, false
+		}
+	}
+	return offset, true
+}
+
+// loadWriteStamps reads the stamps saved by the previous mount, for the
+// mount scan to give back to the files it finds. A damaged table is
+// reported and ignored: changed-since then only knows this mount's writes.
+func (f *Filesystem) loadWriteStamps() {
+	offset, ok := f.stampTableOffset()
+	if !ok {
+		return
+	}
+	stamps, err := disk.DecodeWriteStamps(f.device.At(offset, disk.StampTableSize))
+	if err != nil {
+		log.Printf("Warning: ignoring write stamps saved before this mount: %v", err)
+		return
+	}
+	if len(stamps) == 0 {
+		return
+	}
+	saved := make(map[common.DeviceOffset][]writeStamp)
+	for _, s := range stamps {
+		extent := common.DeviceOffset(s.Extent)
+		saved[extent] = append(saved[extent], writeStamp{epoch: s.Epoch, start: s.Start, end: s.End})
+	}
+	for _, list := range saved {
+		sort.Slice(list, func(i, j int) bool { return list[i].epoch < list[j].epoch })
+	}
+	f.stamps.mu.Lock()
+	f.stamps.saved = saved
+	f.stamps.mu.Unlock()
+}
+
+// restoreWriteStamps gives each file the mount scan finds the stamps saved
+// for its extent. Stamps of extents no file claims are dropped, so a file
+// created later on reused space does not inherit them.
+func (f *Filesystem) restoreWriteStamps() {
+	f.stamps.mu.Lock()
+	saved := f.stamps.saved
+	f.stamps.saved = nil
+	f.stamps.mu.Unlock()
+	if len(saved) == 0 {
+		return
+	}
+	restored := 0
+	f.walkFiles(func(p string, file *File) {
+		file.mu.Lock()
+		defer file.mu.Unlock()
+		if list, ok := saved[file.offset]; ok && len(file.data) > 0 {
+			file.stamps = append(list, file.stamps...)
+			file.trimStampsLocked(maxWriteStamps)
+			restored++
+		}
+	})
+	log.Printf("Restored write stamps of %d files", restored)
+}
+
+// saveWriteStamps rewrites the device's stamp table with the stamps of
+// every file that has an extent. Files still buffered by delayed
+// allocation have nothing on the device for the stamps to describe.
+func (f *Filesystem) saveWriteStamps() error {
+	if f.opts.ReadOnly {
+		return nil
+	}
+	offset, ok := f.stampTableOffset()
+	if !ok {
+		return nil
+	}
+	var stamps []disk.WriteStamp
+	f.walkFiles(func(p string, file *File) {
+		file.mu.RLock()
+		defer file.mu.RUnlock()
+		if len(file.data) == 0 {
+			return
+		}
+		for _, s := range file.stamps {
+			stamps = append(stamps, disk.WriteStamp{Extent: uint64(file.offset), Epoch: s.epoch, Start: s.start, End: s.end})
+		}
+	})
+	stamps = fitWriteStamps(stamps)
+
+	f.stamps.mu.Lock()
+	defer f.stamps.mu.Unlock()
+	var r guardRange
+	if f.guard != nil {
+		r = f.guard.stamps
+	}
+	restore, err := f.guard.lift(r, "write stamp table")
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if err := disk.EncodeWriteStamps(f.device.At(offset, disk.StampTableSize), stamps); err != nil {
+		return err
+	}
+	noteFlush(flushOriginSuper, disk.StampTableSize)
+	return f.device.FlushRange(offset, disk.StampTableSize)
+}
+
+// fitWriteStamps trims stamps to what the table holds. Each file's
+// stamps are first merged into one covering all of them, which may
+// over-report but never misses a change; if the files still do not fit,
+// those written longest ago are dropped.
+func fitWriteStamps(stamps []disk.WriteStamp) []disk.WriteStamp {
+	if len(stamps) <= disk.MaxWriteStamps {
+		return stamps
+	}
+	merged := make(map[uint64]int) // Index in out by extent
+	var out []disk.WriteStamp
+	for _, s := range stamps {
+		i, ok := merged[s.Extent]
+		if !ok {
+			merged[s.Extent] = len(out)
+			out = append(out, s)
+			continue
+		}
+		m := &out[i]
+		if s.Epoch > m.Epoch {
+			m.Epoch = s.Epoch
+		}
+		if s.Start < m.Start {
+			m.Start = s.Start
+		}
+		if s.End > m.End {
+			m.End = s.End
+		}
+	}
+	if len(out) > disk.MaxWriteStamps {
+		sort.Slice(out, func(i, j int) bool { return out[i].Epoch > out[j].Epoch })
+		log.Printf("Warning: write stamp table full: stamps of %d files not saved", len(out)-disk.MaxWriteStamps)
+		out = out[:disk.MaxWriteStamps]
+	}
+	return out
+}
+
+// ChangedFile is a file written after the epoch a changed-since query
+// asked about, with the ranges written, clipped to its current size. A
+// file that was only created or truncated has no ranges.
+type ChangedFile struct {
+	Path   string         `json:"path"`
+	Inode  uint64         `json:"inode"`
+	Size   int64          `json:"size"`
+	Epoch  uint64         `json:"epoch"` // Latest epoch it was written in
+	Ranges []ChangedRange `json:"ranges"`
+}
+
+// ChangedRange is a byte range of a file written after the queried epoch
+type ChangedRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// changedSinceLocked reports the file's writes after epoch, if any. The
+// caller holds f.mu.
+func (f *File) changedSinceLocked(epoch uint64) (ChangedFile, bool) {
+	c := ChangedFile{Inode: f.inode, Size: f.size, Ranges: []ChangedRange{}}
+	var spans []writeStamp
+	for _, s := range f.stamps {
+		if s.epoch <= epoch {
+			continue
+		}
+		c.Epoch = s.epoch
+		if s.end > f.size {
+			s.end = f.size
+		}
+		if s.start < s.end {
+			spans = append(spans, s)
+		}
+	}
+	if c.Epoch == 0 {
+		return c, false
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	for _, s := range spans {
+		if n := len(c.Ranges); n > 0 {
+			last := &c.Ranges[n-1]
+			if s.start <= last.Offset+last.Length {
+				if end := s.end - last.Offset; end > last.Length {
+					last.Length = end
+				}
+				continue
+			}
+		}
+		c.Ranges = append(c.Ranges, ChangedRange{Offset: s.start, Length: s.end - s.start})
+	}
+	return c, true
+}
+
+// ChangedSince lists the files written after epoch, by path. Removed
+// files are not listed; a backup finds them by comparing names.
+func (f *Filesystem) ChangedSince(epoch uint64) []ChangedFile {
+	out := []ChangedFile{}
+	f.walkFiles(func(p string, file *File) {
+		file.mu.RLock()
+		c, ok := file.changedSinceLocked(epoch)
+		file.mu.RUnlock()
+		if ok {
+			c.Path = p
+			out = append(out, c)
+		}
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// EpochInfo reports the current write epoch
+type EpochInfo struct {
+	Epoch    uint64        `json:"epoch"`
+	Previous uint64        `json:"previous,omitempty"` // Set when advancing: the epoch just ended
+	Interval time.Duration `json:"interval_ns,omitempty"`
+}
+
+// ctlEpoch reports the current write epoch
+func (f *Filesystem) ctlEpoch(args json.RawMessage) (interface{}, error) {
+	return EpochInfo{Epoch: f.currentEpoch(), Interval: f.opts.WriteEpochInterval}, nil
+}
+
+// ctlAdvanceEpoch starts a new write epoch and reports the one it ended,
+// which the next changed-since query should pass
+func (f *Filesystem) ctlAdvanceEpoch(args json.RawMessage) (interface{}, error) {
+	prev, err := f.advanceEpoch()
+	if err != nil {
+		return nil, err
+	}
+	return EpochInfo{Epoch: f.currentEpoch(), Previous: prev, Interval: f.opts.WriteEpochInterval}, nil
+}
+
+// ctlChangedSince lists the files and ranges written after an epoch
+func (f *Filesystem) ctlChangedSince(args json.RawMessage) (interface{}, error) {
+	var params struct {
+		Epoch uint64 `json:"epoch"`
+	}
+	if err := control.DecodeArgs(args, &params); err != nil {
+		return nil, err
+	}
+	return f.ChangedSince(params.Epoch), nil
+}
@@ -0,0 +1,157 @@
+package fs_test
+
+import (
+	"reflect"
+	"testing"
+
+	"aethelfs/internal/common"
+	"aethelfs/internal/disk"
+	"aethelfs/internal/fs"
+	"aethelfs/internal/fs/fstest"
+)
+
+// changed returns the changed-since report by path
+func changed(h *fstest.Harness, epoch uint64) map[string][]fs.ChangedRange {
+	out := make(map[string][]fs.ChangedRange)
+	for _, c := range h.FS.ChangedSince(epoch) {
+		out[c.Path] = c.Ranges
+	}
+	return out
+}
+
+func TestChangedSinceWrites(t *testing.T) {
+	h := newHarness(t)
+	a, err := h.WriteFile("/a", make([]byte, 8192), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteFile("/b", make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	prev, err := h.FS.AdvanceEpoch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changed(h, prev); len(got) != 0 {
+		t.Fatalf("changes reported before any write in the new epoch: %v", got)
+	}
+
+	if _, err := h.WriteAt(a, 100, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(a, 4000, []byte("def")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]fs.ChangedRange{"/a": {{Offset: 100, Length: 3903}}}
+	if got := changed(h, prev); !reflect.DeepEqual(got, want) {
+		t.Errorf("changed since %d = %v, want %v", prev, got, want)
+	}
+	if got := changed(h, 0); len(got) != 2 {
+		t.Errorf("changed since 0 = %v, want both files", got)
+	}
+}
+
+func TestChangedSinceTxnAndIngest(t *testing.T) {
+	h := newHarness(t)
+	if _, err := h.WriteFile("/a", []byte("old contents"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := h.WriteFile("/b", []byte("untouched"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := h.FS.AdvanceEpoch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A reservation, the fallocate this filesystem offers, changes no bytes
+	if err := h.Setxattr(b, "user.aethelfs.reserve", []byte("1048576")); err != nil {
+		t.Fatal(err)
+	}
+
+	id := h.FS.TxnBegin()
+	if err := h.FS.TxnStage(id, "/a", []byte("new"), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.FS.TxnCommit(id); err != nil {
+		t.Fatal(err)
+	}
+	results, err := h.FS.Ingest([]fs.IngestEntry{{Path: "dir/c", Mode: 0644, Size: 5, Data: []byte("hello")}})
+	if err != nil || results[0].Error != "" {
+		t.Fatalf("ingest: %v %+v", err, results)
+	}
+
+	want := map[string][]fs.ChangedRange{
+		"/a":     {{Offset: 0, Length: 3}},
+		"/dir/c": {{Offset: 0, Length: 5}},
+	}
+	if got := changed(h, prev); !reflect.DeepEqual(got, want) {
+		t.Errorf("changed since %d = %v, want %v", prev, got, want)
+	}
+}
+
+func TestWriteStampsSurviveRemount(t *testing.T) {
+	h, err := fstest.New(0, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := h.WriteFile("/a", make([]byte, 8192), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.FS.AdvanceEpoch(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(a, 100, []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	// Unmounting allocates the buffered file its extent and saves the table
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	extent := a.Layout().Extents[0].Offset
+
+	table := h.Device.At(common.DeviceOffset(disk.StampTableOffset(common.MetadataReservationSize)), disk.StampTableSize)
+	stamps, err := disk.DecodeWriteStamps(table)
+	if err != nil {
+		t.Fatalf("decode stamp table: %v", err)
+	}
+	want := []disk.WriteStamp{
+		{Extent: uint64(extent), Epoch: 1, Start: 0, End: 8192},
+		{Extent: uint64(extent), Epoch: 2, Start: 100, End: 103},
+	}
+	if !reflect.DeepEqual(stamps, want) {
+		t.Fatalf("stamp table after unmount = %+v, want %+v", stamps, want)
+	}
+
+	h2, err := fstest.Mount(h.Device, testOptions())
+	if err != nil {
+		t.Fatalf("remount: %v", err)
+	}
+	defer h2.Close()
+	// The namespace is not persisted, so a file on the reused extent
+	// must not inherit the old file's stamps at mount
+	b, err := h2.Create("/b", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h2.WriteAt(b, 0, []byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := h2.Fsync(b); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Layout().Extents[0].Offset; got != extent {
+		t.Fatalf("/b placed at %d, want the freed extent at %d", got, extent)
+	}
+	current := b.StampEpochs()
+	if len(current) != 1 || current[0] < 2 {
+		t.Fatalf("/b stamped in epochs %v after remount, want only the current one", current)
+	}
+
+	// A file the scan finds on the extent gets them back
+	h2.FS.RestoreWriteStamps()
+	if got, want := b.StampEpochs(), []uint64{1, 2, current[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("/b stamped in epochs %v after restore, want %v", got, want)
+	}
+}
@@ -0,0 +1,410 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"syscall"
+
+	"bazil.org/fuse"
+)
+
+// Virtual extended attributes synthesized from in-memory state
+const (
+	xattrStats = "user.aethelfs.stats"
+	xattrTier  = "user.aethelfs.tier" // Preferred allocation region
+
+	// Set to "1" on a file to refuse a second writable open with EBUSY
+	xattrExclusive = "user.aethelfs.exclusive-write"
+
+	// Set to "1" on a file to stage small sequential appends
+	xattrCoalesce = "user.aethelfs.coalesce"
+
+	// Set to "1" on a file to keep background work from relocating its
+	// extent; see pin.go
+	xattrPinned = "user.aethelfs.pinned"
+
+	// Setting xattrReserve on a file to LENGTH or OFFSET:LENGTH reserves
+	// contiguous space up to OFFSET+LENGTH, failing with ENOSPC if no free
+	// extent is that large; "0" or removing it releases the reservation.
+	// Like the barrier it stands in for an ioctl. Reading it back reports
+	// the reservation and the largest extent available. xattrLayout reads
+	// back where the file's data lives on the device.
+	xattrReserve = "user.aethelfs.reserve"
+	xattrLayout  = "user.aethelfs.layout"
+
+	// Setting xattrBarrier on an open file, with any value, makes its data
+	// written so far durable without flushing metadata; fsetxattr stands in
+	// for an ioctl, which the FUSE library doesn't support. xattrPersistence
+	// reads back the persistence path the barrier uses.
+	xattrBarrier     = "user.aethelfs.barrier"
+	xattrPersistence = "user.aethelfs.persistence"
+
+	// Set on a directory to compress files in it once they are closed
+	xattrCompress = "user.aethelfs.compress"
+
+	// Set on a directory to the extent size, in bytes, of files created
+	// beneath it. On files it reads back the size they were created with.
+	xattrInitialSize = "user.aethelfs.initial-size"
+
+	// Set to "1" on a directory to read back every write beneath it after
+	// flushing it, failing mismatches with EIO; see verify.go
+	xattrVerifyWrites = "user.aethelfs.verify-writes"
+)
+
+// Getxattr implements the fs.NodeGetxattrer interface
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	switch req.Name {
+	case xattrStats:
+		data, err := json.Marshal(f.heat.snapshot(f.inode, 0))
+		if err != nil {
+			return err
+		}
+		resp.Xattr = data
+		return nil
+	case xattrTier:
+		f.mu.RLock()
+		tier := f.tier
+		f.mu.RUnlock()
+		if tier == "" {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(tier)
+		return nil
+	case xattrExclusive:
+		f.mu.RLock()
+		exclusive := f.exclusive
+		f.mu.RUnlock()
+		if !exclusive {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte("1")
+		return nil
+	case xattrPersistence:
+		resp.Xattr = []byte(f.fs.persistenceMode())
+		return nil
+	case xattrInitialSize:
+		resp.Xattr = []byte(strconv.FormatInt(f.initialSize, 10))
+		return nil
+	case xattrCoalesce:
+		f.mu.RLock()
+		coalesce := f.coalesce
+		f.mu.RUnlock()
+		if !coalesce {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte("1")
+		return nil
+	case xattrPinned:
+		f.mu.RLock()
+		pinned := f.pinned
+		f.mu.RUnlock()
+		if !pinned {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte("1")
+		return nil
+	case xattrReserve:
+		data, err := json.Marshal(f.reserveInfo())
+		if err != nil {
+			return err
+		}
+		resp.Xattr = data
+		return nil
+	case xattrLayout:
+		data, err := json.Marshal(f.layout())
+		if err != nil {
+			return err
+		}
+		resp.Xattr = data
+		return nil
+	}
+	return fuse.ErrNoXattr
+}
+
+var _ = registerBehavior(Behavior{
+	Name: "xattr.user", Supported: false, Errno: "EPERM",
+	Note: "Only the virtual user.aethelfs.* attributes exist; listxattr names those a node has",
+})
+
+// Setxattr implements the fs.NodeSetxattrer interface. The tier steers
+// future allocations and must name a configured region; exclusive-write,
+// coalesce and pinned take "1" or "0", and exclusive-write applies to
+// opens made after it is set.
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	switch req.Name {
+	case xattrBarrier:
+		return f.barrierXattr()
+	case xattrPinned:
+		switch string(req.Xattr) {
+		case "1":
+			return f.pin(f.fs.opts.PinPrefault)
+		case "0":
+			f.unpin()
+			return nil
+		}
+		return syscall.EINVAL
+	case xattrReserve:
+		offset, length, err := parseReserve(string(req.Xattr))
+		if err != nil {
+			return syscall.EINVAL
+		}
+		if length == 0 {
+			f.releaseReservation()
+			return nil
+		}
+		return f.reserveSpace(offset, length)
+	case xattrTier:
+		tier := string(req.Xattr)
+		if !f.fs.hasRegion(tier) {
+			return syscall.EINVAL
+		}
+
+		f.mu.Lock()
+		f.tier = tier
+		f.changed(f.fs.clock.Now())
+		f.mu.Unlock()
+		return nil
+	case xattrExclusive, xattrCoalesce:
+		var on bool
+		switch string(req.Xattr) {
+		case "1":
+			on = true
+		case "0":
+		default:
+			return syscall.EINVAL
+		}
+
+		f.mu.Lock()
+		if req.Name == xattrExclusive {
+			f.exclusive = on
+		} else {
+			f.coalesce = on
+		}
+		f.changed(f.fs.clock.Now())
+		f.mu.Unlock()
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// Removexattr implements the fs.NodeRemovexattrer interface
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	if req.Name == xattrPinned {
+		f.mu.RLock()
+		pinned := f.pinned
+		f.mu.RUnlock()
+		if !pinned {
+			return fuse.ErrNoXattr
+		}
+		f.unpin()
+		return nil
+	}
+	if req.Name == xattrReserve {
+		if !f.releaseReservation() {
+			return fuse.ErrNoXattr
+		}
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch req.Name {
+	case xattrTier:
+		if f.tier == "" {
+			return fuse.ErrNoXattr
+		}
+		f.tier = ""
+		f.changed(f.fs.clock.Now())
+		return nil
+	case xattrExclusive:
+		if !f.exclusive {
+			return fuse.ErrNoXattr
+		}
+		f.exclusive = false
+		f.changed(f.fs.clock.Now())
+		return nil
+	case xattrCoalesce:
+		if !f.coalesce {
+			return fuse.ErrNoXattr
+		}
+		f.coalesce = false
+		f.changed(f.fs.clock.Now())
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// Listxattr implements the fs.NodeListxattrer interface
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	resp.Append(xattrStats)
+	resp.Append(xattrPersistence)
+	resp.Append(xattrInitialSize)
+	resp.Append(xattrReserve)
+	resp.Append(xattrLayout)
+	f.mu.RLock()
+	if f.tier != "" {
+		resp.Append(xattrTier)
+	}
+	if f.exclusive {
+		resp.Append(xattrExclusive)
+	}
+	if f.coalesce {
+		resp.Append(xattrCoalesce)
+	}
+	if f.pinned {
+		resp.Append(xattrPinned)
+	}
+	f.mu.RUnlock()
+	return nil
+}
+
+// Getxattr implements the fs.NodeGetxattrer interface
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	switch req.Name {
+	case xattrEffectivePolicy:
+		resp.Xattr, err = d.effectivePolicyXattr()
+		return err
+	case xattrTreeBytes, xattrTreeInodes:
+		// Settling takes renameMu, which Rename holds while locking dirs
+		resp.Xattr = d.treeXattr(req.Name)
+		return nil
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	switch req.Name {
+	case xattrForceUid, xattrForceGid, xattrForceModeMask:
+		resp.Xattr, err = d.getTemplateXattrLocked(req.Name)
+		return err
+	case xattrCompress:
+		if d.compress == "" {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(d.compress)
+		return nil
+	case xattrInitialSize:
+		if d.initialSize == 0 {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(strconv.FormatInt(d.initialSize, 10))
+		return nil
+	case xattrVerifyWrites:
+		if !d.verifyWrites {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte("1")
+		return nil
+	}
+	return fuse.ErrNoXattr
+}
+
+// Listxattr implements the fs.NodeListxattrer interface
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.compress != "" {
+		resp.Append(xattrCompress)
+	}
+	if d.initialSize != 0 {
+		resp.Append(xattrInitialSize)
+	}
+	if d.verifyWrites {
+		resp.Append(xattrVerifyWrites)
+	}
+	d.listTemplateXattrsLocked(resp)
+	resp.Append(xattrEffectivePolicy)
+	resp.Append(xattrTreeBytes)
+	resp.Append(xattrTreeInodes)
+	return nil
+}
+
+// Setxattr implements the fs.NodeSetxattrer interface. The compression
+// algorithm and the initial size of new files are writable on
+// directories, as is write verification; the initial size must be whole
+// blocks and no larger than one allocation or the file size limit. Only
+// root may set the ownership template.
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	switch req.Name {
+	case xattrForceUid, xattrForceGid, xattrForceModeMask:
+		return d.setTemplateXattr(&req.Header, req.Name, req.Xattr)
+	case xattrCompress:
+		if alg := string(req.Xattr); alg != compressAlgFlate {
+			return syscall.EINVAL
+		}
+
+		d.mu.Lock()
+		d.compress = compressAlgFlate
+		d.changed(d.fs.clock.Now())
+		d.mu.Unlock()
+		return nil
+	case xattrInitialSize:
+		size, err := strconv.ParseInt(string(req.Xattr), 10, 64)
+		if err != nil {
+			return syscall.EINVAL
+		}
+		if err := d.fs.checkInitialSize(size); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		d.initialSize = size
+		d.changed(d.fs.clock.Now())
+		d.mu.Unlock()
+		return nil
+	case xattrVerifyWrites:
+		var on bool
+		switch string(req.Xattr) {
+		case "1":
+			on = true
+		case "0":
+		default:
+			return syscall.EINVAL
+		}
+
+		d.mu.Lock()
+		d.verifyWrites = on
+		d.changed(d.fs.clock.Now())
+		d.mu.Unlock()
+		return nil
+	}
+	return syscall.EPERM
+}
+
+// Removexattr implements the fs.NodeRemovexattrer interface. Files already
+// compressed stay compressed until they are next written; files already
+// created keep their initial extent.
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch req.Name {
+	case xattrForceUid, xattrForceGid, xattrForceModeMask:
+		if req.Header.Uid != 0 {
+			return syscall.EPERM
+		}
+		if err := d.removeTemplateXattrLocked(req.Name); err != nil {
+			return err
+		}
+	case xattrCompress:
+		if d.compress == "" {
+			return fuse.ErrNoXattr
+		}
+		d.compress = ""
+	case xattrInitialSize:
+		if d.initialSize == 0 {
+			return fuse.ErrNoXattr
+		}
+		d.initialSize = 0
+	case xattrVerifyWrites:
+		if !d.verifyWrites {
+			return fuse.ErrNoXattr
+		}
+		d.verifyWrites = false
+	default:
+		return syscall.EPERM
+	}
+	d.changed(d.fs.clock.Now())
+	return nil
+}
@@ -0,0 +1,373 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is implemented by every value held in a Registry
+type metric interface {
+	describe() (name, help, kind string)
+	writeText(w io.Writer)
+	snapshot() interface{}
+}
+
+// Registry holds a named set of metrics
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]metric
+	hooks   []func() // Run before every collection to refresh derived values
+}
+
+// Default is the registry used by the package-level constructors
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// register adds a metric, returning the existing one if the name is taken
+func (r *Registry) register(name string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.metrics[name]; ok {
+		return existing
+	}
+	r.metrics[name] = m
+	return m
+}
+
+// OnCollect registers fn to run before every WriteText and Snapshot, for
+// gauges that are cheaper to compute on demand than to keep current
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, fn)
+}
+
+// collect runs the collection hooks
+func (r *Registry) collect() {
+	r.mu.RLock()
+	hooks := append([]func(){}, r.hooks...)
+	r.mu.RUnlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
+
+// sorted returns the registered metrics ordered by name
+func (r *Registry) sorted() []metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]metric, 0, len(names))
+	for _, name := range names {
+		out = append(out, r.metrics[name])
+	}
+	return out
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) {
+	r.collect()
+	for _, m := range r.sorted() {
+		name, help, kind := m.describe()
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		m.writeText(w)
+	}
+}
+
+// Snapshot returns a JSON-friendly copy of every metric keyed by name
+func (r *Registry) Snapshot() map[string]interface{} {
+	r.collect()
+	out := make(map[string]interface{})
+	for _, m := range r.sorted() {
+		name, _, _ := m.describe()
+		out[name] = m.snapshot()
+	}
+	return out
+}
+
+// Handler serves the registry in the text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WriteText(w)
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v          int64 // first for 64-bit atomic alignment on 32-bit platforms
+	name, help string
+}
+
+// NewCounter registers a counter in the default registry
+func NewCounter(name, help string) *Counter {
+	return Default.register(name, &Counter{name: name, help: help}).(*Counter)
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+// Value returns the current count
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+func (c *Counter) describe() (string, string, string) { return c.name, c.help, "counter" }
+func (c *Counter) writeText(w io.Writer)              { fmt.Fprintf(w, "%s %d\n", c.name, c.Value()) }
+func (c *Counter) snapshot() interface{}              { return c.Value() }
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v          int64
+	name, help string
+}
+
+// NewGauge registers a gauge in the default registry
+func NewGauge(name, help string) *Gauge {
+	return Default.register(name, &Gauge{name: name, help: help}).(*Gauge)
+}
+
+// Set replaces the gauge value
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Add adjusts the gauge by delta, which may be negative
+func (g *Gauge) Add(delta int64) {
+	atomic.AddInt64(&g.v, delta)
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) describe() (string, string, string) { return g.name, g.help, "gauge" }
+func (g *Gauge) writeText(w io.Writer)              { fmt.Fprintf(w, "%s %d\n", g.name, g.Value()) }
+func (g *Gauge) snapshot() interface{}              { return g.Value() }
+
+// CounterVec is a family of counters partitioned by a single label
+type CounterVec struct {
+	name, help, label string
+	mu                sync.RWMutex
+	counters          map[string]*Counter
+}
+
+// NewCounterVec registers a labelled counter family in the default registry
+func NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	return Default.register(name, v).(*CounterVec)
+}
+
+// With returns the counter for the given label value, creating it on first use
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.RLock()
+	c, ok := v.counters[value]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.counters[value]; !ok {
+		c = &Counter{name: v.name}
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) describe() (string, string, string) { return v.name, v.help, "counter" }
+
+func (v *CounterVec) values() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.counters))
+	for k := range v.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *CounterVec) writeText(w io.Writer) {
+	for _, k := range v.values() {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", v.name, v.label, k, v.With(k).Value())
+	}
+}
+
+func (v *CounterVec) snapshot() interface{} {
+	out := make(map[string]int64)
+	for _, k := range v.values() {
+		out[k] = v.With(k).Value()
+	}
+	return out
+}
+
+// GaugeVec is a family of gauges partitioned by a single label
+type GaugeVec struct {
+	name, help, label string
+	mu                sync.RWMutex
+	gauges            map[string]*Gauge
+}
+
+// NewGaugeVec registers a labelled gauge family in the default registry
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	v := &GaugeVec{name: name, help: help, label: label, gauges: make(map[string]*Gauge)}
+	return Default.register(name, v).(*GaugeVec)
+}
+
+// With returns the gauge for the given label value, creating it on first use
+func (v *GaugeVec) With(value string) *Gauge {
+	v.mu.RLock()
+	g, ok := v.gauges[value]
+	v.mu.RUnlock()
+	if ok {
+		return g
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if g, ok = v.gauges[value]; !ok {
+		g = &Gauge{name: v.name}
+		v.gauges[value] = g
+	}
+	return g
+}
+
+func (v *GaugeVec) describe() (string, string, string) { return v.name, v.help, "gauge" }
+
+func (v *GaugeVec) values() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.gauges))
+	for k := range v.gauges {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *GaugeVec) writeText(w io.Writer) {
+	for _, k := range v.values() {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", v.name, v.label, k, v.With(k).Value())
+	}
+}
+
+func (v *GaugeVec) snapshot() interface{} {
+	out := make(map[string]int64)
+	for _, k := range v.values() {
+		out[k] = v.With(k).Value()
+	}
+	return out
+}
+
+// Histogram counts observations into fixed cumulative buckets
+type Histogram struct {
+	count      uint64
+	sumBits    uint64 // float64 sum stored as bits for atomic updates
+	name, help string
+	bounds     []float64
+	counts     []uint64 // one per bound plus the +Inf bucket
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{
+		name:   name,
+		help:   help,
+		bounds: append([]float64(nil), bounds...),
+		counts: make([]uint64, len(bounds)+1),
+	}
+	sort.Float64s(h.bounds)
+	return Default.register(name, h).(*Histogram)
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64frombits(old) + v
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the total of all observations
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+func (h *Histogram) describe() (string, string, string) { return h.name, h.help, "histogram" }
+
+func (h *Histogram) writeText(w io.Writer) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, cumulative)
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, cumulative)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.Sum())
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.Count())
+}
+
+func (h *Histogram) snapshot() interface{} {
+	buckets := make(map[string]uint64, len(h.bounds)+1)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		buckets[fmt.Sprintf("%g", bound)] = cumulative
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.bounds)])
+	buckets["+Inf"] = cumulative
+
+	return map[string]interface{}{
+		"count":   h.Count(),
+		"sum":     h.Sum(),
+		"buckets": buckets,
+	}
+}
+
+// ExponentialBuckets returns count bounds starting at start, each factor times the previous
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
@@ -0,0 +1,232 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aethelfs/internal/metrics"
+)
+
+var (
+	spansExported = metrics.NewCounter("aethelfs_trace_spans_exported_total",
+		"Spans successfully sent to the OTLP collector")
+	spansDropped = metrics.NewCounter("aethelfs_trace_spans_dropped_total",
+		"Spans dropped because the export queue was full or the collector failed")
+)
+
+const (
+	exportQueueLen  = 1024            // Traces buffered before dropping
+	exportBatchLen  = 512             // Spans sent per request
+	exportInterval  = 2 * time.Second // Longest a span waits in the batch
+	exportTimeout   = 5 * time.Second
+	spanKindServer  = 2
+	spanKindInner   = 1
+	statusCodeError = 2
+)
+
+// exporter ships finished traces to an OTLP/HTTP collector using the JSON
+// encoding, batching them on a background goroutine
+type exporter struct {
+	url     string
+	service string
+	client  *http.Client
+	queue   chan []*Span
+	done    chan struct{}
+}
+
+// newExporter starts the background export loop
+func newExporter(cfg Config) *exporter {
+	endpoint := strings.TrimRight(cfg.Endpoint, "/")
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+
+	e := &exporter{
+		url:     endpoint + "/v1/traces",
+		service: cfg.ServiceName,
+		client:  &http.Client{Timeout: exportTimeout},
+		queue:   make(chan []*Span, exportQueueLen),
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// enqueue hands a finished trace to the exporter without blocking
+func (e *exporter) enqueue(spans []*Span) {
+	select {
+	case e.queue <- spans:
+	default:
+		spansDropped.Add(int64(len(spans)))
+	}
+}
+
+// close stops accepting traces and waits for the final batch to be sent
+func (e *exporter) close() {
+	close(e.queue)
+	<-e.done
+}
+
+// run batches queued traces and posts them until the queue is closed
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case spans, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, spans...)
+			if len(batch) >= exportBatchLen {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+// send posts one batch of spans to the collector
+func (e *exporter) send(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		spansDropped.Add(int64(len(batch)))
+		log.Printf("Warning: failed to encode trace batch: %v", err)
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		spansDropped.Add(int64(len(batch)))
+		log.Printf("Warning: failed to export %d spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		spansDropped.Add(int64(len(batch)))
+		log.Printf("Warning: collector rejected %d spans: %s", len(batch), resp.Status)
+		return
+	}
+	spansExported.Add(int64(len(batch)))
+}
+
+// OTLP JSON wire types, see opentelemetry-proto's trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	Status       *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// encode converts spans into an OTLP export request
+func (e *exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		out := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			Kind:    spanKindServer,
+			Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+			End:     strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s != s.root {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+			out.Kind = spanKindInner
+		}
+		for _, a := range s.attrs {
+			out.Attributes = append(out.Attributes, encodeAttr(a))
+		}
+		if s.errMsg != "" {
+			if s.errno != 0 {
+				out.Attributes = append(out.Attributes,
+					encodeAttr(attribute{key: "errno", num: int64(s.errno)}))
+			}
+			out.Status = &otlpStatus{Code: statusCodeError, Message: s.errMsg}
+		}
+		spans = append(spans, out)
+	}
+
+	service := e.service
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue{StringValue: &service}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "aethelfs"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// encodeAttr converts a span attribute to its OTLP form
+func encodeAttr(a attribute) otlpKeyValue {
+	if a.isString {
+		v := a.str
+		return otlpKeyValue{Key: a.key, Value: otlpValue{StringValue: &v}}
+	}
+	v := strconv.FormatInt(a.num, 10)
+	return otlpKeyValue{Key: a.key, Value: otlpValue{IntValue: &v}}
+}
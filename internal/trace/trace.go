@@ -0,0 +1,172 @@
+package trace
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Config controls span sampling and export
+type Config struct {
+	// Endpoint is the OTLP/HTTP collector base URL (e.g. http://localhost:4318)
+	Endpoint string
+
+	// ServiceName is reported as the service.name resource attribute
+	ServiceName string
+
+	// SampleRatio is the fraction of operations traced regardless of latency
+	SampleRatio float64
+
+	// SlowThreshold always samples operations at least this slow (0 disables)
+	SlowThreshold time.Duration
+}
+
+// Tracer creates spans for filesystem operations. A nil *Tracer is valid
+// and disables tracing; every method on it and on the nil spans it returns
+// is a no-op.
+type Tracer struct {
+	cfg      Config
+	exporter *exporter
+}
+
+// New creates a tracer that exports sampled traces to cfg.Endpoint
+func New(cfg Config) *Tracer {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "aethelfsd"
+	}
+	return &Tracer{
+		cfg:      cfg,
+		exporter: newExporter(cfg),
+	}
+}
+
+// Close flushes buffered spans and stops the exporter
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.exporter.close()
+}
+
+// attribute is a single key/value annotation on a span
+type attribute struct {
+	key      string
+	str      string
+	num      int64
+	isString bool
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	tracer   *Tracer
+	root     *Span
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []attribute
+	errno    syscall.Errno
+	errMsg   string
+
+	// Root spans collect finished children until the sampling decision
+	mu       sync.Mutex
+	sampled  bool
+	children []*Span
+}
+
+// Start begins a new root span for an operation
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+
+	s := &Span{
+		tracer:  t,
+		name:    name,
+		start:   time.Now(),
+		sampled: rand.Float64() < t.cfg.SampleRatio,
+	}
+	s.root = s
+	binary.LittleEndian.PutUint64(s.traceID[:8], rand.Uint64())
+	binary.LittleEndian.PutUint64(s.traceID[8:], rand.Uint64())
+	binary.LittleEndian.PutUint64(s.spanID[:], rand.Uint64())
+	return s
+}
+
+// Child begins a span nested under s, such as an allocation or flush phase
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	c := &Span{
+		tracer:   s.tracer,
+		root:     s.root,
+		traceID:  s.traceID,
+		parentID: s.spanID,
+		name:     name,
+		start:    time.Now(),
+	}
+	binary.LittleEndian.PutUint64(c.spanID[:], rand.Uint64())
+	return c
+}
+
+// SetInt annotates the span with an integer attribute
+func (s *Span) SetInt(key string, v int64) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, num: v})
+}
+
+// SetString annotates the span with a string attribute
+func (s *Span) SetString(key, v string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attribute{key: key, str: v, isString: true})
+}
+
+// SetError marks the span as failed, recording the errno when err carries one
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		s.errno = errno
+	}
+	s.errMsg = err.Error()
+}
+
+// End finishes the span. Ending a root span decides whether the whole trace
+// is exported: it is kept if head-sampled or slower than the threshold.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+
+	root := s.root
+	if s != root {
+		root.mu.Lock()
+		root.children = append(root.children, s)
+		root.mu.Unlock()
+		return
+	}
+
+	threshold := s.tracer.cfg.SlowThreshold
+	if !s.sampled && (threshold <= 0 || s.end.Sub(s.start) < threshold) {
+		return
+	}
+
+	root.mu.Lock()
+	spans := append(root.children, root)
+	root.children = nil
+	root.mu.Unlock()
+
+	s.tracer.exporter.enqueue(spans)
+}
@@ -0,0 +1,79 @@
+#!/bin/bash
+# bench_placement.sh - Compare the pack and spread placement policies
+#
+# Usage:
+#   ./bench_placement.sh <dax-device-or-file> [mountpoint]
+#
+# For each policy the device is reformatted and mounted, 64 files are
+# created and written concurrently, and the aggregate bandwidth is printed.
+# Spreading only pays off on an interleave set, so run this against the
+# striped namespace itself. WARNING: the device's contents are destroyed.
+#
+# Environment:
+#   FILES=64        number of files written concurrently
+#   FILE_MB=64      size of each file in MB
+#   BS=1M           dd block size
+#
+set -e
+
+DEVICE="$1"
+MOUNT_POINT="${2:-/mnt/aethelfs-bench}"
+FILES="${FILES:-64}"
+FILE_MB="${FILE_MB:-64}"
+BS="${BS:-1M}"
+BIN="$(dirname "$0")/../bin/aethelfsd"
+
+if [ -z "$DEVICE" ]; then
+    echo "Usage: $0 <dax-device-or-file> [mountpoint]"
+    exit 1
+fi
+if [ ! -x "$BIN" ]; then
+    echo "Build first: make build"
+    exit 1
+fi
+
+DEVICE_FLAGS=""
+if [ -f "$DEVICE" ]; then
+    DEVICE_FLAGS="-file"
+fi
+mkdir -p "$MOUNT_POINT"
+
+# run_policy mounts a freshly formatted device with the given placement
+# policy and prints the aggregate write bandwidth in MB/s
+run_policy() {
+    local policy="$1"
+
+    # Clearing the superblock makes the daemon format the device again
+    dd if=/dev/zero of="$DEVICE" bs=4096 count=1 conv=notrunc status=none
+
+    "$BIN" $DEVICE_FLAGS -placement="$policy" -compact-rate=0 "$DEVICE" "$MOUNT_POINT" &
+    local pid=$!
+    trap "kill $pid 2>/dev/null; fusermount -u '$MOUNT_POINT' 2>/dev/null" EXIT
+    for _ in $(seq 50); do
+        mount | grep -q " $MOUNT_POINT " && break
+        sleep 0.1
+    done
+
+    for i in $(seq "$FILES"); do
+        : > "$MOUNT_POINT/f$i"
+    done
+
+    local start end
+    start=$(date +%s.%N)
+    for i in $(seq "$FILES"); do
+        dd if=/dev/zero of="$MOUNT_POINT/f$i" bs="$BS" count="$FILE_MB" conv=fsync status=none &
+    done
+    wait $(jobs -p | grep -v "^$pid$")
+    end=$(date +%s.%N)
+
+    fusermount -u "$MOUNT_POINT"
+    wait "$pid" || true
+    trap - EXIT
+
+    echo "$end $start" | awk -v mb=$((FILES * FILE_MB)) -v p="$policy" \
+        '{ printf "%-7s %6d MB in %6.2fs: %8.1f MB/s\n", p, mb, $1 - $2, mb / ($1 - $2) }'
+}
+
+echo "=== Placement benchmark: $FILES files of $FILE_MB MB on $DEVICE ==="
+run_policy pack
+run_policy spread
@@ -0,0 +1,86 @@
+#!/bin/bash
+# bench_queue.sh - Compare FUSE background queue limits on 1MB writes
+#
+# Usage:
+#   ./bench_queue.sh <dax-device-or-file> [mountpoint]
+#
+# For each -max-background value the device is reformatted and mounted,
+# FILES files are written concurrently with 1MB dd blocks, and the
+# aggregate bandwidth is printed along with the average write request the
+# kernel actually sent, which shows the effective max_write. WARNING: the
+# device's contents are destroyed.
+#
+# Environment:
+#   BACKGROUND="12 64 256"   -max-background values to compare
+#   FILES=8                  number of files written concurrently
+#   FILE_MB=256              size of each file in MB
+#
+set -e
+
+DEVICE="$1"
+MOUNT_POINT="${2:-/mnt/aethelfs-bench}"
+BACKGROUND="${BACKGROUND:-12 64 256}"
+FILES="${FILES:-8}"
+FILE_MB="${FILE_MB:-256}"
+METRICS_ADDR="127.0.0.1:9187"
+BIN="$(dirname "$0")/../bin/aethelfsd"
+
+if [ -z "$DEVICE" ]; then
+    echo "Usage: $0 <dax-device-or-file> [mountpoint]"
+    exit 1
+fi
+if [ ! -x "$BIN" ]; then
+    echo "Build first: make build"
+    exit 1
+fi
+
+DEVICE_FLAGS=""
+if [ -f "$DEVICE" ]; then
+    DEVICE_FLAGS="-file"
+fi
+mkdir -p "$MOUNT_POINT"
+
+# run_background mounts a freshly formatted device with the given
+# background queue limit and prints the aggregate write bandwidth
+run_background() {
+    local background="$1"
+
+    # Clearing the superblock makes the daemon format the device again
+    dd if=/dev/zero of="$DEVICE" bs=4096 count=1 conv=notrunc status=none
+
+    "$BIN" $DEVICE_FLAGS -max-background="$background" -compact-rate=0 \
+        -metrics-addr="$METRICS_ADDR" "$DEVICE" "$MOUNT_POINT" &
+    local pid=$!
+    trap "kill $pid 2>/dev/null; fusermount -u '$MOUNT_POINT' 2>/dev/null" EXIT
+    for _ in $(seq 50); do
+        mount | grep -q " $MOUNT_POINT " && break
+        sleep 0.1
+    done
+
+    local start end
+    start=$(date +%s.%N)
+    for i in $(seq "$FILES"); do
+        dd if=/dev/zero of="$MOUNT_POINT/f$i" bs=1M count="$FILE_MB" conv=fsync status=none &
+    done
+    wait $(jobs -p | grep -v "^$pid$")
+    end=$(date +%s.%N)
+
+    local avg
+    avg=$(curl -s "http://$METRICS_ADDR/" | awk '
+        /^aethelfs_write_request_bytes_sum/ { sum = $2 }
+        /^aethelfs_write_request_bytes_count/ { n = $2 }
+        END { if (n > 0) printf "%d", sum / n; else print "?" }')
+
+    fusermount -u "$MOUNT_POINT"
+    wait "$pid" || true
+    trap - EXIT
+
+    echo "$end $start" | awk -v mb=$((FILES * FILE_MB)) -v b="$background" -v avg="$avg" \
+        '{ printf "max-background %-5s %6d MB in %6.2fs: %8.1f MB/s, average write request %s bytes\n",
+           b, mb, $1 - $2, mb / ($1 - $2), avg }'
+}
+
+echo "=== Queue benchmark: $FILES files of $FILE_MB MB on $DEVICE ==="
+for background in $BACKGROUND; do
+    run_background "$background"
+done
@@ -21,7 +21,7 @@ echo "  sudo dd if=/dev/zero of=/mnt/pmem0/daxfile bs=1M count=128"
 echo "  sudo chmod 666 /mnt/pmem0/daxfile"
 echo
 echo "Then use this file as your DAX device:"
-echo "  sudo bin/aethelfsd /mnt/pmem0/daxfile /mnt/aethelfs"
+echo "  sudo bin/aethelfsd -file /mnt/pmem0/daxfile /mnt/aethelfs"
 echo
 echo "Would you like to create a test file now? (y/n)"
 read -r response
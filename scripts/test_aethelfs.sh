@@ -181,4 +181,26 @@ if command -v fio &> /dev/null; then
     echo "Running random I/O with fio..."
     fio --name=random-rw --filename="$MOUNT_POINT/fio_test" --size=50M \
         --rw=randrw --bs=4k --direct=1 --runtime=30 --time_based
-fi
\ No newline at end of file
+fi
+# Test 13: inotify sees changes made through the control socket. The
+# daemon invalidates the kernel's caches for them, which the kernel turns
+# into events for watchers of the mount.
+CTL="$(dirname "$0")/../bin/aethelfsctl"
+if command -v inotifywait &> /dev/null && [ -x "$CTL" ]; then
+    echo -e "\n${YELLOW}Test 13: Watcher Notification Test${NC}"
+    WATCHED="$MOUNT_POINT/watched.txt"
+    echo "before" > "$WATCHED"
+    cat "$WATCHED" > /dev/null
+    inotifywait -q -t 10 -e modify -e attrib "$WATCHED" > /tmp/aethelfs_inotify.$$ &
+    watcher=$!
+    sleep 0.5
+    id=$("$CTL" -mount "$MOUNT_POINT" -json txn begin | tr -cd '0-9')
+    echo "after" | "$CTL" -mount "$MOUNT_POINT" txn stage "$id" /watched.txt > /dev/null
+    "$CTL" -mount "$MOUNT_POINT" txn commit "$id" > /dev/null
+    if wait "$watcher" && [ -s /tmp/aethelfs_inotify.$$ ]; then
+        echo -e "${GREEN}✓ Watcher Notification Test Passed${NC}"
+    else
+        echo -e "${YELLOW}- No event after a control-socket commit; the kernel may not translate FUSE invalidations${NC}"
+    fi
+    rm -f /tmp/aethelfs_inotify.$$ "$WATCHED"
+fi